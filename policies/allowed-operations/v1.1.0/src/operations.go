@@ -0,0 +1,121 @@
+package allowed_operations
+
+import (
+	"strconv"
+	"strings"
+)
+
+// operation allows some methods and request media types on the paths that
+// match a pattern. Empty lists allow everything.
+type operation struct {
+	path         *Matcher
+	methods      []string
+	contentTypes []string
+}
+
+// decision is what the operations matching a request allow
+type decision struct {
+	// paths is false when no operation matches the request path
+	paths bool
+	// methods allowed on the path, nil when any method is
+	methods []string
+	// contentTypes allowed for the method, nil when any is
+	contentTypes []string
+}
+
+// decide merges the operations whose path matches. A method is allowed if
+// any of them allows it, and a media type if any of those that allow the
+// method allows it.
+func decide(ops []operation, method, path string) decision {
+	var d decision
+	anyMethod, anyType := false, false
+	for _, op := range ops {
+		if !op.path.Match(path) {
+			continue
+		}
+		d.paths = true
+		if len(op.methods) == 0 {
+			anyMethod = true
+		}
+		for _, m := range op.methods {
+			if !containsParam(d.methods, m) {
+				d.methods = append(d.methods, m)
+			}
+		}
+		if len(op.methods) > 0 && !allowsMethod(op.methods, method) {
+			continue
+		}
+		if len(op.contentTypes) == 0 {
+			anyType = true
+		}
+		for _, t := range op.contentTypes {
+			if !containsParam(d.contentTypes, t) {
+				d.contentTypes = append(d.contentTypes, t)
+			}
+		}
+	}
+	if anyMethod {
+		d.methods = nil
+	} else if containsParam(d.methods, "GET") && !containsParam(d.methods, "HEAD") {
+		d.methods = append(d.methods, "HEAD")
+	}
+	if anyType {
+		d.contentTypes = nil
+	}
+	return d
+}
+
+// allowsMethod reports whether method is in methods. HEAD is allowed
+// wherever GET is.
+func allowsMethod(methods []string, method string) bool {
+	return containsParam(methods, method) || method == "HEAD" && containsParam(methods, "GET")
+}
+
+// allowsType reports whether the media type mediaType matches one of the
+// patterns, which may be type/* or */*
+func allowsType(patterns []string, mediaType string) bool {
+	main, _, _ := strings.Cut(mediaType, "/")
+	for _, p := range patterns {
+		if p == mediaType || p == "*/*" || p == main+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the Content-Type of a request without its parameters,
+// in lower case
+func mediaType(headers map[string][]string) string {
+	values, _ := headerValues(headers, "Content-Type")
+	if len(values) == 0 {
+		return ""
+	}
+	t, _, _ := strings.Cut(values[0], ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// hasBody reports whether the request carries a body. Requests without one
+// are not checked against contentTypes.
+func hasBody(headers map[string][]string) bool {
+	if _, ok := headerValues(headers, "Transfer-Encoding"); ok {
+		return true
+	}
+	values, _ := headerValues(headers, "Content-Length")
+	if len(values) == 0 {
+		return false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	return err != nil || n > 0
+}
+
+// validMediaRange reports whether s is type/subtype, type/* or */*
+func validMediaRange(s string) bool {
+	main, sub, ok := strings.Cut(s, "/")
+	if !ok || main == "" || sub == "" || strings.ContainsAny(s, " ;,") {
+		return false
+	}
+	if main == "*" {
+		return sub == "*"
+	}
+	return !strings.Contains(main, "*") && (sub == "*" || !strings.Contains(sub, "*"))
+}
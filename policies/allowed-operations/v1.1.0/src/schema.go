@@ -0,0 +1,45 @@
+package allowed_operations
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "definitions": {
+    "matcher": {
+      "oneOf": [
+        {"type": "string", "minLength": 1},
+        {
+          "type": "object",
+          "properties": {
+            "exact": {"type": "string"},
+            "prefix": {"type": "string"},
+            "glob": {"type": "string"},
+            "regex": {"type": "string"},
+            "ignoreCase": {"type": "boolean", "default": false}
+          },
+          "additionalProperties": false
+        }
+      ]
+    }
+  },
+  "properties": {
+    "operations": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "path": {"$ref": "#/definitions/matcher"},
+          "methods": {"type": "array", "items": {"type": "string", "minLength": 1}},
+          "contentTypes": {"type": "array", "items": {"type": "string", "minLength": 1}}
+        },
+        "required": ["path"]
+      }
+    },
+    "unmatchedPaths": {"type": "string", "enum": ["allow", "reject"], "default": "allow"}
+  },
+  "required": ["operations"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,229 @@
+package api_key_auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext would be here
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	// SharedContext would be here
+}
+
+type Body struct {
+	// Placeholder for body
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct{}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+const (
+	defaultKeyHeader        = "X-API-Key"
+	defaultUnauthorizedBody = `{"error": "Invalid or missing API key"}`
+)
+
+type APIKeyAuthPolicy struct {
+	mu      sync.Mutex
+	sources map[string]KeySource
+}
+
+type authConfig struct {
+	KeyHeader        string
+	KeyQueryParam    string
+	ConsumerHeader   string
+	RemoveKey        bool
+	UnauthorizedBody string
+	Source           sourceConfig
+}
+
+// Validate configuration parameters
+func (a *APIKeyAuthPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (a *APIKeyAuthPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (a *APIKeyAuthPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody)
+	}
+
+	key := presentedKey(ctx, cfg)
+	if key == "" {
+		return unauthorized(cfg.UnauthorizedBody)
+	}
+
+	consumer, ok, err := a.source(cfg.Source).Lookup(key)
+	if err != nil || !ok {
+		// A source that cannot answer must not let unknown keys through
+		return unauthorized(cfg.UnauthorizedBody)
+	}
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	if cfg.ConsumerHeader != "" {
+		if consumer != "" {
+			mods.SetHeaders[cfg.ConsumerHeader] = consumer
+		} else {
+			mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.ConsumerHeader)
+		}
+	}
+	if cfg.RemoveKey && cfg.KeyHeader != "" {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.KeyHeader)
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (a *APIKeyAuthPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// source returns the key source for cfg, shared by all requests with the same
+// source configuration so caches and loaded files are reused.
+func (a *APIKeyAuthPolicy) source(cfg sourceConfig) KeySource {
+	id := cfg.id()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sources == nil {
+		a.sources = make(map[string]KeySource)
+	}
+	s, ok := a.sources[id]
+	if !ok {
+		s = newKeySource(cfg)
+		a.sources[id] = s
+	}
+	return s
+}
+
+func parseConfig(params map[string]interface{}) (authConfig, error) {
+	cfg := authConfig{
+		KeyHeader:        defaultKeyHeader,
+		RemoveKey:        true,
+		UnauthorizedBody: defaultUnauthorizedBody,
+	}
+
+	for name, dst := range map[string]*string{
+		"keyHeader":        &cfg.KeyHeader,
+		"keyQueryParam":    &cfg.KeyQueryParam,
+		"consumerHeader":   &cfg.ConsumerHeader,
+		"unauthorizedBody": &cfg.UnauthorizedBody,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a string", name)
+			}
+			*dst = s
+		}
+	}
+	if cfg.KeyHeader == "" && cfg.KeyQueryParam == "" {
+		return cfg, errors.New("at least one of keyHeader and keyQueryParam must be set")
+	}
+	if v, ok := params["removeKey"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("removeKey must be a boolean")
+		}
+		cfg.RemoveKey = b
+	}
+
+	source, err := parseSourceConfig(params["keySource"])
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Source = source
+	return cfg, nil
+}
+
+// presentedKey reads the key from the header first, then the query string
+func presentedKey(ctx *RequestContext, cfg authConfig) string {
+	if cfg.KeyHeader != "" {
+		for k, values := range ctx.Headers {
+			if strings.EqualFold(k, cfg.KeyHeader) && len(values) > 0 && values[0] != "" {
+				return strings.TrimSpace(values[0])
+			}
+		}
+	}
+	if cfg.KeyQueryParam != "" {
+		if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+			if query, err := url.ParseQuery(ctx.Path[i+1:]); err == nil {
+				return query.Get(cfg.KeyQueryParam)
+			}
+		}
+	}
+	return ""
+}
+
+func unauthorized(body string) ImmediateResponse {
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type": {"application/json"},
+		},
+		Body: body,
+	}
+}
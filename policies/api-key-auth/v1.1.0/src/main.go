@@ -0,0 +1,413 @@
+package api_key_auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+const (
+	defaultKeyHeader        = "X-API-Key"
+	defaultUnauthorizedBody = `{"error": "Invalid or missing API key"}`
+)
+
+type APIKeyAuthPolicy struct {
+	mu      sync.Mutex
+	sources map[string]KeySource
+}
+
+type authConfig struct {
+	KeyHeader        string
+	KeyQueryParam    string
+	ConsumerHeader   string
+	RemoveKey        bool
+	UnauthorizedBody string
+	Source           sourceConfig
+}
+
+// Validate configuration parameters
+func (a *APIKeyAuthPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (a *APIKeyAuthPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (a *APIKeyAuthPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody)
+	}
+
+	key := presentedKey(ctx, cfg)
+	if key == "" {
+		return unauthorized(cfg.UnauthorizedBody)
+	}
+
+	consumer, ok, err := a.source(cfg.Source).Lookup(key)
+	if err != nil || !ok {
+		// A source that cannot answer must not let unknown keys through
+		return unauthorized(cfg.UnauthorizedBody)
+	}
+
+	if consumer != "" {
+		ctx.SharedContext.Set(ConsumerIDKey, consumer)
+	}
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	if cfg.ConsumerHeader != "" {
+		if consumer != "" {
+			mods.SetHeaders[cfg.ConsumerHeader] = consumer
+		} else {
+			mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.ConsumerHeader)
+		}
+	}
+	if cfg.RemoveKey && cfg.KeyHeader != "" {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.KeyHeader)
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (a *APIKeyAuthPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// source returns the key source for cfg, shared by all requests with the same
+// source configuration so caches and loaded files are reused.
+func (a *APIKeyAuthPolicy) source(cfg sourceConfig) KeySource {
+	id := cfg.id()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sources == nil {
+		a.sources = make(map[string]KeySource)
+	}
+	s, ok := a.sources[id]
+	if !ok {
+		s = newKeySource(cfg)
+		a.sources[id] = s
+	}
+	return s
+}
+
+func parseConfig(params map[string]interface{}) (authConfig, error) {
+	cfg := authConfig{
+		KeyHeader:        defaultKeyHeader,
+		RemoveKey:        true,
+		UnauthorizedBody: defaultUnauthorizedBody,
+	}
+
+	for name, dst := range map[string]*string{
+		"keyHeader":        &cfg.KeyHeader,
+		"keyQueryParam":    &cfg.KeyQueryParam,
+		"consumerHeader":   &cfg.ConsumerHeader,
+		"unauthorizedBody": &cfg.UnauthorizedBody,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a string", name)
+			}
+			*dst = s
+		}
+	}
+	if cfg.KeyHeader == "" && cfg.KeyQueryParam == "" {
+		return cfg, errors.New("at least one of keyHeader and keyQueryParam must be set")
+	}
+	if v, ok := params["removeKey"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("removeKey must be a boolean")
+		}
+		cfg.RemoveKey = b
+	}
+
+	source, err := parseSourceConfig(params["keySource"])
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Source = source
+	return cfg, nil
+}
+
+// presentedKey reads the key from the header first, then the query string
+func presentedKey(ctx *RequestContext, cfg authConfig) string {
+	if cfg.KeyHeader != "" {
+		for k, values := range ctx.Headers {
+			if strings.EqualFold(k, cfg.KeyHeader) && len(values) > 0 && values[0] != "" {
+				return strings.TrimSpace(values[0])
+			}
+		}
+	}
+	if cfg.KeyQueryParam != "" {
+		if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+			if query, err := url.ParseQuery(ctx.Path[i+1:]); err == nil {
+				return query.Get(cfg.KeyQueryParam)
+			}
+		}
+	}
+	return ""
+}
+
+func unauthorized(body string) ImmediateResponse {
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type": {"application/json"},
+		},
+		Body: body,
+	}
+}
@@ -0,0 +1,387 @@
+package api_key_auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeySource resolves a presented API key to the consumer that owns it.
+// Implementations must be safe for concurrent use.
+type KeySource interface {
+	// Lookup reports whether key is valid and, if so, the consumer it belongs
+	// to. An error means the source could not decide.
+	Lookup(key string) (consumer string, ok bool, err error)
+}
+
+const (
+	sourceStatic = "static"
+	sourceFile   = "file"
+	sourceHTTP   = "http"
+
+	defaultReloadInterval   = 30 * time.Second
+	defaultHTTPTimeout      = 2 * time.Second
+	defaultCacheTTL         = 5 * time.Minute
+	defaultNegativeCacheTTL = 30 * time.Second
+	maxCacheEntries         = 10000
+	maxIntrospectionSize    = 64 << 10
+)
+
+type keyEntry struct {
+	Key      string `json:"key,omitempty"`
+	KeyHash  string `json:"keyHash,omitempty"`
+	Consumer string `json:"consumer,omitempty"`
+}
+
+type sourceConfig struct {
+	Type             string            `json:"type"`
+	Keys             []keyEntry        `json:"keys,omitempty"`
+	Path             string            `json:"path,omitempty"`
+	ReloadInterval   time.Duration     `json:"reloadInterval,omitempty"`
+	URL              string            `json:"url,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Timeout          time.Duration     `json:"timeout,omitempty"`
+	CacheTTL         time.Duration     `json:"cacheTtl,omitempty"`
+	NegativeCacheTTL time.Duration     `json:"negativeCacheTtl,omitempty"`
+}
+
+// id identifies configurations that can share one source instance
+func (c sourceConfig) id() string {
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func parseSourceConfig(raw interface{}) (sourceConfig, error) {
+	cfg := sourceConfig{
+		ReloadInterval:   defaultReloadInterval,
+		Timeout:          defaultHTTPTimeout,
+		CacheTTL:         defaultCacheTTL,
+		NegativeCacheTTL: defaultNegativeCacheTTL,
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg, errors.New("keySource is required and must be an object")
+	}
+	cfg.Type, _ = m["type"].(string)
+
+	for name, dst := range map[string]*time.Duration{
+		"reloadIntervalSeconds":   &cfg.ReloadInterval,
+		"cacheTtlSeconds":         &cfg.CacheTTL,
+		"negativeCacheTtlSeconds": &cfg.NegativeCacheTTL,
+		"timeoutMs":               &cfg.Timeout,
+	} {
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, fmt.Errorf("keySource.%s must be a non-negative integer", name)
+		}
+		unit := time.Second
+		if strings.HasSuffix(name, "Ms") {
+			unit = time.Millisecond
+		}
+		*dst = time.Duration(f) * unit
+	}
+
+	switch cfg.Type {
+	case sourceStatic:
+		keys, err := parseKeyEntries(m["keys"])
+		if err != nil {
+			return cfg, fmt.Errorf("keySource.keys: %v", err)
+		}
+		if len(keys) == 0 {
+			return cfg, errors.New("keySource.keys must list at least one key")
+		}
+		cfg.Keys = keys
+	case sourceFile:
+		path, ok := m["path"].(string)
+		if !ok || path == "" {
+			return cfg, errors.New("keySource.path is required for the file source and must be a string")
+		}
+		cfg.Path = path
+	case sourceHTTP:
+		u, ok := m["url"].(string)
+		if !ok || !(strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")) {
+			return cfg, errors.New("keySource.url is required for the http source and must be an http(s) URL")
+		}
+		cfg.URL = u
+		if v, ok := m["headers"]; ok {
+			hm, ok := v.(map[string]interface{})
+			if !ok {
+				return cfg, errors.New("keySource.headers must be an object")
+			}
+			cfg.Headers = make(map[string]string, len(hm))
+			for k, v := range hm {
+				s, ok := v.(string)
+				if !ok {
+					return cfg, fmt.Errorf("keySource.headers.%s must be a string", k)
+				}
+				cfg.Headers[k] = s
+			}
+		}
+	default:
+		return cfg, fmt.Errorf("keySource.type must be one of: %s, %s, %s", sourceStatic, sourceFile, sourceHTTP)
+	}
+	return cfg, nil
+}
+
+// parseKeyEntries reads a list of {key|keyHash, consumer} objects
+func parseKeyEntries(raw interface{}) ([]keyEntry, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("must be a list")
+	}
+	entries := make([]keyEntry, 0, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %d must be an object", i)
+		}
+		var e keyEntry
+		e.Key, _ = m["key"].(string)
+		e.KeyHash, _ = m["keyHash"].(string)
+		e.Consumer, _ = m["consumer"].(string)
+		if (e.Key == "") == (e.KeyHash == "") {
+			return nil, fmt.Errorf("entry %d must set exactly one of key and keyHash", i)
+		}
+		if e.KeyHash != "" {
+			if _, err := decodeKeyHash(e.KeyHash); err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func newKeySource(cfg sourceConfig) KeySource {
+	switch cfg.Type {
+	case sourceFile:
+		return &fileSource{path: cfg.Path, interval: cfg.ReloadInterval}
+	case sourceHTTP:
+		return &httpSource{
+			cfg:    cfg,
+			client: &http.Client{Timeout: cfg.Timeout},
+			cache:  make(map[[32]byte]cachedResult),
+		}
+	}
+	return newKeyTable(cfg.Keys)
+}
+
+// keyTable is the static source. Keys are held only as SHA-256 digests, so
+// lookups compare digests rather than the secrets themselves.
+type keyTable struct {
+	consumers map[[32]byte]string
+}
+
+func newKeyTable(entries []keyEntry) *keyTable {
+	t := &keyTable{consumers: make(map[[32]byte]string, len(entries))}
+	for _, e := range entries {
+		digest := sha256.Sum256([]byte(e.Key))
+		if e.KeyHash != "" {
+			digest, _ = decodeKeyHash(e.KeyHash)
+		}
+		t.consumers[digest] = e.Consumer
+	}
+	return t
+}
+
+func (t *keyTable) Lookup(key string) (string, bool, error) {
+	consumer, ok := t.consumers[sha256.Sum256([]byte(key))]
+	return consumer, ok, nil
+}
+
+func decodeKeyHash(s string) ([32]byte, error) {
+	var digest [32]byte
+	hexDigest, ok := strings.CutPrefix(s, "sha256:")
+	if !ok {
+		return digest, errors.New("keyHash must have the form sha256:<hex digest>")
+	}
+	b, err := hex.DecodeString(hexDigest)
+	if err != nil || len(b) != len(digest) {
+		return digest, errors.New("keyHash must have the form sha256:<hex digest>")
+	}
+	copy(digest[:], b)
+	return digest, nil
+}
+
+// fileSource reads keys from a JSON file and reloads it when its modification
+// time changes, checking at most once per interval.
+type fileSource struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.Mutex
+	table     *keyTable
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (s *fileSource) Lookup(key string) (string, bool, error) {
+	table, err := s.current()
+	if err != nil {
+		return "", false, err
+	}
+	return table.Lookup(key)
+}
+
+func (s *fileSource) current() (*keyTable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.table != nil && now.Sub(s.checkedAt) < s.interval {
+		return s.table, nil
+	}
+	s.checkedAt = now
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// Keep the last good key set if the file disappears
+		if s.table != nil {
+			return s.table, nil
+		}
+		return nil, err
+	}
+	if s.table != nil && info.ModTime().Equal(s.modTime) {
+		return s.table, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if s.table != nil {
+			return s.table, nil
+		}
+		return nil, err
+	}
+	table, err := parseKeyFile(data)
+	if err != nil {
+		if s.table != nil {
+			return s.table, nil
+		}
+		return nil, err
+	}
+	s.table = table
+	s.modTime = info.ModTime()
+	return s.table, nil
+}
+
+// parseKeyFile accepts either a list of key entries or {"keys": [...]}
+func parseKeyFile(data []byte) (*keyTable, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid key file: %v", err)
+	}
+	if m, ok := raw.(map[string]interface{}); ok {
+		raw = m["keys"]
+	}
+	entries, err := parseKeyEntries(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file: %v", err)
+	}
+	return newKeyTable(entries), nil
+}
+
+type cachedResult struct {
+	consumer  string
+	valid     bool
+	expiresAt time.Time
+}
+
+// httpSource asks an introspection endpoint about each key and caches the
+// answers. Valid and invalid answers have separate TTLs; failures are never
+// cached.
+type httpSource struct {
+	cfg    sourceConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[32]byte]cachedResult
+}
+
+func (s *httpSource) Lookup(key string) (string, bool, error) {
+	digest := sha256.Sum256([]byte(key))
+	now := time.Now()
+
+	s.mu.Lock()
+	if r, ok := s.cache[digest]; ok && now.Before(r.expiresAt) {
+		s.mu.Unlock()
+		return r.consumer, r.valid, nil
+	}
+	s.mu.Unlock()
+
+	consumer, valid, err := s.introspect(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	ttl := s.cfg.CacheTTL
+	if !valid {
+		ttl = s.cfg.NegativeCacheTTL
+	}
+	if ttl > 0 {
+		s.mu.Lock()
+		if len(s.cache) >= maxCacheEntries {
+			for k, r := range s.cache {
+				if !now.Before(r.expiresAt) {
+					delete(s.cache, k)
+				}
+			}
+			if len(s.cache) >= maxCacheEntries {
+				s.cache = make(map[[32]byte]cachedResult)
+			}
+		}
+		s.cache[digest] = cachedResult{consumer: consumer, valid: valid, expiresAt: now.Add(ttl)}
+		s.mu.Unlock()
+	}
+	return consumer, valid, nil
+}
+
+// introspect POSTs {"key": "..."} and expects {"valid": bool, "consumer": "..."}.
+// 401, 403 and 404 replies also mean the key is invalid.
+func (s *httpSource) introspect(key string) (string, bool, error) {
+	body, _ := json.Marshal(map[string]string{"key": key})
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("introspection endpoint returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Valid    bool   `json:"valid"`
+		Consumer string `json:"consumer"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionSize)).Decode(&result); err != nil {
+		return "", false, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	return result.Consumer, result.Valid, nil
+}
@@ -0,0 +1,729 @@
+package audit_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+	// Metrics is nil when the gateway does not collect metrics, see
+	// MetricsOrNop
+	Metrics Metrics
+	// Span is nil when the gateway does not trace requests, see SpanOrNop
+	Span Span
+	// Logger is nil when the gateway does not take policy logs, see
+	// LoggerOrNop
+	Logger Logger
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+	Metrics         Metrics
+	Span            Span
+	Logger          Logger
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+	// TraceContextKey holds the TraceContext of the request as set by the
+	// tracing policy. Gateways that trace requests continue that trace.
+	TraceContextKey = "trace.context"
+)
+
+// Metrics creates the instruments a policy records measurements with. The
+// gateway hands each policy instance its own Metrics and exports what is
+// recorded, e.g. to Prometheus, labelled with the policy name and version,
+// so policies only add labels of their own. Names follow the Prometheus
+// conventions, such as rate_limiter_requests_total. Asking again for an
+// instrument with the same name and labels returns the same one.
+type Metrics interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	// Histogram uses buckets as upper bounds; nil chooses default buckets
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Labels are label names with their values. Every instrument of one name
+// must use the same label names.
+type Labels map[string]string
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter interface {
+	// Add increases the counter; negative deltas are ignored
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// MetricsOrNop returns m, or a Metrics whose instruments discard everything
+// when m is nil because the gateway does not collect metrics
+func MetricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, Labels) Counter { return nopInstrument{} }
+
+func (nopMetrics) Gauge(string, string, Labels) Gauge { return nopInstrument{} }
+
+func (nopMetrics) Histogram(string, string, []float64, Labels) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64) {}
+
+func (nopInstrument) Set(float64) {}
+
+func (nopInstrument) Observe(float64) {}
+
+// Span is the trace span the gateway records for a policy execution.
+// Policies add attributes and events to it; starting, ending and exporting
+// spans, e.g. over OTLP, is left to the gateway.
+type Span interface {
+	// SetAttribute records a string, bool, int64 or float64 value
+	SetAttribute(key string, value interface{})
+	// AddEvent records a timestamped event; attributes may be nil
+	AddEvent(name string, attributes map[string]interface{})
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// TraceContext returns the IDs of the span, e.g. to log them
+	TraceContext() TraceContext
+}
+
+// TraceContext identifies a span in the terms of W3C Trace Context
+type TraceContext struct {
+	// TraceID is 32 and SpanID 16 lowercase hex characters
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// State is the vendor data of the tracestate header, if any
+	State string
+}
+
+// SpanOrNop returns s, or a Span that discards everything when s is nil
+// because the gateway does not trace requests
+func SpanOrNop(s Span) Span {
+	if s == nil {
+		return nopSpan{}
+	}
+	return s
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) AddEvent(string, map[string]interface{}) {}
+
+func (nopSpan) RecordError(error) {}
+
+func (nopSpan) TraceContext() TraceContext { return TraceContext{} }
+
+// Logger writes structured log records through the gateway's logging, which
+// adds the policy name and version and the request's trace ID. Fields hold
+// values that encode as JSON; secrets do not belong in them.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LogLevel is the severity of a log record
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo  LogLevel = "info"
+	LogWarn  LogLevel = "warn"
+	LogError LogLevel = "error"
+)
+
+// LoggerOrNop returns l, or a Logger that discards everything when l is nil
+// because the gateway does not take policy logs
+func LoggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, map[string]interface{}) {}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Keys of the SharedContext values the record is made of, besides those of
+// the SDK
+const (
+	// requestKey carries the request's part of the record to the response
+	// phase
+	requestKey       = "audit-log.request"
+	correlationIDKey = "correlation.id"
+	clientIPKey      = "client.ip"
+)
+
+// Sink types
+const (
+	sinkStdout  = "stdout"
+	sinkFile    = "file"
+	sinkHTTP    = "http"
+	sinkGateway = "gateway"
+)
+
+// Sink defaults for parameters of a sink object that leaves them out
+const (
+	defaultMaxSizeMb     = 100
+	defaultMaxBackups    = 5
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultMaxRetries    = 3
+	defaultTimeout       = 5 * time.Second
+	defaultBufferSize    = 10000
+)
+
+// retryDelay is the wait before the first retry of a batch; it doubles with
+// every further retry up to maxRetryDelay
+const (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+)
+
+type AuditLogPolicy struct {
+	mu      sync.Mutex
+	sink    sink
+	sinkCfg sinkConfig
+}
+
+type auditConfig struct {
+	Sink            sinkConfig
+	RequestHeaders  []string
+	ResponseHeaders []string
+	SharedKeys      []string
+	Include         []string
+	Exclude         []string
+}
+
+type sinkConfig struct {
+	Type          string
+	Path          string
+	MaxSizeBytes  int64
+	MaxBackups    int
+	URL           string
+	Headers       map[string]string
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	Timeout       time.Duration
+	BufferSize    int
+}
+
+// Validate configuration parameters
+func (p *AuditLogPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *AuditLogPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *AuditLogPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	ctx.SharedContext.Set(requestKey, newRequestRecord(ctx, cfg.RequestHeaders, time.Now()))
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (p *AuditLogPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+
+	req, _ := SharedValue[requestRecord](ctx.SharedContext, requestKey)
+	rec := cfg.buildRecord(req, ctx, time.Now())
+	logger := LoggerOrNop(ctx.Logger)
+	if cfg.Sink.Type == sinkGateway {
+		logger.Log(LogInfo, "audit", rec)
+		return UpstreamResponseModifications{}
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logger.Log(LogError, "audit record cannot be encoded", map[string]interface{}{"error": err.Error()})
+		return UpstreamResponseModifications{}
+	}
+	s, err := p.openSink(cfg.Sink)
+	if err != nil {
+		logger.Log(LogError, "audit log sink cannot be opened", map[string]interface{}{"error": err.Error()})
+		return UpstreamResponseModifications{}
+	}
+	if err := s.write(data); err != nil {
+		logger.Log(LogWarn, "audit record dropped", map[string]interface{}{"error": err.Error()})
+	}
+	return UpstreamResponseModifications{}
+}
+
+// openSink returns the sink for cfg, opening it on first use and replacing
+// it whenever the sink configuration changes. A sink that fails to open is
+// tried again on the next request.
+func (p *AuditLogPolicy) openSink(cfg sinkConfig) (sink, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sink != nil && reflect.DeepEqual(p.sinkCfg, cfg) {
+		return p.sink, nil
+	}
+	s, err := newSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p.sink != nil {
+		// An HTTP sink sends its queue before it stops, which requests
+		// should not wait for
+		go p.sink.close()
+	}
+	p.sink, p.sinkCfg = s, cfg
+	return s, nil
+}
+
+func parseConfig(params map[string]interface{}) (auditConfig, error) {
+	var cfg auditConfig
+	var errs paramErrors
+
+	cfg.Sink = parseSinkConfig(params["sink"], &errs)
+	// In a fixed order, so problems are reported in a stable order
+	for _, list := range []struct {
+		name    string
+		dst     *[]string
+		headers bool
+	}{
+		{"requestHeaders", &cfg.RequestHeaders, true},
+		{"responseHeaders", &cfg.ResponseHeaders, true},
+		{"sharedKeys", &cfg.SharedKeys, false},
+		{"include", &cfg.Include, false},
+		{"exclude", &cfg.Exclude, false},
+	} {
+		items, _ := params[list.name].([]interface{})
+		for i, item := range items {
+			s, _ := item.(string)
+			if list.headers && !validHeaderName(s) {
+				errs.add(fmt.Sprintf("%s[%d]", list.name, i), "must be a valid header name")
+			}
+			*list.dst = append(*list.dst, s)
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+func parseSinkConfig(raw interface{}, errs *paramErrors) sinkConfig {
+	cfg := sinkConfig{
+		Type:          sinkStdout,
+		MaxSizeBytes:  defaultMaxSizeMb << 20,
+		MaxBackups:    defaultMaxBackups,
+		BatchSize:     defaultBatchSize,
+		FlushInterval: defaultFlushInterval,
+		MaxRetries:    defaultMaxRetries,
+		Timeout:       defaultTimeout,
+		BufferSize:    defaultBufferSize,
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg
+	}
+	if s, ok := m["type"].(string); ok {
+		cfg.Type = s
+	}
+	cfg.Path, _ = m["path"].(string)
+	cfg.URL, _ = m["url"].(string)
+	if f, ok := m["maxSizeMb"].(float64); ok {
+		cfg.MaxSizeBytes = int64(f) << 20
+	}
+	for name, dst := range map[string]*int{
+		"maxBackups": &cfg.MaxBackups,
+		"batchSize":  &cfg.BatchSize,
+		"maxRetries": &cfg.MaxRetries,
+		"bufferSize": &cfg.BufferSize,
+	} {
+		if f, ok := m[name].(float64); ok {
+			*dst = int(f)
+		}
+	}
+	for name, dst := range map[string]*time.Duration{
+		"flushIntervalMs": &cfg.FlushInterval,
+		"timeoutMs":       &cfg.Timeout,
+	} {
+		if f, ok := m[name].(float64); ok {
+			*dst = time.Duration(f) * time.Millisecond
+		}
+	}
+	if headers, ok := m["headers"].(map[string]interface{}); ok {
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		cfg.Headers = make(map[string]string, len(headers))
+		for _, name := range names {
+			if !validHeaderName(name) {
+				errs.add("sink.headers."+name, "must be a valid header name")
+			}
+			cfg.Headers[name], _ = headers[name].(string)
+		}
+	}
+
+	switch cfg.Type {
+	case sinkFile:
+		if cfg.Path == "" {
+			errs.add("sink.path", "is required for the file sink")
+		}
+	case sinkHTTP:
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("sink.url", "must be an http or https URL for the http sink")
+		}
+	}
+	return cfg
+}
+
+// headerValues returns the values of a header, matching its name without
+// regard to case
+func headerValues(headers map[string][]string, name string) ([]string, bool) {
+	if values, ok := headers[name]; ok {
+		return values, true
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package audit_log
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "sink": {
+      "type": "object",
+      "properties": {
+        "type": {"type": "string", "enum": ["stdout", "file", "http", "gateway"], "default": "stdout"},
+        "path": {"type": "string", "minLength": 1},
+        "maxSizeMb": {"type": "integer", "minimum": 1, "default": 100},
+        "maxBackups": {"type": "integer", "minimum": 0, "default": 5},
+        "url": {"type": "string"},
+        "headers": {"type": "object", "additionalProperties": {"type": "string"}},
+        "batchSize": {"type": "integer", "minimum": 1, "maximum": 10000, "default": 100},
+        "flushIntervalMs": {"type": "integer", "minimum": 10, "default": 1000},
+        "maxRetries": {"type": "integer", "minimum": 0, "maximum": 10, "default": 3},
+        "timeoutMs": {"type": "integer", "minimum": 1, "default": 5000},
+        "bufferSize": {"type": "integer", "minimum": 1, "default": 10000}
+      }
+    },
+    "requestHeaders": {"type": "array", "items": {"type": "string"}, "default": []},
+    "responseHeaders": {"type": "array", "items": {"type": "string"}, "default": []},
+    "sharedKeys": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "default": ["bot-detection.reason", "rate-limiter.decision"]
+    },
+    "include": {"type": "array", "items": {"type": "string", "minLength": 1}, "default": []},
+    "exclude": {"type": "array", "items": {"type": "string", "minLength": 1}, "default": ["request.query"]}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
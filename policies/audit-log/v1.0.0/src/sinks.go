@@ -0,0 +1,269 @@
+package audit_log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errQueueFull is returned when the HTTP sink cannot keep up and drops a
+// record
+var errQueueFull = errors.New("audit log queue is full")
+
+// sink writes encoded records, one JSON object each
+type sink interface {
+	write(record []byte) error
+	close() error
+}
+
+func newSink(cfg sinkConfig) (sink, error) {
+	switch cfg.Type {
+	case sinkFile:
+		return openFileSink(cfg.Path, cfg.MaxSizeBytes, cfg.MaxBackups)
+	case sinkHTTP:
+		return newHTTPSink(cfg), nil
+	}
+	return &streamSink{w: os.Stdout, mu: &stdoutMu}, nil
+}
+
+// stdoutMu is shared by all policy instances, so lines written to stdout
+// never interleave
+var stdoutMu sync.Mutex
+
+// streamSink writes one record per line
+type streamSink struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (s *streamSink) write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+func (s *streamSink) close() error {
+	return nil
+}
+
+// fileSink appends one record per line to a file. When the file would grow
+// past maxSize it is renamed to path.1, earlier backups move up by one and
+// the oldest beyond maxBackups is removed.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(record []byte) error {
+	line := append(record, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		// An earlier rotation failed to reopen the file
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return s.open()
+	}
+	os.Remove(s.backup(s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(s.backup(i), s.backup(i+1))
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) backup(n int) string {
+	return s.path + "." + strconv.Itoa(n)
+}
+
+func (s *fileSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// httpSink posts records in batches, as a JSON array, from a background
+// goroutine so requests never wait for the collector. A batch is sent when
+// it is full or FlushInterval has passed. Failed sends are retried with a
+// growing delay; records are dropped when the queue is full or the retries
+// are used up.
+type httpSink struct {
+	cfg    sinkConfig
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newHTTPSink(cfg sinkConfig) *httpSink {
+	s := &httpSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan []byte, cfg.BufferSize),
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *httpSink) write(record []byte) error {
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (s *httpSink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	var batch [][]byte
+	for {
+		select {
+		case record := <-s.queue:
+			batch = append(batch, record)
+			if len(batch) >= s.cfg.BatchSize {
+				s.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(batch)
+				batch = nil
+			}
+		case <-s.done:
+			// Send what is left before stopping
+			for {
+				select {
+				case record := <-s.queue:
+					batch = append(batch, record)
+					if len(batch) >= s.cfg.BatchSize {
+						s.send(batch)
+						batch = nil
+					}
+				default:
+					if len(batch) > 0 {
+						s.send(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *httpSink) send(batch [][]byte) {
+	body := append([]byte{'['}, bytes.Join(batch, []byte{','})...)
+	body = append(body, ']')
+	delay := retryDelay
+	var err error
+	for attempt := 0; attempt <= s.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, maxRetryDelay)
+		}
+		var retry bool
+		if retry, err = s.post(body); !retry {
+			break
+		}
+	}
+	if err != nil {
+		// There is no request to report this on, so it goes to the
+		// gateway's own output
+		fmt.Fprintf(os.Stderr, "audit-log: dropped %d records: %v\n", len(batch), err)
+	}
+}
+
+// post sends one batch and reports whether a failure is worth retrying
+func (s *httpSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range s.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("collector returned status %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// close sends the queued records and stops the sink
+func (s *httpSink) close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
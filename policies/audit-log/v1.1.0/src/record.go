@@ -0,0 +1,198 @@
+package audit_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of headers that carry credentials
+const redacted = "[REDACTED]"
+
+// secretHeaders are logged as redacted even when they are listed
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+}
+
+// requestRecord is what the request phase keeps for the record written in
+// the response phase, which does not see the request
+type requestRecord struct {
+	Start    time.Time
+	Method   string
+	Path     string
+	Query    string
+	RemoteIP string
+	Headers  map[string]interface{}
+}
+
+func newRequestRecord(ctx *RequestContext, headers []string, now time.Time) requestRecord {
+	path, query, _ := strings.Cut(ctx.Path, "?")
+	rec := requestRecord{
+		Start:    now,
+		Method:   ctx.Method,
+		Path:     path,
+		Query:    query,
+		RemoteIP: ctx.RemoteAddr,
+		Headers:  selectHeaders(ctx.Headers, headers),
+	}
+	if host, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		rec.RemoteIP = host
+	}
+	return rec
+}
+
+// buildRecord assembles the audit record of an exchange. Fields without a
+// value are left out rather than written as null.
+func (cfg auditConfig) buildRecord(req requestRecord, ctx *ResponseContext, now time.Time) map[string]interface{} {
+	request := map[string]interface{}{
+		"method":  req.Method,
+		"path":    req.Path,
+		"headers": req.Headers,
+	}
+	if req.Query != "" {
+		request["query"] = req.Query
+	}
+	clientIP := req.RemoteIP
+	if ip, ok := SharedValue[string](ctx.SharedContext, clientIPKey); ok && ip != "" {
+		clientIP = ip
+	}
+	if clientIP != "" {
+		request["clientIp"] = clientIP
+	}
+
+	rec := map[string]interface{}{
+		"timestamp": req.Start.UTC().Format(time.RFC3339Nano),
+		"request":   request,
+		"response": map[string]interface{}{
+			"status":  ctx.ResponseStatus,
+			"headers": selectHeaders(ctx.ResponseHeaders, cfg.ResponseHeaders),
+		},
+	}
+	if !req.Start.IsZero() {
+		// Milliseconds with microsecond precision
+		rec["latencyMs"] = float64(now.Sub(req.Start).Microseconds()) / 1000
+	}
+	if id, ok := SharedValue[string](ctx.SharedContext, ConsumerIDKey); ok && id != "" {
+		rec["consumer"] = id
+	}
+	if id, ok := SharedValue[string](ctx.SharedContext, correlationIDKey); ok && id != "" {
+		rec["correlationId"] = id
+	}
+	if tc, ok := SharedValue[TraceContext](ctx.SharedContext, TraceContextKey); ok && tc.TraceID != "" {
+		rec["traceId"] = tc.TraceID
+	}
+
+	shared := make(map[string]interface{})
+	for _, key := range cfg.SharedKeys {
+		if v, ok := ctx.SharedContext.Get(key); ok {
+			shared[key] = jsonValue(v)
+		}
+	}
+	if len(shared) > 0 {
+		rec["shared"] = shared
+	}
+
+	if len(cfg.Include) > 0 {
+		kept := make(map[string]interface{})
+		for _, path := range cfg.Include {
+			copyField(kept, rec, path)
+		}
+		rec = kept
+	}
+	for _, path := range cfg.Exclude {
+		removeField(rec, path)
+	}
+	return rec
+}
+
+// selectHeaders picks the listed headers, keyed by their lower case names.
+// Repeated headers are joined with commas.
+func selectHeaders(headers map[string][]string, names []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, name := range names {
+		values, ok := headerValues(headers, name)
+		if !ok {
+			continue
+		}
+		key := strings.ToLower(name)
+		if secretHeaders[key] {
+			out[key] = redacted
+			continue
+		}
+		out[key] = strings.Join(values, ",")
+	}
+	return out
+}
+
+// jsonValue makes a SharedContext value safe to encode. Values JSON cannot
+// encode, such as functions, are written as text.
+func jsonValue(v interface{}) interface{} {
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// fieldKeys resolves a dotted field path, such as shared.consumer.id, to
+// the keys it names in rec. Keys may contain dots themselves, as
+// SharedContext keys do, so at each level the longest key matching the
+// front of the path is taken.
+func fieldKeys(rec map[string]interface{}, path string) []string {
+	var keys []string
+	m := rec
+	for m != nil {
+		best := ""
+		for k := range m {
+			if (path == k || strings.HasPrefix(path, k+".")) && len(k) > len(best) {
+				best = k
+			}
+		}
+		if best == "" {
+			return nil
+		}
+		keys = append(keys, best)
+		if path == best {
+			return keys
+		}
+		path = path[len(best)+1:]
+		m, _ = m[best].(map[string]interface{})
+	}
+	return nil
+}
+
+// copyField copies the field at path from src to dst, creating the objects
+// that lead to it
+func copyField(dst, src map[string]interface{}, path string) {
+	keys := fieldKeys(src, path)
+	if keys == nil {
+		return
+	}
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := dst[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			dst[k] = next
+		}
+		dst = next
+		src = src[k].(map[string]interface{})
+	}
+	last := keys[len(keys)-1]
+	dst[last] = src[last]
+}
+
+func removeField(rec map[string]interface{}, path string) {
+	keys := fieldKeys(rec, path)
+	if keys == nil {
+		return
+	}
+	for _, k := range keys[:len(keys)-1] {
+		rec = rec[k].(map[string]interface{})
+	}
+	delete(rec, keys[len(keys)-1])
+}
@@ -0,0 +1,154 @@
+package basic_auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+)
+
+const (
+	bcryptMinCost = 4
+	bcryptMaxCost = 31
+	// bcryptMaxKey is the number of password bytes, including the
+	// terminating zero, that bcrypt uses; longer passwords are truncated
+	bcryptMaxKey = 72
+)
+
+// bcryptEncoding is the base64 alphabet bcrypt hashes are written in
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptMagic is the plaintext bcrypt encrypts with the derived key
+var bcryptMagic = []byte("OrpheanBeholderScryDoubt")
+
+// bcryptHash is a parsed $2a$, $2b$ or $2y$ hash
+type bcryptHash struct {
+	cost   int
+	salt   []byte
+	digest string
+}
+
+// parseBcrypt reads a hash such as
+// $2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy
+func parseBcrypt(s string) (*bcryptHash, error) {
+	if len(s) != 60 || s[0] != '$' || s[1] != '2' || s[3] != '$' || s[6] != '$' {
+		return nil, errors.New("is not a bcrypt hash")
+	}
+	switch s[2] {
+	case 'a', 'b', 'y':
+	default:
+		return nil, errors.New("uses an unsupported bcrypt version")
+	}
+	cost, err := strconv.Atoi(s[4:6])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return nil, errors.New("has an invalid bcrypt cost")
+	}
+	// 22 characters hold 16 bytes and 4 unused bits
+	salt, err := bcryptEncoding.DecodeString(s[7:29] + "..")
+	if err != nil {
+		return nil, errors.New("has an invalid bcrypt salt")
+	}
+	if _, err := bcryptEncoding.DecodeString(s[29:]); err != nil {
+		return nil, errors.New("has an invalid bcrypt digest")
+	}
+	return &bcryptHash{cost: cost, salt: salt[:16], digest: s[29:]}, nil
+}
+
+func (h *bcryptHash) verify(password []byte) bool {
+	key := make([]byte, 0, len(password)+1)
+	key = append(append(key, password...), 0)
+	if len(key) > bcryptMaxKey {
+		key = key[:bcryptMaxKey]
+	}
+
+	c := newEksBlowfish(h.cost, h.salt, key)
+	text := make([]uint32, len(bcryptMagic)/4)
+	for i := range text {
+		text[i] = be32(bcryptMagic[i*4:])
+	}
+	for i := 0; i < 64; i++ {
+		for j := 0; j < len(text); j += 2 {
+			text[j], text[j+1] = c.encrypt(text[j], text[j+1])
+		}
+	}
+	out := make([]byte, len(bcryptMagic))
+	for i, w := range text {
+		out[i*4], out[i*4+1], out[i*4+2], out[i*4+3] = byte(w>>24), byte(w>>16), byte(w>>8), byte(w)
+	}
+	// Only 23 of the 24 bytes are part of the hash
+	digest := bcryptEncoding.EncodeToString(out[:23])
+	return subtle.ConstantTimeCompare([]byte(digest), []byte(h.digest)) == 1
+}
+
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+// newEksBlowfish runs the expensive key schedule of bcrypt, which repeats the
+// Blowfish key expansion 2^cost times
+func newEksBlowfish(cost int, salt, key []byte) *blowfish {
+	c := &blowfish{p: blowfishP, s: blowfishS}
+	c.expand(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expand(key, nil)
+		c.expand(salt, nil)
+	}
+	return c
+}
+
+// expand mixes key into the P-array and re-encrypts the state, folding in
+// salt when it is given
+func (c *blowfish) expand(key, salt []byte) {
+	var kpos, spos int
+	for i := range c.p {
+		c.p[i] ^= streamWord(key, &kpos)
+	}
+	var l, r uint32
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &spos)
+			r ^= streamWord(salt, &spos)
+		}
+		l, r = c.encrypt(l, r)
+	}
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+	for i := range c.s {
+		for j := 0; j < 256; j += 2 {
+			next()
+			c.s[i][j], c.s[i][j+1] = l, r
+		}
+	}
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) + c.s[3][x&0xff]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i <= 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+	r ^= c.p[17]
+	return r, l
+}
+
+// streamWord reads the next big-endian word from data, wrapping around at the
+// end
+func streamWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
+	}
+	return w
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
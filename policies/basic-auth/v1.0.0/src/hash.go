@@ -0,0 +1,24 @@
+package basic_auth
+
+import (
+	"errors"
+	"strings"
+)
+
+// passwordHash is a stored password hash that can check a password
+type passwordHash interface {
+	verify(password []byte) bool
+}
+
+// parsePasswordHash reads a bcrypt or argon2 hash. Anything else is refused,
+// so a plaintext password pasted into the configuration is an error rather
+// than a credential that never matches.
+func parsePasswordHash(s string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2"):
+		return parseBcrypt(s)
+	case strings.HasPrefix(s, "$argon2"):
+		return parseArgon2(s)
+	}
+	return nil, errors.New("must be a bcrypt or argon2 hash, plaintext passwords are not accepted")
+}
@@ -0,0 +1,292 @@
+package basic_auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync"
+)
+
+const (
+	argon2i  = 1
+	argon2id = 2
+
+	argon2Version    = 0x13
+	argon2SyncPoints = 4
+	argon2BlockWords = 128
+	// argon2MaxMemory bounds the memory a configured hash may demand, in KiB
+	argon2MaxMemory = 1024 * 1024
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+// argon2Hash is a parsed hash in the PHC string format, such as
+// $argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG
+type argon2Hash struct {
+	mode    int
+	memory  uint32
+	time    uint32
+	threads uint32
+	salt    []byte
+	digest  []byte
+}
+
+func parseArgon2(s string) (*argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return nil, errors.New("is not an argon2 hash")
+	}
+	h := &argon2Hash{}
+	switch parts[1] {
+	case "argon2id":
+		h.mode = argon2id
+	case "argon2i":
+		h.mode = argon2i
+	default:
+		return nil, fmt.Errorf("uses the unsupported variant %s", parts[1])
+	}
+	if parts[2] != "v=19" {
+		return nil, errors.New("must use argon2 version 19")
+	}
+	var m, t, p uint64
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil || fmt.Sprintf("m=%d,t=%d,p=%d", m, t, p) != parts[3] {
+		return nil, errors.New("has invalid argon2 parameters")
+	}
+	switch {
+	case p < 1 || p > 255:
+		return nil, errors.New("must use an argon2 parallelism of 1 to 255")
+	case t < 1 || t > 1<<16:
+		return nil, errors.New("has an invalid argon2 time cost")
+	case m < 8*p || m > argon2MaxMemory:
+		return nil, fmt.Errorf("must use between %d and %d KiB of argon2 memory", 8*p, argon2MaxMemory)
+	}
+	h.memory, h.time, h.threads = uint32(m), uint32(t), uint32(p)
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) < 8 {
+		return nil, errors.New("has an invalid argon2 salt")
+	}
+	if h.digest, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.digest) < 4 {
+		return nil, errors.New("has an invalid argon2 digest")
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password []byte) bool {
+	key := argon2Key(password, h.salt, nil, nil, h.time, h.memory, h.threads, uint32(len(h.digest)), h.mode)
+	return subtle.ConstantTimeCompare(key, h.digest) == 1
+}
+
+// argon2Key derives a key as specified in RFC 9106
+func argon2Key(password, salt, secret, data []byte, time, memory, threads, keyLen uint32, mode int) []byte {
+	h0 := argon2InitHash(password, salt, secret, data, time, memory, threads, keyLen, mode)
+
+	memory = memory / (argon2SyncPoints * threads) * (argon2SyncPoints * threads)
+	if memory < 2*argon2SyncPoints*threads {
+		memory = 2 * argon2SyncPoints * threads
+	}
+	B := argon2InitBlocks(h0, memory, threads)
+	argon2Fill(B, time, memory, threads, mode)
+
+	lanes := memory / threads
+	final := B[lanes-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		for i, v := range B[lane*lanes+lanes-1] {
+			final[i] ^= v
+		}
+	}
+	var block [1024]byte
+	for i, v := range final {
+		binary.LittleEndian.PutUint64(block[i*8:], v)
+	}
+	return argon2VarHash(block[:], keyLen)
+}
+
+func argon2InitHash(password, salt, secret, data []byte, time, memory, threads, keyLen uint32, mode int) []byte {
+	var buf []byte
+	le32 := func(v uint32) {
+		buf = binary.LittleEndian.AppendUint32(buf, v)
+	}
+	le32(threads)
+	le32(keyLen)
+	le32(memory)
+	le32(time)
+	le32(argon2Version)
+	le32(uint32(mode))
+	for _, in := range [][]byte{password, salt, secret, data} {
+		le32(uint32(len(in)))
+		buf = append(buf, in...)
+	}
+	return blake2b(64, buf)
+}
+
+// argon2VarHash is the variable length hash H' of RFC 9106
+func argon2VarHash(in []byte, size uint32) []byte {
+	prefix := binary.LittleEndian.AppendUint32(nil, size)
+	if size <= 64 {
+		return blake2b(int(size), prefix, in)
+	}
+	// The first 32 bytes of a chain of 64 byte digests, then a last digest
+	// as long as what is left
+	r := (size+31)/32 - 2
+	out := make([]byte, 0, size)
+	v := blake2b(64, prefix, in)
+	out = append(out, v[:32]...)
+	for i := uint32(1); i < r; i++ {
+		v = blake2b(64, v)
+		out = append(out, v[:32]...)
+	}
+	return append(out, blake2b(int(size-32*r), v)...)
+}
+
+func argon2InitBlocks(h0 []byte, memory, threads uint32) []argon2Block {
+	B := make([]argon2Block, memory)
+	lanes := memory / threads
+	for lane := uint32(0); lane < threads; lane++ {
+		for i := uint32(0); i < 2; i++ {
+			seed := binary.LittleEndian.AppendUint32(append([]byte(nil), h0...), i)
+			seed = binary.LittleEndian.AppendUint32(seed, lane)
+			block := argon2VarHash(seed, 1024)
+			for j := range B[lane*lanes+i] {
+				B[lane*lanes+i][j] = binary.LittleEndian.Uint64(block[j*8:])
+			}
+		}
+	}
+	return B
+}
+
+func argon2Fill(B []argon2Block, time, memory, threads uint32, mode int) {
+	lanes := memory / threads
+	segments := lanes / argon2SyncPoints
+
+	segment := func(pass, slice, lane uint32) {
+		var addresses, in, zero argon2Block
+		// Argon2i, and Argon2id in the first half of the first pass, pick
+		// reference blocks independently of the password
+		independent := mode == argon2i || (mode == argon2id && pass == 0 && slice < argon2SyncPoints/2)
+		if independent {
+			in[0], in[1], in[2], in[3], in[4], in[5] = uint64(pass), uint64(lane), uint64(slice), uint64(memory), uint64(time), uint64(mode)
+		}
+		index := uint32(0)
+		if pass == 0 && slice == 0 {
+			// The first two blocks of each lane are already set
+			index = 2
+			if independent {
+				in[6]++
+				argon2Compress(&addresses, &in, &zero, false)
+				argon2Compress(&addresses, &addresses, &zero, false)
+			}
+		}
+		offset := lane*lanes + slice*segments + index
+		for ; index < segments; index, offset = index+1, offset+1 {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += lanes
+			}
+			var random uint64
+			if independent {
+				if index%argon2BlockWords == 0 {
+					in[6]++
+					argon2Compress(&addresses, &in, &zero, false)
+					argon2Compress(&addresses, &addresses, &zero, false)
+				}
+				random = addresses[index%argon2BlockWords]
+			} else {
+				random = B[prev][0]
+			}
+			ref := argon2Index(random, lanes, segments, threads, pass, slice, lane, index)
+			argon2Compress(&B[offset], &B[prev], &B[ref], pass > 0)
+		}
+	}
+
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			// Lanes only refer to other lanes' finished slices, so the
+			// segments of one slice can be filled at the same time
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go func(lane uint32) {
+					defer wg.Done()
+					segment(pass, slice, lane)
+				}(lane)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// argon2Index maps a pseudo-random value to the block a new block refers to
+func argon2Index(random uint64, lanes, segments, threads, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % threads
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+	m, s := 3*segments, ((slice+1)%argon2SyncPoints)*segments
+	if lane == refLane {
+		m += index
+	}
+	if pass == 0 {
+		m, s = slice*segments, 0
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		m--
+	}
+	x := random & 0xffffffff
+	x = x * x >> 32
+	x = x * uint64(m) >> 32
+	return refLane*lanes + uint32((uint64(s)+uint64(m)-(x+1))%uint64(lanes))
+}
+
+// argon2Compress is the compression function G. With xor set the result is
+// combined with the block already in out, as later passes require.
+func argon2Compress(out, x, y *argon2Block, xor bool) {
+	var r argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	z := r
+	for i := 0; i < argon2BlockWords; i += 16 {
+		blamka(&z, i, i+1, i+2, i+3, i+4, i+5, i+6, i+7, i+8, i+9, i+10, i+11, i+12, i+13, i+14, i+15)
+	}
+	for i := 0; i < 16; i += 2 {
+		blamka(&z, i, i+1, i+16, i+17, i+32, i+33, i+48, i+49, i+64, i+65, i+80, i+81, i+96, i+97, i+112, i+113)
+	}
+	for i := range z {
+		if xor {
+			out[i] ^= r[i] ^ z[i]
+		} else {
+			out[i] = r[i] ^ z[i]
+		}
+	}
+}
+
+// blamka is the BLAKE2b round with the multiplications Argon2 adds, applied
+// to sixteen words of b
+func blamka(b *argon2Block, i0, i1, i2, i3, i4, i5, i6, i7, i8, i9, i10, i11, i12, i13, i14, i15 int) {
+	g := func(a, b2, c, d *uint64) {
+		*a += *b2 + 2*uint64(uint32(*a))*uint64(uint32(*b2))
+		*d = bits.RotateLeft64(*d^*a, -32)
+		*c += *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+		*b2 = bits.RotateLeft64(*b2^*c, -24)
+		*a += *b2 + 2*uint64(uint32(*a))*uint64(uint32(*b2))
+		*d = bits.RotateLeft64(*d^*a, -16)
+		*c += *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+		*b2 = bits.RotateLeft64(*b2^*c, -63)
+	}
+	g(&b[i0], &b[i4], &b[i8], &b[i12])
+	g(&b[i1], &b[i5], &b[i9], &b[i13])
+	g(&b[i2], &b[i6], &b[i10], &b[i14])
+	g(&b[i3], &b[i7], &b[i11], &b[i15])
+	g(&b[i0], &b[i5], &b[i10], &b[i15])
+	g(&b[i1], &b[i6], &b[i11], &b[i12])
+	g(&b[i2], &b[i7], &b[i8], &b[i13])
+	g(&b[i3], &b[i4], &b[i9], &b[i14])
+}
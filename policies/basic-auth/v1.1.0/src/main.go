@@ -0,0 +1,658 @@
+package basic_auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Initializer is implemented by policies that set up state for their
+// instance. The gateway calls Init once, with the parameters Validate
+// accepted and before the first request, and drops the instance if it
+// returns an error.
+type Initializer interface {
+	Init(params map[string]interface{}) error
+}
+
+// Rotator is implemented by policies that take new secret values in place.
+// When a secret the parameters refer to with $secretRef changes, the gateway
+// validates the parameters resolved anew and calls Rotate with them; an
+// error keeps the old values in use.
+type Rotator interface {
+	Rotate(params map[string]interface{}) error
+}
+
+const (
+	defaultRealm            = "Restricted"
+	defaultUnauthorizedBody = `{"error": "Unauthorized"}`
+
+	// maxCachedVerifications bounds the verification cache. When it is full
+	// and nothing has expired, the cache starts over.
+	maxCachedVerifications = 10000
+)
+
+var (
+	_ Initializer = (*BasicAuthPolicy)(nil)
+	_ Rotator     = (*BasicAuthPolicy)(nil)
+)
+
+type BasicAuthPolicy struct {
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]cachedVerification
+	// hashes are the password hashes by user of the parameters Init or the
+	// last Rotate got
+	hashes map[string]credential
+	// retired are hashes Rotate replaced, still accepted until their time
+	retired []retiredCredential
+}
+
+// retiredCredential is the previous password hash of a user
+type retiredCredential struct {
+	username string
+	credential
+	until time.Time
+}
+
+// cachedVerification records a password that matched a stored hash, so the
+// next request with the same credentials skips the deliberately slow hash
+type cachedVerification struct {
+	hash    string
+	expires time.Time
+}
+
+type credential struct {
+	rawHash string
+	hash    passwordHash
+}
+
+type authConfig struct {
+	Realm       string
+	Credentials map[string]credential
+	// First is the credential checked for unknown usernames, so they take as
+	// long to reject as wrong passwords
+	First                credential
+	UsernameHeader       string
+	ForwardAuthorization bool
+	UnauthorizedBody     string
+	CacheTTL             time.Duration
+	RotationGrace        time.Duration
+}
+
+// Validate configuration parameters
+func (b *BasicAuthPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Init records the password hashes, so Rotate can tell which of them change
+func (b *BasicAuthPolicy) Init(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hashes = cfg.Credentials
+	return nil
+}
+
+// Rotate takes new hashes read with $secretRef. Unlike a new instance, it
+// keeps the verification cache, whose entries are tied to the hash they
+// matched, and with rotationGraceSeconds keeps accepting the previous
+// password of a user for a while.
+func (b *BasicAuthPolicy) Rotate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.retired[:0]
+	for _, r := range b.retired {
+		if now.Before(r.until) {
+			kept = append(kept, r)
+		}
+	}
+	b.retired = kept
+	for username, old := range b.hashes {
+		if cred, ok := cfg.Credentials[username]; ok && cred.rawHash == old.rawHash {
+			continue
+		}
+		if cfg.RotationGrace > 0 {
+			b.retired = append(b.retired, retiredCredential{username: username, credential: old, until: now.Add(cfg.RotationGrace)})
+		}
+	}
+	b.hashes = cfg.Credentials
+	return nil
+}
+
+// retiredCredentials returns the previous hashes of a user that are still
+// accepted
+func (b *BasicAuthPolicy) retiredCredentials(username string, now time.Time) []credential {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var creds []credential
+	for _, r := range b.retired {
+		if r.username == username && now.Before(r.until) {
+			creds = append(creds, r.credential)
+		}
+	}
+	return creds
+}
+
+// Declare processing behavior
+func (b *BasicAuthPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (b *BasicAuthPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return unauthorized(defaultRealm, defaultUnauthorizedBody)
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultRealm, defaultUnauthorizedBody)
+	}
+
+	username, password, ok := basicCredentials(ctx.Headers)
+	if !ok || !b.authenticate(cfg, username, password) {
+		return unauthorized(cfg.Realm, cfg.UnauthorizedBody)
+	}
+
+	ctx.SharedContext.Set(ConsumerIDKey, username)
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	if cfg.UsernameHeader != "" {
+		mods.SetHeaders[cfg.UsernameHeader] = username
+	}
+	if !cfg.ForwardAuthorization {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, "Authorization")
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (b *BasicAuthPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// authenticate checks a username and password against the configured
+// credentials, and then against the hashes the user had before a rotation
+func (b *BasicAuthPolicy) authenticate(cfg authConfig, username, password string) bool {
+	cred, known := cfg.Credentials[username]
+	if !known {
+		// Spend the same work as for a known user, so response times do not
+		// tell which usernames exist
+		cfg.First.hash.verify([]byte(password))
+		return false
+	}
+
+	var key [sha256.Size]byte
+	if cfg.CacheTTL > 0 {
+		key = sha256.Sum256([]byte(username + "\x00" + password))
+	}
+	if b.matches(cfg, key, cred, password) {
+		return true
+	}
+	for _, old := range b.retiredCredentials(username, time.Now()) {
+		if b.matches(cfg, key, old, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks a password against one hash, through the cache when it is
+// on
+func (b *BasicAuthPolicy) matches(cfg authConfig, key [sha256.Size]byte, cred credential, password string) bool {
+	if cfg.CacheTTL > 0 && b.cached(key, cred.rawHash) {
+		return true
+	}
+	if !cred.hash.verify([]byte(password)) {
+		return false
+	}
+	if cfg.CacheTTL > 0 {
+		b.remember(key, cred.rawHash, cfg.CacheTTL)
+	}
+	return true
+}
+
+// cached reports whether the credentials behind key recently matched hash.
+// Entries are tied to the hash, so changing a password takes effect at once.
+func (b *BasicAuthPolicy) cached(key [sha256.Size]byte, hash string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.verified[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(entry.hash), []byte(hash)) == 1
+}
+
+func (b *BasicAuthPolicy) remember(key [sha256.Size]byte, hash string, ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.verified == nil {
+		b.verified = make(map[[sha256.Size]byte]cachedVerification)
+	}
+	if len(b.verified) >= maxCachedVerifications {
+		for k, entry := range b.verified {
+			if now.After(entry.expires) {
+				delete(b.verified, k)
+			}
+		}
+		if len(b.verified) >= maxCachedVerifications {
+			b.verified = make(map[[sha256.Size]byte]cachedVerification)
+		}
+	}
+	b.verified[key] = cachedVerification{hash: hash, expires: now.Add(ttl)}
+}
+
+// parseConfig reads the parameters after the schema has checked them and
+// parses the password hashes
+func parseConfig(params map[string]interface{}) (authConfig, error) {
+	cfg := authConfig{Credentials: map[string]credential{}}
+	var errs paramErrors
+
+	cfg.Realm, _ = params["realm"].(string)
+	if strings.ContainsAny(cfg.Realm, "\"\\\r\n") {
+		errs.add("realm", "must not contain quotes, backslashes or line breaks")
+	}
+	cfg.UsernameHeader, _ = params["usernameHeader"].(string)
+	if _, ok := params["usernameHeader"]; ok && !validHeaderName(cfg.UsernameHeader) {
+		errs.add("usernameHeader", "must be a valid header name")
+	}
+	cfg.ForwardAuthorization, _ = params["forwardAuthorization"].(bool)
+	cfg.UnauthorizedBody, _ = params["unauthorizedBody"].(string)
+	if ttl, ok := params["cacheTtlSeconds"].(float64); ok {
+		cfg.CacheTTL = time.Duration(ttl) * time.Second
+	}
+	if grace, ok := params["rotationGraceSeconds"].(float64); ok {
+		cfg.RotationGrace = time.Duration(grace) * time.Second
+	}
+
+	list, _ := params["credentials"].([]interface{})
+	for i, item := range list {
+		m, _ := item.(map[string]interface{})
+		path := fmt.Sprintf("credentials[%d]", i)
+		username, _ := m["username"].(string)
+		raw, _ := m["hash"].(string)
+		if strings.ContainsRune(username, ':') {
+			// The first colon separates the username from the password
+			errs.add(path+".username", "must not contain a colon")
+		}
+		if _, dup := cfg.Credentials[username]; dup {
+			errs.add(path+".username", fmt.Sprintf("duplicates %q", username))
+		}
+		hash, err := parsePasswordHash(raw)
+		if err != nil {
+			errs.add(path+".hash", err.Error())
+			continue
+		}
+		cred := credential{rawHash: raw, hash: hash}
+		cfg.Credentials[username] = cred
+		if i == 0 {
+			cfg.First = cred
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// basicCredentials decodes the Authorization header of the Basic scheme
+// (RFC 7617)
+func basicCredentials(headers map[string][]string) (username, password string, ok bool) {
+	var value string
+	for k, values := range headers {
+		if strings.EqualFold(k, "Authorization") && len(values) > 0 {
+			value = strings.TrimSpace(values[0])
+			break
+		}
+	}
+	scheme, encoded, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func unauthorized(realm, body string) ImmediateResponse {
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type":     {"application/json"},
+			"WWW-Authenticate": {fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm)},
+		},
+		Body: body,
+	}
+}
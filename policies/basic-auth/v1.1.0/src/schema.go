@@ -0,0 +1,31 @@
+package basic_auth
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "realm": {"type": "string", "minLength": 1, "default": "Restricted"},
+    "credentials": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "username": {"type": "string", "minLength": 1},
+          "hash": {"type": "string"}
+        },
+        "required": ["username", "hash"]
+      }
+    },
+    "usernameHeader": {"type": "string"},
+    "forwardAuthorization": {"type": "boolean", "default": false},
+    "unauthorizedBody": {"type": "string", "default": "{\"error\": \"Unauthorized\"}"},
+    "cacheTtlSeconds": {"type": "integer", "minimum": 0, "default": 300},
+    "rotationGraceSeconds": {"type": "integer", "minimum": 0, "default": 0}
+  },
+  "required": ["credentials"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,273 @@
+package body_transform
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+// Body holds the buffered message body in BUFFER mode
+type Body struct {
+	Content []byte
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+// Body, when non-nil, replaces the message body sent on
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	Body          []byte
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+	Body       []byte
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// requestKey carries request attributes to the response transformation
+const requestKey = "body-transform.request"
+
+const invalidBodyResponse = `{"error": "Invalid request body"}`
+
+type BodyTransformPolicy struct {
+	mu        sync.Mutex
+	templates map[string]*template.Template
+}
+
+type transformConfig struct {
+	Request  *transformSpec
+	Response *transformSpec
+}
+
+// Validate configuration parameters
+func (p *BodyTransformPolicy) Validate(params map[string]interface{}) error {
+	_, err := p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *BodyTransformPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *BodyTransformPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	in := &transformInput{
+		Method:         ctx.Method,
+		Path:           ctx.Path,
+		headers:        ctx.Headers,
+		requestHeaders: ctx.Headers,
+	}
+	if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+		in.Path = ctx.Path[:i]
+		in.query, _ = url.ParseQuery(ctx.Path[i+1:])
+	}
+	if cfg.Response != nil && ctx.SharedContext != nil {
+		ctx.SharedContext.Set(requestKey, *in)
+	}
+
+	spec := cfg.Request
+	body := bodyContent(ctx.Body)
+	if spec == nil || !transformable(ctx.Headers, body) {
+		return UpstreamRequestModifications{}
+	}
+	out, err := spec.apply(body, in)
+	if err != nil {
+		if spec.RejectInvalid {
+			return ImmediateResponse{
+				Status:  400,
+				Headers: map[string][]string{"Content-Type": {"application/json"}},
+				Body:    invalidBodyResponse,
+			}
+		}
+		return UpstreamRequestModifications{}
+	}
+
+	mods := UpstreamRequestModifications{Body: out}
+	if spec.ContentType != "" {
+		mods.SetHeaders = map[string]string{"Content-Type": spec.ContentType}
+	}
+	return mods
+}
+
+// Response phase execution
+func (p *BodyTransformPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	cfg, err := p.parseConfig(params)
+	body := bodyContent(ctx.ResponseBody)
+	if err != nil || cfg.Response == nil || !transformable(ctx.ResponseHeaders, body) {
+		return UpstreamResponseModifications{}
+	}
+
+	in := &transformInput{}
+	if ctx.SharedContext != nil {
+		if v, ok := ctx.SharedContext.Get(requestKey); ok {
+			if req, ok := v.(transformInput); ok {
+				in = &req
+			}
+		}
+	}
+	in.Status = ctx.ResponseStatus
+	in.headers = ctx.ResponseHeaders
+
+	out, err := cfg.Response.apply(body, in)
+	if err != nil {
+		// The upstream answer is passed on unchanged rather than replaced by an error
+		return UpstreamResponseModifications{}
+	}
+
+	mods := UpstreamResponseModifications{Body: out}
+	if cfg.Response.ContentType != "" {
+		mods.SetHeaders = map[string]string{"Content-Type": cfg.Response.ContentType}
+	}
+	return mods
+}
+
+func (p *BodyTransformPolicy) parseConfig(params map[string]interface{}) (transformConfig, error) {
+	var cfg transformConfig
+	var err error
+	if cfg.Request, err = p.parseSpec(params["request"], "request", true); err != nil {
+		return cfg, err
+	}
+	if cfg.Response, err = p.parseSpec(params["response"], "response", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Request == nil && cfg.Response == nil {
+		return cfg, fmt.Errorf("at least one of request and response must be configured")
+	}
+	return cfg, nil
+}
+
+// template parses a body template once per policy instance
+func (p *BodyTransformPolicy) template(text string) (*template.Template, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.templates[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("body").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if p.templates == nil {
+		p.templates = make(map[string]*template.Template)
+	}
+	p.templates[text] = t
+	return t, nil
+}
+
+func bodyContent(b *Body) []byte {
+	if b == nil {
+		return nil
+	}
+	return b.Content
+}
+
+// transformable reports whether a message is JSON. A message without a
+// Content-Type is treated as JSON unless it has no body at all, so bodiless
+// requests such as GETs are left alone.
+func transformable(headers map[string][]string, body []byte) bool {
+	ct := strings.ToLower(headerValue(headers, "Content-Type"))
+	if ct == "" {
+		return len(body) > 0
+	}
+	mediaType, _, _ := strings.Cut(ct, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,309 @@
+package body_transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	opSet    = "set"
+	opRemove = "remove"
+	opRename = "rename"
+	opCopy   = "copy"
+)
+
+// transformSpec describes how the body of one phase is rewritten. Operations
+// run first; a template, if present, then renders the final body.
+type transformSpec struct {
+	Operations    []operation
+	Template      *template.Template
+	ContentType   string
+	RejectInvalid bool
+}
+
+type operation struct {
+	Op        string
+	Path      fieldPath
+	From      fieldPath
+	Value     interface{}
+	ValueFrom *valueSource
+}
+
+// valueSource names a request or response attribute injected into the body
+type valueSource struct {
+	Kind string
+	Name string
+}
+
+// transformInput is what operations and templates can read. Templates see the
+// exported fields and methods, e.g. {{.Body.id}} or {{.Header "X-User"}}.
+type transformInput struct {
+	Body   interface{}
+	Method string
+	Path   string
+	Status int
+
+	headers        map[string][]string
+	requestHeaders map[string][]string
+	query          url.Values
+}
+
+// Header reads a header of the current phase
+func (in *transformInput) Header(name string) string {
+	return headerValue(in.headers, name)
+}
+
+// RequestHeader reads a request header, also in the response phase
+func (in *transformInput) RequestHeader(name string) string {
+	return headerValue(in.requestHeaders, name)
+}
+
+// Query reads a query parameter of the request
+func (in *transformInput) Query(name string) string {
+	return in.query.Get(name)
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := marshalJSON(v)
+		return string(b), err
+	},
+}
+
+func (p *BodyTransformPolicy) parseSpec(raw interface{}, name string, requestPhase bool) (*transformSpec, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an object", name)
+	}
+	spec := &transformSpec{}
+
+	if v, ok := m["operations"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s.operations must be a list", name)
+		}
+		for i, item := range list {
+			op, err := parseOperation(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s.operations[%d]: %v", name, i, err)
+			}
+			spec.Operations = append(spec.Operations, op)
+		}
+	}
+
+	if v, ok := m["template"]; ok {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("%s.template must be a non-empty string", name)
+		}
+		t, err := p.template(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s.template: %v", name, err)
+		}
+		spec.Template = t
+	}
+	if len(spec.Operations) == 0 && spec.Template == nil {
+		return nil, fmt.Errorf("%s must set operations or a template", name)
+	}
+
+	if v, ok := m["contentType"]; ok {
+		s, ok := v.(string)
+		if !ok || s == "" || strings.ContainsAny(s, "\r\n") {
+			return nil, fmt.Errorf("%s.contentType must be a media type", name)
+		}
+		spec.ContentType = s
+	}
+	if v, ok := m["rejectInvalidBody"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s.rejectInvalidBody must be a boolean", name)
+		}
+		if !requestPhase && b {
+			return nil, fmt.Errorf("%s.rejectInvalidBody is only supported for requests", name)
+		}
+		spec.RejectInvalid = b
+	}
+	return spec, nil
+}
+
+func parseOperation(raw interface{}) (operation, error) {
+	var op operation
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return op, errors.New("must be an object")
+	}
+	op.Op, _ = m["op"].(string)
+
+	path, _ := m["path"].(string)
+	var err error
+	if op.Path, err = parsePath(path); err != nil {
+		return op, err
+	}
+
+	switch op.Op {
+	case opSet:
+		value, hasValue := m["value"]
+		from, hasFrom := m["valueFrom"]
+		if hasValue == hasFrom {
+			return op, errors.New("set needs exactly one of value and valueFrom")
+		}
+		if hasValue {
+			op.Value = value
+			break
+		}
+		s, ok := from.(string)
+		if !ok {
+			return op, errors.New("valueFrom must be a string")
+		}
+		if op.ValueFrom, err = parseValueSource(s); err != nil {
+			return op, err
+		}
+	case opRemove:
+	case opRename, opCopy:
+		from, _ := m["from"].(string)
+		if op.From, err = parsePath(from); err != nil {
+			return op, fmt.Errorf("from: %v", err)
+		}
+	default:
+		return op, fmt.Errorf("op must be one of: %s, %s, %s, %s", opSet, opRemove, opRename, opCopy)
+	}
+	return op, nil
+}
+
+// parseValueSource reads "header:<name>", "requestHeader:<name>",
+// "query:<name>", "method", "path" or "status"
+func parseValueSource(s string) (*valueSource, error) {
+	kind, name, _ := strings.Cut(s, ":")
+	switch kind {
+	case "header", "requestHeader", "query":
+		if name == "" {
+			return nil, fmt.Errorf("valueFrom %q needs a name, e.g. %s:X-User", s, kind)
+		}
+	case "method", "path", "status":
+		if name != "" {
+			return nil, fmt.Errorf("valueFrom %q does not take a name", s)
+		}
+	default:
+		return nil, fmt.Errorf("valueFrom %q must start with header:, requestHeader: or query:, or be method, path or status", s)
+	}
+	return &valueSource{Kind: kind, Name: name}, nil
+}
+
+func (vs *valueSource) resolve(in *transformInput) (string, bool) {
+	var v string
+	switch vs.Kind {
+	case "header":
+		v = in.Header(vs.Name)
+	case "requestHeader":
+		v = in.RequestHeader(vs.Name)
+	case "query":
+		v = in.Query(vs.Name)
+	case "method":
+		v = in.Method
+	case "path":
+		v = in.Path
+	case "status":
+		if in.Status > 0 {
+			v = strconv.Itoa(in.Status)
+		}
+	}
+	return v, v != ""
+}
+
+// apply rewrites body and returns the new content. An empty body is treated
+// as a missing document so operations can build one from scratch.
+func (spec *transformSpec) apply(body []byte, in *transformInput) ([]byte, error) {
+	var doc interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		// Keep numbers as written so large integers survive the round trip
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("body is not valid JSON: %v", err)
+		}
+		if dec.More() {
+			return nil, errors.New("body is not valid JSON: trailing data")
+		}
+	}
+
+	var err error
+	for _, op := range spec.Operations {
+		switch op.Op {
+		case opSet:
+			value := op.Value
+			if op.ValueFrom != nil {
+				s, ok := op.ValueFrom.resolve(in)
+				if !ok {
+					// Missing attributes leave the body as it is
+					continue
+				}
+				value = s
+			}
+			doc, err = op.Path.set(doc, value)
+		case opRemove:
+			doc = op.Path.remove(doc)
+		case opRename, opCopy:
+			v, ok := op.From.get(doc)
+			if !ok {
+				continue
+			}
+			if op.Op == opRename {
+				doc = op.From.remove(doc)
+			} else {
+				v = deepCopy(v)
+			}
+			doc, err = op.Path.set(doc, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", op.Op, op.Path, err)
+		}
+	}
+
+	if spec.Template == nil {
+		return marshalJSON(doc)
+	}
+	in.Body = doc
+	var out bytes.Buffer
+	if err := spec.Template.Execute(&out, in); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// marshalJSON encodes without HTML escaping so "<" and "&" stay readable
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(node))
+		for k, child := range node {
+			out[k] = deepCopy(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(node))
+		for i, child := range node {
+			out[i] = deepCopy(child)
+		}
+		return out
+	}
+	return v
+}
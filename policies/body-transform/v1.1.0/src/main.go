@@ -0,0 +1,356 @@
+package body_transform
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// requestKey carries request attributes to the response transformation
+const requestKey = "body-transform.request"
+
+const invalidBodyResponse = `{"error": "Invalid request body"}`
+
+type BodyTransformPolicy struct {
+	mu        sync.Mutex
+	templates map[string]*template.Template
+}
+
+type transformConfig struct {
+	Request      *transformSpec
+	Response     *transformSpec
+	MaxBodyBytes int64
+}
+
+// Validate configuration parameters
+func (p *BodyTransformPolicy) Validate(params map[string]interface{}) error {
+	_, err := p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *BodyTransformPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *BodyTransformPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	in := &transformInput{
+		Method:         ctx.Method,
+		Path:           ctx.Path,
+		headers:        ctx.Headers,
+		requestHeaders: ctx.Headers,
+	}
+	if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+		in.Path = ctx.Path[:i]
+		in.query, _ = url.ParseQuery(ctx.Path[i+1:])
+	}
+	if cfg.Response != nil && ctx.SharedContext != nil {
+		ctx.SharedContext.Set(requestKey, *in)
+	}
+
+	spec := cfg.Request
+	if spec == nil || !cfg.transformable(ctx.Body) {
+		return UpstreamRequestModifications{}
+	}
+	out, err := spec.apply(ctx.Body.Bytes(), in)
+	if err != nil {
+		if spec.RejectInvalid {
+			return ImmediateResponse{
+				Status:  400,
+				Headers: map[string][]string{"Content-Type": {"application/json"}},
+				Body:    invalidBodyResponse,
+			}
+		}
+		return UpstreamRequestModifications{}
+	}
+
+	ctx.Body.Replace(out)
+	mods := UpstreamRequestModifications{}
+	if spec.ContentType != "" {
+		mods.SetHeaders = map[string]string{"Content-Type": spec.ContentType}
+	}
+	return mods
+}
+
+// Response phase execution
+func (p *BodyTransformPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	cfg, err := p.parseConfig(params)
+	if err != nil || cfg.Response == nil || !cfg.transformable(ctx.ResponseBody) {
+		return UpstreamResponseModifications{}
+	}
+
+	in := &transformInput{}
+	if ctx.SharedContext != nil {
+		if v, ok := ctx.SharedContext.Get(requestKey); ok {
+			if req, ok := v.(transformInput); ok {
+				in = &req
+			}
+		}
+	}
+	in.Status = ctx.ResponseStatus
+	in.headers = ctx.ResponseHeaders
+
+	out, err := cfg.Response.apply(ctx.ResponseBody.Bytes(), in)
+	if err != nil {
+		// The upstream answer is passed on unchanged rather than replaced by an error
+		return UpstreamResponseModifications{}
+	}
+
+	ctx.ResponseBody.Replace(out)
+	mods := UpstreamResponseModifications{}
+	if cfg.Response.ContentType != "" {
+		mods.SetHeaders = map[string]string{"Content-Type": cfg.Response.ContentType}
+	}
+	return mods
+}
+
+func (p *BodyTransformPolicy) parseConfig(params map[string]interface{}) (transformConfig, error) {
+	var cfg transformConfig
+	var err error
+	if cfg.Request, err = p.parseSpec(params["request"], "request", true); err != nil {
+		return cfg, err
+	}
+	if cfg.Response, err = p.parseSpec(params["response"], "response", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Request == nil && cfg.Response == nil {
+		return cfg, errors.New("at least one of request and response must be configured")
+	}
+	if v, ok := params["maxBodyBytes"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, errors.New("maxBodyBytes must be a non-negative integer")
+		}
+		cfg.MaxBodyBytes = int64(f)
+	}
+	return cfg, nil
+}
+
+// template parses a body template once per policy instance
+func (p *BodyTransformPolicy) template(text string) (*template.Template, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.templates[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("body").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if p.templates == nil {
+		p.templates = make(map[string]*template.Template)
+	}
+	p.templates[text] = t
+	return t, nil
+}
+
+// transformable reports whether a body is buffered JSON within the size limit.
+// A body without a Content-Type is treated as JSON unless it is empty, so
+// bodiless requests such as GETs are left alone.
+func (cfg transformConfig) transformable(body *Body) bool {
+	if body == nil || body.Stream() != nil {
+		return false
+	}
+	if cfg.MaxBodyBytes > 0 && body.ContentLength() > cfg.MaxBodyBytes {
+		return false
+	}
+	ct := strings.ToLower(body.ContentType())
+	if ct == "" {
+		return body.ContentLength() > 0
+	}
+	mediaType, _, _ := strings.Cut(ct, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package body_transform
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fieldPath addresses a value inside a decoded JSON document. Segments are
+// separated by dots; numeric segments index arrays, e.g. "items.0.id".
+type fieldPath []string
+
+func parsePath(s string) (fieldPath, error) {
+	if s == "" {
+		return nil, errors.New("path must not be empty")
+	}
+	parts := strings.Split(s, ".")
+	for _, p := range parts {
+		if p == "" {
+			return nil, fmt.Errorf("path %q has an empty segment", s)
+		}
+	}
+	return fieldPath(parts), nil
+}
+
+func (p fieldPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// get returns the value at p, if every segment exists
+func (p fieldPath) get(doc interface{}) (interface{}, bool) {
+	v := doc
+	for _, seg := range p {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// set stores value at p and returns the updated document. Missing objects on
+// the way are created; arrays are only indexed, never grown.
+func (p fieldPath) set(doc interface{}, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+	seg, rest := p[0], p[1:]
+	switch node := doc.(type) {
+	case nil:
+		child, err := rest.set(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{seg: child}, nil
+	case map[string]interface{}:
+		child, err := rest.set(node[seg], value)
+		if err != nil {
+			return nil, err
+		}
+		node[seg] = child
+		return node, nil
+	case []interface{}:
+		i, err := strconv.Atoi(seg)
+		if err != nil || i < 0 || i >= len(node) {
+			return nil, fmt.Errorf("index %q is out of range", seg)
+		}
+		child, err := rest.set(node[i], value)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("cannot set %q inside a %s", seg, jsonType(doc))
+}
+
+// remove deletes the value at p. Removing an array element shifts the rest.
+func (p fieldPath) remove(doc interface{}) interface{} {
+	if len(p) == 0 {
+		return doc
+	}
+	seg, rest := p[0], p[1:]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			delete(node, seg)
+		} else if child, ok := node[seg]; ok {
+			node[seg] = rest.remove(child)
+		}
+		return node
+	case []interface{}:
+		i, err := strconv.Atoi(seg)
+		if err != nil || i < 0 || i >= len(node) {
+			return node
+		}
+		if len(rest) == 0 {
+			return append(node[:i], node[i+1:]...)
+		}
+		node[i] = rest.remove(node[i])
+		return node
+	}
+	return doc
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return "number"
+}
@@ -0,0 +1,532 @@
+package bot_detection
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+const (
+	actionBlock    = "block"
+	actionTag      = "tag"
+	actionThrottle = "throttle"
+
+	// Reasons a request is flagged, as sent in the tag header and stored
+	// in the SharedContext
+	reasonUserAgent  = "user-agent"
+	reasonMissing    = "missing-header"
+	reasonSuspicious = "suspicious-request"
+)
+
+// reasonKey stores why a request was flagged in the SharedContext, for
+// logging and later policies
+const reasonKey = "bot-detection.reason"
+
+// limitFactorKey is read by the Rate Limiting Policy (v1.7.0 or later),
+// which counts the request against a budget scaled down by the factor
+const limitFactorKey = "rate-limiter.limitFactor"
+
+type BotDetectionPolicy struct {
+	mu      sync.Mutex
+	regexes map[string]*regexp.Regexp
+}
+
+type botConfig struct {
+	Action          string
+	Deny            []*regexp.Regexp
+	Allow           []*regexp.Regexp
+	RequiredHeaders []string
+	Suspicious      []*regexp.Regexp
+	TagHeader       string
+	ThrottleFactor  float64
+	BlockBody       string
+}
+
+// Validate configuration parameters
+func (p *BotDetectionPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *BotDetectionPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *BotDetectionPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	reason := cfg.detect(ctx)
+	if reason == "" {
+		if cfg.Action == actionTag {
+			// A client must not be able to send the tag itself
+			return UpstreamRequestModifications{
+				HeaderOps: []HeaderOp{{Op: HeaderOpRemove, Name: cfg.TagHeader}},
+			}
+		}
+		return UpstreamRequestModifications{}
+	}
+
+	ctx.SharedContext.Set(reasonKey, reason)
+	switch cfg.Action {
+	case actionTag:
+		return UpstreamRequestModifications{
+			HeaderOps: []HeaderOp{{Op: HeaderOpSet, Name: cfg.TagHeader, Value: reason}},
+		}
+	case actionThrottle:
+		ctx.SharedContext.Set(limitFactorKey, cfg.ThrottleFactor)
+		return UpstreamRequestModifications{}
+	}
+	return ImmediateResponse{
+		Status:  403,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    cfg.BlockBody,
+	}
+}
+
+// Response phase (not used)
+func (p *BotDetectionPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// detect returns why the request looks automated, or "" if it does not. A
+// User-Agent on the allow list exempts the request from every check.
+func (cfg botConfig) detect(ctx *RequestContext) string {
+	userAgent := headerValue(ctx.Headers, "User-Agent")
+	if userAgent != "" && matchesAny(cfg.Allow, userAgent) {
+		return ""
+	}
+	if userAgent != "" && matchesAny(cfg.Deny, userAgent) {
+		return reasonUserAgent
+	}
+	for _, name := range cfg.RequiredHeaders {
+		if strings.TrimSpace(headerValue(ctx.Headers, name)) == "" {
+			return reasonMissing
+		}
+	}
+	if len(cfg.Suspicious) > 0 {
+		if matchesAny(cfg.Suspicious, ctx.Path) {
+			return reasonSuspicious
+		}
+		// Probes often percent-encode their payloads
+		if decoded, err := url.QueryUnescape(ctx.Path); err == nil && decoded != ctx.Path && matchesAny(cfg.Suspicious, decoded) {
+			return reasonSuspicious
+		}
+	}
+	return ""
+}
+
+// parseConfig reads the parameters after the schema has checked them and
+// compiles the patterns
+func (p *BotDetectionPolicy) parseConfig(params map[string]interface{}) (botConfig, error) {
+	cfg := botConfig{}
+	var errs paramErrors
+	cfg.Action, _ = params["action"].(string)
+	cfg.TagHeader, _ = params["tagHeader"].(string)
+	cfg.ThrottleFactor, _ = params["throttleFactor"].(float64)
+	cfg.BlockBody, _ = params["blockBody"].(string)
+	if cfg.Action == actionTag && !validHeaderName(cfg.TagHeader) {
+		errs.add("tagHeader", "must be a valid header name")
+	}
+
+	ua, _ := params["userAgent"].(map[string]interface{})
+	if useDefaults, _ := ua["useDefaultDenyList"].(bool); useDefaults {
+		cfg.Deny = append(cfg.Deny, defaultDenyUserAgents...)
+	}
+	cfg.Deny = append(cfg.Deny, p.patterns(ua["deny"], "userAgent.deny", &errs)...)
+	cfg.Allow = p.patterns(ua["allow"], "userAgent.allow", &errs)
+
+	required, _ := params["requiredHeaders"].([]interface{})
+	for i, item := range required {
+		name, _ := item.(string)
+		if !validHeaderName(name) {
+			errs.add(fmt.Sprintf("requiredHeaders[%d]", i), "must be a valid header name")
+			continue
+		}
+		cfg.RequiredHeaders = append(cfg.RequiredHeaders, name)
+	}
+
+	if detect, _ := params["detectSuspiciousRequests"].(bool); detect {
+		cfg.Suspicious = append(cfg.Suspicious, suspiciousRequestPatterns...)
+	}
+	cfg.Suspicious = append(cfg.Suspicious, p.patterns(params["suspiciousPatterns"], "suspiciousPatterns", &errs)...)
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// patterns compiles a list of regular expressions, matched without regard
+// to case
+func (p *BotDetectionPolicy) patterns(v interface{}, path string, errs *paramErrors) []*regexp.Regexp {
+	list, _ := v.([]interface{})
+	var out []*regexp.Regexp
+	for i, item := range list {
+		expr, _ := item.(string)
+		re, err := p.regex("(?i)" + expr)
+		if err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "is not a valid regular expression: "+err.Error())
+			continue
+		}
+		out = append(out, re)
+	}
+	return out
+}
+
+// regex compiles a pattern once per policy instance
+func (p *BotDetectionPolicy) regex(expr string) (*regexp.Regexp, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if re, ok := p.regexes[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if p.regexes == nil {
+		p.regexes = make(map[string]*regexp.Regexp)
+	}
+	p.regexes[expr] = re
+	return re, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package bot_detection
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "action": {"type": "string", "enum": ["block", "tag", "throttle"], "default": "block"},
+    "userAgent": {
+      "type": "object",
+      "properties": {
+        "deny": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "allow": {"type": "array", "items": {"type": "string", "minLength": 1}},
+        "useDefaultDenyList": {"type": "boolean", "default": true}
+      },
+      "default": {"useDefaultDenyList": true}
+    },
+    "requiredHeaders": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "default": ["User-Agent"]
+    },
+    "detectSuspiciousRequests": {"type": "boolean", "default": true},
+    "suspiciousPatterns": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "tagHeader": {"type": "string", "default": "X-Bot-Detected"},
+    "throttleFactor": {"type": "number", "exclusiveMinimum": 0, "maximum": 1, "default": 0.5},
+    "blockBody": {"type": "string", "default": "{\"error\": \"Forbidden\"}"}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,26 @@
+package bot_detection
+
+import "regexp"
+
+// defaultDenyUserAgents match the User-Agent of common vulnerability scanners
+// and exploit tools. Ordinary HTTP libraries such as curl are not listed,
+// since real clients use them too.
+var defaultDenyUserAgents = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(sqlmap|nikto|nmap|masscan|zgrab|nuclei|wpscan|dirbuster|gobuster|ffuf|feroxbuster|acunetix|nessus|openvas|w3af|havij|netsparker|jaeles|commix)\b`),
+	// Log4Shell probes put the lookup in every header they can
+	regexp.MustCompile(`(?i)\$\{jndi:`),
+}
+
+// suspiciousRequestPatterns match paths and queries that only probes and
+// attacks send: files that should never be served, software the API does
+// not run, path traversal and common injection payloads. They are matched
+// against the path both as sent and percent-decoded.
+var suspiciousRequestPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(^|/)\.(env|git|svn|hg|aws|ssh|htpasswd|htaccess|ds_store)(/|$|\?)`),
+	regexp.MustCompile(`(?i)/(wp-admin|wp-login\.php|wp-content|wp-includes|xmlrpc\.php|phpmyadmin|pma|cgi-bin|boaform)(/|$|\?)`),
+	regexp.MustCompile(`\.\./|\.\.\\`),
+	regexp.MustCompile(`(?i)/(etc/passwd|proc/self/|win\.ini)`),
+	regexp.MustCompile(`(?i)\bunion\b[\s+]+(all[\s+]+)?select\b|'\s*or\s*'?1'?\s*=\s*'?1`),
+	regexp.MustCompile(`(?i)<script|javascript:`),
+	regexp.MustCompile(`(?i)\$\{jndi:`),
+}
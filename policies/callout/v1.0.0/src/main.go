@@ -0,0 +1,994 @@
+package callout
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+	// Metrics is nil when the gateway does not collect metrics, see
+	// MetricsOrNop
+	Metrics Metrics
+	// Span is nil when the gateway does not trace requests, see SpanOrNop
+	Span Span
+	// Logger is nil when the gateway does not take policy logs, see
+	// LoggerOrNop
+	Logger Logger
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+	Metrics         Metrics
+	Span            Span
+	Logger          Logger
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+	// TraceContextKey holds the TraceContext of the request as set by the
+	// tracing policy. Gateways that trace requests continue that trace.
+	TraceContextKey = "trace.context"
+)
+
+// Parameters every policy accepts without declaring them. The gateway handles
+// them itself and removes them before calling Validate, Init, Compile,
+// OnRequest or OnResponse, so policy-definition.yaml must not declare them.
+const (
+	// EnforcementModeParam decides what happens to an ImmediateResponse, and
+	// is EnforcementEnforce or EnforcementShadow
+	EnforcementModeParam = "enforcementMode"
+	// EnforcementEnforce, the default, sends an ImmediateResponse to the client
+	EnforcementEnforce = "enforce"
+	// EnforcementShadow holds an ImmediateResponse back and carries on as if
+	// the policy had returned no modifications, so operators can try rules on
+	// live traffic. The gateway counts the response in ShadowBlocksMetric,
+	// labelled with the policy and status, writes a log record and, in the
+	// request phase, adds WouldBlockHeader to the upstream request with a
+	// value such as "rate-limiter; status=429". Policies run as they do in
+	// enforce mode, so their own metrics count the response they returned.
+	EnforcementShadow = "shadow"
+
+	WouldBlockHeader   = "X-Policy-Would-Block"
+	ShadowBlocksMetric = "policy_shadow_blocks_total"
+
+	// OnErrorParam decides what happens when a phase returns a PolicyError or
+	// panics, and is OnErrorReject, OnErrorContinue or OnErrorRetry. The
+	// gateway logs every failure and counts it in PolicyErrorsMetric,
+	// labelled with the policy, the phase and the kind: error, panic or
+	// circuit_open.
+	OnErrorParam = "onError"
+	// OnErrorReject, the default, fails closed: the client gets
+	// PolicyErrorStatus with {"error": "Policy failed"}. In shadow mode the
+	// response is held back like a policy's own.
+	OnErrorReject = "reject"
+	// OnErrorContinue fails open: the message carries on unchanged
+	OnErrorContinue = "continue"
+	// OnErrorRetry calls the phase once more and rejects when it fails again
+	OnErrorRetry = "retry"
+	// ErrorCircuitParam stops calling a phase that keeps failing. It is an
+	// object with failures, the number of failures in a row that opens the
+	// circuit, and openSeconds, how long it stays open. Each phase of a
+	// policy instance has a circuit of its own. While it is open the phase
+	// fails without calling the policy, so onError still decides whether
+	// requests pass, and PolicyCircuitMetric, labelled with the policy and
+	// phase, is 1. The first call after that closes the circuit if it
+	// succeeds and opens it again if not.
+	ErrorCircuitParam = "errorCircuit"
+
+	PolicyErrorStatus   = 500
+	PolicyErrorsMetric  = "policy_errors_total"
+	PolicyCircuitMetric = "policy_circuit_open"
+)
+
+// PolicyError is the action of a phase that could not do its job, e.g.
+// because a store or key server the policy depends on is unreachable. The
+// gateway handles it, and panics in OnRequest and OnResponse, as the
+// OnErrorParam of the policy instance says. Policies that have a safe
+// fallback of their own, such as a failOpen parameter, keep returning that.
+type PolicyError struct {
+	Err error
+}
+
+func (e PolicyError) Error() string {
+	if e.Err == nil {
+		return "policy error"
+	}
+	return e.Err.Error()
+}
+
+// Metrics creates the instruments a policy records measurements with. The
+// gateway hands each policy instance its own Metrics and exports what is
+// recorded, e.g. to Prometheus, labelled with the policy name and version,
+// so policies only add labels of their own. Names follow the Prometheus
+// conventions, such as rate_limiter_requests_total. Asking again for an
+// instrument with the same name and labels returns the same one.
+type Metrics interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	// Histogram uses buckets as upper bounds; nil chooses default buckets
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Labels are label names with their values. Every instrument of one name
+// must use the same label names.
+type Labels map[string]string
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter interface {
+	// Add increases the counter; negative deltas are ignored
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// MetricsOrNop returns m, or a Metrics whose instruments discard everything
+// when m is nil because the gateway does not collect metrics
+func MetricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, Labels) Counter { return nopInstrument{} }
+
+func (nopMetrics) Gauge(string, string, Labels) Gauge { return nopInstrument{} }
+
+func (nopMetrics) Histogram(string, string, []float64, Labels) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64) {}
+
+func (nopInstrument) Set(float64) {}
+
+func (nopInstrument) Observe(float64) {}
+
+// Span is the trace span the gateway records for a policy execution.
+// Policies add attributes and events to it; starting, ending and exporting
+// spans, e.g. over OTLP, is left to the gateway.
+type Span interface {
+	// SetAttribute records a string, bool, int64 or float64 value
+	SetAttribute(key string, value interface{})
+	// AddEvent records a timestamped event; attributes may be nil
+	AddEvent(name string, attributes map[string]interface{})
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// TraceContext returns the IDs of the span, e.g. to log them
+	TraceContext() TraceContext
+}
+
+// TraceContext identifies a span in the terms of W3C Trace Context
+type TraceContext struct {
+	// TraceID is 32 and SpanID 16 lowercase hex characters
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// State is the vendor data of the tracestate header, if any
+	State string
+}
+
+// SpanOrNop returns s, or a Span that discards everything when s is nil
+// because the gateway does not trace requests
+func SpanOrNop(s Span) Span {
+	if s == nil {
+		return nopSpan{}
+	}
+	return s
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) AddEvent(string, map[string]interface{}) {}
+
+func (nopSpan) RecordError(error) {}
+
+func (nopSpan) TraceContext() TraceContext { return TraceContext{} }
+
+// Logger writes structured log records through the gateway's logging, which
+// adds the policy name and version and the request's trace ID. Fields hold
+// values that encode as JSON; secrets do not belong in them.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LogLevel is the severity of a log record
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo  LogLevel = "info"
+	LogWarn  LogLevel = "warn"
+	LogError LogLevel = "error"
+)
+
+// LoggerOrNop returns l, or a Logger that discards everything when l is nil
+// because the gateway does not take policy logs
+func LoggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, map[string]interface{}) {}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+	// Timeout bounds how long the gateway waits for the upstream response
+	// when non-zero. Once it passes, the gateway cancels the upstream request
+	// and answers 504; the response phase then runs with ResponseStatus 504.
+	// Adapters that cannot enforce it keep the route's own timeout.
+	Timeout time.Duration
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Compiler is implemented by policies that read their parameters once, when
+// a route is configured, rather than on every request. The gateway calls
+// Compile after Validate succeeds and runs the phases of the CompiledPolicy
+// in place of OnRequest and OnResponse, so the parameters map is not decoded
+// and type-asserted on the hot path. OnRequest and OnResponse remain for
+// gateways that do not compile policies.
+type Compiler interface {
+	Compile(params map[string]interface{}) (CompiledPolicy, error)
+}
+
+// CompiledPolicy is a policy bound to the parameters of one route. Every
+// request of the route shares it, so it must be safe for concurrent use. The
+// gateway only reads the actions it returns, so a phase may return the same
+// *UpstreamRequestModifications for every request and allocate nothing.
+type CompiledPolicy interface {
+	OnRequest(ctx *RequestContext) RequestAction
+	OnResponse(ctx *ResponseContext) ResponseAction
+}
+
+// The gateway creates one policy value per policy instance, i.e. per route
+// and set of parameters, and calls it in this order:
+//
+//	Validate, Init, Compile, OnRequest and OnResponse for every request, Close
+//
+// Init and Close are optional. A policy that keeps state, such as counters,
+// caches or connections, builds it in Init and releases it in Close, so the
+// phases neither create state lazily nor race to do so. Policies that must
+// still run on gateways without these hooks keep creating state on first use
+// when Init was not called.
+
+// Initializer is implemented by policies that set up state for their
+// instance. The gateway calls Init once, with the parameters Validate
+// accepted and before the first request, and drops the instance if it
+// returns an error. Init may start goroutines, e.g. to refresh a key set or
+// evict cache entries, that run until Close. It should not fail because a
+// remote service is unreachable; the phases report that per request.
+type Initializer interface {
+	Init(params map[string]interface{}) error
+}
+
+// Closer is implemented by policies that release resources when their
+// instance is removed, because the route changed or the gateway shuts down.
+// The gateway calls Close once, after Init succeeded and the last request of
+// the instance completed, and logs the error it returns. Close stops the
+// goroutines Init started.
+type Closer interface {
+	Close() error
+}
+
+// deadlineKey is where the timeout policy keeps the deadline of the request
+const deadlineKey = "timeout.deadline"
+
+const (
+	// calloutMetric counts callouts by result: ok, cached, client_error or
+	// error
+	calloutMetric = "callout_requests_total"
+	// durationMetric observes how long the callouts the policy made took,
+	// retries included
+	durationMetric = "callout_duration_seconds"
+)
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var (
+	unchangedRequest  = &UpstreamRequestModifications{}
+	unchangedResponse = &UpstreamResponseModifications{}
+)
+
+var (
+	_ Compiler    = (*CalloutPolicy)(nil)
+	_ Initializer = (*CalloutPolicy)(nil)
+	_ Closer      = (*CalloutPolicy)(nil)
+)
+
+type CalloutPolicy struct {
+	mu        sync.Mutex
+	client    *calloutClient
+	templates map[string]*template.Template
+}
+
+type calloutConfig struct {
+	URL             string
+	Method          string
+	Headers         map[string]string
+	ForwardHeaders  []string
+	Body            string
+	ContentType     string
+	Timeout         time.Duration
+	Retries         int
+	RetryBackoff    time.Duration
+	CacheTTL        time.Duration
+	CacheKey        string
+	MaxCacheEntries int
+	Inject          []injection
+	OnClientError   string
+}
+
+// injection passes one field of the service response on
+type injection struct {
+	// Field is a member name or a dot path such as tenant.id
+	Field     string
+	Header    string
+	SharedKey string
+	Required  bool
+}
+
+// compiledCallout is the policy bound to the parameters of one route
+type compiledCallout struct {
+	cfg    calloutConfig
+	client *calloutClient
+	// templates holds the parsed url, headers, body and cacheKey values that
+	// contain actions, by their text
+	templates map[string]*template.Template
+}
+
+// Validate configuration parameters
+func (p *CalloutPolicy) Validate(params map[string]interface{}) error {
+	_, err := p.compile(params)
+	return err
+}
+
+// Init creates the HTTP client of the instance and, when responses are
+// cached, starts dropping expired ones in the background
+func (p *CalloutPolicy) Init(params map[string]interface{}) error {
+	c, err := p.compile(params)
+	if err != nil {
+		return err
+	}
+	if ttl := c.cfg.CacheTTL; ttl > 0 {
+		if ttl > maxSweepInterval {
+			ttl = maxSweepInterval
+		}
+		c.client.startSweeping(ttl)
+	}
+	return nil
+}
+
+// Close stops the cache sweeper and closes idle connections to the service
+func (p *CalloutPolicy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		p.client.close()
+		p.client = nil
+	}
+	return nil
+}
+
+// Compile parameters once per route
+func (p *CalloutPolicy) Compile(params map[string]interface{}) (CompiledPolicy, error) {
+	c, err := p.compile(params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *CalloutPolicy) compile(params map[string]interface{}) (*compiledCallout, error) {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return nil, err
+	}
+	var errs paramErrors
+	cfg := parseConfig(params, &errs)
+	c := &compiledCallout{cfg: cfg, templates: make(map[string]*template.Template)}
+	p.parseTemplate(c, "url", cfg.URL, &errs)
+	for name, value := range cfg.Headers {
+		p.parseTemplate(c, "headers."+name, value, &errs)
+	}
+	p.parseTemplate(c, "body", cfg.Body, &errs)
+	p.parseTemplate(c, "cacheKey", cfg.CacheKey, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	c.client = p.calloutClient()
+	return c, nil
+}
+
+func (p *CalloutPolicy) parseTemplate(c *compiledCallout, path, text string, errs *paramErrors) {
+	if !templated(text) {
+		return
+	}
+	t, err := p.template(text)
+	if err != nil {
+		errs.add(path, "is not a valid template: "+err.Error())
+		return
+	}
+	c.templates[text] = t
+}
+
+// calloutClient returns the client of the instance, creating it for gateways
+// that do not call Init
+func (p *CalloutPolicy) calloutClient() *calloutClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		p.client = newCalloutClient()
+	}
+	return p.client
+}
+
+// Declare processing behavior
+func (p *CalloutPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *CalloutPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	c, err := p.compile(params)
+	if err != nil {
+		return unchangedRequest
+	}
+	return c.OnRequest(ctx)
+}
+
+// Response phase (not used)
+func (p *CalloutPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return unchangedResponse
+}
+
+// OnRequest calls the service and passes the injected fields on. A callout
+// that fails, after retries, is a PolicyError, so the onError parameter of
+// the instance decides whether requests go ahead without the fields.
+func (c *compiledCallout) OnRequest(ctx *RequestContext) RequestAction {
+	metrics := MetricsOrNop(ctx.Metrics)
+	start := time.Now()
+	res, cached, err := c.call(ctx)
+	if !cached {
+		metrics.Histogram(durationMetric, "Time callouts took, retries included", durationBuckets, nil).
+			Observe(time.Since(start).Seconds())
+	}
+	switch {
+	case err != nil:
+		c.count(metrics, "error")
+		return PolicyError{Err: fmt.Errorf("callout failed: %w", err)}
+	case res.success():
+		if cached {
+			c.count(metrics, "cached")
+		} else {
+			c.count(metrics, "ok")
+		}
+		return c.inject(ctx, res)
+	case res.status >= 400 && res.status < 500:
+		c.count(metrics, "client_error")
+		switch c.cfg.OnClientError {
+		case "forward":
+			resp := ImmediateResponse{Status: res.status, Body: string(res.body)}
+			if res.contentType != "" {
+				resp.Headers = map[string][]string{"Content-Type": {res.contentType}}
+			}
+			return resp
+		case "skip":
+			return c.inject(ctx, nil)
+		}
+	default:
+		c.count(metrics, "error")
+	}
+	return PolicyError{Err: fmt.Errorf("callout failed: service returned status %d", res.status)}
+}
+
+// OnResponse has nothing to do
+func (c *compiledCallout) OnResponse(ctx *ResponseContext) ResponseAction {
+	return unchangedResponse
+}
+
+func (c *compiledCallout) count(metrics Metrics, result string) {
+	metrics.Counter(calloutMetric, "Callouts by result", Labels{"result": result}).Add(1)
+}
+
+// call renders the callout of the request and sends it, or answers it from
+// the cache
+func (c *compiledCallout) call(ctx *RequestContext) (*calloutResult, bool, error) {
+	in := newTemplateInput(ctx)
+	req, err := c.request(in)
+	if err != nil {
+		return nil, false, err
+	}
+	var key [sha256.Size]byte
+	if c.cfg.CacheTTL > 0 {
+		if c.cfg.CacheKey != "" {
+			custom, err := c.render(c.cfg.CacheKey, in)
+			if err != nil {
+				return nil, false, fmt.Errorf("rendering cacheKey: %w", err)
+			}
+			key = sha256.Sum256([]byte(custom))
+		} else {
+			key = req.cacheKey()
+		}
+	}
+	deadline, _ := SharedValue[time.Time](ctx.SharedContext, deadlineKey)
+	return c.client.call(c.cfg, req, key, deadline)
+}
+
+// request renders the url, headers and body templates
+func (c *compiledCallout) request(in *templateInput) (*calloutRequest, error) {
+	target, err := c.render(c.cfg.URL, in)
+	if err != nil {
+		return nil, fmt.Errorf("rendering url: %w", err)
+	}
+	if _, err := url.Parse(target); err != nil {
+		return nil, fmt.Errorf("rendered url is invalid: %w", err)
+	}
+	req := &calloutRequest{method: c.cfg.Method, url: target, header: make(http.Header)}
+	for _, name := range c.cfg.ForwardHeaders {
+		if values := headerValues(in.headers, name); len(values) > 0 {
+			req.header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, value := range c.cfg.Headers {
+		if value, err = c.render(value, in); err != nil {
+			return nil, fmt.Errorf("rendering headers.%s: %w", name, err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("headers.%s renders to an invalid header value", name)
+		}
+		req.header.Set(name, value)
+	}
+	if req.header.Get("Accept") == "" {
+		req.header.Set("Accept", "application/json")
+	}
+	if c.cfg.Method != http.MethodGet {
+		if req.body, err = c.render(c.cfg.Body, in); err != nil {
+			return nil, fmt.Errorf("rendering body: %w", err)
+		}
+		if req.header.Get("Content-Type") == "" {
+			req.header.Set("Content-Type", c.cfg.ContentType)
+		}
+	}
+	return req, nil
+}
+
+// inject sets the headers and SharedContext values of the inject list from a
+// response, or removes the headers when res is nil. Headers whose field is
+// missing are removed too, so clients cannot supply them instead.
+func (c *compiledCallout) inject(ctx *RequestContext, res *calloutResult) RequestAction {
+	if len(c.cfg.Inject) == 0 {
+		return unchangedRequest
+	}
+	var doc interface{}
+	if res != nil {
+		var err error
+		if doc, err = res.document(); err != nil {
+			return PolicyError{Err: fmt.Errorf("callout failed: %w", err)}
+		}
+	}
+	values := make([]interface{}, len(c.cfg.Inject))
+	for i, inj := range c.cfg.Inject {
+		v, ok := lookup(doc, inj.Field)
+		if !ok && inj.Required && res != nil {
+			return PolicyError{Err: fmt.Errorf("callout failed: service response has no %s", inj.Field)}
+		}
+		values[i] = v
+	}
+
+	mods := &UpstreamRequestModifications{}
+	for i, inj := range c.cfg.Inject {
+		if inj.Header != "" {
+			if s, ok := headerString(values[i]); ok {
+				mods.HeaderOps = append(mods.HeaderOps, HeaderOp{Op: HeaderOpSet, Name: inj.Header, Value: s})
+			} else {
+				mods.HeaderOps = append(mods.HeaderOps, HeaderOp{Op: HeaderOpRemove, Name: inj.Header})
+			}
+		}
+		if inj.SharedKey != "" && values[i] != nil {
+			ctx.SharedContext.Set(inj.SharedKey, values[i])
+		}
+	}
+	return mods
+}
+
+func parseConfig(params map[string]interface{}, errs *paramErrors) calloutConfig {
+	cfg := calloutConfig{Headers: make(map[string]string)}
+	cfg.URL, _ = params["url"].(string)
+	if msg := checkURL(cfg.URL); msg != "" {
+		errs.add("url", msg)
+	}
+	cfg.Method, _ = params["method"].(string)
+	headers, _ := params["headers"].(map[string]interface{})
+	for name, v := range headers {
+		if !validHeaderName(name) {
+			errs.add("headers."+name, "is not a valid header name")
+			continue
+		}
+		cfg.Headers[name], _ = v.(string)
+	}
+	forward, _ := params["forwardHeaders"].([]interface{})
+	for i, v := range forward {
+		name, _ := v.(string)
+		if !validHeaderName(name) {
+			errs.add(fmt.Sprintf("forwardHeaders[%d]", i), "is not a valid header name")
+			continue
+		}
+		cfg.ForwardHeaders = append(cfg.ForwardHeaders, name)
+	}
+	cfg.Body, _ = params["body"].(string)
+	if cfg.Body != "" && cfg.Method == http.MethodGet {
+		errs.add("body", "is only sent with POST and PUT")
+	}
+	cfg.ContentType, _ = params["contentType"].(string)
+	cfg.Timeout = millis(params["timeoutMs"])
+	cfg.Retries = intParam(params["retries"])
+	cfg.RetryBackoff = millis(params["retryBackoffMs"])
+	cfg.CacheTTL = time.Duration(intParam(params["cacheTtlSeconds"])) * time.Second
+	cfg.CacheKey, _ = params["cacheKey"].(string)
+	cfg.MaxCacheEntries = intParam(params["maxCacheEntries"])
+
+	inject, _ := params["inject"].([]interface{})
+	for i, raw := range inject {
+		obj, _ := raw.(map[string]interface{})
+		path := fmt.Sprintf("inject[%d]", i)
+		var inj injection
+		inj.Field, _ = obj["field"].(string)
+		inj.Header, _ = obj["header"].(string)
+		inj.SharedKey, _ = obj["sharedKey"].(string)
+		inj.Required, _ = obj["required"].(bool)
+		if inj.Field == "" || strings.HasPrefix(inj.Field, ".") || strings.HasSuffix(inj.Field, ".") || strings.Contains(inj.Field, "..") {
+			errs.add(path+".field", "must be a member name such as tenant, or a path such as tenant.id")
+		}
+		if inj.Header != "" && !validHeaderName(inj.Header) {
+			errs.add(path+".header", "is not a valid header name")
+		}
+		if inj.Header == "" && inj.SharedKey == "" {
+			errs.add(path, "needs a header or a sharedKey")
+		}
+		cfg.Inject = append(cfg.Inject, inj)
+	}
+	cfg.OnClientError, _ = params["onClientError"].(string)
+	return cfg
+}
+
+// checkURL returns what is wrong with a url parameter, or "". Actions may
+// only follow the host, so requests cannot steer the callout to another
+// service.
+func checkURL(raw string) string {
+	static := raw
+	if i := strings.Index(raw, "{{"); i >= 0 {
+		static = raw[:i]
+	}
+	u, err := url.Parse(static)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "must be an http or https URL, with templates only after the host"
+	}
+	if static != raw && !strings.ContainsAny(static[len(u.Scheme)+len("://"):], "/?") {
+		return "must be an http or https URL, with templates only after the host"
+	}
+	return ""
+}
+
+// validHeaderName accepts RFC 7230 tokens
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func intParam(v interface{}) int {
+	f, _ := v.(float64)
+	return int(f)
+}
+
+func millis(v interface{}) time.Duration {
+	return time.Duration(intParam(v)) * time.Millisecond
+}
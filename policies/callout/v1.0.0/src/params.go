@@ -0,0 +1,483 @@
+package callout
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramError is one problem with the policy parameters. Path names the
+// parameter the way the documentation does, e.g. store.timeoutMs or
+// request[0].op.
+type paramError struct {
+	Path    string
+	Message string
+}
+
+// paramErrors lists every problem found, so a configuration can be fixed in
+// one go instead of one error at a time
+type paramErrors []paramError
+
+func (e paramErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = pe.Path + " " + pe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// paramSchema is a compiled parameter schema. It supports the subset of JSON
+// Schema used in policy-definition.yaml files: type, properties, required,
+// additionalProperties, items, enum, default, numeric bounds, length and
+// size bounds, oneOf and $ref to #/definitions.
+type paramSchema struct {
+	types      []string
+	properties map[string]*paramSchema
+	required   []string
+	// additional is nil when unknown properties are allowed unchecked
+	additional   *paramSchema
+	noAdditional bool
+	items        *paramSchema
+	enum         []interface{}
+	minimum      *float64
+	maximum      *float64
+	exclusiveMin *float64
+	exclusiveMax *float64
+	minLength    *int
+	maxLength    *int
+	minItems     *int
+	maxItems     *int
+	oneOf        []*paramSchema
+	def          interface{}
+	hasDefault   bool
+	ref          string
+	definitions  map[string]*paramSchema
+}
+
+// mustCompileParams compiles a schema that ships with the policy. A broken
+// schema is a programming error, so it panics at start-up.
+func mustCompileParams(doc string) *paramSchema {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &raw); err != nil {
+		panic("parameters schema: " + err.Error())
+	}
+	root := &paramSchema{}
+	defs, _ := raw["definitions"].(map[string]interface{})
+	root.definitions = make(map[string]*paramSchema, len(defs))
+	for name, d := range defs {
+		m, _ := d.(map[string]interface{})
+		root.definitions[name] = compileParams(m, root)
+	}
+	*root = *compileParams(raw, root)
+	return root
+}
+
+func compileParams(m map[string]interface{}, root *paramSchema) *paramSchema {
+	s := &paramSchema{definitions: root.definitions}
+	switch t := m["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			if name, ok := v.(string); ok {
+				s.types = append(s.types, name)
+			}
+		}
+	}
+	if props, ok := m["properties"].(map[string]interface{}); ok {
+		s.properties = make(map[string]*paramSchema, len(props))
+		for name, p := range props {
+			pm, _ := p.(map[string]interface{})
+			s.properties[name] = compileParams(pm, root)
+		}
+	}
+	if req, ok := m["required"].([]interface{}); ok {
+		for _, v := range req {
+			if name, ok := v.(string); ok {
+				s.required = append(s.required, name)
+			}
+		}
+	}
+	switch ap := m["additionalProperties"].(type) {
+	case bool:
+		s.noAdditional = !ap
+	case map[string]interface{}:
+		s.additional = compileParams(ap, root)
+	}
+	if items, ok := m["items"].(map[string]interface{}); ok {
+		s.items = compileParams(items, root)
+	}
+	s.enum, _ = m["enum"].([]interface{})
+	for name, dst := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMin,
+		"exclusiveMaximum": &s.exclusiveMax,
+	} {
+		if f, ok := m[name].(float64); ok {
+			*dst = &f
+		}
+	}
+	for name, dst := range map[string]**int{
+		"minLength": &s.minLength,
+		"maxLength": &s.maxLength,
+		"minItems":  &s.minItems,
+		"maxItems":  &s.maxItems,
+	} {
+		if f, ok := m[name].(float64); ok {
+			n := int(f)
+			*dst = &n
+		}
+	}
+	if list, ok := m["oneOf"].([]interface{}); ok {
+		for _, v := range list {
+			om, _ := v.(map[string]interface{})
+			s.oneOf = append(s.oneOf, compileParams(om, root))
+		}
+	}
+	s.def, s.hasDefault = m["default"]
+	if ref, ok := m["$ref"].(string); ok {
+		s.ref = strings.TrimPrefix(ref, "#/definitions/")
+	}
+	return s
+}
+
+// apply checks params against the schema and returns a copy with defaults
+// filled in and values coerced to their declared types, so "60" becomes 60
+// for an integer and "false" becomes false for a boolean
+func (s *paramSchema) apply(params map[string]interface{}) (map[string]interface{}, error) {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	out, err := s.applyAt(params, "")
+	if err != nil {
+		return nil, err
+	}
+	m, _ := out.(map[string]interface{})
+	return m, nil
+}
+
+// applyAt checks a single value found at path, for values a policy reads on
+// its own such as nested strategies
+func (s *paramSchema) applyAt(v interface{}, path string) (interface{}, error) {
+	var errs paramErrors
+	out := s.check(v, path, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return out, nil
+}
+
+func (s *paramSchema) check(v interface{}, path string, errs *paramErrors) interface{} {
+	if s.ref != "" {
+		if def, ok := s.definitions[s.ref]; ok {
+			return def.check(v, path, errs)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		return s.checkOneOf(v, path, errs)
+	}
+
+	if len(s.types) > 0 {
+		coerced, ok := coerceParam(s.types, v)
+		if !ok {
+			errs.add(path, "must be "+describeTypes(s.types))
+			return v
+		}
+		v = coerced
+	}
+	if len(s.enum) > 0 && !enumContains(s.enum, v) {
+		errs.add(path, "must be one of: "+describeEnum(s.enum))
+		return v
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return s.checkObject(val, path, errs)
+	case []interface{}:
+		return s.checkList(val, path, errs)
+	case string:
+		if s.minLength != nil && len(val) < *s.minLength {
+			if *s.minLength == 1 {
+				errs.add(path, "must not be empty")
+			} else {
+				errs.add(path, fmt.Sprintf("must be at least %d characters long", *s.minLength))
+			}
+		}
+		if s.maxLength != nil && len(val) > *s.maxLength {
+			errs.add(path, fmt.Sprintf("must be at most %d characters long", *s.maxLength))
+		}
+	case float64:
+		s.checkNumber(val, path, errs)
+	}
+	return v
+}
+
+func (s *paramSchema) checkObject(obj map[string]interface{}, path string, errs *paramErrors) interface{} {
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			errs.add(join(path, name), "is required")
+		}
+	}
+	// Report problems in a stable order
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make(map[string]interface{}, len(obj)+len(s.properties))
+	for _, name := range names {
+		v := obj[name]
+		if p, ok := s.properties[name]; ok {
+			out[name] = p.check(v, join(path, name), errs)
+			continue
+		}
+		switch {
+		case s.additional != nil:
+			out[name] = s.additional.check(v, join(path, name), errs)
+		case s.noAdditional:
+			errs.add(join(path, name), "is not a known parameter")
+		default:
+			out[name] = v
+		}
+	}
+	for name, p := range s.properties {
+		if _, ok := out[name]; !ok && p.hasDefault {
+			out[name] = cloneParam(p.def)
+		}
+	}
+	return out
+}
+
+func (s *paramSchema) checkList(list []interface{}, path string, errs *paramErrors) interface{} {
+	if s.minItems != nil && len(list) < *s.minItems {
+		if *s.minItems == 1 {
+			errs.add(path, "must not be empty")
+		} else {
+			errs.add(path, fmt.Sprintf("must have at least %d entries", *s.minItems))
+		}
+	}
+	if s.maxItems != nil && len(list) > *s.maxItems {
+		errs.add(path, fmt.Sprintf("must have at most %d entries", *s.maxItems))
+	}
+	if s.items == nil {
+		return list
+	}
+	out := make([]interface{}, len(list))
+	for i, item := range list {
+		out[i] = s.items.check(item, fmt.Sprintf("%s[%d]", path, i), errs)
+	}
+	return out
+}
+
+func (s *paramSchema) checkNumber(f float64, path string, errs *paramErrors) {
+	switch {
+	case s.minimum != nil && f < *s.minimum:
+		errs.add(path, "must be at least "+formatNumber(*s.minimum))
+	case s.maximum != nil && f > *s.maximum:
+		errs.add(path, "must be at most "+formatNumber(*s.maximum))
+	case s.exclusiveMin != nil && f <= *s.exclusiveMin:
+		errs.add(path, "must be greater than "+formatNumber(*s.exclusiveMin))
+	case s.exclusiveMax != nil && f >= *s.exclusiveMax:
+		errs.add(path, "must be less than "+formatNumber(*s.exclusiveMax))
+	}
+}
+
+// checkOneOf accepts a value that matches exactly one alternative. When it
+// matches none, the errors of the alternative with the value's type are
+// reported, since that is almost always the one that was meant.
+func (s *paramSchema) checkOneOf(v interface{}, path string, errs *paramErrors) interface{} {
+	var matched []interface{}
+	var typed []*paramSchema
+	for _, alt := range s.oneOf {
+		var altErrs paramErrors
+		out := alt.check(v, path, &altErrs)
+		if len(altErrs) == 0 {
+			matched = append(matched, out)
+		}
+		if _, ok := coerceParam(alt.resolved().types, v); ok || len(alt.resolved().types) == 0 {
+			typed = append(typed, alt)
+		}
+	}
+	switch {
+	case len(matched) == 1:
+		return matched[0]
+	case len(matched) > 1:
+		// Alternatives overlap, e.g. an untyped one; take the first
+		return matched[0]
+	case len(typed) == 1:
+		return typed[0].check(v, path, errs)
+	}
+	var types []string
+	for _, alt := range s.oneOf {
+		types = append(types, alt.resolved().types...)
+	}
+	errs.add(path, "must be "+describeTypes(types))
+	return v
+}
+
+func (s *paramSchema) resolved() *paramSchema {
+	if s.ref != "" {
+		if def, ok := s.definitions[s.ref]; ok {
+			return def
+		}
+	}
+	return s
+}
+
+// coerceParam converts v to one of the types if it is not one already. Only
+// lossless conversions from strings are made.
+func coerceParam(types []string, v interface{}) (interface{}, bool) {
+	for _, t := range types {
+		if paramType(v, t) {
+			return v, true
+		}
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v, false
+	}
+	for _, t := range types {
+		switch t {
+		case "integer", "number":
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) && paramType(f, t) {
+				return f, true
+			}
+		case "boolean":
+			switch s {
+			case "true":
+				return true, true
+			case "false":
+				return false, true
+			}
+		}
+	}
+	return v, false
+}
+
+func paramType(v interface{}, t string) bool {
+	switch t {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func describeTypes(types []string) string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		switch t {
+		case "integer":
+			t = "an integer"
+		case "object":
+			t = "an object"
+		case "array":
+			t = "a list"
+		case "null":
+			t = "null"
+		default:
+			t = "a " + t
+		}
+		if !containsParam(names, t) {
+			names = append(names, t)
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+func describeEnum(enum []interface{}) string {
+	names := make([]string, len(enum))
+	for i, v := range enum {
+		names[i] = fmt.Sprint(v)
+	}
+	return strings.Join(names, ", ")
+}
+
+func enumContains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// cloneParam copies a default so callers cannot change the schema's copy
+func cloneParam(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = cloneParam(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = cloneParam(item)
+		}
+		return out
+	}
+	return v
+}
+
+// property returns the schema of a named property, or nil
+func (s *paramSchema) property(name string) *paramSchema {
+	return s.resolved().properties[name]
+}
+
+// invalidParam reports a problem the schema cannot express, such as a rule
+// between two parameters, in the same form as the schema errors
+func invalidParam(path, format string, args ...interface{}) error {
+	return paramErrors{{Path: path, Message: fmt.Sprintf(format, args...)}}
+}
+
+func (e *paramErrors) add(path, message string) {
+	if path == "" {
+		path = "parameters"
+	}
+	*e = append(*e, paramError{Path: path, Message: message})
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func containsParam(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
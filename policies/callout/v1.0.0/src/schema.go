@@ -0,0 +1,41 @@
+package callout
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "url": {"type": "string"},
+    "method": {"type": "string", "enum": ["GET", "POST", "PUT"], "default": "GET"},
+    "headers": {"type": "object", "additionalProperties": {"type": "string"}, "default": {}},
+    "forwardHeaders": {"type": "array", "items": {"type": "string"}, "default": []},
+    "body": {"type": "string"},
+    "contentType": {"type": "string", "default": "application/json"},
+    "timeoutMs": {"type": "integer", "minimum": 1, "maximum": 60000, "default": 1000},
+    "retries": {"type": "integer", "minimum": 0, "maximum": 5, "default": 0},
+    "retryBackoffMs": {"type": "integer", "minimum": 0, "maximum": 10000, "default": 100},
+    "cacheTtlSeconds": {"type": "integer", "minimum": 0, "default": 0},
+    "cacheKey": {"type": "string"},
+    "maxCacheEntries": {"type": "integer", "minimum": 1, "default": 10000},
+    "inject": {
+      "type": "array",
+      "default": [],
+      "items": {
+        "type": "object",
+        "properties": {
+          "field": {"type": "string"},
+          "header": {"type": "string"},
+          "sharedKey": {"type": "string"},
+          "required": {"type": "boolean", "default": false}
+        },
+        "required": ["field"],
+        "additionalProperties": false
+      }
+    },
+    "onClientError": {"type": "string", "enum": ["fail", "skip", "forward"], "default": "fail"}
+  },
+  "required": ["url"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,134 @@
+package callout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateInput is what the url, headers, body and cacheKey templates can
+// read, e.g. {{.Method}} or {{.Header "Host"}}
+type templateInput struct {
+	Method     string
+	Path       string
+	RemoteAddr string
+
+	headers map[string][]string
+	query   url.Values
+	shared  *SharedContext
+}
+
+func newTemplateInput(ctx *RequestContext) *templateInput {
+	in := &templateInput{
+		Method:     ctx.Method,
+		Path:       ctx.Path,
+		RemoteAddr: ctx.RemoteAddr,
+		headers:    ctx.Headers,
+		shared:     ctx.SharedContext,
+	}
+	if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+		in.Path = ctx.Path[:i]
+		in.query, _ = url.ParseQuery(ctx.Path[i+1:])
+	}
+	return in
+}
+
+// Header reads a request header
+func (in *templateInput) Header(name string) string {
+	return headerValue(in.headers, name)
+}
+
+// Query reads a query parameter of the request
+func (in *templateInput) Query(name string) string {
+	return in.query.Get(name)
+}
+
+// Shared reads a value another policy stored in the SharedContext, such as
+// "consumer.id"
+func (in *templateInput) Shared(key string) string {
+	v, ok := in.shared.Get(key)
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	// json quotes a value for a JSON body, e.g. {"host": {{.Header "Host" | json}}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"timestamp": func() string {
+		return time.Now().UTC().Format(time.RFC3339Nano)
+	},
+	"unixMillis": func() int64 {
+		return time.Now().UnixMilli()
+	},
+}
+
+// templated reports whether a value needs rendering. Values without actions
+// are sent as they are.
+func templated(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// template parses a template once per policy instance
+func (p *CalloutPolicy) template(text string) (*template.Template, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.templates[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("value").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if p.templates == nil {
+		p.templates = make(map[string]*template.Template)
+	}
+	p.templates[text] = t
+	return t, nil
+}
+
+// render resolves a value with the templates compiled for the route
+func (c *compiledCallout) render(text string, in *templateInput) (string, error) {
+	t, ok := c.templates[text]
+	if !ok {
+		return text, nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, in); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// headerValues returns every value of a header, matching its name without
+// regard to case
+func headerValues(headers map[string][]string, name string) []string {
+	if values, ok := headers[name]; ok {
+		return values
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values
+		}
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package callout
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseSize bounds how much of a service response is read
+const maxResponseSize = 1 << 20
+
+// maxSweepInterval bounds how long expired cache entries are kept
+const maxSweepInterval = time.Minute
+
+var (
+	errDeadline = errors.New("request deadline passed before the service answered")
+	errTooLarge = errors.New("service response is larger than 1 MiB")
+	errNotJSON  = errors.New("service response is not a JSON document")
+)
+
+// calloutRequest is a callout with its templates rendered
+type calloutRequest struct {
+	method string
+	url    string
+	header http.Header
+	body   string
+}
+
+// cacheKey hashes everything that is sent, so callers with different
+// credentials never share a cached response and raw credentials are not kept
+func (r *calloutRequest) cacheKey() [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, r.method+"\x00"+r.url+"\x00")
+	names := make([]string, 0, len(r.header))
+	for name := range r.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		io.WriteString(h, name+":"+strings.Join(r.header[name], "\x01")+"\x00")
+	}
+	io.WriteString(h, r.body)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// calloutResult is a response of the service
+type calloutResult struct {
+	status      int
+	contentType string
+	body        []byte
+
+	once   sync.Once
+	doc    interface{}
+	docErr error
+}
+
+func (r *calloutResult) success() bool {
+	return r.status >= 200 && r.status < 300
+}
+
+// document decodes the body once, however many requests read it from the
+// cache. Numbers stay json.Number so large integers keep their precision.
+func (r *calloutResult) document() (interface{}, error) {
+	r.once.Do(func() {
+		dec := json.NewDecoder(bytes.NewReader(r.body))
+		dec.UseNumber()
+		if err := dec.Decode(&r.doc); err != nil {
+			r.docErr = errNotJSON
+		}
+	})
+	return r.doc, r.docErr
+}
+
+type cachedResult struct {
+	result  *calloutResult
+	expires time.Time
+}
+
+// inflightCall is a callout other requests with the same cache key wait for
+// instead of sending their own
+type inflightCall struct {
+	done   chan struct{}
+	result *calloutResult
+	err    error
+}
+
+// wait returns the outcome of the call, or errDeadline if the deadline of the
+// waiting request passes first
+func (call *inflightCall) wait(deadline time.Time) (*calloutResult, error) {
+	if deadline.IsZero() {
+		<-call.done
+		return call.result, call.err
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-call.done:
+		return call.result, call.err
+	case <-t.C:
+		return nil, errDeadline
+	}
+}
+
+// calloutClient sends the callouts of a policy instance and caches successful
+// responses. Client errors and failures are not cached, so a tenant that is
+// created after a lookup failed is found on the next request.
+type calloutClient struct {
+	transport *http.Transport
+	http      *http.Client
+
+	mu       sync.Mutex
+	cache    map[[sha256.Size]byte]cachedResult
+	inflight map[[sha256.Size]byte]*inflightCall
+	done     chan struct{}
+	closed   bool
+}
+
+func newCalloutClient() *calloutClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return &calloutClient{
+		transport: transport,
+		http: &http.Client{
+			Transport: transport,
+			// Redirects are answered as they are, so the service cannot send
+			// the forwarded headers to another host
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache:    make(map[[sha256.Size]byte]cachedResult),
+		inflight: make(map[[sha256.Size]byte]*inflightCall),
+	}
+}
+
+// call returns the response to req from the cache when caching is on and it
+// holds one, and sends req otherwise. cached reports whether req was
+// answered without a callout of its own.
+func (c *calloutClient) call(cfg calloutConfig, req *calloutRequest, key [sha256.Size]byte, deadline time.Time) (res *calloutResult, cached bool, err error) {
+	if cfg.CacheTTL <= 0 {
+		res, err = c.send(cfg, req, deadline)
+		return res, false, err
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if r, ok := c.cache[key]; ok {
+		if now.Before(r.expires) {
+			c.mu.Unlock()
+			return r.result, true, nil
+		}
+		delete(c.cache, key)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		res, err = call.wait(deadline)
+		return res, true, err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.result, call.err = c.send(cfg, req, deadline)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && call.result.success() {
+		c.store(key, cachedResult{result: call.result, expires: now.Add(cfg.CacheTTL)}, now, cfg.MaxCacheEntries)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.result, false, call.err
+}
+
+// send makes the callout, retrying connection errors, timeouts and 502, 503
+// and 504 responses as often as cfg allows. Retries wait RetryBackoff, twice
+// that before the second and so on, and are not made when the request
+// deadline would pass while waiting.
+func (c *calloutClient) send(cfg calloutConfig, req *calloutRequest, deadline time.Time) (*calloutResult, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := c.sendOnce(cfg, req, deadline)
+		if err == nil && !retryableStatus(res.status) {
+			return res, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("service returned status %d", res.status)
+		}
+		if attempt >= cfg.Retries || errors.Is(err, errDeadline) || errors.Is(err, errTooLarge) {
+			return nil, err
+		}
+		wait := time.Duration(attempt+1) * cfg.RetryBackoff
+		if !deadline.IsZero() && time.Until(deadline) <= wait {
+			return nil, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// sendOnce makes one attempt, bounded by the callout timeout and by the
+// request deadline, whichever comes first
+func (c *calloutClient) sendOnce(cfg calloutConfig, req *calloutRequest, deadline time.Time) (*calloutResult, error) {
+	timeout := cfg.Timeout
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, errDeadline
+		}
+		if left < timeout {
+			timeout = left
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var body io.Reader
+	if req.method != http.MethodGet {
+		body = strings.NewReader(req.body)
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, req.url, body)
+	if err != nil {
+		return nil, err
+	}
+	hr.Header = req.header.Clone()
+
+	resp, err := c.http.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseSize {
+		return nil, errTooLarge
+	}
+	return &calloutResult{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: data}, nil
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// store adds a result, making room by dropping expired entries and, if the
+// cache is still full, arbitrary ones. c.mu must be held.
+func (c *calloutClient) store(key [sha256.Size]byte, r cachedResult, now time.Time, maxEntries int) {
+	if len(c.cache) >= maxEntries {
+		c.sweep(now)
+		for k := range c.cache {
+			if len(c.cache) < maxEntries {
+				break
+			}
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = r
+}
+
+// sweep drops expired entries. c.mu must be held.
+func (c *calloutClient) sweep(now time.Time) {
+	for k, r := range c.cache {
+		if !now.Before(r.expires) {
+			delete(c.cache, k)
+		}
+	}
+}
+
+// startSweeping drops expired entries every interval until close, so the
+// responses of callers that stopped sending requests do not linger
+func (c *calloutClient) startSweeping(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done != nil || c.closed {
+		return
+	}
+	c.done = make(chan struct{})
+	go func(done chan struct{}) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				c.mu.Lock()
+				c.sweep(now)
+				c.mu.Unlock()
+			}
+		}
+	}(c.done)
+}
+
+// close stops sweeping, empties the cache and closes idle connections
+func (c *calloutClient) close() {
+	c.mu.Lock()
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	c.closed = true
+	c.cache = make(map[[sha256.Size]byte]cachedResult)
+	c.mu.Unlock()
+	c.transport.CloseIdleConnections()
+}
+
+// lookup returns a member of a JSON document. Dots address nested members.
+func lookup(doc interface{}, field string) (interface{}, bool) {
+	v := doc
+	for _, part := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// headerString renders a field as a header value. Lists of strings and
+// numbers are joined with commas and objects are sent as JSON.
+func headerString(v interface{}) (string, bool) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = fmt.Sprint(v)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				items = append(items, item)
+			case json.Number:
+				items = append(items, item.String())
+			}
+		}
+		s = strings.Join(items, ",")
+	case map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		s = string(b)
+	default:
+		return "", false
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return "", false
+	}
+	return s, true
+}
@@ -0,0 +1,875 @@
+package cel_policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Values are represented by these Go types:
+//
+//	bool, int64, uint64, float64, string, []byte, nil for null,
+//	[]interface{} for lists, celMap for maps,
+//	time.Time for timestamps and time.Duration for durations
+//
+// JSON documents, such as JWT claims, are converted by celValue, so their
+// numbers are doubles.
+
+// celMap holds map entries by key. Keys are bools, strings, int64 or uint64;
+// uints that fit an int are stored as ints, so that 1 and 1u find the same
+// entry.
+type celMap map[interface{}]interface{}
+
+// sharedValues exposes the SharedContext as a map that is read on demand.
+// It supports indexing, field selection, has and in but cannot be iterated.
+type sharedValues struct {
+	ctx *SharedContext
+}
+
+// maxEvalSteps bounds the work of one evaluation, so that macros nested over
+// large lists cannot stall a request
+const maxEvalSteps = 1_000_000
+
+var errEvalLimit = errors.New("evaluation took too many steps")
+
+// activation binds the iteration variables of the enclosing macros
+type activation struct {
+	name   string
+	val    interface{}
+	parent *activation
+}
+
+type evaluator struct {
+	vars  map[string]interface{}
+	steps int
+}
+
+// evaluate runs a parsed expression with the given variables
+func evaluate(e expr, vars map[string]interface{}) (interface{}, error) {
+	ev := &evaluator{vars: vars}
+	return ev.eval(e, nil)
+}
+
+func (ev *evaluator) lookup(name string, act *activation) interface{} {
+	for a := act; a != nil; a = a.parent {
+		if a.name == name {
+			return a.val
+		}
+	}
+	return ev.vars[name]
+}
+
+func (ev *evaluator) eval(e expr, act *activation) (interface{}, error) {
+	if ev.steps++; ev.steps > maxEvalSteps {
+		return nil, errEvalLimit
+	}
+	switch e := e.(type) {
+	case *literal:
+		return e.val, nil
+	case *ident:
+		return ev.lookup(e.name, act), nil
+	case *selectExpr:
+		v, err := ev.eval(e.operand, act)
+		if err != nil {
+			return nil, err
+		}
+		return selectField(v, e.field, e.test)
+	case *indexExpr:
+		v, err := ev.eval(e.operand, act)
+		if err != nil {
+			return nil, err
+		}
+		i, err := ev.eval(e.index, act)
+		if err != nil {
+			return nil, err
+		}
+		return index(v, i)
+	case *listExpr:
+		list := make([]interface{}, len(e.elems))
+		for i, elem := range e.elems {
+			v, err := ev.eval(elem, act)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case *mapExpr:
+		m := make(celMap, len(e.keys))
+		for i := range e.keys {
+			k, err := ev.eval(e.keys[i], act)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := mapKey(k)
+			if !ok {
+				return nil, fmt.Errorf("unsupported map key type %s", typeName(k))
+			}
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("duplicate map key %s", formatValue(k))
+			}
+			v, err := ev.eval(e.values[i], act)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case *unaryExpr:
+		v, err := ev.eval(e.operand, act)
+		if err != nil {
+			return nil, err
+		}
+		return unary(e.op, v)
+	case *binaryExpr:
+		if e.op == "&&" || e.op == "||" {
+			return ev.logical(e, act)
+		}
+		l, err := ev.eval(e.left, act)
+		if err != nil {
+			return nil, err
+		}
+		r, err := ev.eval(e.right, act)
+		if err != nil {
+			return nil, err
+		}
+		return binary(e.op, l, r)
+	case *condExpr:
+		c, err := ev.eval(e.cond, act)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := c.(bool)
+		if !ok {
+			return nil, noOverload("_?_:_", c)
+		}
+		if b {
+			return ev.eval(e.then, act)
+		}
+		return ev.eval(e.otherwise, act)
+	case *callExpr:
+		args := make([]interface{}, 0, len(e.args)+1)
+		if e.target != nil {
+			t, err := ev.eval(e.target, act)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, t)
+		}
+		for _, a := range e.args {
+			v, err := ev.eval(a, act)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+		return functions[e.fn].impl(args)
+	case *comprehension:
+		return ev.comprehend(e, act)
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+// logical evaluates && and ||. As in CEL, an error on one side is dropped
+// when the other side decides the result on its own, so false && error is
+// false whichever order the operands come in.
+func (ev *evaluator) logical(e *binaryExpr, act *activation) (interface{}, error) {
+	decisive := e.op == "||"
+	l, lerr := ev.eval(e.left, act)
+	if lb, ok := l.(bool); lerr == nil && ok && lb == decisive {
+		return decisive, nil
+	}
+	r, rerr := ev.eval(e.right, act)
+	if rb, ok := r.(bool); rerr == nil && ok && rb == decisive {
+		return decisive, nil
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	_, lok := l.(bool)
+	_, rok := r.(bool)
+	if !lok || !rok {
+		return nil, noOverload("_"+e.op+"_", l, r)
+	}
+	return !decisive, nil
+}
+
+func (ev *evaluator) comprehend(c *comprehension, act *activation) (interface{}, error) {
+	rng, err := ev.eval(c.rng, act)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	switch v := rng.(type) {
+	case []interface{}:
+		items = v
+	case celMap:
+		items = sortedKeys(v)
+	case *sharedValues:
+		return nil, errors.New("shared cannot be iterated")
+	default:
+		return nil, fmt.Errorf("%s cannot iterate over %s", c.macro, typeName(rng))
+	}
+
+	var firstErr error
+	count := 0
+	var out []interface{}
+	for _, item := range items {
+		inner := &activation{name: c.iterVar, val: item, parent: act}
+		if c.filter != nil {
+			v, err := ev.eval(c.filter, inner)
+			if err == nil {
+				if _, ok := v.(bool); !ok {
+					err = fmt.Errorf("%s predicate returned %s, not bool", c.macro, typeName(v))
+				}
+			}
+			if err != nil {
+				if err == errEvalLimit || c.macro != "all" && c.macro != "exists" {
+					return nil, err
+				}
+				// all and exists may still be decided by another element
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			match := v.(bool)
+			switch c.macro {
+			case "all":
+				if !match {
+					return false, nil
+				}
+			case "exists":
+				if match {
+					return true, nil
+				}
+			case "exists_one":
+				if match {
+					count++
+				}
+			}
+			if !match && (c.macro == "filter" || c.macro == "map") {
+				continue
+			}
+		}
+		switch c.macro {
+		case "filter":
+			out = append(out, item)
+		case "map":
+			v, err := ev.eval(c.transform, inner)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+	}
+	switch c.macro {
+	case "all", "exists":
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return c.macro == "all", nil
+	case "exists_one":
+		return count == 1, nil
+	}
+	if out == nil {
+		out = []interface{}{}
+	}
+	return out, nil
+}
+
+func selectField(v interface{}, field string, test bool) (interface{}, error) {
+	switch m := v.(type) {
+	case celMap:
+		val, ok := m[field]
+		if test {
+			return ok, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", field)
+		}
+		return val, nil
+	case *sharedValues:
+		val, ok := m.ctx.Get(field)
+		if test {
+			return ok, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", field)
+		}
+		return celValue(val), nil
+	}
+	return nil, fmt.Errorf("type %s does not support field selection", typeName(v))
+}
+
+func index(v, i interface{}) (interface{}, error) {
+	switch c := v.(type) {
+	case []interface{}:
+		n, ok := integral(i)
+		if !ok {
+			return nil, noOverload("_[_]", v, i)
+		}
+		if n < 0 || n >= int64(len(c)) {
+			return nil, fmt.Errorf("index out of range: %d", n)
+		}
+		return c[n], nil
+	case celMap:
+		key, ok := lookupKey(i)
+		// A double with a fraction is a valid index that finds nothing
+		if _, isDouble := i.(float64); !ok && !isDouble {
+			return nil, noOverload("_[_]", v, i)
+		}
+		val, ok := c[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", formatValue(i))
+		}
+		return val, nil
+	case *sharedValues:
+		key, ok := i.(string)
+		if !ok {
+			return nil, noOverload("_[_]", v, i)
+		}
+		return selectField(v, key, false)
+	}
+	return nil, noOverload("_[_]", v, i)
+}
+
+// integral returns the value of an int, a uint or a double without a
+// fraction
+func integral(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), true
+		}
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// mapKey normalizes a key of a map literal
+func mapKey(k interface{}) (interface{}, bool) {
+	switch k := k.(type) {
+	case bool, string, int64:
+		return k, true
+	case uint64:
+		if k <= math.MaxInt64 {
+			return int64(k), true
+		}
+		return k, true
+	}
+	return nil, false
+}
+
+// lookupKey normalizes a key used to index a map. Doubles without a fraction
+// find int keys, as numbers compare equal across types.
+func lookupKey(k interface{}) (interface{}, bool) {
+	if f, ok := k.(float64); ok {
+		if n, ok := integral(f); ok {
+			return n, true
+		}
+		if f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 {
+			return uint64(f), true
+		}
+		return nil, false
+	}
+	return mapKey(k)
+}
+
+// sortedKeys orders map keys by type and then value, so that macros over
+// maps give the same result every time
+func sortedKeys(m celMap) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case bool:
+			return 0
+		case int64, uint64:
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		c, _, _ := compare(a, b)
+		return c < 0
+	})
+	return keys
+}
+
+func unary(op string, v interface{}) (interface{}, error) {
+	switch op {
+	case "!":
+		if b, ok := v.(bool); ok {
+			return !b, nil
+		}
+	case "-":
+		switch n := v.(type) {
+		case int64:
+			if n == math.MinInt64 {
+				return nil, errors.New("int overflow")
+			}
+			return -n, nil
+		case float64:
+			return -n, nil
+		case time.Duration:
+			return -n, nil
+		}
+	}
+	return nil, noOverload(op+"_", v)
+}
+
+func binary(op string, l, r interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "<", "<=", ">", ">=":
+		c, nan, err := compare(l, r)
+		if err != nil {
+			return nil, noOverload("_"+op+"_", l, r)
+		}
+		if nan {
+			return false, nil
+		}
+		switch op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		return contains(r, l)
+	}
+	return arithmetic(op, l, r)
+}
+
+func contains(coll, v interface{}) (interface{}, error) {
+	switch c := coll.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if equal(item, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case celMap:
+		key, ok := lookupKey(v)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[key]
+		return found, nil
+	case *sharedValues:
+		key, ok := v.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c.ctx.Get(key)
+		return found, nil
+	}
+	return nil, noOverload("@in", v, coll)
+}
+
+// equal compares values of any type; values of different types are not
+// equal, except numbers, which compare by value
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case bool, string:
+		return a == b
+	case []byte:
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(a, bb)
+	case int64, uint64, float64:
+		c, nan, err := compare(a, b)
+		return err == nil && !nan && c == 0
+	case []interface{}:
+		bl, ok := b.([]interface{})
+		if !ok || len(a) != len(bl) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], bl[i]) {
+				return false
+			}
+		}
+		return true
+	case celMap:
+		bm, ok := b.(celMap)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			other, ok := bm[k]
+			if !ok || !equal(v, other) {
+				return false
+			}
+		}
+		return true
+	case time.Time:
+		bt, ok := b.(time.Time)
+		return ok && a.Equal(bt)
+	case time.Duration:
+		return a == b
+	}
+	return false
+}
+
+// compare orders two values of the same type, or two numbers of any type.
+// nan is set when a double is NaN, which makes every comparison false.
+func compare(a, b interface{}) (c int, nan bool, err error) {
+	if isNumber(a) && isNumber(b) {
+		return compareNumbers(a, b)
+	}
+	switch a := a.(type) {
+	case string:
+		if bs, ok := b.(string); ok {
+			return strings.Compare(a, bs), false, nil
+		}
+	case []byte:
+		if bb, ok := b.([]byte); ok {
+			return bytes.Compare(a, bb), false, nil
+		}
+	case bool:
+		if bb, ok := b.(bool); ok {
+			switch {
+			case a == bb:
+				return 0, false, nil
+			case bb:
+				return -1, false, nil
+			}
+			return 1, false, nil
+		}
+	case time.Time:
+		if bt, ok := b.(time.Time); ok {
+			return a.Compare(bt), false, nil
+		}
+	case time.Duration:
+		if bd, ok := b.(time.Duration); ok {
+			return sign(int64(a - bd)), false, nil
+		}
+	}
+	return 0, false, errors.New("incomparable")
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+func compareNumbers(a, b interface{}) (int, bool, error) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return cmp(x, y), false, nil
+		case uint64:
+			if x < 0 {
+				return -1, false, nil
+			}
+			return cmp(uint64(x), y), false, nil
+		case float64:
+			return compareFloat(float64(x), y)
+		}
+	case uint64:
+		switch y := b.(type) {
+		case int64:
+			c, nan, err := compareNumbers(y, x)
+			return -c, nan, err
+		case uint64:
+			return cmp(x, y), false, nil
+		case float64:
+			return compareFloat(float64(x), y)
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			return compareFloat(x, y)
+		}
+		c, nan, err := compareNumbers(b, a)
+		return -c, nan, err
+	}
+	return 0, false, errors.New("incomparable")
+}
+
+func compareFloat(x, y float64) (int, bool, error) {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return 0, true, nil
+	}
+	return cmp(x, y), false, nil
+}
+
+func cmp[T int64 | uint64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func sign(n int64) int {
+	return cmp(n, 0)
+}
+
+var errOverflow = errors.New("integer overflow")
+
+func arithmetic(op string, l, r interface{}) (interface{}, error) {
+	switch x := l.(type) {
+	case int64:
+		if y, ok := r.(int64); ok {
+			return intArithmetic(op, x, y)
+		}
+	case uint64:
+		if y, ok := r.(uint64); ok {
+			return uintArithmetic(op, x, y)
+		}
+	case float64:
+		if y, ok := r.(float64); ok {
+			switch op {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			case "/":
+				return x / y, nil
+			}
+		}
+	case string:
+		if y, ok := r.(string); ok && op == "+" {
+			return x + y, nil
+		}
+	case []byte:
+		if y, ok := r.([]byte); ok && op == "+" {
+			return append(append([]byte{}, x...), y...), nil
+		}
+	case []interface{}:
+		if y, ok := r.([]interface{}); ok && op == "+" {
+			return append(append(make([]interface{}, 0, len(x)+len(y)), x...), y...), nil
+		}
+	case time.Time:
+		switch y := r.(type) {
+		case time.Duration:
+			if op == "+" {
+				return x.Add(y), nil
+			}
+			if op == "-" {
+				return x.Add(-y), nil
+			}
+		case time.Time:
+			if op == "-" {
+				d := x.Sub(y)
+				if d == math.MaxInt64 || d == math.MinInt64 {
+					return nil, errOverflow
+				}
+				return d, nil
+			}
+		}
+	case time.Duration:
+		switch y := r.(type) {
+		case time.Duration:
+			if op == "+" || op == "-" {
+				d, err := intArithmetic(op, int64(x), int64(y))
+				if err != nil {
+					return nil, err
+				}
+				return time.Duration(d.(int64)), nil
+			}
+		case time.Time:
+			if op == "+" {
+				return y.Add(x), nil
+			}
+		}
+	}
+	return nil, noOverload("_"+op+"_", l, r)
+}
+
+func intArithmetic(op string, x, y int64) (interface{}, error) {
+	switch op {
+	case "+":
+		r := x + y
+		if (x > 0 && y > 0 && r < 0) || (x < 0 && y < 0 && r >= 0) {
+			return nil, errOverflow
+		}
+		return r, nil
+	case "-":
+		r := x - y
+		if (x >= 0 && y < 0 && r < 0) || (x < 0 && y > 0 && r >= 0) {
+			return nil, errOverflow
+		}
+		return r, nil
+	case "*":
+		r := x * y
+		if x != 0 && (r/x != y || x == -1 && y == math.MinInt64 || y == -1 && x == math.MinInt64) {
+			return nil, errOverflow
+		}
+		return r, nil
+	case "/", "%":
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if x == math.MinInt64 && y == -1 {
+			if op == "%" {
+				return int64(0), nil
+			}
+			return nil, errOverflow
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	}
+	return nil, noOverload("_"+op+"_", x, y)
+}
+
+func uintArithmetic(op string, x, y uint64) (interface{}, error) {
+	switch op {
+	case "+":
+		if x+y < x {
+			return nil, errOverflow
+		}
+		return x + y, nil
+	case "-":
+		if y > x {
+			return nil, errOverflow
+		}
+		return x - y, nil
+	case "*":
+		if x != 0 && (x*y)/x != y {
+			return nil, errOverflow
+		}
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	}
+	return nil, noOverload("_"+op+"_", x, y)
+}
+
+func noOverload(fn string, args ...interface{}) error {
+	types := make([]string, len(args))
+	for i, a := range args {
+		types[i] = typeName(a)
+	}
+	return fmt.Errorf("no such overload: %s(%s)", fn, strings.Join(types, ", "))
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null_type"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case uint64:
+		return "uint"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case []interface{}:
+		return "list"
+	case celMap, *sharedValues:
+		return "map"
+	case time.Time:
+		return "google.protobuf.Timestamp"
+	case time.Duration:
+		return "google.protobuf.Duration"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// formatValue renders a value for error messages
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case nil:
+		return "null"
+	}
+	if s, err := toString(v); err == nil {
+		return s
+	}
+	return typeName(v)
+}
+
+// celValue converts a value from the SharedContext or a JSON document: maps
+// with string keys become celMaps, string slices lists, and Go integers ints.
+// Values of other types are left as they are; the operators and functions
+// reject them.
+func celValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(celMap, len(v))
+		for k, val := range v {
+			m[k] = celValue(val)
+		}
+		return m
+	case map[string]string:
+		m := make(celMap, len(v))
+		for k, val := range v {
+			m[k] = val
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = celValue(item)
+		}
+		return list
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case float32:
+		return float64(v)
+	}
+	return v
+}
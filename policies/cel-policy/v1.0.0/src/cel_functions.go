@@ -0,0 +1,502 @@
+package cel_policy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// function is a function expressions can call. global and member list the
+// numbers of arguments it takes as f(args) and as target.f(args); impl gets
+// the target as the first argument of member calls.
+type function struct {
+	global, member []int
+	impl           func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"size":        {[]int{1}, []int{0}, celSize},
+	"contains":    {nil, []int{1}, stringPredicate("contains", strings.Contains)},
+	"startsWith":  {nil, []int{1}, stringPredicate("startsWith", strings.HasPrefix)},
+	"endsWith":    {nil, []int{1}, stringPredicate("endsWith", strings.HasSuffix)},
+	"matches":     {[]int{2}, []int{1}, celMatches},
+	"lowerAscii":  {nil, []int{0}, stringMap("lowerAscii", lowerASCII)},
+	"upperAscii":  {nil, []int{0}, stringMap("upperAscii", upperASCII)},
+	"trim":        {nil, []int{0}, stringMap("trim", strings.TrimSpace)},
+	"split":       {nil, []int{1, 2}, celSplit},
+	"join":        {nil, []int{0, 1}, celJoin},
+	"replace":     {nil, []int{2, 3}, celReplace},
+	"indexOf":     {nil, []int{1}, celIndexOf(false)},
+	"lastIndexOf": {nil, []int{1}, celIndexOf(true)},
+	"substring":   {nil, []int{1, 2}, celSubstring},
+	"charAt":      {nil, []int{1}, celCharAt},
+	"int":         {[]int{1}, nil, toInt},
+	"uint":        {[]int{1}, nil, toUint},
+	"double":      {[]int{1}, nil, toDouble},
+	"string":      {[]int{1}, nil, func(a []interface{}) (interface{}, error) { return toString(a[0]) }},
+	"bytes":       {[]int{1}, nil, toBytes},
+	"bool":        {[]int{1}, nil, toBool},
+	"dyn":         {[]int{1}, nil, func(a []interface{}) (interface{}, error) { return a[0], nil }},
+	"timestamp":   {[]int{1}, nil, toTimestamp},
+	"duration":    {[]int{1}, nil, toDuration},
+
+	"getFullYear":     {nil, []int{0, 1}, timePart("getFullYear", func(t time.Time) int { return t.Year() })},
+	"getMonth":        {nil, []int{0, 1}, timePart("getMonth", func(t time.Time) int { return int(t.Month()) - 1 })},
+	"getDayOfYear":    {nil, []int{0, 1}, timePart("getDayOfYear", func(t time.Time) int { return t.YearDay() - 1 })},
+	"getDayOfMonth":   {nil, []int{0, 1}, timePart("getDayOfMonth", func(t time.Time) int { return t.Day() - 1 })},
+	"getDate":         {nil, []int{0, 1}, timePart("getDate", func(t time.Time) int { return t.Day() })},
+	"getDayOfWeek":    {nil, []int{0, 1}, timePart("getDayOfWeek", func(t time.Time) int { return int(t.Weekday()) })},
+	"getHours":        {nil, []int{0, 1}, timePart("getHours", func(t time.Time) int { return t.Hour() })},
+	"getMinutes":      {nil, []int{0, 1}, timePart("getMinutes", func(t time.Time) int { return t.Minute() })},
+	"getSeconds":      {nil, []int{0, 1}, timePart("getSeconds", func(t time.Time) int { return t.Second() })},
+	"getMilliseconds": {nil, []int{0, 1}, timePart("getMilliseconds", func(t time.Time) int { return t.Nanosecond() / 1e6 })},
+}
+
+func functionArity(name string, member bool, n int) bool {
+	arities := functions[name].global
+	if member {
+		arities = functions[name].member
+	}
+	for _, a := range arities {
+		if a == n {
+			return true
+		}
+	}
+	return false
+}
+
+func celSize(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	case []byte:
+		return int64(len(v)), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case celMap:
+		return int64(len(v)), nil
+	}
+	return nil, noOverload("size", a[0])
+}
+
+func stringPredicate(name string, fn func(s, t string) bool) func([]interface{}) (interface{}, error) {
+	return func(a []interface{}) (interface{}, error) {
+		s, ok1 := a[0].(string)
+		t, ok2 := a[1].(string)
+		if !ok1 || !ok2 {
+			return nil, noOverload(name, a...)
+		}
+		return fn(s, t), nil
+	}
+}
+
+func stringMap(name string, fn func(string) string) func([]interface{}) (interface{}, error) {
+	return func(a []interface{}) (interface{}, error) {
+		s, ok := a[0].(string)
+		if !ok {
+			return nil, noOverload(name, a...)
+		}
+		return fn(s), nil
+	}
+}
+
+// lowerASCII and upperASCII change the case of ASCII letters only, as the
+// CEL string extensions do
+func lowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+func upperASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, s)
+}
+
+// regexCache keeps compiled patterns. Patterns built from request values
+// could grow it without bound, so it stops taking new ones when full.
+var regexCache struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}
+
+const regexCacheSize = 256
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.Lock()
+	re, ok := regexCache.m[pattern]
+	regexCache.Unlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Lock()
+	if regexCache.m == nil {
+		regexCache.m = make(map[string]*regexp.Regexp)
+	}
+	if len(regexCache.m) < regexCacheSize {
+		regexCache.m[pattern] = re
+	}
+	regexCache.Unlock()
+	return re, nil
+}
+
+func celMatches(a []interface{}) (interface{}, error) {
+	s, ok1 := a[0].(string)
+	pattern, ok2 := a[1].(string)
+	if !ok1 || !ok2 {
+		return nil, noOverload("matches", a...)
+	}
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return re.MatchString(s), nil
+}
+
+func celSplit(a []interface{}) (interface{}, error) {
+	s, ok1 := a[0].(string)
+	sep, ok2 := a[1].(string)
+	limit := int64(-1)
+	ok3 := true
+	if len(a) == 3 {
+		limit, ok3 = a[2].(int64)
+	}
+	if !ok1 || !ok2 || !ok3 {
+		return nil, noOverload("split", a...)
+	}
+	if limit == 0 {
+		return []interface{}{}, nil
+	}
+	if limit > math.MaxInt32 {
+		limit = -1
+	}
+	parts := strings.SplitN(s, sep, int(limit))
+	out := make([]interface{}, len(parts))
+	for i, p := range parts {
+		out[i] = p
+	}
+	return out, nil
+}
+
+func celJoin(a []interface{}) (interface{}, error) {
+	list, ok1 := a[0].([]interface{})
+	sep, ok2 := "", true
+	if len(a) == 2 {
+		sep, ok2 = a[1].(string)
+	}
+	if !ok1 || !ok2 {
+		return nil, noOverload("join", a...)
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("join: list holds %s, not string", typeName(item))
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func celReplace(a []interface{}) (interface{}, error) {
+	s, ok1 := a[0].(string)
+	old, ok2 := a[1].(string)
+	repl, ok3 := a[2].(string)
+	n, ok4 := int64(-1), true
+	if len(a) == 4 {
+		n, ok4 = a[3].(int64)
+	}
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, noOverload("replace", a...)
+	}
+	if n > math.MaxInt32 {
+		n = -1
+	}
+	return strings.Replace(s, old, repl, int(n)), nil
+}
+
+// celIndexOf returns the position of a substring in code points, or -1
+func celIndexOf(last bool) func([]interface{}) (interface{}, error) {
+	return func(a []interface{}) (interface{}, error) {
+		s, ok1 := a[0].(string)
+		sub, ok2 := a[1].(string)
+		if !ok1 || !ok2 {
+			return nil, noOverload("indexOf", a...)
+		}
+		i := strings.Index(s, sub)
+		if last {
+			i = strings.LastIndex(s, sub)
+		}
+		if i < 0 {
+			return int64(-1), nil
+		}
+		return int64(utf8.RuneCountInString(s[:i])), nil
+	}
+}
+
+// celSubstring takes code point offsets; the end is exclusive
+func celSubstring(a []interface{}) (interface{}, error) {
+	s, ok1 := a[0].(string)
+	start, ok2 := a[1].(int64)
+	runes := []rune(s)
+	end, ok3 := int64(len(runes)), true
+	if len(a) == 3 {
+		end, ok3 = a[2].(int64)
+	}
+	if !ok1 || !ok2 || !ok3 {
+		return nil, noOverload("substring", a...)
+	}
+	if start < 0 || end > int64(len(runes)) || start > end {
+		return nil, fmt.Errorf("substring: range [%d, %d) is out of bounds for a string of length %d", start, end, len(runes))
+	}
+	return string(runes[start:end]), nil
+}
+
+func celCharAt(a []interface{}) (interface{}, error) {
+	s, ok1 := a[0].(string)
+	i, ok2 := a[1].(int64)
+	if !ok1 || !ok2 {
+		return nil, noOverload("charAt", a...)
+	}
+	runes := []rune(s)
+	switch {
+	case i < 0 || i > int64(len(runes)):
+		return nil, fmt.Errorf("charAt: index %d is out of range", i)
+	case i == int64(len(runes)):
+		return "", nil
+	}
+	return string(runes[i]), nil
+}
+
+func toInt(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, errors.New("int: uint is out of range")
+		}
+		return int64(v), nil
+	case float64:
+		if math.IsNaN(v) || v <= math.MinInt64 || v >= math.MaxInt64 {
+			return nil, errors.New("int: double is out of range")
+		}
+		return int64(v), nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("int: cannot convert %q", v)
+		}
+		return n, nil
+	case time.Time:
+		return v.Unix(), nil
+	}
+	return nil, noOverload("int", a[0])
+}
+
+func toUint(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		if v < 0 {
+			return nil, errors.New("uint: int is out of range")
+		}
+		return uint64(v), nil
+	case float64:
+		if math.IsNaN(v) || v < 0 || v >= math.MaxUint64 {
+			return nil, errors.New("uint: double is out of range")
+		}
+		return uint64(v), nil
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("uint: cannot convert %q", v)
+		}
+		return n, nil
+	}
+	return nil, noOverload("uint", a[0])
+}
+
+func toDouble(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("double: cannot convert %q", v)
+		}
+		return f, nil
+	}
+	return nil, noOverload("double", a[0])
+}
+
+func toString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []byte:
+		if !utf8.Valid(v) {
+			return "", errors.New("string: bytes are not valid UTF-8")
+		}
+		return string(v), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	case time.Duration:
+		return strconv.FormatFloat(v.Seconds(), 'f', -1, 64) + "s", nil
+	}
+	return "", noOverload("string", v)
+}
+
+func toBytes(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, noOverload("bytes", a[0])
+}
+
+func toBool(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch v {
+		case "true", "TRUE", "True", "t", "1":
+			return true, nil
+		case "false", "FALSE", "False", "f", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("bool: cannot convert %q", v)
+	}
+	return nil, noOverload("bool", a[0])
+}
+
+// toTimestamp reads RFC 3339 text or Unix seconds
+func toTimestamp(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp: cannot convert %q", v)
+		}
+		return t, nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	}
+	return nil, noOverload("timestamp", a[0])
+}
+
+// toDuration reads durations such as 1h30m or 2.5s
+func toDuration(a []interface{}) (interface{}, error) {
+	switch v := a[0].(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("duration: cannot convert %q", v)
+		}
+		return d, nil
+	}
+	return nil, noOverload("duration", a[0])
+}
+
+// timePart reads part of a timestamp in UTC or in the time zone given as the
+// argument, an IANA name or an offset such as +05:30. On durations, the
+// hour, minute, second and millisecond accessors give the whole duration in
+// that unit.
+func timePart(name string, part func(time.Time) int) func([]interface{}) (interface{}, error) {
+	return func(a []interface{}) (interface{}, error) {
+		if d, ok := a[0].(time.Duration); ok && len(a) == 1 {
+			switch name {
+			case "getHours":
+				return int64(d / time.Hour), nil
+			case "getMinutes":
+				return int64(d / time.Minute), nil
+			case "getSeconds":
+				return int64(d / time.Second), nil
+			case "getMilliseconds":
+				return int64(d / time.Millisecond), nil
+			}
+		}
+		t, ok := a[0].(time.Time)
+		if !ok {
+			return nil, noOverload(name, a...)
+		}
+		loc := time.UTC
+		if len(a) == 2 {
+			tz, ok := a[1].(string)
+			if !ok {
+				return nil, noOverload(name, a...)
+			}
+			var err error
+			if loc, err = timeZone(tz); err != nil {
+				return nil, err
+			}
+		}
+		return int64(part(t.In(loc))), nil
+	}
+}
+
+// locations caches loaded time zones, as expressions may name one on every
+// request. Only valid names are stored, so the cache stays small.
+var locations sync.Map
+
+func timeZone(name string) (*time.Location, error) {
+	if len(name) == 6 && (name[0] == '+' || name[0] == '-') && name[3] == ':' {
+		h, err1 := strconv.Atoi(name[1:3])
+		m, err2 := strconv.Atoi(name[4:6])
+		if err1 == nil && err2 == nil && h <= 23 && m <= 59 {
+			offset := h*3600 + m*60
+			if name[0] == '-' {
+				offset = -offset
+			}
+			return time.FixedZone(name, offset), nil
+		}
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
@@ -0,0 +1,799 @@
+package cel_policy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file parses CEL expressions as defined by the CEL language
+// specification: literals, lists, maps, field selection, indexing, the
+// operators with their precedence, function and method calls, and the has,
+// all, exists, exists_one, map and filter macros. Message construction such
+// as Foo{a: 1} is rejected, since the policy works with maps only.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokUint
+	tokDouble
+	tokString
+	tokBytes
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// val holds the value of literals
+	val interface{}
+	pos position
+}
+
+type position struct {
+	line, col int
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%d:%d", p.line, p.col)
+}
+
+// operators are matched longest first
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%",
+	"!", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}"}
+
+// reserved cannot be used as identifiers
+var reserved = map[string]bool{
+	"as": true, "break": true, "const": true, "continue": true, "else": true, "for": true,
+	"function": true, "if": true, "import": true, "let": true, "loop": true, "package": true,
+	"namespace": true, "return": true, "var": true, "void": true, "while": true,
+}
+
+type lexer struct {
+	src  string
+	i    int
+	line int
+	// lineStart is the offset of the current line
+	lineStart int
+}
+
+func lexCEL(src string) ([]token, error) {
+	l := &lexer{src: src, line: 1}
+	var toks []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) pos() position {
+	return position{l.line, l.i - l.lineStart + 1}
+}
+
+func (l *lexer) errorf(pos position, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", pos, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) skipSpace() {
+	for l.i < len(l.src) {
+		switch c := l.src[l.i]; {
+		case c == '\n':
+			l.i++
+			l.line++
+			l.lineStart = l.i
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			l.i++
+		case strings.HasPrefix(l.src[l.i:], "//"):
+			for l.i < len(l.src) && l.src[l.i] != '\n' {
+				l.i++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpace()
+	pos := l.pos()
+	if l.i >= len(l.src) {
+		return token{kind: tokEOF, pos: pos}, nil
+	}
+	c := l.src[l.i]
+	switch {
+	case isDigit(c) || c == '.' && l.i+1 < len(l.src) && isDigit(l.src[l.i+1]):
+		return l.number(pos)
+	case c == '"' || c == '\'':
+		return l.str(pos, false, false)
+	case c == '_' || isLetter(c):
+		j := l.i + 1
+		for j < len(l.src) && (l.src[j] == '_' || isLetter(l.src[j]) || isDigit(l.src[j])) {
+			j++
+		}
+		word := l.src[l.i:j]
+		// String prefixes: r for raw strings, b for bytes, in either order
+		if j < len(l.src) && (l.src[j] == '"' || l.src[j] == '\'') {
+			switch strings.ToLower(word) {
+			case "r", "b", "rb", "br":
+				l.i = j
+				lower := strings.ToLower(word)
+				return l.str(pos, strings.Contains(lower, "r"), strings.Contains(lower, "b"))
+			}
+		}
+		l.i = j
+		return token{kind: tokIdent, text: word, pos: pos}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.i:], op) {
+			l.i += len(op)
+			return token{kind: tokOp, text: op, pos: pos}, nil
+		}
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.i:])
+	return token{}, l.errorf(pos, "unexpected character %q", r)
+}
+
+func (l *lexer) number(pos position) (token, error) {
+	start := l.i
+	if strings.HasPrefix(l.src[l.i:], "0x") || strings.HasPrefix(l.src[l.i:], "0X") {
+		l.i += 2
+		for l.i < len(l.src) && isHexDigit(l.src[l.i]) {
+			l.i++
+		}
+		return l.integer(pos, l.src[start:l.i], 16)
+	}
+	isFloat := false
+	for l.i < len(l.src) && isDigit(l.src[l.i]) {
+		l.i++
+	}
+	if l.i+1 < len(l.src) && l.src[l.i] == '.' && isDigit(l.src[l.i+1]) {
+		isFloat = true
+		l.i++
+		for l.i < len(l.src) && isDigit(l.src[l.i]) {
+			l.i++
+		}
+	}
+	if l.i < len(l.src) && (l.src[l.i] == 'e' || l.src[l.i] == 'E') {
+		j := l.i + 1
+		if j < len(l.src) && (l.src[j] == '+' || l.src[j] == '-') {
+			j++
+		}
+		if j < len(l.src) && isDigit(l.src[j]) {
+			isFloat = true
+			for l.i = j; l.i < len(l.src) && isDigit(l.src[l.i]); l.i++ {
+			}
+		}
+	}
+	text := l.src[start:l.i]
+	if !isFloat {
+		return l.integer(pos, text, 10)
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !math.IsInf(f, 0) {
+		return token{}, l.errorf(pos, "invalid number %s", text)
+	}
+	return token{kind: tokDouble, text: text, val: f, pos: pos}, nil
+}
+
+// integer finishes an int literal, or a uint literal with a u suffix.
+// Ints are kept as text, so that the parser can apply a leading minus
+// before checking the range.
+func (l *lexer) integer(pos position, text string, base int) (token, error) {
+	if l.i < len(l.src) && (l.src[l.i] == 'u' || l.src[l.i] == 'U') {
+		l.i++
+		digits := text
+		if base == 16 {
+			digits = text[2:]
+		}
+		u, err := strconv.ParseUint(digits, base, 64)
+		if err != nil {
+			return token{}, l.errorf(pos, "invalid uint literal %s", text)
+		}
+		return token{kind: tokUint, text: text, val: u, pos: pos}, nil
+	}
+	if base == 16 && len(text) == 2 {
+		return token{}, l.errorf(pos, "invalid int literal %s", text)
+	}
+	return token{kind: tokInt, text: text, pos: pos}, nil
+}
+
+func (l *lexer) str(pos position, raw, isBytes bool) (token, error) {
+	quote := l.src[l.i : l.i+1]
+	if strings.HasPrefix(l.src[l.i:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	l.i += len(quote)
+	var b strings.Builder
+	for {
+		if l.i >= len(l.src) {
+			return token{}, l.errorf(pos, "unterminated string")
+		}
+		if strings.HasPrefix(l.src[l.i:], quote) {
+			l.i += len(quote)
+			break
+		}
+		c := l.src[l.i]
+		if c == '\n' {
+			if len(quote) == 1 {
+				return token{}, l.errorf(pos, "unterminated string")
+			}
+			b.WriteByte(c)
+			l.i++
+			l.line++
+			l.lineStart = l.i
+			continue
+		}
+		if c != '\\' || raw {
+			b.WriteByte(c)
+			l.i++
+			continue
+		}
+		if err := l.escape(&b, isBytes); err != nil {
+			return token{}, err
+		}
+	}
+	if isBytes {
+		return token{kind: tokBytes, val: []byte(b.String()), pos: pos}, nil
+	}
+	s := b.String()
+	if !utf8.ValidString(s) {
+		return token{}, l.errorf(pos, "string is not valid UTF-8")
+	}
+	return token{kind: tokString, val: s, pos: pos}, nil
+}
+
+var simpleEscapes = map[byte]byte{'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t',
+	'v': '\v', '\\': '\\', '\'': '\'', '"': '"', '`': '`', '?': '?'}
+
+// escape decodes one escape sequence. Octal and \x escapes are bytes in
+// bytes literals and code points in strings.
+func (l *lexer) escape(b *strings.Builder, isBytes bool) error {
+	pos := l.pos()
+	if l.i+1 >= len(l.src) {
+		return l.errorf(pos, "unterminated string")
+	}
+	c := l.src[l.i+1]
+	l.i += 2
+	if r, ok := simpleEscapes[c]; ok {
+		b.WriteByte(r)
+		return nil
+	}
+	var digits, base int
+	switch {
+	case c == 'x' || c == 'X':
+		digits, base = 2, 16
+	case c == 'u' && !isBytes:
+		digits, base = 4, 16
+	case c == 'U' && !isBytes:
+		digits, base = 8, 16
+	case c >= '0' && c <= '3':
+		digits, base = 3, 8
+		l.i--
+	default:
+		return l.errorf(pos, "invalid escape sequence \\%c", c)
+	}
+	if l.i+digits > len(l.src) {
+		return l.errorf(pos, "invalid escape sequence")
+	}
+	n, err := strconv.ParseUint(l.src[l.i:l.i+digits], base, 32)
+	if err != nil {
+		return l.errorf(pos, "invalid escape sequence")
+	}
+	l.i += digits
+	switch {
+	case isBytes:
+		b.WriteByte(byte(n))
+	case n > utf8.MaxRune || n >= 0xD800 && n < 0xE000:
+		return l.errorf(pos, "invalid code point in escape sequence")
+	default:
+		b.WriteRune(rune(n))
+	}
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// expr is a node of the expression tree
+type expr interface{}
+
+type literal struct {
+	val interface{}
+}
+
+type ident struct {
+	name string
+	pos  position
+}
+
+// selectExpr is operand.field, or has(operand.field) with test set
+type selectExpr struct {
+	operand expr
+	field   string
+	test    bool
+	pos     position
+}
+
+type indexExpr struct {
+	operand, index expr
+	pos            position
+}
+
+// callExpr is a function call, or a method call when target is set
+type callExpr struct {
+	fn     string
+	target expr
+	args   []expr
+	pos    position
+}
+
+type listExpr struct {
+	elems []expr
+}
+
+type mapExpr struct {
+	keys, values []expr
+	pos          position
+}
+
+type unaryExpr struct {
+	op      string
+	operand expr
+	pos     position
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+	pos         position
+}
+
+type condExpr struct {
+	cond, then, otherwise expr
+}
+
+// comprehension is one of the macros all, exists, exists_one, map and
+// filter over the elements of a list or the keys of a map
+type comprehension struct {
+	macro   string
+	rng     expr
+	iterVar string
+	// filter is the predicate of filter, the optional filter of map, and the
+	// condition of all, exists and exists_one
+	filter expr
+	// transform is the result expression of map
+	transform expr
+	pos       position
+}
+
+// maxDepth bounds the nesting of expressions, so that the parser cannot run
+// out of stack
+const maxDepth = 250
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+	// vars are the variables in scope: the declared ones and the iteration
+	// variables of enclosing macros
+	vars map[string]int
+}
+
+type parseError struct {
+	msg string
+}
+
+func (e parseError) Error() string {
+	return e.msg
+}
+
+// parseExpr parses src and checks that it only refers to the given
+// variables and known functions
+func parseExpr(src string, vars []string) (e expr, err error) {
+	toks, err := lexCEL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, vars: make(map[string]int)}
+	for _, v := range vars {
+		p.vars[v] = 1
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			e, err = nil, pe
+		}
+	}()
+	e = p.parseExpr()
+	if t := p.peek(); t.kind != tokEOF {
+		p.failAt(t.pos, "unexpected %s", describeToken(t))
+	}
+	return e, nil
+}
+
+func (p *parser) failAt(pos position, format string, args ...interface{}) {
+	panic(parseError{fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, args...))})
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if p.isOp(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) {
+	if !p.acceptOp(op) {
+		t := p.peek()
+		p.failAt(t.pos, "expected %s, found %s", op, describeToken(t))
+	}
+}
+
+func (p *parser) expectIdent() token {
+	t := p.next()
+	if t.kind != tokIdent {
+		p.failAt(t.pos, "expected a name, found %s", describeToken(t))
+	}
+	if reserved[t.text] {
+		p.failAt(t.pos, "%s is a reserved word", t.text)
+	}
+	return t
+}
+
+func describeToken(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString, tokBytes:
+		return "string"
+	case tokInt, tokUint, tokDouble:
+		return "number " + t.text
+	}
+	return t.text
+}
+
+func (p *parser) enter() {
+	if p.depth++; p.depth > maxDepth {
+		p.failAt(p.peek().pos, "expression is nested too deeply")
+	}
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) parseExpr() expr {
+	p.enter()
+	defer p.leave()
+	cond := p.parseOr()
+	if !p.acceptOp("?") {
+		return cond
+	}
+	then := p.parseOr()
+	p.expectOp(":")
+	return &condExpr{cond: cond, then: then, otherwise: p.parseExpr()}
+}
+
+func (p *parser) parseOr() expr {
+	left := p.parseAnd()
+	for p.isOp("||") {
+		t := p.next()
+		left = &binaryExpr{op: "||", left: left, right: p.parseAnd(), pos: t.pos}
+	}
+	return left
+}
+
+func (p *parser) parseAnd() expr {
+	left := p.parseRelation()
+	for p.isOp("&&") {
+		t := p.next()
+		left = &binaryExpr{op: "&&", left: left, right: p.parseRelation(), pos: t.pos}
+	}
+	return left
+}
+
+var relations = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parseRelation() expr {
+	left := p.parseAddition()
+	for {
+		t := p.peek()
+		op := ""
+		switch {
+		case t.kind == tokOp && relations[t.text]:
+			op = t.text
+		case t.kind == tokIdent && t.text == "in":
+			op = "in"
+		default:
+			return left
+		}
+		p.next()
+		left = &binaryExpr{op: op, left: left, right: p.parseAddition(), pos: t.pos}
+	}
+}
+
+func (p *parser) parseAddition() expr {
+	left := p.parseMultiplication()
+	for p.isOp("+") || p.isOp("-") {
+		t := p.next()
+		left = &binaryExpr{op: t.text, left: left, right: p.parseMultiplication(), pos: t.pos}
+	}
+	return left
+}
+
+func (p *parser) parseMultiplication() expr {
+	left := p.parseUnary()
+	for p.isOp("*") || p.isOp("/") || p.isOp("%") {
+		t := p.next()
+		left = &binaryExpr{op: t.text, left: left, right: p.parseUnary(), pos: t.pos}
+	}
+	return left
+}
+
+func (p *parser) parseUnary() expr {
+	p.enter()
+	defer p.leave()
+	t := p.peek()
+	switch {
+	case p.isOp("!"):
+		p.next()
+		return &unaryExpr{op: "!", operand: p.parseUnary(), pos: t.pos}
+	case p.isOp("-"):
+		p.next()
+		// -9223372036854775808 is only in range with its sign
+		if lit := p.peek(); lit.kind == tokInt {
+			p.next()
+			return p.parseMember(p.intLiteral(lit, "-"))
+		}
+		return &unaryExpr{op: "-", operand: p.parseUnary(), pos: t.pos}
+	}
+	return p.parseMember(p.parsePrimary())
+}
+
+func (p *parser) intLiteral(t token, sign string) expr {
+	text := t.text
+	base := 10
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		text, base = text[2:], 16
+	}
+	n, err := strconv.ParseInt(sign+text, base, 64)
+	if err != nil {
+		p.failAt(t.pos, "int literal %s%s is out of range", sign, t.text)
+	}
+	return &literal{n}
+}
+
+func (p *parser) parseMember(e expr) expr {
+	for {
+		t := p.peek()
+		switch {
+		case p.acceptOp("."):
+			name := p.expectIdent()
+			switch {
+			case p.isOp("(") && p.isMacro(name):
+				e = p.parseMacro(name, e)
+			case p.isOp("(") && macros[name.text] != nil:
+				p.failAt(name.pos, "%s takes a variable name and an expression", name.text)
+			case p.acceptOp("("):
+				e = p.finishCall(name, e, p.parseArgs(")"))
+			default:
+				e = &selectExpr{operand: e, field: name.text, pos: name.pos}
+			}
+		case p.acceptOp("["):
+			index := p.parseExpr()
+			p.expectOp("]")
+			e = &indexExpr{operand: e, index: index, pos: t.pos}
+		case p.isOp("{"):
+			p.failAt(t.pos, "message construction is not supported")
+		default:
+			return e
+		}
+	}
+}
+
+// parseArgs parses a list of expressions up to end, after the opening
+// bracket. A trailing comma is allowed.
+func (p *parser) parseArgs(end string) []expr {
+	var args []expr
+	for !p.acceptOp(end) {
+		args = append(args, p.parseExpr())
+		if !p.acceptOp(",") {
+			p.expectOp(end)
+			break
+		}
+	}
+	return args
+}
+
+func (p *parser) parsePrimary() expr {
+	p.enter()
+	defer p.leave()
+	t := p.next()
+	switch t.kind {
+	case tokInt:
+		return p.intLiteral(t, "")
+	case tokUint, tokDouble, tokString, tokBytes:
+		return &literal{t.val}
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literal{true}
+		case "false":
+			return &literal{false}
+		case "null":
+			return &literal{nil}
+		case "in":
+			p.failAt(t.pos, "unexpected in")
+		}
+		if reserved[t.text] {
+			p.failAt(t.pos, "%s is a reserved word", t.text)
+		}
+		if p.isOp("(") {
+			return p.parseGlobalCall(t)
+		}
+		if p.vars[t.text] == 0 {
+			p.failAt(t.pos, "undeclared reference to %s", t.text)
+		}
+		return &ident{name: t.text, pos: t.pos}
+	case tokOp:
+		switch t.text {
+		case "(":
+			e := p.parseExpr()
+			p.expectOp(")")
+			return e
+		case "[":
+			return &listExpr{elems: p.parseArgs("]")}
+		case "{":
+			m := &mapExpr{pos: t.pos}
+			for !p.acceptOp("}") {
+				m.keys = append(m.keys, p.parseExpr())
+				p.expectOp(":")
+				m.values = append(m.values, p.parseExpr())
+				if !p.acceptOp(",") {
+					p.expectOp("}")
+					break
+				}
+			}
+			return m
+		case ".":
+			// A leading dot names a variable in the root scope
+			name := p.expectIdent()
+			if p.isOp("(") {
+				return p.parseGlobalCall(name)
+			}
+			if p.vars[name.text] == 0 {
+				p.failAt(name.pos, "undeclared reference to %s", name.text)
+			}
+			return &ident{name: name.text, pos: name.pos}
+		}
+	}
+	p.failAt(t.pos, "unexpected %s", describeToken(t))
+	return nil
+}
+
+func (p *parser) parseGlobalCall(name token) expr {
+	p.next()
+	if name.text == "has" {
+		args := p.parseArgs(")")
+		var sel *selectExpr
+		if len(args) == 1 {
+			sel, _ = args[0].(*selectExpr)
+		}
+		if sel == nil {
+			p.failAt(name.pos, "has() takes a field selection such as has(claims.sub)")
+		}
+		test := *sel
+		test.test = true
+		return &test
+	}
+	return p.finishCall(name, nil, p.parseArgs(")"))
+}
+
+var macros = map[string][]int{
+	"all": {2}, "exists": {2}, "exists_one": {2}, "filter": {2}, "map": {2, 3},
+}
+
+// isMacro reports whether the method call at hand, before its opening
+// parenthesis, is a macro: a macro name with a variable name as the first
+// argument
+func (p *parser) isMacro(name token) bool {
+	_, ok := macros[name.text]
+	return ok && p.pos+2 < len(p.toks) && p.toks[p.pos+1].kind == tokIdent &&
+		p.toks[p.pos+2].kind == tokOp && p.toks[p.pos+2].text == ","
+}
+
+// parseMacro parses the arguments of a macro, with its iteration variable
+// in scope after the first
+func (p *parser) parseMacro(name token, target expr) expr {
+	p.expectOp("(")
+	v := p.expectIdent()
+	p.expectOp(",")
+	p.vars[v.text]++
+	args := p.parseArgs(")")
+	p.vars[v.text]--
+
+	arities := macros[name.text]
+	ok := false
+	for _, n := range arities {
+		ok = ok || len(args)+1 == n
+	}
+	if !ok {
+		p.failAt(name.pos, "%s takes %d arguments", name.text, arities[0])
+	}
+	c := &comprehension{macro: name.text, rng: target, iterVar: v.text, pos: name.pos}
+	if name.text == "map" {
+		c.transform = args[len(args)-1]
+		if len(args) == 2 {
+			c.filter = args[0]
+		}
+	} else {
+		c.filter = args[0]
+	}
+	return c
+}
+
+// finishCall builds a function or method call once its arguments are parsed
+func (p *parser) finishCall(name token, target expr, args []expr) expr {
+	if _, ok := functions[name.text]; !ok {
+		p.failAt(name.pos, "undeclared reference to function %s", name.text)
+	}
+	if !functionArity(name.text, target != nil, len(args)) {
+		kind := "function"
+		if target != nil {
+			kind = "method"
+		}
+		p.failAt(name.pos, "no %s %s taking %d arguments", kind, name.text, len(args))
+	}
+	if name.text == "matches" {
+		// Patterns given as literals are checked now
+		if lit, ok := args[len(args)-1].(*literal); ok {
+			if s, ok := lit.val.(string); ok {
+				if _, err := compileRegex(s); err != nil {
+					p.failAt(name.pos, "invalid regular expression: %v", err)
+				}
+			}
+		}
+	}
+	return &callExpr{fn: name.text, target: target, args: args, pos: name.pos}
+}
@@ -0,0 +1,721 @@
+package cel_policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+	// Metrics is nil when the gateway does not collect metrics, see
+	// MetricsOrNop
+	Metrics Metrics
+	// Span is nil when the gateway does not trace requests, see SpanOrNop
+	Span Span
+	// Logger is nil when the gateway does not take policy logs, see
+	// LoggerOrNop
+	Logger Logger
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+	Metrics         Metrics
+	Span            Span
+	Logger          Logger
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+	// TraceContextKey holds the TraceContext of the request as set by the
+	// tracing policy. Gateways that trace requests continue that trace.
+	TraceContextKey = "trace.context"
+)
+
+// Metrics creates the instruments a policy records measurements with. The
+// gateway hands each policy instance its own Metrics and exports what is
+// recorded, e.g. to Prometheus, labelled with the policy name and version,
+// so policies only add labels of their own. Names follow the Prometheus
+// conventions, such as rate_limiter_requests_total. Asking again for an
+// instrument with the same name and labels returns the same one.
+type Metrics interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	// Histogram uses buckets as upper bounds; nil chooses default buckets
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Labels are label names with their values. Every instrument of one name
+// must use the same label names.
+type Labels map[string]string
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter interface {
+	// Add increases the counter; negative deltas are ignored
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// MetricsOrNop returns m, or a Metrics whose instruments discard everything
+// when m is nil because the gateway does not collect metrics
+func MetricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, Labels) Counter { return nopInstrument{} }
+
+func (nopMetrics) Gauge(string, string, Labels) Gauge { return nopInstrument{} }
+
+func (nopMetrics) Histogram(string, string, []float64, Labels) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64) {}
+
+func (nopInstrument) Set(float64) {}
+
+func (nopInstrument) Observe(float64) {}
+
+// Span is the trace span the gateway records for a policy execution.
+// Policies add attributes and events to it; starting, ending and exporting
+// spans, e.g. over OTLP, is left to the gateway.
+type Span interface {
+	// SetAttribute records a string, bool, int64 or float64 value
+	SetAttribute(key string, value interface{})
+	// AddEvent records a timestamped event; attributes may be nil
+	AddEvent(name string, attributes map[string]interface{})
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// TraceContext returns the IDs of the span, e.g. to log them
+	TraceContext() TraceContext
+}
+
+// TraceContext identifies a span in the terms of W3C Trace Context
+type TraceContext struct {
+	// TraceID is 32 and SpanID 16 lowercase hex characters
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// State is the vendor data of the tracestate header, if any
+	State string
+}
+
+// SpanOrNop returns s, or a Span that discards everything when s is nil
+// because the gateway does not trace requests
+func SpanOrNop(s Span) Span {
+	if s == nil {
+		return nopSpan{}
+	}
+	return s
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) AddEvent(string, map[string]interface{}) {}
+
+func (nopSpan) RecordError(error) {}
+
+func (nopSpan) TraceContext() TraceContext { return TraceContext{} }
+
+// Logger writes structured log records through the gateway's logging, which
+// adds the policy name and version and the request's trace ID. Fields hold
+// values that encode as JSON; secrets do not belong in them.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LogLevel is the severity of a log record
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo  LogLevel = "info"
+	LogWarn  LogLevel = "warn"
+	LogError LogLevel = "error"
+)
+
+// LoggerOrNop returns l, or a Logger that discards everything when l is nil
+// because the gateway does not take policy logs
+func LoggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, map[string]interface{}) {}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Keys of the values the policy reads from the SharedContext
+const (
+	// clientIPKey is the client address resolved by an earlier policy
+	clientIPKey = "client.ip"
+	// claimsKeys hold the claims verified by the JWT Validator and OAuth2
+	// Introspection Policies, in the order they are tried
+	jwtClaimsKey           = "jwt.claims"
+	introspectionClaimsKey = "oauth2-introspection.claims"
+)
+
+// Modes of the policy
+const (
+	modeDenyIf    = "deny-if"
+	modeAllowIf   = "allow-if"
+	modeSetHeader = "set-header"
+)
+
+// variables are the names expressions can refer to
+var variables = []string{"request", "source", "consumer", "claims", "shared"}
+
+// maxPrograms bounds the parsed expressions kept for past configurations
+const maxPrograms = 64
+
+type CelPolicy struct {
+	mu       sync.Mutex
+	programs map[string]*program
+}
+
+// program is a parsed expression, or the error parsing it gave
+type program struct {
+	expr expr
+	err  error
+}
+
+type celConfig struct {
+	Mode       string
+	Expression string
+	Header     string
+	DenyStatus int
+	DenyBody   string
+	FailOpen   bool
+}
+
+// Validate configuration parameters
+func (p *CelPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	if _, err := p.program(cfg.Expression); err != nil {
+		return invalidParam("expression", "%v", err)
+	}
+	return nil
+}
+
+// Declare processing behavior
+func (p *CelPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *CelPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	e, err := p.program(cfg.Expression)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	v, err := evaluate(e, buildVariables(ctx))
+	if cfg.Mode == modeSetHeader {
+		if err != nil {
+			logFailure(ctx, cfg, err)
+			return UpstreamRequestModifications{}
+		}
+		if v == nil {
+			return UpstreamRequestModifications{RemoveHeaders: []string{cfg.Header}}
+		}
+		value, err := headerValue(v)
+		if err != nil {
+			logFailure(ctx, cfg, err)
+			return UpstreamRequestModifications{}
+		}
+		return UpstreamRequestModifications{SetHeaders: map[string]string{cfg.Header: value}}
+	}
+
+	match, ok := v.(bool)
+	if err == nil && !ok {
+		err = fmt.Errorf("expression returned %s, not bool", typeName(v))
+	}
+	if err != nil {
+		logFailure(ctx, cfg, err)
+		if cfg.FailOpen {
+			return UpstreamRequestModifications{}
+		}
+		return deny(cfg)
+	}
+	if match == (cfg.Mode == modeDenyIf) {
+		return deny(cfg)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (p *CelPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// program returns the parsed expression, parsing it on first use
+func (p *CelPolicy) program(src string) (expr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if prog, ok := p.programs[src]; ok {
+		return prog.expr, prog.err
+	}
+	if p.programs == nil || len(p.programs) >= maxPrograms {
+		p.programs = make(map[string]*program)
+	}
+	prog := &program{}
+	prog.expr, prog.err = parseExpr(src, variables)
+	p.programs[src] = prog
+	return prog.expr, prog.err
+}
+
+// buildVariables describes the request to the expression. Attribute names
+// follow Envoy's where there is an equivalent.
+func buildVariables(ctx *RequestContext) map[string]interface{} {
+	urlPath, query := ctx.Path, ""
+	if i := strings.IndexByte(urlPath, '?'); i >= 0 {
+		urlPath, query = urlPath[:i], urlPath[i+1:]
+	}
+	headers := make(celMap)
+	for name, values := range ctx.Headers {
+		lower := strings.ToLower(name)
+		if old, ok := headers[lower]; ok {
+			values = append([]string{old.(string)}, values...)
+		}
+		headers[lower] = strings.Join(values, ", ")
+	}
+	host, _ := headers["host"].(string)
+
+	request := celMap{
+		"method":   ctx.Method,
+		"path":     ctx.Path,
+		"url_path": urlPath,
+		"query":    query,
+		"host":     host,
+		"headers":  headers,
+		"time":     time.Now().UTC(),
+	}
+
+	address := ""
+	if ip, ok := SharedValue[string](ctx.SharedContext, clientIPKey); ok && ip != "" {
+		address = ip
+	} else if h, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		address = h
+	} else {
+		address = ctx.RemoteAddr
+	}
+
+	consumer, _ := SharedValue[string](ctx.SharedContext, ConsumerIDKey)
+	claims := celMap{}
+	for _, key := range []string{jwtClaimsKey, introspectionClaimsKey} {
+		if c, ok := SharedValue[map[string]interface{}](ctx.SharedContext, key); ok {
+			claims = celValue(c).(celMap)
+			break
+		}
+	}
+
+	return map[string]interface{}{
+		"request":  request,
+		"source":   celMap{"address": address},
+		"consumer": consumer,
+		"claims":   claims,
+		"shared":   &sharedValues{ctx: ctx.SharedContext},
+	}
+}
+
+// headerValue renders the result of a set-header expression
+func headerValue(v interface{}) (string, error) {
+	switch v.(type) {
+	case string, bool, int64, uint64, float64, time.Time, time.Duration:
+	default:
+		return "", fmt.Errorf("expression returned %s, which is not a header value", typeName(v))
+	}
+	s, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return "", errors.New("expression returned a value with line breaks")
+	}
+	return s, nil
+}
+
+func logFailure(ctx *RequestContext, cfg celConfig, err error) {
+	LoggerOrNop(ctx.Logger).Log(LogWarn, "expression evaluation failed", map[string]interface{}{
+		"mode":  cfg.Mode,
+		"error": err.Error(),
+	})
+}
+
+func deny(cfg celConfig) ImmediateResponse {
+	return ImmediateResponse{
+		Status:  cfg.DenyStatus,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    cfg.DenyBody,
+	}
+}
+
+func parseConfig(params map[string]interface{}) (celConfig, error) {
+	var cfg celConfig
+	var errs paramErrors
+
+	cfg.Mode, _ = params["mode"].(string)
+	cfg.Expression, _ = params["expression"].(string)
+	cfg.Header, _ = params["header"].(string)
+	cfg.DenyBody, _ = params["denyBody"].(string)
+	cfg.FailOpen, _ = params["failOpen"].(bool)
+	status, _ := params["denyStatus"].(float64)
+	cfg.DenyStatus = int(status)
+
+	switch {
+	case cfg.Mode == modeSetHeader && cfg.Header == "":
+		errs.add("header", "is required with mode set-header")
+	case cfg.Mode == modeSetHeader && !validHeaderName(cfg.Header):
+		errs.add("header", "must be a valid header name")
+	case cfg.Mode != modeSetHeader && cfg.Header != "":
+		errs.add("header", "is only used with mode set-header")
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// headerValues returns the values of a header, matching its name without
+// regard to case
+func headerValues(headers map[string][]string, name string) ([]string, bool) {
+	if values, ok := headers[name]; ok {
+		return values, true
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+package cel_policy
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "mode": {"type": "string", "enum": ["deny-if", "allow-if", "set-header"]},
+    "expression": {"type": "string", "minLength": 1},
+    "header": {"type": "string"},
+    "denyStatus": {"type": "integer", "minimum": 400, "maximum": 599, "default": 403},
+    "denyBody": {"type": "string", "default": "{\"error\": \"Forbidden\"}"},
+    "failOpen": {"type": "boolean", "default": false}
+  },
+  "required": ["mode", "expression"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
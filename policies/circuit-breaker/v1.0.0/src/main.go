@@ -0,0 +1,390 @@
+package circuit_breaker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// callKey carries a forwarded request to the response phase
+const callKey = "circuit-breaker.call"
+
+const (
+	defaultFailureRate     = 50
+	defaultMinimumRequests = 20
+	defaultWindow          = 60 * time.Second
+	defaultOpenDuration    = 30 * time.Second
+	defaultHalfOpenProbes  = 3
+
+	openResponse = `{"error": "Service unavailable"}`
+)
+
+type CircuitBreakerPolicy struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breakerConfig struct {
+	Name            string        `json:"name"`
+	FailureRate     int           `json:"failureRate"`
+	MinimumRequests int           `json:"minimumRequests"`
+	Window          time.Duration `json:"window"`
+	OpenDuration    time.Duration `json:"openDuration"`
+	HalfOpenProbes  int           `json:"halfOpenProbes"`
+	SlowCall        time.Duration `json:"slowCall"`
+	FailureStatuses []int         `json:"failureStatuses"`
+}
+
+// id identifies configurations that share a breaker
+func (cfg breakerConfig) id() string {
+	b, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// call is a request the breaker let through
+type call struct {
+	breaker *breaker
+	start   time.Time
+	probe   bool
+}
+
+// Validate configuration parameters
+func (p *CircuitBreakerPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *CircuitBreakerPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *CircuitBreakerPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	b := p.breaker(cfg)
+	now := time.Now()
+
+	probe, retryAfter, ok := b.allow(now)
+	if !ok {
+		return ImmediateResponse{
+			Status: 503,
+			Headers: map[string][]string{
+				"Content-Type": {"application/json"},
+				"Retry-After":  {strconv.FormatInt(seconds(retryAfter), 10)},
+			},
+			Body: openResponse,
+		}
+	}
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(callKey, &call{breaker: b, start: now, probe: probe})
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (p *CircuitBreakerPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	if ctx.SharedContext == nil {
+		return UpstreamResponseModifications{}
+	}
+	v, _ := ctx.SharedContext.Get(callKey)
+	c, ok := v.(*call)
+	if !ok {
+		return UpstreamResponseModifications{}
+	}
+	now := time.Now()
+	c.breaker.record(now, c.probe, c.breaker.cfg.failed(ctx.ResponseStatus, now.Sub(c.start)))
+	return UpstreamResponseModifications{}
+}
+
+// breaker returns the breaker for a configuration, creating it on first use
+func (p *CircuitBreakerPolicy) breaker(cfg breakerConfig) *breaker {
+	id := cfg.id()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.breakers[id]; ok {
+		return b
+	}
+	if p.breakers == nil {
+		p.breakers = make(map[string]*breaker)
+	}
+	b := newBreaker(cfg)
+	p.breakers[id] = b
+	return b
+}
+
+// failed reports whether an upstream answer counts against the upstream
+func (cfg breakerConfig) failed(status int, latency time.Duration) bool {
+	if cfg.SlowCall > 0 && latency > cfg.SlowCall {
+		return true
+	}
+	if cfg.FailureStatuses == nil {
+		return status >= 500 && status <= 599
+	}
+	for _, s := range cfg.FailureStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func parseConfig(params map[string]interface{}) (breakerConfig, error) {
+	cfg := breakerConfig{
+		FailureRate:     defaultFailureRate,
+		MinimumRequests: defaultMinimumRequests,
+		Window:          defaultWindow,
+		OpenDuration:    defaultOpenDuration,
+		HalfOpenProbes:  defaultHalfOpenProbes,
+	}
+
+	if v, ok := params["name"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return cfg, errors.New("name must be a string")
+		}
+		cfg.Name = s
+	}
+	for name, dst := range map[string]*int{
+		"minimumRequests":  &cfg.MinimumRequests,
+		"halfOpenRequests": &cfg.HalfOpenProbes,
+	} {
+		if v, ok := params[name]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 1 || f != float64(int(f)) {
+				return cfg, fmt.Errorf("%s must be a positive integer", name)
+			}
+			*dst = int(f)
+		}
+	}
+	if v, ok := params["failureRatePercent"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f > 100 || f != float64(int(f)) {
+			return cfg, errors.New("failureRatePercent must be an integer between 1 and 100")
+		}
+		cfg.FailureRate = int(f)
+	}
+	for name, dst := range map[string]*time.Duration{
+		"windowSeconds":       &cfg.Window,
+		"openDurationSeconds": &cfg.OpenDuration,
+	} {
+		if v, ok := params[name]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 1 || f != float64(int64(f)) {
+				return cfg, fmt.Errorf("%s must be a positive integer", name)
+			}
+			*dst = time.Duration(f) * time.Second
+		}
+	}
+	if v, ok := params["slowCallThresholdMs"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, errors.New("slowCallThresholdMs must be a non-negative integer")
+		}
+		cfg.SlowCall = time.Duration(f) * time.Millisecond
+	}
+	if v, ok := params["failureStatusCodes"]; ok {
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return cfg, errors.New("failureStatusCodes must be a non-empty list of status codes")
+		}
+		for _, item := range list {
+			f, ok := item.(float64)
+			if !ok || f < 100 || f > 599 || f != float64(int(f)) {
+				return cfg, fmt.Errorf("failureStatusCodes: %v is not a status code", item)
+			}
+			cfg.FailureStatuses = append(cfg.FailureStatuses, int(f))
+		}
+	}
+	return cfg, nil
+}
+
+// seconds rounds up, so clients never retry before the breaker half-opens
+func seconds(d time.Duration) int64 {
+	s := int64((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
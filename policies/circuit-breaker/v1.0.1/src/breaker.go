@@ -0,0 +1,147 @@
+package circuit_breaker
+
+import (
+	"sync"
+	"time"
+)
+
+type state int
+
+const (
+	// stateClosed forwards every request and counts the outcomes
+	stateClosed state = iota
+	// stateOpen rejects every request until the open duration has passed
+	stateOpen
+	// stateHalfOpen forwards a few probe requests to test the upstream
+	stateHalfOpen
+)
+
+// windowBuckets is the resolution of the failure rate window
+const windowBuckets = 10
+
+// breaker is the state machine for one upstream
+type breaker struct {
+	cfg breakerConfig
+
+	mu    sync.Mutex
+	state state
+	// since is when the current state was entered
+	since time.Time
+	// probes and successes count half-open requests in flight and succeeded
+	probes    int
+	successes int
+	window    window
+}
+
+func newBreaker(cfg breakerConfig) *breaker {
+	return &breaker{cfg: cfg, window: window{size: cfg.Window}}
+}
+
+// allow decides whether a request may be forwarded. probe is set for requests
+// forwarded while half-open; retryAfter is set for rejected requests.
+func (b *breaker) allow(now time.Time) (probe bool, retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == stateOpen {
+		if wait := b.cfg.OpenDuration - now.Sub(b.since); wait > 0 {
+			return false, wait, false
+		}
+		b.enter(stateHalfOpen, now)
+	}
+	if b.state == stateHalfOpen {
+		// Probes that never report back, e.g. because the gateway dropped
+		// the response, must not keep the breaker half-open forever
+		if b.probes > 0 && now.Sub(b.since) > b.cfg.OpenDuration {
+			b.enter(stateHalfOpen, now)
+		}
+		if b.probes+b.successes >= b.cfg.HalfOpenProbes {
+			return false, time.Second, false
+		}
+		b.probes++
+		return true, 0, true
+	}
+	return false, 0, true
+}
+
+// record counts the outcome of a forwarded request
+func (b *breaker) record(now time.Time, probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		if b.state != stateHalfOpen {
+			// The breaker has moved on since the probe was sent
+			return
+		}
+		b.probes--
+		if failed {
+			b.enter(stateOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenProbes {
+			b.enter(stateClosed, now)
+		}
+		return
+	}
+
+	if b.state != stateClosed {
+		return
+	}
+	b.window.add(now, failed)
+	total, failures := b.window.counts(now)
+	if total >= b.cfg.MinimumRequests && failures*100 >= total*b.cfg.FailureRate {
+		b.enter(stateOpen, now)
+	}
+}
+
+func (b *breaker) enter(s state, now time.Time) {
+	b.state = s
+	b.since = now
+	b.probes = 0
+	b.successes = 0
+	if s == stateClosed {
+		b.window = window{size: b.cfg.Window}
+	}
+}
+
+// window counts outcomes over a sliding period split into buckets
+type window struct {
+	size    time.Duration
+	buckets [windowBuckets]bucket
+}
+
+type bucket struct {
+	// start is the bucket's slot number; buckets from older slots are stale
+	start    int64
+	total    int
+	failures int
+}
+
+func (w *window) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(w.size/windowBuckets)
+}
+
+func (w *window) add(now time.Time, failed bool) {
+	slot := w.slot(now)
+	bk := &w.buckets[slot%windowBuckets]
+	if bk.start != slot {
+		*bk = bucket{start: slot}
+	}
+	bk.total++
+	if failed {
+		bk.failures++
+	}
+}
+
+func (w *window) counts(now time.Time) (total, failures int) {
+	slot := w.slot(now)
+	for _, bk := range w.buckets {
+		if slot-bk.start < windowBuckets {
+			total += bk.total
+			failures += bk.failures
+		}
+	}
+	return total, failures
+}
@@ -0,0 +1,539 @@
+package compression
+
+import (
+	"bytes"
+	"sort"
+)
+
+// This file is a Brotli encoder (RFC 7932). It finds matches with hash
+// chains and writes each meta-block with its own prefix codes, without block
+// splitting, context modeling or the static dictionary. That compresses a
+// little less than the reference encoder, and any Brotli decoder reads it.
+
+const (
+	brotliWindowBits = 22
+	// brotliMaxDistance is the largest backward distance the window allows
+	brotliMaxDistance = 1<<brotliWindowBits - 16
+	// brotliBlockSize is the most input one meta-block covers
+	brotliBlockSize = 1 << 20
+	brotliMinMatch  = 4
+	brotliMaxMatch  = 1 << 16
+	brotliHashBits  = 16
+)
+
+// Sizes of the prefix code alphabets with NPOSTFIX and NDIRECT zero
+const (
+	literalAlphabet  = 256
+	commandAlphabet  = 704
+	distanceAlphabet = 64
+)
+
+// brotliCommand inserts insert literals starting at pos, then copies copy
+// bytes from distance bytes back. The last command of a meta-block may have
+// no copy.
+type brotliCommand struct {
+	pos      int
+	insert   int
+	copy     int
+	distance int
+}
+
+// Base values and extra bit counts of insert and copy length codes
+var (
+	insertBase  = [24]int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	insertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	copyBase    = [24]int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	copyExtra   = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// commandCellBase gives the first command code of the cell holding insert
+// codes 8*i to 8*i+7 and copy codes 8*j to 8*j+7, among the cells that read
+// an explicit distance
+var commandCellBase = [3][3]int{{128, 192, 384}, {256, 320, 512}, {448, 576, 640}}
+
+// codeLengthOrder is the order code length code lengths are written in
+var codeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// codeLengthLengthCode is the fixed code for code length code lengths 0-5,
+// as bit values and bit counts
+var codeLengthLengthCode = [6][2]uint64{{0, 2}, {7, 4}, {3, 3}, {2, 2}, {1, 2}, {15, 4}}
+
+type bitWriter struct {
+	buf   bytes.Buffer
+	acc   uint64
+	nbits uint
+}
+
+// write appends the n low bits of v, least significant bit first
+func (w *bitWriter) write(n uint, v uint64) {
+	w.acc |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf.WriteByte(byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf.WriteByte(byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf.Bytes()
+}
+
+// brotliCompress compresses data. level 1-11 sets how many earlier
+// positions are tried for each match.
+func brotliCompress(data []byte, level int) []byte {
+	w := &bitWriter{}
+	// WBITS 22 is written as 1 followed by 22-17 in three bits
+	w.write(1, 1)
+	w.write(3, brotliWindowBits-17)
+
+	m := newMatcher(data, level)
+	for start := 0; start < len(data); start += brotliBlockSize {
+		end := min(start+brotliBlockSize, len(data))
+		writeMetaBlock(w, data, start, end, m.commands(start, end))
+	}
+	// ISLAST and ISLASTEMPTY
+	w.write(2, 3)
+	return w.bytes()
+}
+
+type matcher struct {
+	data     []byte
+	head     []int32
+	prev     []int32
+	maxChain int
+	next     int
+}
+
+func newMatcher(data []byte, level int) *matcher {
+	m := &matcher{
+		data:     data,
+		head:     make([]int32, 1<<brotliHashBits),
+		prev:     make([]int32, len(data)),
+		maxChain: 1 << (min(max(level, 1), 11) / 2),
+	}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	return m
+}
+
+func (m *matcher) hash(pos int) int {
+	d := m.data[pos:]
+	v := uint32(d[0]) | uint32(d[1])<<8 | uint32(d[2])<<16 | uint32(d[3])<<24
+	return int((v * 0x1e35a7bd) >> (32 - brotliHashBits))
+}
+
+// insert adds the positions up to pos to the hash chains
+func (m *matcher) insert(pos int) {
+	for ; m.next < pos && m.next+brotliMinMatch <= len(m.data); m.next++ {
+		h := m.hash(m.next)
+		m.prev[m.next] = m.head[h]
+		m.head[h] = int32(m.next)
+	}
+	m.next = max(m.next, pos)
+}
+
+// longest returns the longest earlier match for pos that ends before end
+func (m *matcher) longest(pos, end int) (length, distance int) {
+	if pos+brotliMinMatch > end {
+		return 0, 0
+	}
+	limit := min(end-pos, brotliMaxMatch)
+	cand := int(m.head[m.hash(pos)])
+	for chain := 0; cand >= 0 && chain < m.maxChain; chain++ {
+		if pos-cand > brotliMaxDistance {
+			break
+		}
+		if m.data[cand+length] == m.data[pos+length] || length == 0 {
+			n := 0
+			for n < limit && m.data[cand+n] == m.data[pos+n] {
+				n++
+			}
+			if n > length {
+				length, distance = n, pos-cand
+				if n == limit {
+					break
+				}
+			}
+		}
+		cand = int(m.prev[cand])
+	}
+	if length < brotliMinMatch {
+		return 0, 0
+	}
+	return length, distance
+}
+
+// commands splits data[start:end] into commands. Matches may reach back
+// into earlier blocks.
+func (m *matcher) commands(start, end int) []brotliCommand {
+	var cmds []brotliCommand
+	literals := start
+	for pos := start; pos < end; {
+		m.insert(pos)
+		length, distance := m.longest(pos, end)
+		if length == 0 {
+			pos++
+			continue
+		}
+		cmds = append(cmds, brotliCommand{pos: literals, insert: pos - literals, copy: length, distance: distance})
+		pos += length
+		literals = pos
+	}
+	if literals < end || len(cmds) == 0 {
+		cmds = append(cmds, brotliCommand{pos: literals, insert: end - literals})
+	}
+	return cmds
+}
+
+func lengthCode(n int, base []int) int {
+	code := len(base) - 1
+	for code > 0 && base[code] > n {
+		code--
+	}
+	return code
+}
+
+// commandSymbol returns the command code for an insert and copy length,
+// with the insert and copy length codes it combines
+func commandSymbol(insert, copy int) (symbol, insCode, copyCode int) {
+	insCode = lengthCode(insert, insertBase[:])
+	copyCode = lengthCode(max(copy, 2), copyBase[:])
+	symbol = commandCellBase[insCode>>3][copyCode>>3] + (insCode&7)<<3 | copyCode&7
+	return symbol, insCode, copyCode
+}
+
+// distanceSymbol returns the distance code for a distance, with its extra
+// bits. With NPOSTFIX and NDIRECT zero, codes 16 and up cover distances in
+// ranges that double in size.
+func distanceSymbol(distance int) (symbol int, nbits uint, extra uint64) {
+	x := distance + 3
+	nbits = uint(0)
+	for x>>(nbits+2) != 0 {
+		nbits++
+	}
+	prefix := (x >> nbits) & 1
+	symbol = 16 + 2*(int(nbits)-1) + prefix
+	extra = uint64(x - (2+prefix)<<nbits)
+	return symbol, nbits, extra
+}
+
+func writeMetaBlock(w *bitWriter, data []byte, start, end int, cmds []brotliCommand) {
+	literalFreq := make([]int, literalAlphabet)
+	commandFreq := make([]int, commandAlphabet)
+	distanceFreq := make([]int, distanceAlphabet)
+	for _, c := range cmds {
+		for _, b := range data[c.pos : c.pos+c.insert] {
+			literalFreq[b]++
+		}
+		sym, _, _ := commandSymbol(c.insert, c.copy)
+		commandFreq[sym]++
+		if c.copy > 0 {
+			d, _, _ := distanceSymbol(c.distance)
+			distanceFreq[d]++
+		}
+	}
+
+	// ISLAST, MNIBBLES, MLEN-1 and ISUNCOMPRESSED
+	mlen := end - start - 1
+	nibbles := uint(4)
+	for mlen>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	w.write(1, 0)
+	w.write(2, uint64(nibbles-4))
+	w.write(4*nibbles, uint64(mlen))
+	w.write(1, 0)
+	// One block type per category, NPOSTFIX and NDIRECT zero, the context
+	// mode of the literal block type, then one literal and one distance tree
+	w.write(3, 0)
+	w.write(6, 0)
+	w.write(2, 0)
+	w.write(2, 0)
+
+	literalCode := writePrefixCode(w, literalFreq, 8)
+	commandCode := writePrefixCode(w, commandFreq, 10)
+	distanceCode := writePrefixCode(w, distanceFreq, 6)
+
+	for _, c := range cmds {
+		sym, insCode, copyCode := commandSymbol(c.insert, c.copy)
+		commandCode.write(w, sym)
+		w.write(insertExtra[insCode], uint64(c.insert-insertBase[insCode]))
+		w.write(copyExtra[copyCode], uint64(max(c.copy, 2)-copyBase[copyCode]))
+		for _, b := range data[c.pos : c.pos+c.insert] {
+			literalCode.write(w, int(b))
+		}
+		if c.copy == 0 {
+			// The meta-block ends with the literals, the copy is not read
+			continue
+		}
+		d, nbits, extra := distanceSymbol(c.distance)
+		distanceCode.write(w, d)
+		w.write(nbits, extra)
+	}
+}
+
+// prefixCode holds the bit-reversed canonical code of every symbol, ready
+// to be written least significant bit first
+type prefixCode struct {
+	codes   []uint64
+	lengths []uint8
+}
+
+func (c prefixCode) write(w *bitWriter, symbol int) {
+	w.write(uint(c.lengths[symbol]), c.codes[symbol])
+}
+
+// writePrefixCode writes the prefix code for the symbol frequencies and
+// returns it. Up to four used symbols use a simple prefix code, more a
+// complex one. alphabetBits is the width of a symbol in a simple code.
+func writePrefixCode(w *bitWriter, freq []int, alphabetBits uint) prefixCode {
+	var used []int
+	for sym, f := range freq {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) == 0 {
+		// Nothing is coded, but the code must still be valid
+		used = []int{0}
+	}
+	lengths := make([]uint8, len(freq))
+
+	if len(used) <= 4 {
+		sort.Slice(used, func(i, j int) bool { return freq[used[i]] > freq[used[j]] })
+		// HSKIP 1 marks a simple code, followed by NSYM-1 and the symbols
+		w.write(2, 1)
+		w.write(2, uint64(len(used)-1))
+		for _, sym := range used {
+			w.write(alphabetBits, uint64(sym))
+		}
+		switch len(used) {
+		case 2:
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		case 3:
+			lengths[used[0]], lengths[used[1]], lengths[used[2]] = 1, 2, 2
+		case 4:
+			// Tree select 0: four codes of length 2
+			w.write(1, 0)
+			for _, sym := range used {
+				lengths[sym] = 2
+			}
+		}
+		return canonicalCode(lengths)
+	}
+
+	huffmanLengths(freq, 15, lengths)
+	writeComplexLengths(w, lengths)
+	return canonicalCode(lengths)
+}
+
+// codeLengthSymbol is one symbol of the code length alphabet: a length 0-15,
+// 16 to repeat the previous length 3-6 times or 17 to repeat zero 3-10
+// times, with its extra bits
+type codeLengthSymbol struct {
+	symbol int
+	extra  uint64
+}
+
+// writeComplexLengths writes the code lengths of a complex prefix code
+func writeComplexLengths(w *bitWriter, lengths []uint8) {
+	last := len(lengths) - 1
+	for lengths[last] == 0 {
+		last--
+	}
+	// Runs are coded as a length and a repeat. A repeat never directly
+	// follows a repeat of the same kind, whose counts would be combined.
+	var symbols []codeLengthSymbol
+	for i := 0; i <= last; {
+		l := lengths[i]
+		run := 1
+		for i+run <= last && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run > 0 {
+				switch {
+				case run >= 3:
+					n := min(run, 10)
+					symbols = append(symbols, codeLengthSymbol{17, uint64(n - 3)})
+					run -= n
+					if run > 0 {
+						symbols = append(symbols, codeLengthSymbol{0, 0})
+						run--
+					}
+				default:
+					symbols = append(symbols, codeLengthSymbol{0, 0})
+					run--
+				}
+			}
+			continue
+		}
+		for run > 0 {
+			symbols = append(symbols, codeLengthSymbol{int(l), 0})
+			run--
+			if run >= 3 {
+				n := min(run, 6)
+				symbols = append(symbols, codeLengthSymbol{16, uint64(n - 3)})
+				run -= n
+			}
+		}
+	}
+
+	freq := make([]int, 18)
+	for _, s := range symbols {
+		freq[s.symbol]++
+	}
+	clLengths := make([]uint8, 18)
+	used := 0
+	for _, f := range freq {
+		if f > 0 {
+			used++
+		}
+	}
+	if used == 1 {
+		// A single code length symbol takes no bits
+		for sym, f := range freq {
+			if f > 0 {
+				clLengths[sym] = 1
+			}
+		}
+	} else {
+		huffmanLengths(freq, 5, clLengths)
+	}
+
+	// HSKIP 0, then the code length code lengths until they fill the code
+	w.write(2, 0)
+	space := 32
+	for _, sym := range codeLengthOrder {
+		l := clLengths[sym]
+		w.write(uint(codeLengthLengthCode[l][1]), codeLengthLengthCode[l][0])
+		if l != 0 && used > 1 {
+			space -= 32 >> l
+			if space == 0 {
+				break
+			}
+		}
+	}
+
+	if used == 1 {
+		clLengths = make([]uint8, 18)
+	}
+	clCode := canonicalCode(clLengths)
+	for _, s := range symbols {
+		clCode.write(w, s.symbol)
+		switch s.symbol {
+		case 16:
+			w.write(2, s.extra)
+		case 17:
+			w.write(3, s.extra)
+		}
+	}
+}
+
+// huffmanLengths sets the code lengths of a Huffman code for the
+// frequencies, at most maxLen long. At least two frequencies must be
+// non-zero. Frequencies are flattened until the code fits.
+func huffmanLengths(freq []int, maxLen int, lengths []uint8) {
+	f := append([]int(nil), freq...)
+	for {
+		if buildHuffman(f, maxLen, lengths) {
+			return
+		}
+		for i := range f {
+			if f[i] > 0 {
+				f[i] = max(1, f[i]/2)
+			}
+		}
+	}
+}
+
+type huffmanNode struct {
+	weight      int
+	symbol      int
+	left, right *huffmanNode
+}
+
+// buildHuffman computes Huffman code lengths and reports whether they fit
+// in maxLen
+func buildHuffman(freq []int, maxLen int, lengths []uint8) bool {
+	var leaves []*huffmanNode
+	for sym, f := range freq {
+		if f > 0 {
+			leaves = append(leaves, &huffmanNode{weight: f, symbol: sym})
+		}
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].weight < leaves[j].weight })
+	// Two queues: leaves in weight order and merged nodes, which are
+	// created in weight order
+	var merged []*huffmanNode
+	pop := func() *huffmanNode {
+		if len(merged) == 0 || len(leaves) > 0 && leaves[0].weight <= merged[0].weight {
+			n := leaves[0]
+			leaves = leaves[1:]
+			return n
+		}
+		n := merged[0]
+		merged = merged[1:]
+		return n
+	}
+	for len(leaves)+len(merged) > 1 {
+		a, b := pop(), pop()
+		merged = append(merged, &huffmanNode{weight: a.weight + b.weight, symbol: -1, left: a, right: b})
+	}
+	for i := range lengths {
+		lengths[i] = 0
+	}
+	ok := true
+	var walk func(n *huffmanNode, depth int)
+	walk = func(n *huffmanNode, depth int) {
+		if n.symbol >= 0 {
+			if depth > maxLen {
+				ok = false
+			}
+			lengths[n.symbol] = uint8(depth)
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(pop(), 0)
+	return ok
+}
+
+// canonicalCode assigns canonical codes to code lengths: shorter codes
+// first, and symbols in order within a length
+func canonicalCode(lengths []uint8) prefixCode {
+	var count [16]uint64
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [16]uint64
+	code := uint64(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	c := prefixCode{codes: make([]uint64, len(lengths)), lengths: lengths}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		v := next[l]
+		next[l]++
+		var rev uint64
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (v>>i)&1
+		}
+		c.codes[sym] = rev
+	}
+	return c
+}
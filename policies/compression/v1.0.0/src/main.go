@@ -0,0 +1,695 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// acceptEncodingKey holds the client's Accept-Encoding for the response
+// phase, which does not see the request headers
+const acceptEncodingKey = "compression.acceptEncoding"
+
+// requestEncodings are the request content codings the policy decodes
+const requestEncodings = "gzip, deflate"
+
+type CompressionPolicy struct{}
+
+type compressionConfig struct {
+	DecompressRequests   bool
+	MaxDecompressedBytes int64
+	CompressResponses    bool
+	// Encodings are the response codings in order of preference
+	Encodings    []string
+	MinSizeBytes int
+	ContentTypes []string
+	GzipLevel    int
+	BrotliLevel  int
+}
+
+// Validate configuration parameters
+func (p *CompressionPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *CompressionPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *CompressionPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	var mods UpstreamRequestModifications
+	if cfg.CompressResponses {
+		if values, ok := headerValues(ctx.Headers, "Accept-Encoding"); ok {
+			ctx.SharedContext.Set(acceptEncodingKey, strings.Join(values, ","))
+		}
+		// The upstream answers uncompressed, so that policies reading the
+		// response body see plain content; this policy compresses it last
+		mods.RemoveHeaders = append(mods.RemoveHeaders, "Accept-Encoding")
+	}
+
+	if !cfg.DecompressRequests {
+		return mods
+	}
+	values, _ := headerValues(ctx.Headers, "Content-Encoding")
+	codings := contentCodings(values)
+	if len(codings) == 0 || ctx.Body == nil || ctx.Body.Stream() != nil {
+		return mods
+	}
+	for _, coding := range codings {
+		if !decodable(coding) {
+			return ImmediateResponse{
+				Status: 415,
+				Headers: map[string][]string{
+					"Content-Type":    {"application/json"},
+					"Accept-Encoding": {requestEncodings},
+				},
+				Body: `{"error": "Unsupported Content-Encoding"}`,
+			}
+		}
+	}
+	body, err := decompress(ctx.Body.Bytes(), codings, cfg.MaxDecompressedBytes)
+	switch {
+	case errors.Is(err, errTooLarge):
+		return ImmediateResponse{
+			Status:  413,
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    `{"error": "Decompressed request body is too large"}`,
+		}
+	case err != nil:
+		return ImmediateResponse{
+			Status:  400,
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    `{"error": "Invalid compressed request body"}`,
+		}
+	}
+	mods.Body = body
+	mods.RemoveHeaders = append(mods.RemoveHeaders, "Content-Encoding")
+	return mods
+}
+
+// Response phase execution
+func (p *CompressionPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil || !cfg.CompressResponses || !cfg.compressible(ctx) {
+		return UpstreamResponseModifications{}
+	}
+
+	// Caches must keep compressed and plain variants apart, whichever one
+	// this client gets
+	var mods UpstreamResponseModifications
+	if !varies(ctx.ResponseHeaders) {
+		mods.HeaderOps = append(mods.HeaderOps, HeaderOp{Op: HeaderOpAppend, Name: "Vary", Value: "Accept-Encoding"})
+	}
+	accept, _ := SharedValue[string](ctx.SharedContext, acceptEncodingKey)
+	encoding := chooseEncoding(accept, cfg.Encodings)
+	if encoding == "" {
+		return mods
+	}
+	body := ctx.ResponseBody.Bytes()
+	out, err := cfg.compress(encoding, body)
+	if err != nil || len(out) >= len(body) {
+		// Content that does not get smaller is sent as it is
+		return mods
+	}
+	mods.Body = out
+	mods.HeaderOps = append(mods.HeaderOps, HeaderOp{Op: HeaderOpSet, Name: "Content-Encoding", Value: encoding})
+	// The encoded body is a different representation, so a strong ETag of
+	// the plain one no longer applies to it byte for byte
+	if etag := headerValue(ctx.ResponseHeaders, "ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		mods.HeaderOps = append(mods.HeaderOps, HeaderOp{Op: HeaderOpSet, Name: "ETag", Value: "W/" + etag})
+	}
+	return mods
+}
+
+// compressible reports whether a response may be compressed: a complete,
+// unencoded body of a compressible type and at least MinSizeBytes long
+func (cfg compressionConfig) compressible(ctx *ResponseContext) bool {
+	switch status := ctx.ResponseStatus; {
+	case status < 200, status == 204, status == 206, status == 304:
+		return false
+	}
+	body := ctx.ResponseBody
+	if body == nil || body.Stream() != nil || len(body.Bytes()) == 0 || len(body.Bytes()) < cfg.MinSizeBytes {
+		return false
+	}
+	values, _ := headerValues(ctx.ResponseHeaders, "Content-Encoding")
+	if len(contentCodings(values)) > 0 {
+		return false
+	}
+	for _, directive := range strings.Split(headerValue(ctx.ResponseHeaders, "Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return false
+		}
+	}
+	contentType := body.ContentType()
+	if contentType == "" {
+		contentType = headerValue(ctx.ResponseHeaders, "Content-Type")
+	}
+	mediaType := baseMediaType(contentType)
+	for _, pattern := range cfg.ContentTypes {
+		if matchMediaType(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg compressionConfig) compress(encoding string, body []byte) ([]byte, error) {
+	if encoding == "br" {
+		return brotliCompress(body, cfg.BrotliLevel), nil
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	if encoding == "gzip" {
+		w, err = gzip.NewWriterLevel(&buf, cfg.GzipLevel)
+	} else {
+		w, err = zlib.NewWriterLevel(&buf, cfg.GzipLevel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var errTooLarge = errors.New("decompressed body exceeds the limit")
+
+// decompress undoes the content codings, which were applied in the order
+// listed
+func decompress(body []byte, codings []string, limit int64) ([]byte, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			r = zr
+		case "deflate":
+			// deflate is meant to be zlib framed, but some clients send raw
+			// deflate data
+			zr, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r = flate.NewReader(bytes.NewReader(body))
+			} else {
+				r = zr
+			}
+		default:
+			continue
+		}
+		out, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > limit {
+			return nil, errTooLarge
+		}
+		body = out
+	}
+	return body, nil
+}
+
+func decodable(coding string) bool {
+	switch coding {
+	case "gzip", "x-gzip", "deflate", "identity":
+		return true
+	}
+	return false
+}
+
+// contentCodings lists the codings of Content-Encoding header values in
+// lower case, leaving out identity
+func contentCodings(values []string) []string {
+	var codings []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// chooseEncoding returns the encoding the client accepts with the highest
+// quality, preferring encodings in the configured order among equals, or ""
+func chooseEncoding(accept string, encodings []string) string {
+	quality := map[string]float64{}
+	for _, item := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		quality[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := quality[encoding]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// varies reports whether the Vary header already covers Accept-Encoding
+func varies(headers map[string][]string) bool {
+	values, _ := headerValues(headers, "Vary")
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchMediaType matches a media type against a pattern such as text/html,
+// text/* or application/*+json
+func matchMediaType(pattern, mediaType string) bool {
+	pt, ps, _ := strings.Cut(strings.ToLower(pattern), "/")
+	mt, ms, ok := strings.Cut(mediaType, "/")
+	if !ok || pt != mt && pt != "*" {
+		return false
+	}
+	switch {
+	case ps == "*":
+		return true
+	case strings.HasPrefix(ps, "*+"):
+		return strings.HasSuffix(ms, ps[1:])
+	}
+	return ps == ms
+}
+
+// parseConfig reads the settings after the schema has checked them
+func parseConfig(params map[string]interface{}) (compressionConfig, error) {
+	var cfg compressionConfig
+	var errs paramErrors
+
+	cfg.DecompressRequests, _ = params["decompressRequests"].(bool)
+	cfg.CompressResponses, _ = params["compressResponses"].(bool)
+	maxBytes, _ := params["maxDecompressedBytes"].(float64)
+	minSize, _ := params["minSizeBytes"].(float64)
+	gzipLevel, _ := params["gzipLevel"].(float64)
+	brotliLevel, _ := params["brotliLevel"].(float64)
+	cfg.MaxDecompressedBytes = int64(maxBytes)
+	cfg.MinSizeBytes = int(minSize)
+	cfg.GzipLevel = int(gzipLevel)
+	cfg.BrotliLevel = int(brotliLevel)
+
+	encodings, _ := params["encodings"].([]interface{})
+	for i, item := range encodings {
+		s, _ := item.(string)
+		if containsParam(cfg.Encodings, s) {
+			errs.add(fmt.Sprintf("encodings[%d]", i), fmt.Sprintf("duplicates %q", s))
+		}
+		cfg.Encodings = append(cfg.Encodings, s)
+	}
+	types, _ := params["contentTypes"].([]interface{})
+	for i, item := range types {
+		s, _ := item.(string)
+		typ, sub, ok := strings.Cut(s, "/")
+		if !ok || typ == "" || sub == "" || strings.ContainsAny(s, " ;") {
+			errs.add(fmt.Sprintf("contentTypes[%d]", i), "must be a media type such as text/html, text/* or application/*+json")
+		}
+		cfg.ContentTypes = append(cfg.ContentTypes, s)
+	}
+	if !cfg.DecompressRequests && !cfg.CompressResponses {
+		errs.add("compressResponses", "must be true when decompressRequests is false")
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// baseMediaType returns the media type of a Content-Type value without its
+// parameters, in lower case
+func baseMediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// headerValues returns the values of a header, matching its name without
+// regard to case
+func headerValues(headers map[string][]string, name string) ([]string, bool) {
+	if values, ok := headers[name]; ok {
+		return values, true
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// headerValue returns the first value of a header
+func headerValue(headers map[string][]string, name string) string {
+	if values, _ := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package compression
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "decompressRequests": {"type": "boolean", "default": true},
+    "maxDecompressedBytes": {"type": "integer", "minimum": 1, "default": 10485760},
+    "compressResponses": {"type": "boolean", "default": true},
+    "encodings": {
+      "type": "array",
+      "minItems": 1,
+      "items": {"type": "string", "enum": ["br", "gzip", "deflate"]},
+      "default": ["br", "gzip"]
+    },
+    "minSizeBytes": {"type": "integer", "minimum": 0, "default": 1024},
+    "contentTypes": {
+      "type": "array",
+      "minItems": 1,
+      "items": {"type": "string", "minLength": 1},
+      "default": ["text/*", "application/json", "application/*+json", "application/javascript", "application/xml", "application/*+xml", "image/svg+xml"]
+    },
+    "gzipLevel": {"type": "integer", "minimum": 1, "maximum": 9, "default": 6},
+    "brotliLevel": {"type": "integer", "minimum": 1, "maximum": 11, "default": 5}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,93 @@
+package concurrency_limit
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter tracks the requests in flight for every key of one configuration
+type limiter struct {
+	mu sync.Mutex
+	// keys maps each key to the deadlines of its requests in flight, by slot
+	keys      map[string]map[uint64]time.Time
+	nextID    uint64
+	nextSweep time.Time
+}
+
+// slot is held by a forwarded request until its response is seen
+type slot struct {
+	limiter *limiter
+	key     string
+	id      uint64
+}
+
+func newLimiter() *limiter {
+	return &limiter{keys: make(map[string]map[uint64]time.Time)}
+}
+
+// acquire takes a slot for key if fewer than limit requests are in flight.
+// Slots held for longer than hold are taken to belong to requests whose
+// response never reached the policy and are freed; expired reports how many.
+func (l *limiter) acquire(key string, limit int, hold time.Duration, now time.Time) (s *slot, expired int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Keys whose only slots were never released are dropped now and then,
+	// so they do not accumulate
+	if now.After(l.nextSweep) {
+		for k, slots := range l.keys {
+			expired += l.expire(k, slots, now)
+		}
+		l.nextSweep = now.Add(hold)
+	}
+
+	slots := l.keys[key]
+	if len(slots) >= limit {
+		expired += l.expire(key, slots, now)
+		slots = l.keys[key]
+	}
+	if len(slots) >= limit {
+		return nil, expired
+	}
+	if slots == nil {
+		slots = make(map[uint64]time.Time)
+		l.keys[key] = slots
+	}
+	l.nextID++
+	slots[l.nextID] = now.Add(hold)
+	return &slot{limiter: l, key: key, id: l.nextID}, expired
+}
+
+// expire frees the slots of key whose deadline has passed. The caller holds
+// the lock.
+func (l *limiter) expire(key string, slots map[uint64]time.Time, now time.Time) int {
+	n := 0
+	for id, deadline := range slots {
+		if !now.Before(deadline) {
+			delete(slots, id)
+			n++
+		}
+	}
+	if len(slots) == 0 {
+		delete(l.keys, key)
+	}
+	return n
+}
+
+// release frees the slot. It reports false if the slot was already freed,
+// by an earlier release or because it was held too long.
+func (s *slot) release() bool {
+	l := s.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots := l.keys[s.key]
+	if _, ok := slots[s.id]; !ok {
+		return false
+	}
+	delete(slots, s.id)
+	if len(slots) == 0 {
+		delete(l.keys, s.key)
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package concurrency_limit
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "maxConcurrent": {"type": "integer", "minimum": 1},
+    "key": {"type": "string", "enum": ["global", "consumer", "route"], "default": "global"},
+    "name": {"type": "string", "default": ""},
+    "retryAfterSeconds": {"type": "integer", "minimum": 1, "maximum": 3600, "default": 1},
+    "maxHoldSeconds": {"type": "integer", "minimum": 1, "maximum": 86400, "default": 300}
+  },
+  "required": ["maxConcurrent"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
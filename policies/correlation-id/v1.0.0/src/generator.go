@@ -0,0 +1,96 @@
+package correlation_id
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// generator names the format of generated IDs
+type generator string
+
+const (
+	// generatorUUID produces random version 4 UUIDs
+	generatorUUID generator = "uuid"
+	// generatorULID produces ULIDs, which sort by creation time
+	generatorULID generator = "ulid"
+	// generatorTrace produces W3C trace IDs, reusing the trace ID of an
+	// incoming traceparent header when there is one
+	generatorTrace generator = "trace"
+)
+
+// crockford is the ULID alphabet
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g generator) generate(headers map[string][]string) string {
+	switch g {
+	case generatorULID:
+		return newULID(time.Now())
+	case generatorTrace:
+		if id, ok := traceParentID(headerValue(headers, "traceparent")); ok {
+			return id
+		}
+		return newTraceID()
+	}
+	return newUUID()
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// newULID encodes a 48-bit millisecond timestamp followed by 80 random bits
+// as 26 Crockford base32 characters
+func newULID(now time.Time) string {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(now.UnixMilli()))
+	copy(b[:6], ms[2:])
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	// 128 bits in 26 characters leaves two unused bits at the top
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func newTraceID() string {
+	var b [16]byte
+	for {
+		rand.Read(b[:])
+		// An all-zero trace ID is invalid
+		if b != ([16]byte{}) {
+			return hex.EncodeToString(b[:])
+		}
+	}
+}
+
+// traceParentID extracts the trace ID from a W3C traceparent header of the
+// form version-traceid-parentid-flags
+func traceParentID(header string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 {
+		return "", false
+	}
+	id := parts[1]
+	if strings.Trim(id, "0") == "" || strings.ToLower(id) != id {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,119 @@
+package correlation_id
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// generator names the format of generated IDs
+type generator string
+
+const (
+	// generatorUUID produces random version 4 UUIDs
+	generatorUUID generator = "uuid"
+	// generatorULID produces ULIDs, which sort by creation time
+	generatorULID generator = "ulid"
+	// generatorTrace produces W3C trace IDs, reusing the trace ID of an
+	// incoming traceparent header when there is one
+	generatorTrace generator = "trace"
+)
+
+// crockford is the ULID alphabet
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g generator) generate(headers map[string][]string) string {
+	switch g {
+	case generatorULID:
+		return newULID(time.Now())
+	case generatorTrace:
+		if id, ok := traceParentID(headerValue(headers, "traceparent")); ok {
+			return id
+		}
+		return newTraceID()
+	}
+	return newUUID()
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	// Encoded in place rather than with fmt, so the string is the only
+	// allocation
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:16])
+	return string(out[:])
+}
+
+// newULID encodes a 48-bit millisecond timestamp followed by 80 random bits
+// as 26 Crockford base32 characters
+func newULID(now time.Time) string {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(now.UnixMilli()))
+	copy(b[:6], ms[2:])
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	// 128 bits in 26 characters leaves two unused bits at the top
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func newTraceID() string {
+	var b [16]byte
+	for {
+		rand.Read(b[:])
+		// An all-zero trace ID is invalid
+		if b != ([16]byte{}) {
+			var out [32]byte
+			hex.Encode(out[:], b[:])
+			return string(out[:])
+		}
+	}
+}
+
+// traceParentID extracts the trace ID from a W3C traceparent header of the
+// form version-traceid-parentid-flags. The ID is a substring of the header,
+// so nothing is allocated.
+func traceParentID(header string) (string, bool) {
+	h := strings.TrimSpace(header)
+	// Later versions may add fields, so only the first four are checked
+	if len(h) < 36 || h[2] != '-' || h[35] != '-' || strings.Count(h[36:], "-") < 1 {
+		return "", false
+	}
+	if version := h[:2]; version == "ff" || strings.IndexByte(version, '-') >= 0 {
+		return "", false
+	}
+	id := h[3:35]
+	zero := true
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", false
+		}
+		zero = zero && c == '0'
+	}
+	if zero {
+		return "", false
+	}
+	return id, true
+}
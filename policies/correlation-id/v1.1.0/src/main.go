@@ -0,0 +1,509 @@
+package correlation_id
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Compiler is implemented by policies that read their parameters once, when
+// a route is configured, rather than on every request. The gateway calls
+// Compile after Validate succeeds and runs the phases of the CompiledPolicy
+// in place of OnRequest and OnResponse, so the parameters map is not decoded
+// and type-asserted on the hot path. OnRequest and OnResponse remain for
+// gateways that do not compile policies.
+type Compiler interface {
+	Compile(params map[string]interface{}) (CompiledPolicy, error)
+}
+
+// CompiledPolicy is a policy bound to the parameters of one route. Every
+// request of the route shares it, so it must be safe for concurrent use. The
+// gateway only reads the actions it returns, so a phase may return the same
+// *UpstreamRequestModifications for every request and allocate nothing.
+type CompiledPolicy interface {
+	OnRequest(ctx *RequestContext) RequestAction
+	OnResponse(ctx *ResponseContext) ResponseAction
+}
+
+// idKey records the correlation ID in the SharedContext for the response
+// phase and for later policies
+const idKey = "correlation.id"
+
+const (
+	defaultHeaderName = "X-Correlation-ID"
+
+	// maxClientIDLength bounds client-supplied IDs, which end up in logs
+	maxClientIDLength = 200
+)
+
+type CorrelationIDPolicy struct{}
+
+type idConfig struct {
+	HeaderName        string
+	Generator         generator
+	OverrideClientID  bool
+	IncludeInResponse bool
+}
+
+// compiledID is the policy bound to the parameters of one route
+type compiledID struct {
+	cfg idConfig
+}
+
+// Returned when the message keeps its headers, so that passing an ID on
+// allocates nothing
+var (
+	unchangedRequest  = &UpstreamRequestModifications{}
+	unchangedResponse = &UpstreamResponseModifications{}
+)
+
+// requestIDOp and responseIDOp hold a modification together with its single
+// operation, so that setting the ID takes one allocation
+type requestIDOp struct {
+	mods UpstreamRequestModifications
+	ops  [1]HeaderOp
+}
+
+type responseIDOp struct {
+	mods UpstreamResponseModifications
+	ops  [1]HeaderOp
+}
+
+var _ Compiler = (*CorrelationIDPolicy)(nil)
+
+// Validate configuration parameters
+func (p *CorrelationIDPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *CorrelationIDPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Compile parameters once per route
+func (p *CorrelationIDPolicy) Compile(params map[string]interface{}) (CompiledPolicy, error) {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledID{cfg: cfg}, nil
+}
+
+// Request phase execution
+func (p *CorrelationIDPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	return (&compiledID{cfg: cfg}).OnRequest(ctx)
+}
+
+// Response phase execution
+func (p *CorrelationIDPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	return (&compiledID{cfg: cfg}).OnResponse(ctx)
+}
+
+func (c *compiledID) OnRequest(ctx *RequestContext) RequestAction {
+	id := headerValue(ctx.Headers, c.cfg.HeaderName)
+	if !c.cfg.OverrideClientID && validClientID(id) {
+		// The upstream already receives the client's ID
+		ctx.SharedContext.Set(idKey, id)
+		return unchangedRequest
+	}
+	id = c.cfg.Generator.generate(ctx.Headers)
+	ctx.SharedContext.Set(idKey, id)
+	m := &requestIDOp{}
+	m.ops[0] = HeaderOp{Op: HeaderOpSet, Name: c.cfg.HeaderName, Value: id}
+	m.mods.HeaderOps = m.ops[:]
+	return &m.mods
+}
+
+func (c *compiledID) OnResponse(ctx *ResponseContext) ResponseAction {
+	if !c.cfg.IncludeInResponse {
+		return unchangedResponse
+	}
+	id, ok := SharedValue[string](ctx.SharedContext, idKey)
+	if !ok || id == "" {
+		return unchangedResponse
+	}
+	m := &responseIDOp{}
+	m.ops[0] = HeaderOp{Op: HeaderOpSet, Name: c.cfg.HeaderName, Value: id}
+	m.mods.HeaderOps = m.ops[:]
+	return &m.mods
+}
+
+func parseConfig(params map[string]interface{}) (idConfig, error) {
+	cfg := idConfig{
+		HeaderName:        defaultHeaderName,
+		Generator:         generatorUUID,
+		IncludeInResponse: true,
+	}
+
+	if v, ok := params["headerName"]; ok {
+		s, ok := v.(string)
+		if !ok || !validHeaderName(s) {
+			return cfg, errors.New("headerName must be a valid header name")
+		}
+		cfg.HeaderName = s
+	}
+	if v, ok := params["generator"]; ok {
+		s, _ := v.(string)
+		switch generator(s) {
+		case generatorUUID, generatorULID, generatorTrace:
+			cfg.Generator = generator(s)
+		default:
+			return cfg, fmt.Errorf("generator must be one of: %s, %s, %s", generatorUUID, generatorULID, generatorTrace)
+		}
+	}
+	for name, dst := range map[string]*bool{
+		"overrideClientId":  &cfg.OverrideClientID,
+		"includeInResponse": &cfg.IncludeInResponse,
+	} {
+		if v, ok := params[name]; ok {
+			b, ok := v.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a boolean", name)
+			}
+			*dst = b
+		}
+	}
+	return cfg, nil
+}
+
+// validClientID reports whether a client-supplied ID may be passed on. IDs
+// that are too long or contain spaces or control characters are replaced so
+// they cannot corrupt log lines.
+func validClientID(id string) bool {
+	if id == "" || len(id) > maxClientIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// originMatcher decides whether a request Origin is allowed
+type originMatcher interface {
+	matches(origin string) bool
+}
+
+// exactOrigin matches one origin. Scheme and host are case-insensitive.
+type exactOrigin string
+
+func (o exactOrigin) matches(origin string) bool {
+	return strings.EqualFold(string(o), origin)
+}
+
+// wildcardOrigin matches origins such as https://*.example.com, where the
+// wildcard stands for one or more subdomain labels.
+type wildcardOrigin struct {
+	prefix string
+	suffix string
+}
+
+func (o wildcardOrigin) matches(origin string) bool {
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(o.prefix)+len(o.suffix) ||
+		!strings.HasPrefix(origin, o.prefix) || !strings.HasSuffix(origin, o.suffix) {
+		return false
+	}
+	for _, r := range origin[len(o.prefix) : len(origin)-len(o.suffix)] {
+		// Only host characters, so the wildcard cannot swallow a port or path
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// originPattern matches the whole origin against a regular expression
+type originPattern struct {
+	re *regexp.Regexp
+}
+
+func (o *originPattern) matches(origin string) bool {
+	return o.re.MatchString(origin)
+}
+
+func parseOrigin(s string) (originMatcher, error) {
+	if s == "" {
+		return nil, errors.New("origin must not be empty")
+	}
+	if s == "null" {
+		return exactOrigin(s), nil
+	}
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return nil, fmt.Errorf("origin %q must start with http:// or https://", s)
+	}
+	if strings.HasSuffix(s, "/") {
+		return nil, fmt.Errorf("origin %q must not end with a slash", s)
+	}
+
+	switch strings.Count(s, "*") {
+	case 0:
+		return exactOrigin(s), nil
+	case 1:
+		s = strings.ToLower(s)
+		i := strings.Index(s, "*")
+		prefix, suffix := s[:i], s[i+1:]
+		if !strings.HasSuffix(prefix, "://") || !strings.HasPrefix(suffix, ".") {
+			return nil, fmt.Errorf("origin %q: the wildcard must be the leading host label, e.g. https://*.example.com", s)
+		}
+		return wildcardOrigin{prefix: prefix, suffix: suffix}, nil
+	}
+	return nil, fmt.Errorf("origin %q may contain at most one wildcard", s)
+}
+
+// compilePattern anchors expr so it has to match the whole origin
+func compilePattern(expr string) (*originPattern, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", expr, err)
+	}
+	return &originPattern{re: re}, nil
+}
@@ -0,0 +1,585 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// originKey carries the accepted origin of an actual request to the response phase
+const originKey = "cors.origin"
+
+var defaultAllowedMethods = []string{"GET", "HEAD", "POST"}
+
+type CORSPolicy struct {
+	mu       sync.Mutex
+	patterns map[string]*originPattern
+}
+
+type corsConfig struct {
+	Origins          []originMatcher
+	AnyOrigin        bool
+	Methods          []string
+	Headers          []string
+	AnyHeader        bool
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+// Validate configuration parameters
+func (c *CORSPolicy) Validate(params map[string]interface{}) error {
+	_, err := c.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (c *CORSPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (c *CORSPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	origin := headerValue(ctx.Headers, "Origin")
+	if origin == "" {
+		// Not a cross-origin request
+		return UpstreamRequestModifications{}
+	}
+
+	cfg, err := c.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	allowed := cfg.allowsOrigin(origin)
+
+	requestMethod := headerValue(ctx.Headers, "Access-Control-Request-Method")
+	if strings.EqualFold(ctx.Method, "OPTIONS") && requestMethod != "" {
+		return cfg.preflight(origin, allowed, requestMethod, headerValue(ctx.Headers, "Access-Control-Request-Headers"))
+	}
+
+	if allowed {
+		ctx.SharedContext.Set(originKey, origin)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (c *CORSPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	origin, ok := SharedValue[string](ctx.SharedContext, originKey)
+	if !ok || origin == "" {
+		return UpstreamResponseModifications{}
+	}
+
+	cfg, err := c.parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+
+	headers := cfg.originHeaders(origin)
+	if len(cfg.ExposedHeaders) > 0 {
+		headers["Access-Control-Expose-Headers"] = strings.Join(cfg.ExposedHeaders, ", ")
+	}
+	if vary, ok := headers["Vary"]; ok {
+		headers["Vary"] = mergeVary(headerValues(ctx.ResponseHeaders, "Vary"), vary)
+	}
+	return UpstreamResponseModifications{SetHeaders: headers}
+}
+
+// preflight answers an OPTIONS preflight request without calling the upstream
+func (cfg corsConfig) preflight(origin string, allowed bool, method, requestHeaders string) ImmediateResponse {
+	if !allowed || !contains(cfg.Methods, method) {
+		return ImmediateResponse{Status: 403}
+	}
+	requested := splitList(requestHeaders)
+	if !cfg.AnyHeader {
+		for _, h := range requested {
+			if !containsFold(cfg.Headers, h) {
+				return ImmediateResponse{Status: 403}
+			}
+		}
+	}
+
+	headers := map[string][]string{}
+	for k, v := range cfg.originHeaders(origin) {
+		headers[k] = []string{v}
+	}
+	headers["Access-Control-Allow-Methods"] = []string{strings.Join(cfg.Methods, ", ")}
+	if cfg.AnyHeader {
+		if len(requested) > 0 {
+			headers["Access-Control-Allow-Headers"] = []string{strings.Join(requested, ", ")}
+		}
+	} else if len(cfg.Headers) > 0 {
+		headers["Access-Control-Allow-Headers"] = []string{strings.Join(cfg.Headers, ", ")}
+	}
+	if cfg.MaxAge > 0 {
+		headers["Access-Control-Max-Age"] = []string{strconv.Itoa(cfg.MaxAge)}
+	}
+	// The answer depends on the requested method and headers as well
+	vary := "Access-Control-Request-Method, Access-Control-Request-Headers"
+	if v, ok := headers["Vary"]; ok {
+		vary = v[0] + ", " + vary
+	}
+	headers["Vary"] = []string{vary}
+	return ImmediateResponse{Status: 204, Headers: headers}
+}
+
+// originHeaders returns the headers shared by preflight and actual responses
+func (cfg corsConfig) originHeaders(origin string) map[string]string {
+	headers := map[string]string{}
+	if cfg.AnyOrigin && !cfg.AllowCredentials {
+		headers["Access-Control-Allow-Origin"] = "*"
+	} else {
+		// Echoing the origin makes the response differ per origin
+		headers["Access-Control-Allow-Origin"] = origin
+		headers["Vary"] = "Origin"
+	}
+	if cfg.AllowCredentials {
+		headers["Access-Control-Allow-Credentials"] = "true"
+	}
+	return headers
+}
+
+func (cfg corsConfig) allowsOrigin(origin string) bool {
+	if cfg.AnyOrigin {
+		return true
+	}
+	for _, m := range cfg.Origins {
+		if m.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSPolicy) parseConfig(params map[string]interface{}) (corsConfig, error) {
+	cfg := corsConfig{Methods: defaultAllowedMethods, AnyHeader: true}
+
+	origins, err := stringList(params, "allowedOrigins")
+	if err != nil {
+		return cfg, err
+	}
+	patterns, err := stringList(params, "allowedOriginPatterns")
+	if err != nil {
+		return cfg, err
+	}
+	if len(origins) == 0 && len(patterns) == 0 {
+		return cfg, errors.New("allowedOrigins or allowedOriginPatterns must list at least one origin")
+	}
+	for _, o := range origins {
+		if o == "*" {
+			cfg.AnyOrigin = true
+			continue
+		}
+		m, err := parseOrigin(o)
+		if err != nil {
+			return cfg, fmt.Errorf("allowedOrigins: %v", err)
+		}
+		cfg.Origins = append(cfg.Origins, m)
+	}
+	for _, p := range patterns {
+		m, err := c.pattern(p)
+		if err != nil {
+			return cfg, fmt.Errorf("allowedOriginPatterns: %v", err)
+		}
+		cfg.Origins = append(cfg.Origins, m)
+	}
+
+	if _, ok := params["allowedMethods"]; ok {
+		if cfg.Methods, err = stringList(params, "allowedMethods"); err != nil {
+			return cfg, err
+		}
+		for i, m := range cfg.Methods {
+			if m == "" || strings.ContainsAny(m, " ,\t") {
+				return cfg, fmt.Errorf("allowedMethods: invalid method %q", m)
+			}
+			cfg.Methods[i] = strings.ToUpper(m)
+		}
+	}
+	if _, ok := params["allowedHeaders"]; ok {
+		headers, err := stringList(params, "allowedHeaders")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.AnyHeader = false
+		for _, h := range headers {
+			if h == "*" {
+				cfg.AnyHeader = true
+				continue
+			}
+			cfg.Headers = append(cfg.Headers, h)
+		}
+	}
+	if cfg.ExposedHeaders, err = stringList(params, "exposedHeaders"); err != nil {
+		return cfg, err
+	}
+
+	if v, ok := params["allowCredentials"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("allowCredentials must be a boolean")
+		}
+		cfg.AllowCredentials = b
+	}
+	if cfg.AllowCredentials && cfg.AnyOrigin {
+		// Browsers reject "*" with credentials, and echoing every origin would
+		// let any site read authenticated responses
+		return cfg, errors.New(`allowCredentials cannot be combined with allowedOrigins "*"`)
+	}
+
+	if v, ok := params["maxAgeSeconds"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, errors.New("maxAgeSeconds must be a non-negative integer")
+		}
+		cfg.MaxAge = int(f)
+	}
+	return cfg, nil
+}
+
+// pattern compiles an origin regex once per policy instance
+func (c *CORSPolicy) pattern(expr string) (*originPattern, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.patterns[expr]; ok {
+		return p, nil
+	}
+	p, err := compilePattern(expr)
+	if err != nil {
+		return nil, err
+	}
+	if c.patterns == nil {
+		c.patterns = make(map[string]*originPattern)
+	}
+	c.patterns[expr] = p
+	return p, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	if values, ok := headers[name]; ok {
+		return values
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// mergeVary adds fields to the upstream Vary header instead of replacing it
+func mergeVary(existing []string, fields string) string {
+	var out []string
+	for _, v := range existing {
+		for _, f := range splitList(v) {
+			if f == "*" {
+				return "*"
+			}
+			if !containsFold(out, f) {
+				out = append(out, f)
+			}
+		}
+	}
+	for _, f := range splitList(fields) {
+		if !containsFold(out, f) {
+			out = append(out, f)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
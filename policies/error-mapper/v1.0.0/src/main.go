@@ -0,0 +1,821 @@
+package error_mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+	// Metrics is nil when the gateway does not collect metrics, see
+	// MetricsOrNop
+	Metrics Metrics
+	// Span is nil when the gateway does not trace requests, see SpanOrNop
+	Span Span
+	// Logger is nil when the gateway does not take policy logs, see
+	// LoggerOrNop
+	Logger Logger
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+	Metrics         Metrics
+	Span            Span
+	Logger          Logger
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+	// TraceContextKey holds the TraceContext of the request as set by the
+	// tracing policy. Gateways that trace requests continue that trace.
+	TraceContextKey = "trace.context"
+)
+
+// Parameters every policy accepts without declaring them. The gateway handles
+// them itself and removes them before calling Validate, Init, Compile,
+// OnRequest or OnResponse, so policy-definition.yaml must not declare them.
+const (
+	// EnforcementModeParam decides what happens to an ImmediateResponse, and
+	// is EnforcementEnforce or EnforcementShadow
+	EnforcementModeParam = "enforcementMode"
+	// EnforcementEnforce, the default, sends an ImmediateResponse to the client
+	EnforcementEnforce = "enforce"
+	// EnforcementShadow holds an ImmediateResponse back and carries on as if
+	// the policy had returned no modifications, so operators can try rules on
+	// live traffic. The gateway counts the response in ShadowBlocksMetric,
+	// labelled with the policy and status, writes a log record and, in the
+	// request phase, adds WouldBlockHeader to the upstream request with a
+	// value such as "rate-limiter; status=429". Policies run as they do in
+	// enforce mode, so their own metrics count the response they returned.
+	EnforcementShadow = "shadow"
+
+	WouldBlockHeader   = "X-Policy-Would-Block"
+	ShadowBlocksMetric = "policy_shadow_blocks_total"
+
+	// OnErrorParam decides what happens when a phase returns a PolicyError or
+	// panics, and is OnErrorReject, OnErrorContinue or OnErrorRetry. The
+	// gateway logs every failure and counts it in PolicyErrorsMetric,
+	// labelled with the policy, the phase and the kind: error, panic or
+	// circuit_open.
+	OnErrorParam = "onError"
+	// OnErrorReject, the default, fails closed: the client gets
+	// PolicyErrorStatus with {"error": "Policy failed"}. In shadow mode the
+	// response is held back like a policy's own.
+	OnErrorReject = "reject"
+	// OnErrorContinue fails open: the message carries on unchanged
+	OnErrorContinue = "continue"
+	// OnErrorRetry calls the phase once more and rejects when it fails again
+	OnErrorRetry = "retry"
+	// ErrorCircuitParam stops calling a phase that keeps failing. It is an
+	// object with failures, the number of failures in a row that opens the
+	// circuit, and openSeconds, how long it stays open. Each phase of a
+	// policy instance has a circuit of its own. While it is open the phase
+	// fails without calling the policy, so onError still decides whether
+	// requests pass, and PolicyCircuitMetric, labelled with the policy and
+	// phase, is 1. The first call after that closes the circuit if it
+	// succeeds and opens it again if not.
+	ErrorCircuitParam = "errorCircuit"
+
+	PolicyErrorStatus   = 500
+	PolicyErrorsMetric  = "policy_errors_total"
+	PolicyCircuitMetric = "policy_circuit_open"
+)
+
+// PolicyError is the action of a phase that could not do its job, e.g.
+// because a store or key server the policy depends on is unreachable. The
+// gateway handles it, and panics in OnRequest and OnResponse, as the
+// OnErrorParam of the policy instance says. Policies that have a safe
+// fallback of their own, such as a failOpen parameter, keep returning that.
+type PolicyError struct {
+	Err error
+}
+
+func (e PolicyError) Error() string {
+	if e.Err == nil {
+		return "policy error"
+	}
+	return e.Err.Error()
+}
+
+// Metrics creates the instruments a policy records measurements with. The
+// gateway hands each policy instance its own Metrics and exports what is
+// recorded, e.g. to Prometheus, labelled with the policy name and version,
+// so policies only add labels of their own. Names follow the Prometheus
+// conventions, such as rate_limiter_requests_total. Asking again for an
+// instrument with the same name and labels returns the same one.
+type Metrics interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	// Histogram uses buckets as upper bounds; nil chooses default buckets
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Labels are label names with their values. Every instrument of one name
+// must use the same label names.
+type Labels map[string]string
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter interface {
+	// Add increases the counter; negative deltas are ignored
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// MetricsOrNop returns m, or a Metrics whose instruments discard everything
+// when m is nil because the gateway does not collect metrics
+func MetricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, Labels) Counter { return nopInstrument{} }
+
+func (nopMetrics) Gauge(string, string, Labels) Gauge { return nopInstrument{} }
+
+func (nopMetrics) Histogram(string, string, []float64, Labels) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64) {}
+
+func (nopInstrument) Set(float64) {}
+
+func (nopInstrument) Observe(float64) {}
+
+// Span is the trace span the gateway records for a policy execution.
+// Policies add attributes and events to it; starting, ending and exporting
+// spans, e.g. over OTLP, is left to the gateway.
+type Span interface {
+	// SetAttribute records a string, bool, int64 or float64 value
+	SetAttribute(key string, value interface{})
+	// AddEvent records a timestamped event; attributes may be nil
+	AddEvent(name string, attributes map[string]interface{})
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// TraceContext returns the IDs of the span, e.g. to log them
+	TraceContext() TraceContext
+}
+
+// TraceContext identifies a span in the terms of W3C Trace Context
+type TraceContext struct {
+	// TraceID is 32 and SpanID 16 lowercase hex characters
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// State is the vendor data of the tracestate header, if any
+	State string
+}
+
+// SpanOrNop returns s, or a Span that discards everything when s is nil
+// because the gateway does not trace requests
+func SpanOrNop(s Span) Span {
+	if s == nil {
+		return nopSpan{}
+	}
+	return s
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) AddEvent(string, map[string]interface{}) {}
+
+func (nopSpan) RecordError(error) {}
+
+func (nopSpan) TraceContext() TraceContext { return TraceContext{} }
+
+// Logger writes structured log records through the gateway's logging, which
+// adds the policy name and version and the request's trace ID. Fields hold
+// values that encode as JSON; secrets do not belong in them.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LogLevel is the severity of a log record
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo  LogLevel = "info"
+	LogWarn  LogLevel = "warn"
+	LogError LogLevel = "error"
+)
+
+// LoggerOrNop returns l, or a Logger that discards everything when l is nil
+// because the gateway does not take policy logs
+func LoggerOrNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, map[string]interface{}) {}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+	// Timeout bounds how long the gateway waits for the upstream response
+	// when non-zero. Once it passes, the gateway cancels the upstream request
+	// and answers 504; the response phase then runs with ResponseStatus 504.
+	// Adapters that cannot enforce it keep the route's own timeout.
+	Timeout time.Duration
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Compiler is implemented by policies that read their parameters once, when
+// a route is configured, rather than on every request. The gateway calls
+// Compile after Validate succeeds and runs the phases of the CompiledPolicy
+// in place of OnRequest and OnResponse, so the parameters map is not decoded
+// and type-asserted on the hot path. OnRequest and OnResponse remain for
+// gateways that do not compile policies.
+type Compiler interface {
+	Compile(params map[string]interface{}) (CompiledPolicy, error)
+}
+
+// CompiledPolicy is a policy bound to the parameters of one route. Every
+// request of the route shares it, so it must be safe for concurrent use. The
+// gateway only reads the actions it returns, so a phase may return the same
+// *UpstreamRequestModifications for every request and allocate nothing.
+type CompiledPolicy interface {
+	OnRequest(ctx *RequestContext) RequestAction
+	OnResponse(ctx *ResponseContext) ResponseAction
+}
+
+// The gateway creates one policy value per policy instance, i.e. per route
+// and set of parameters, and calls it in this order:
+//
+//	Validate, Init, Compile, OnRequest and OnResponse for every request, Close
+//
+// Init and Close are optional. A policy that keeps state, such as counters,
+// caches or connections, builds it in Init and releases it in Close, so the
+// phases neither create state lazily nor race to do so. Policies that must
+// still run on gateways without these hooks keep creating state on first use
+// when Init was not called.
+
+// Initializer is implemented by policies that set up state for their
+// instance. The gateway calls Init once, with the parameters Validate
+// accepted and before the first request, and drops the instance if it
+// returns an error. Init may start goroutines, e.g. to refresh a key set or
+// evict cache entries, that run until Close. It should not fail because a
+// remote service is unreachable; the phases report that per request.
+type Initializer interface {
+	Init(params map[string]interface{}) error
+}
+
+// Closer is implemented by policies that release resources when their
+// instance is removed, because the route changed or the gateway shuts down.
+// The gateway calls Close once, after Init succeeded and the last request of
+// the instance completed, and logs the error it returns. Close stops the
+// goroutines Init started.
+type Closer interface {
+	Close() error
+}
+
+// pathKey records the request path in the SharedContext for the instance
+// member of the response phase
+const pathKey = "error-mapper.path"
+
+// correlationIDKey is where the correlation-id policy keeps the ID of the
+// request
+const correlationIDKey = "correlation.id"
+
+const (
+	problemContentType = "application/problem+json"
+	// mappedMetric counts rewritten responses by upstream status
+	mappedMetric = "error_mapper_responses_total"
+)
+
+var (
+	unchangedRequest  = &UpstreamRequestModifications{}
+	unchangedResponse = &UpstreamResponseModifications{}
+)
+
+var _ Compiler = (*ErrorMapperPolicy)(nil)
+
+type ErrorMapperPolicy struct{}
+
+type mapperConfig struct {
+	Mappings             []*mapping
+	DetailFields         []string
+	IncludeInstance      bool
+	IncludeCorrelationID bool
+}
+
+// mapping rewrites the responses whose status is one of Statuses
+type mapping struct {
+	// Statuses holds codes such as "502" and classes such as "5xx"
+	Statuses []string
+	// Status replaces the upstream status when non-zero
+	Status int
+	Type   string
+	// Title is the reason phrase of the status sent when empty
+	Title  string
+	Detail string
+	// extensions are the extension members, encoded as ,"name":value
+	extensions []byte
+}
+
+// compiledMapper is the policy bound to the parameters of one route
+type compiledMapper struct {
+	cfg mapperConfig
+}
+
+// Validate configuration parameters
+func (p *ErrorMapperPolicy) Validate(params map[string]interface{}) error {
+	_, err := p.compile(params)
+	return err
+}
+
+// Compile parameters once per route
+func (p *ErrorMapperPolicy) Compile(params map[string]interface{}) (CompiledPolicy, error) {
+	c, err := p.compile(params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *ErrorMapperPolicy) compile(params map[string]interface{}) (*compiledMapper, error) {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledMapper{cfg: cfg}, nil
+}
+
+// Declare processing behavior
+func (p *ErrorMapperPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *ErrorMapperPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	c, err := p.compile(params)
+	if err != nil {
+		return unchangedRequest
+	}
+	return c.OnRequest(ctx)
+}
+
+// Response phase execution
+func (p *ErrorMapperPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	c, err := p.compile(params)
+	if err != nil {
+		return unchangedResponse
+	}
+	return c.OnResponse(ctx)
+}
+
+// OnRequest records the path for the instance member
+func (c *compiledMapper) OnRequest(ctx *RequestContext) RequestAction {
+	if c.cfg.IncludeInstance && ctx.SharedContext != nil {
+		path, _, _ := strings.Cut(ctx.Path, "?")
+		ctx.SharedContext.Set(pathKey, path)
+	}
+	return unchangedRequest
+}
+
+// OnResponse replaces the body of a mapped error response with a problem
+// document. The upstream body is never forwarded, so stack traces and other
+// internals it holds do not reach the client.
+func (c *compiledMapper) OnResponse(ctx *ResponseContext) ResponseAction {
+	m := c.cfg.match(ctx.ResponseStatus)
+	if m == nil {
+		return unchangedResponse
+	}
+	pr := problem{status: ctx.ResponseStatus, detail: m.Detail}
+	if m.Status != 0 {
+		pr.status = m.Status
+	}
+	if pr.detail == "" && len(c.cfg.DetailFields) > 0 {
+		pr.detail = upstreamDetail(ctx.ResponseBody.Bytes(), c.cfg.DetailFields)
+	}
+	if c.cfg.IncludeInstance {
+		pr.instance, _ = SharedValue[string](ctx.SharedContext, pathKey)
+	}
+	if c.cfg.IncludeCorrelationID {
+		pr.correlationID, _ = SharedValue[string](ctx.SharedContext, correlationIDKey)
+	}
+	MetricsOrNop(ctx.Metrics).Counter(mappedMetric, "Upstream error responses rewritten as problem details",
+		Labels{"status": strconv.Itoa(ctx.ResponseStatus)}).Add(1)
+
+	mods := &UpstreamResponseModifications{
+		HeaderOps: []HeaderOp{
+			{Op: HeaderOpSet, Name: "Content-Type", Value: problemContentType},
+			// The new body is not encoded like the upstream's
+			{Op: HeaderOpRemove, Name: "Content-Encoding"},
+		},
+		Body: m.render(pr),
+	}
+	if pr.status != ctx.ResponseStatus {
+		mods.Status = pr.status
+	}
+	return mods
+}
+
+// match returns the first mapping for status, or nil. The status is
+// formatted on the stack, so responses that pass allocate nothing.
+func (cfg mapperConfig) match(status int) *mapping {
+	var buf [20]byte
+	code := strconv.AppendInt(buf[:0], int64(status), 10)
+	for _, m := range cfg.Mappings {
+		for _, s := range m.Statuses {
+			if s == string(code) || len(code) == 3 && s[0] == code[0] && s[1:] == "xx" {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func parseConfig(params map[string]interface{}) (mapperConfig, error) {
+	var cfg mapperConfig
+	var errs paramErrors
+
+	mappings, _ := params["mappings"].([]interface{})
+	for i, raw := range mappings {
+		obj, _ := raw.(map[string]interface{})
+		cfg.Mappings = append(cfg.Mappings, parseMapping(obj, fmt.Sprintf("mappings[%d]", i), &errs))
+	}
+	fields, _ := params["detailFields"].([]interface{})
+	for i, v := range fields {
+		name, _ := v.(string)
+		if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+			errs.add(fmt.Sprintf("detailFields[%d]", i), "must be a member name such as message, or a path such as error.message")
+			continue
+		}
+		cfg.DetailFields = append(cfg.DetailFields, name)
+	}
+	cfg.IncludeInstance, _ = params["includeInstance"].(bool)
+	cfg.IncludeCorrelationID, _ = params["includeCorrelationId"].(bool)
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+func parseMapping(obj map[string]interface{}, path string, errs *paramErrors) *mapping {
+	m := &mapping{Type: "about:blank"}
+	statuses, _ := obj["statuses"].([]interface{})
+	for i, v := range statuses {
+		var status string
+		switch v := v.(type) {
+		case float64:
+			status = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			status = strings.ToLower(v)
+		}
+		if !validErrorStatus(status) {
+			errs.add(fmt.Sprintf("%s.statuses[%d]", path, i), "must be an error status such as 502 or a class such as 5xx")
+			continue
+		}
+		m.Statuses = append(m.Statuses, status)
+	}
+	if f, ok := obj["status"].(float64); ok {
+		m.Status = int(f)
+	}
+	if t, ok := obj["type"].(string); ok {
+		if _, err := url.Parse(t); err != nil || t == "" {
+			errs.add(path+".type", "must be a URI reference")
+		}
+		m.Type = t
+	}
+	m.Title, _ = obj["title"].(string)
+	m.Detail, _ = obj["detail"].(string)
+
+	extensions, _ := obj["extensions"].(map[string]interface{})
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reservedMembers[name] {
+			errs.add(path+".extensions."+name, "is a member the policy sets itself")
+			continue
+		}
+		value, err := json.Marshal(extensions[name])
+		if err != nil {
+			errs.add(path+".extensions."+name, "cannot be encoded as JSON")
+			continue
+		}
+		m.extensions = append(m.extensions, ',')
+		m.extensions = appendJSONString(m.extensions, name)
+		m.extensions = append(m.extensions, ':')
+		m.extensions = append(m.extensions, value...)
+	}
+	return m
+}
+
+// validErrorStatus accepts the codes and classes of client and server errors
+func validErrorStatus(s string) bool {
+	if len(s) != 3 || s[0] != '4' && s[0] != '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	return s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
@@ -0,0 +1,108 @@
+package error_mapper
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDetailLength bounds the detail taken from an upstream body, in
+// characters
+const maxDetailLength = 200
+
+// reservedMembers are the members of RFC 7807 problem documents and those
+// the policy adds, which extensions cannot replace
+var reservedMembers = map[string]bool{
+	"type":          true,
+	"title":         true,
+	"status":        true,
+	"detail":        true,
+	"instance":      true,
+	"correlationId": true,
+}
+
+// problem holds what differs between responses of one mapping
+type problem struct {
+	status        int
+	detail        string
+	instance      string
+	correlationID string
+}
+
+// render writes the problem document: the standard members in the order
+// of RFC 7807, then correlationId and the extension members
+func (m *mapping) render(p problem) []byte {
+	title := m.Title
+	if title == "" {
+		title = http.StatusText(p.status)
+	}
+	b := make([]byte, 0, 96+len(m.Type)+len(title)+len(p.detail)+len(p.instance)+len(m.extensions))
+	b = append(b, `{"type":`...)
+	b = appendJSONString(b, m.Type)
+	b = append(b, `,"title":`...)
+	b = appendJSONString(b, title)
+	b = append(b, `,"status":`...)
+	b = strconv.AppendInt(b, int64(p.status), 10)
+	if p.detail != "" {
+		b = append(b, `,"detail":`...)
+		b = appendJSONString(b, p.detail)
+	}
+	if p.instance != "" {
+		b = append(b, `,"instance":`...)
+		b = appendJSONString(b, p.instance)
+	}
+	if p.correlationID != "" {
+		b = append(b, `,"correlationId":`...)
+		b = appendJSONString(b, p.correlationID)
+	}
+	b = append(b, m.extensions...)
+	return append(b, '}')
+}
+
+func appendJSONString(b []byte, s string) []byte {
+	quoted, _ := json.Marshal(s)
+	return append(b, quoted...)
+}
+
+// upstreamDetail returns the first of fields that is a string member of the
+// JSON object in body, such as message or error.message. Only its first line
+// is kept, since stack traces and other internals usually follow it, and it
+// is cut to maxDetailLength characters. Bodies that are not JSON give none.
+func upstreamDetail(body []byte, fields []string) string {
+	var doc map[string]interface{}
+	if len(body) == 0 || json.Unmarshal(body, &doc) != nil {
+		return ""
+	}
+	for _, field := range fields {
+		var v interface{} = doc
+		for _, name := range strings.Split(field, ".") {
+			obj, _ := v.(map[string]interface{})
+			v = obj[name]
+		}
+		s, _ := v.(string)
+		if line := firstLine(s); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexAny(s, "\r\n"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= maxDetailLength {
+		return s
+	}
+	n := 0
+	for i := range s {
+		if n == maxDetailLength {
+			return strings.TrimSpace(s[:i]) + "…"
+		}
+		n++
+	}
+	return s
+}
@@ -0,0 +1,33 @@
+package error_mapper
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "mappings": {
+      "type": "array",
+      "minItems": 1,
+      "default": [{"statuses": ["5xx"]}],
+      "items": {
+        "type": "object",
+        "properties": {
+          "statuses": {"type": "array", "minItems": 1, "items": {"type": ["integer", "string"]}},
+          "status": {"type": "integer", "minimum": 400, "maximum": 599},
+          "type": {"type": "string", "default": "about:blank"},
+          "title": {"type": "string"},
+          "detail": {"type": "string"},
+          "extensions": {"type": "object"}
+        },
+        "required": ["statuses"],
+        "additionalProperties": false
+      }
+    },
+    "detailFields": {"type": "array", "default": [], "items": {"type": "string"}},
+    "includeInstance": {"type": "boolean", "default": true},
+    "includeCorrelationId": {"type": "boolean", "default": true}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
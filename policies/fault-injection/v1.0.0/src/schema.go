@@ -0,0 +1,31 @@
+package fault_injection
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "delay": {
+      "type": "object",
+      "properties": {
+        "durationMs": {"type": "integer", "minimum": 1, "maximum": 60000},
+        "percentage": {"type": "number", "minimum": 0, "maximum": 100, "default": 100}
+      },
+      "required": ["durationMs"]
+    },
+    "abort": {
+      "type": "object",
+      "properties": {
+        "percentage": {"type": "number", "minimum": 0, "maximum": 100},
+        "status": {"type": "integer", "minimum": 100, "maximum": 599, "default": 503},
+        "body": {"type": "string", "default": "{\"error\": \"Fault injected\"}"},
+        "retryAfterSeconds": {"type": "integer", "minimum": 0}
+      },
+      "required": ["percentage"]
+    },
+    "seed": {"type": "integer"}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
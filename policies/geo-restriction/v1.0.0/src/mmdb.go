@@ -0,0 +1,363 @@
+package geo_restriction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMetadataSize is how far from the end of the file the marker may be
+const maxMetadataSize = 128 << 10
+
+// dataSeparator is the number of zero bytes between the search tree and the
+// data section
+const dataSeparator = 16
+
+// maxDataDepth bounds the nesting of maps and arrays, so a corrupt file
+// cannot exhaust the stack
+const maxDataDepth = 64
+
+var errCorrupt = errors.New("corrupt MaxMind DB file")
+
+// mmdb is a database in the MaxMind DB format, as GeoIP2, GeoLite2 and the
+// MMDB editions of IP2Location use. See
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// Type is the database_type of the metadata, e.g. GeoLite2-Country
+	Type string
+	// data is the data section that records point into
+	data []byte
+	// ipv4Start is the node IPv4 lookups start from in an IPv6 tree, the
+	// one reached by 96 zero bits
+	ipv4Start uint
+}
+
+func openMMDB(buf []byte) (*mmdb, error) {
+	start := len(buf) - maxMetadataSize
+	if start < 0 {
+		start = 0
+	}
+	i := bytes.LastIndex(buf[start:], metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file: metadata not found")
+	}
+	metaStart := start + i + len(metadataMarker)
+	d := decoder{data: buf[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("reading metadata: not a map")
+	}
+
+	db := &mmdb{buf: buf}
+	db.nodeCount, _ = metaUint(meta, "node_count")
+	db.recordSize, _ = metaUint(meta, "record_size")
+	db.ipVersion, _ = metaUint(meta, "ip_version")
+	db.Type, _ = meta["database_type"].(string)
+	if major, _ := metaUint(meta, "binary_format_major_version"); major != 2 {
+		return nil, fmt.Errorf("unsupported MaxMind DB format version %d", major)
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+dataSeparator > uint(start+i) {
+		return nil, errCorrupt
+	}
+	db.data = buf[treeSize+dataSeparator : start+i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func metaUint(meta map[string]interface{}, key string) (uint, bool) {
+	v, ok := meta[key].(uint64)
+	return uint(v), ok
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a node
+func (db *mmdb) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	b := db.buf[node*8+bit*4:]
+	return uint(binary.BigEndian.Uint32(b))
+}
+
+// lookup returns the record of the network that contains ip, or nil when
+// the database has none
+func (db *mmdb) lookup(ip netip.Addr) (map[string]interface{}, error) {
+	ip = ip.Unmap()
+	var bits []byte
+	node := uint(0)
+	switch {
+	case ip.Is4() && db.ipVersion == 6:
+		b := ip.As4()
+		bits, node = b[:], db.ipv4Start
+	case ip.Is4():
+		b := ip.As4()
+		bits = b[:]
+	case db.ipVersion == 4:
+		// An IPv4 database knows nothing of IPv6 addresses
+		return nil, nil
+	default:
+		b := ip.As16()
+		bits = b[:]
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		// The address ran out before the tree did
+		return nil, errCorrupt
+	}
+	offset := node - db.nodeCount - dataSeparator
+	if offset >= uint(len(db.data)) {
+		return nil, errCorrupt
+	}
+	d := decoder{data: db.data}
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder reads values of a data section. Maps decode to
+// map[string]interface{}, arrays to []interface{}, unsigned integers to
+// uint64, int32 to int64 and uint128 to *big.Int.
+type decoder struct {
+	data []byte
+}
+
+// decode reads the value at offset and returns it with the offset after it
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDataDepth {
+		return nil, 0, errCorrupt
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		// Decoding goes on after the pointer, not after the value it
+		// points to, which is never another pointer
+		ptyp, psize, poffset, err := d.control(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ptyp == typePointer {
+			return nil, 0, errCorrupt
+		}
+		v, _, err := d.value(ptyp, psize, poffset, depth)
+		return v, offset, err
+	}
+	return d.value(typ, size, offset, depth)
+}
+
+// control reads a control byte and the extended type and size bytes after
+// it. For pointers, size is the offset pointed to.
+func (d decoder) control(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, errCorrupt
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		n := uint(ctrl>>3&0x3) + 1
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		var p uint
+		switch n {
+		case 1:
+			p = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 2:
+			p = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			p = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		return typ, p, offset + n, nil
+	}
+	if typ == typeExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + int(b[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		v := uint(0)
+		for _, c := range b {
+			v = v<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[n-1] + v
+		offset += n
+	}
+	return typ, size, offset, nil
+}
+
+func (d decoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.data)) || offset+n < offset {
+		return nil, errCorrupt
+	}
+	return d.data[offset : offset+n], nil
+}
+
+func (d decoder) value(typ int, size, offset uint, depth int) (interface{}, uint, error) {
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > map[int]uint{typeUint16: 2, typeUint32: 4, typeUint64: 8}[typ] {
+			return nil, 0, errCorrupt
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupt
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(v)), offset, nil
+		}
+		return int64(v), offset, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errCorrupt
+		}
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	// Containers and end markers only appear in data caches, never in
+	// records and metadata
+	return nil, 0, errCorrupt
+}
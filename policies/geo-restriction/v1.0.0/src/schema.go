@@ -0,0 +1,27 @@
+package geo_restriction
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "databasePath": {"type": "string", "minLength": 1},
+    "asnDatabasePath": {"type": "string", "minLength": 1},
+    "allowCountries": {"type": "array", "items": {"type": "string"}, "default": []},
+    "denyCountries": {"type": "array", "items": {"type": "string"}, "default": []},
+    "allowAsns": {"type": "array", "items": {"type": "integer", "minimum": 1}, "default": []},
+    "denyAsns": {"type": "array", "items": {"type": "integer", "minimum": 1}, "default": []},
+    "unknownAction": {"type": "string", "enum": ["allow", "deny"], "default": "allow"},
+    "clientIpSource": {"type": "string", "enum": ["remoteAddr", "xForwardedFor"], "default": "remoteAddr"},
+    "trustedProxyDepth": {"type": "integer", "minimum": 1, "default": 1},
+    "addHeaders": {"type": "boolean", "default": false},
+    "reloadIntervalSeconds": {"type": "integer", "minimum": 0, "default": 60},
+    "countryField": {"type": "string", "minLength": 1, "default": "country.iso_code"},
+    "blockedStatus": {"type": "integer", "minimum": 400, "maximum": 599, "default": 403},
+    "blockedBody": {"type": "string", "default": "{\"error\": \"Access from your location is not allowed\"}"}
+  },
+  "required": ["databasePath"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
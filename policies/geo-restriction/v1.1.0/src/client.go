@@ -0,0 +1,64 @@
+package geo_restriction
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const (
+	sourceRemoteAddr    = "remoteAddr"
+	sourceXForwardedFor = "xForwardedFor"
+)
+
+// clientIP returns the address of the caller. An address resolved by an
+// earlier policy, such as the IP Restriction Policy, is used as it is.
+func (cfg geoConfig) clientIP(ctx *RequestContext) (netip.Addr, bool) {
+	if s, ok := SharedValue[string](ctx.SharedContext, clientIPKey); ok {
+		if ip, ok := parseAddr(s); ok {
+			return ip, true
+		}
+	}
+	if cfg.ClientIPSource != sourceXForwardedFor {
+		return parseAddr(ctx.RemoteAddr)
+	}
+	// Each of the depth trusted proxies in front of the gateway appends one
+	// entry, so the client is the depth-th entry from the right; anything
+	// further left can be forged by the caller.
+	hops := forwardedHops(ctx.Headers)
+	if len(hops) < cfg.TrustedProxyDepth {
+		return netip.Addr{}, false
+	}
+	return parseAddr(hops[len(hops)-cfg.TrustedProxyDepth])
+}
+
+func forwardedHops(headers map[string][]string) []string {
+	var hops []string
+	for k, values := range headers {
+		if !strings.EqualFold(k, "X-Forwarded-For") {
+			continue
+		}
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseAddr accepts a bare address or host:port, as found in RemoteAddr
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
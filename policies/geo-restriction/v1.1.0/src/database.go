@@ -0,0 +1,109 @@
+package geo_restriction
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// retryInterval is how soon a file that failed to load is tried again
+const retryInterval = 10 * time.Second
+
+// database keeps a MaxMind DB file loaded and reloads it when the file
+// changes. Changes are looked for at most once per reload interval, on the
+// request path, so an idle gateway keeps no timers.
+type database struct {
+	path string
+	// loadMu is held while the file is read
+	loadMu sync.Mutex
+
+	mu      sync.Mutex
+	db      *mmdb
+	modTime time.Time
+	size    int64
+	// next is when the file is looked at again
+	next time.Time
+}
+
+// get returns the loaded database, or nil while none could be loaded. The
+// first load makes callers wait; a reload happens while other requests go
+// on with the loaded version. err reports a failed load to the caller that
+// attempted it.
+func (d *database) get(now time.Time, interval time.Duration) (*mmdb, error) {
+	d.mu.Lock()
+	db, due := d.db, !now.Before(d.next)
+	d.mu.Unlock()
+	if !due {
+		return db, nil
+	}
+	if db == nil {
+		d.loadMu.Lock()
+	} else if !d.loadMu.TryLock() {
+		return db, nil
+	}
+	defer d.loadMu.Unlock()
+	return d.reload(now, interval)
+}
+
+// reload reads the file if it changed since it was loaded. A file that
+// cannot be read leaves the loaded version in use.
+func (d *database) reload(now time.Time, interval time.Duration) (*mmdb, error) {
+	d.mu.Lock()
+	db, modTime, size, due := d.db, d.modTime, d.size, !now.Before(d.next)
+	d.mu.Unlock()
+	if !due {
+		// Loaded by the caller this one waited for
+		return db, nil
+	}
+
+	info, err := os.Stat(d.path)
+	if err == nil && db != nil && info.ModTime().Equal(modTime) && info.Size() == size {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.next = nextCheck(now, interval)
+		return db, nil
+	}
+	var loaded *mmdb
+	if err == nil {
+		var buf []byte
+		if buf, err = os.ReadFile(d.path); err == nil {
+			loaded, err = openMMDB(buf)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.next = now.Add(min(retryInterval, nextCheck(now, interval).Sub(now)))
+		return d.db, err
+	}
+	d.db, d.modTime, d.size = loaded, info.ModTime(), info.Size()
+	d.next = nextCheck(now, interval)
+	return loaded, nil
+}
+
+// load reads the file now, for Init
+func (d *database) load(now time.Time, interval time.Duration) error {
+	d.loadMu.Lock()
+	defer d.loadMu.Unlock()
+	_, err := d.reload(now, interval)
+	return err
+}
+
+// close drops the loaded file. A request still holding it finishes its
+// lookup.
+func (d *database) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.db, d.modTime, d.size, d.next = nil, time.Time{}, 0, time.Time{}
+}
+
+// nextCheck is when a loaded file is looked at again. An interval of 0
+// turns reloading off.
+func nextCheck(now time.Time, interval time.Duration) time.Time {
+	if interval == 0 {
+		// Far enough to never come
+		return now.AddDate(100, 0, 0)
+	}
+	return now.Add(interval)
+}
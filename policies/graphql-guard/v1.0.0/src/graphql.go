@@ -0,0 +1,599 @@
+package graphql_guard
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file parses GraphQL executable documents (operations and fragments)
+// as specified in https://spec.graphql.org/October2021/. Only what the
+// limits need is kept: the shape of selection sets, aliases and integer
+// arguments. Schema definitions are rejected, servers do not execute them.
+
+// maxNesting bounds how deeply selection sets, lists and objects may nest
+// before parsing stops, whatever the configured depth limit is
+const maxNesting = 256
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	name       string
+	selections []*selection
+}
+
+type fragment struct {
+	name       string
+	selections []*selection
+}
+
+type selectionKind int
+
+const (
+	selectionField selectionKind = iota
+	selectionSpread
+	selectionInline
+)
+
+type selection struct {
+	kind selectionKind
+	// name is the field name, or the fragment name of a spread
+	name  string
+	alias string
+	args  []argument
+	// selections are the sub-selections of a field or inline fragment
+	selections []*selection
+}
+
+// argument keeps an argument's integer value or the variable it refers to,
+// the only values the limits look at
+type argument struct {
+	name     string
+	intValue *int64
+	variable string
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	// Whitespace, commas and comments are insignificant
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return l.token()
+		}
+	}
+	return token{kind: tokenEOF, pos: l.pos}, nil
+}
+
+func (l *lexer) token() (token, error) {
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: tokenPunct, value: "...", pos: start}, nil
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		l.pos++
+		return token{kind: tokenPunct, value: string(c), pos: start}, nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokenName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		return l.string()
+	}
+	return token{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	digits := l.digits()
+	if digits == 0 {
+		return token{}, fmt.Errorf("invalid number at offset %d", start)
+	}
+	kind := tokenInt
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.pos++
+		if l.digits() == 0 {
+			return token{}, fmt.Errorf("invalid number at offset %d", start)
+		}
+		kind = tokenFloat
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if l.digits() == 0 {
+			return token{}, fmt.Errorf("invalid number at offset %d", start)
+		}
+		kind = tokenFloat
+	}
+	return token{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+}
+
+func (l *lexer) digits() int {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+// string skips over a string or block string. Its content does not matter
+// to the limits, so escapes are not decoded.
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		l.pos += 3
+		for l.pos < len(l.src) {
+			switch {
+			case strings.HasPrefix(l.src[l.pos:], `\"""`):
+				l.pos += 4
+			case strings.HasPrefix(l.src[l.pos:], `"""`):
+				l.pos += 3
+				return token{kind: tokenString, pos: start}, nil
+			default:
+				l.pos++
+			}
+		}
+		return token{}, fmt.Errorf("unterminated block string at offset %d", start)
+	}
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+		case '"':
+			l.pos++
+			return token{kind: tokenString, pos: start}, nil
+		case '\n', '\r':
+			return token{}, fmt.Errorf("unterminated string at offset %d", start)
+		default:
+			l.pos++
+		}
+	}
+	return token{}, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+type parser struct {
+	lex     lexer
+	tok     token
+	nesting int
+}
+
+// parseDocument parses a query document
+func parseDocument(src string) (*document, error) {
+	p := &parser{lex: lexer{src: src}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunct, "{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{selections: sel})
+		case p.peek(tokenName, "query"), p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(tokenName, "fragment"):
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[f.name]; dup {
+				return nil, fmt.Errorf("fragment %q is defined more than once", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected("an operation or fragment")
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("the document contains no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+// skip consumes the token if it matches
+func (p *parser) skip(kind tokenKind, value string) (bool, error) {
+	if !p.peek(kind, value) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return p.unexpected(fmt.Sprintf("%q", value))
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.unexpected("a name")
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) unexpected(want string) error {
+	if p.tok.kind == tokenEOF {
+		return fmt.Errorf("expected %s, found the end of the document", want)
+	}
+	found := p.tok.value
+	if p.tok.kind == tokenString {
+		found = "a string"
+	}
+	return fmt.Errorf("expected %s, found %q at offset %d", want, found, p.tok.pos)
+}
+
+// enter guards against input nested deeply enough to make parsing expensive
+func (p *parser) enter() error {
+	p.nesting++
+	if p.nesting > maxNesting {
+		return fmt.Errorf("the document is nested more than %d levels deep", maxNesting)
+	}
+	return nil
+}
+
+func (p *parser) leave() { p.nesting-- }
+
+func (p *parser) operation() (*operation, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	op := &operation{}
+	if p.tok.kind == tokenName {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek(tokenPunct, "(") {
+		if err := p.variableDefinitions(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sel
+	return op, nil
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, errors.New(`a fragment cannot be named "on"`)
+	}
+	if err := p.expect(tokenName, "on"); err != nil {
+		return nil, err
+	}
+	if _, err := p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &fragment{name: name, selections: sel}, nil
+}
+
+func (p *parser) variableDefinitions() error {
+	if err := p.expect(tokenPunct, "("); err != nil {
+		return err
+	}
+	for {
+		if ok, err := p.skip(tokenPunct, ")"); ok || err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunct, "$"); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunct, ":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if ok, err := p.skip(tokenPunct, "="); err != nil {
+			return err
+		} else if ok {
+			if _, err := p.value(); err != nil {
+				return err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) typeRef() error {
+	if err := p.enter(); err != nil {
+		return err
+	}
+	defer p.leave()
+	if ok, err := p.skip(tokenPunct, "["); err != nil {
+		return err
+	} else if ok {
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunct, "]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	_, err := p.skip(tokenPunct, "!")
+	return err
+}
+
+func (p *parser) directives() error {
+	for p.peek(tokenPunct, "@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.peek(tokenPunct, "(") {
+			if _, err := p.arguments(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) selectionSet() ([]*selection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect(tokenPunct, "{"); err != nil {
+		return nil, err
+	}
+	var out []*selection
+	for {
+		if ok, err := p.skip(tokenPunct, "}"); err != nil {
+			return nil, err
+		} else if ok {
+			if len(out) == 0 {
+				return nil, errors.New("a selection set must not be empty")
+			}
+			return out, nil
+		}
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sel)
+	}
+}
+
+func (p *parser) selection() (*selection, error) {
+	if ok, err := p.skip(tokenPunct, "..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == tokenName && p.tok.value != "on" {
+			name := p.tok.value
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			return &selection{kind: selectionSpread, name: name}, p.directives()
+		}
+		if ok, err := p.skip(tokenName, "on"); err != nil {
+			return nil, err
+		} else if ok {
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return nil, err
+		}
+		sel, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		return &selection{kind: selectionInline, selections: sel}, nil
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &selection{kind: selectionField, name: name}
+	if ok, err := p.skip(tokenPunct, ":"); err != nil {
+		return nil, err
+	} else if ok {
+		field.alias = name
+		if field.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek(tokenPunct, "(") {
+		if field.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokenPunct, "{") {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *parser) arguments() ([]argument, error) {
+	if err := p.expect(tokenPunct, "("); err != nil {
+		return nil, err
+	}
+	var out []argument
+	for {
+		if ok, err := p.skip(tokenPunct, ")"); err != nil {
+			return nil, err
+		} else if ok {
+			if len(out) == 0 {
+				return nil, errors.New("an argument list must not be empty")
+			}
+			return out, nil
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenPunct, ":"); err != nil {
+			return nil, err
+		}
+		arg, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		arg.name = name
+		out = append(out, arg)
+	}
+}
+
+// value parses an input value and returns what the limits need of it
+func (p *parser) value() (argument, error) {
+	if err := p.enter(); err != nil {
+		return argument{}, err
+	}
+	defer p.leave()
+	var arg argument
+	switch {
+	case p.peek(tokenPunct, "$"):
+		if err := p.advance(); err != nil {
+			return arg, err
+		}
+		name, err := p.name()
+		arg.variable = name
+		return arg, err
+	case p.tok.kind == tokenInt:
+		if n, err := strconv.ParseInt(p.tok.value, 10, 64); err == nil {
+			arg.intValue = &n
+		}
+		return arg, p.advance()
+	case p.tok.kind == tokenFloat, p.tok.kind == tokenString, p.tok.kind == tokenName:
+		return arg, p.advance()
+	case p.peek(tokenPunct, "["):
+		if err := p.advance(); err != nil {
+			return arg, err
+		}
+		for {
+			if ok, err := p.skip(tokenPunct, "]"); ok || err != nil {
+				return arg, err
+			}
+			if _, err := p.value(); err != nil {
+				return arg, err
+			}
+		}
+	case p.peek(tokenPunct, "{"):
+		if err := p.advance(); err != nil {
+			return arg, err
+		}
+		for {
+			if ok, err := p.skip(tokenPunct, "}"); ok || err != nil {
+				return arg, err
+			}
+			if _, err := p.name(); err != nil {
+				return arg, err
+			}
+			if err := p.expect(tokenPunct, ":"); err != nil {
+				return arg, err
+			}
+			if _, err := p.value(); err != nil {
+				return arg, err
+			}
+		}
+	}
+	return arg, p.unexpected("a value")
+}
@@ -0,0 +1,614 @@
+package graphql_guard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+type GraphqlGuardPolicy struct{}
+
+// Error codes reported in the extensions of rejections
+const (
+	codeParseFailed            = "GRAPHQL_PARSE_FAILED"
+	codeUnsupportedContentType = "UNSUPPORTED_CONTENT_TYPE"
+	codeBatchLimit             = "BATCH_LIMIT_EXCEEDED"
+	codeIntrospection          = "INTROSPECTION_DISABLED"
+	codeDepthLimit             = "QUERY_DEPTH_EXCEEDED"
+	codeAliasLimit             = "ALIAS_LIMIT_EXCEEDED"
+	codeComplexityLimit        = "QUERY_COMPLEXITY_EXCEEDED"
+)
+
+type guardConfig struct {
+	Paths              []string
+	MaxDepth           int64
+	MaxAliases         int64
+	MaxComplexity      int64
+	ListSizeArguments  []string
+	BlockIntrospection bool
+	MaxBatchSize       int
+	RejectStatus       int
+}
+
+// gqlRequest is one GraphQL request as sent over HTTP
+type gqlRequest struct {
+	Query         *string                `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+// rejection is why a request is refused
+type rejection struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Validate configuration parameters
+func (p *GraphqlGuardPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *GraphqlGuardPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *GraphqlGuardPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	if r := cfg.check(ctx); r != nil {
+		return reject(*r)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (p *GraphqlGuardPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// check returns why the request must be refused, or nil. Requests to other
+// paths and requests that carry no GraphQL document are not checked.
+func (cfg guardConfig) check(ctx *RequestContext) *rejection {
+	path, rawQuery, _ := strings.Cut(ctx.Path, "?")
+	if !containsParam(cfg.Paths, path) {
+		return nil
+	}
+
+	var requests []gqlRequest
+	switch strings.ToUpper(ctx.Method) {
+	case "GET":
+		req, ok, err := queryRequest(rawQuery)
+		if err != nil {
+			return cfg.rejection(codeParseFailed, err.Error())
+		}
+		if !ok {
+			// No document, e.g. a browser loading an IDE served at the path
+			return nil
+		}
+		requests = []gqlRequest{req}
+	case "POST":
+		mediaType := baseMediaType(ctx.Body.ContentType())
+		if mediaType == "" {
+			mediaType = baseMediaType(headerValue(ctx.Headers, "Content-Type"))
+		}
+		switch {
+		case mediaType == "application/graphql":
+			query := string(ctx.Body.Bytes())
+			requests = []gqlRequest{{Query: &query}}
+		case mediaType == "" || isJSON(mediaType):
+			var err error
+			requests, err = bodyRequests(ctx.Body.Bytes())
+			if err != nil {
+				return cfg.rejection(codeParseFailed, err.Error())
+			}
+		default:
+			// Other bodies cannot be checked and must not get past unchecked
+			return &rejection{
+				Status:  415,
+				Code:    codeUnsupportedContentType,
+				Message: fmt.Sprintf("content type %q is not supported, send application/json", mediaType),
+			}
+		}
+	default:
+		return nil
+	}
+
+	if len(requests) > cfg.MaxBatchSize {
+		return cfg.rejection(codeBatchLimit, fmt.Sprintf("batch of %d operations exceeds the limit of %d", len(requests), cfg.MaxBatchSize))
+	}
+	for _, req := range requests {
+		if r := cfg.checkRequest(req); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// checkRequest measures the operations of one GraphQL request against the
+// limits
+func (cfg guardConfig) checkRequest(req gqlRequest) *rejection {
+	if req.Query == nil {
+		if _, ok := req.Extensions["persistedQuery"]; ok {
+			// The document was checked when the persisted query was registered
+			return nil
+		}
+		return cfg.rejection(codeParseFailed, "the request has no query")
+	}
+	doc, err := parseDocument(*req.Query)
+	if err != nil {
+		return cfg.rejection(codeParseFailed, "syntax error: "+err.Error())
+	}
+
+	ops := doc.operations
+	if req.OperationName != "" {
+		ops = nil
+		for _, op := range doc.operations {
+			if op.name == req.OperationName {
+				ops = []*operation{op}
+				break
+			}
+		}
+		if ops == nil {
+			return cfg.rejection(codeParseFailed, fmt.Sprintf("operation %q is not defined", req.OperationName))
+		}
+	}
+
+	// Without an operation name every operation is measured, the server
+	// decides which one, if any, it runs
+	a := newAnalyzer(doc, cfg.ListSizeArguments, req.Variables)
+	for _, op := range ops {
+		c, err := a.operation(op)
+		if err != nil {
+			return cfg.rejection(codeParseFailed, err.Error())
+		}
+		switch {
+		case cfg.BlockIntrospection && c.introspection:
+			return cfg.rejection(codeIntrospection, "introspection is disabled")
+		case c.depth > cfg.MaxDepth:
+			return cfg.rejection(codeDepthLimit, fmt.Sprintf("query depth %d exceeds the limit of %d", c.depth, cfg.MaxDepth))
+		case c.aliases > cfg.MaxAliases:
+			return cfg.rejection(codeAliasLimit, fmt.Sprintf("%d aliases exceed the limit of %d", c.aliases, cfg.MaxAliases))
+		case c.complexity > cfg.MaxComplexity:
+			return cfg.rejection(codeComplexityLimit, fmt.Sprintf("query complexity %d exceeds the limit of %d", c.complexity, cfg.MaxComplexity))
+		}
+	}
+	return nil
+}
+
+func (cfg guardConfig) rejection(code, message string) *rejection {
+	return &rejection{Status: cfg.RejectStatus, Code: code, Message: message}
+}
+
+// queryRequest reads a GraphQL request from the query string of a GET
+// request. ok is false when there is no query parameter.
+func queryRequest(rawQuery string) (req gqlRequest, ok bool, err error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return req, false, fmt.Errorf("invalid query string: %v", err)
+	}
+	if !values.Has("query") && !values.Has("extensions") {
+		return req, false, nil
+	}
+	if values.Has("query") {
+		query := values.Get("query")
+		req.Query = &query
+	}
+	req.OperationName = values.Get("operationName")
+	for name, target := range map[string]*map[string]interface{}{"variables": &req.Variables, "extensions": &req.Extensions} {
+		if s := values.Get(name); s != "" {
+			if err := json.Unmarshal([]byte(s), target); err != nil {
+				return req, false, fmt.Errorf("%s is not a JSON object", name)
+			}
+		}
+	}
+	return req, true, nil
+}
+
+// bodyRequests reads a JSON request body, a single request or a batch
+func bodyRequests(body []byte) ([]gqlRequest, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, errors.New("the request body is empty")
+	}
+	if trimmed[0] == '[' {
+		var batch []gqlRequest
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, errors.New("the request body is not a valid GraphQL batch")
+		}
+		if len(batch) == 0 {
+			return nil, errors.New("the batch is empty")
+		}
+		return batch, nil
+	}
+	var req gqlRequest
+	if err := json.Unmarshal(trimmed, &req); err != nil {
+		return nil, errors.New("the request body is not a valid GraphQL request")
+	}
+	return []gqlRequest{req}, nil
+}
+
+// reject answers with a GraphQL error response
+func reject(r rejection) ImmediateResponse {
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors": []interface{}{map[string]interface{}{
+			"message":    r.Message,
+			"extensions": map[string]interface{}{"code": r.Code},
+		}},
+	})
+	return ImmediateResponse{
+		Status:  r.Status,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    string(body),
+	}
+}
+
+// parseConfig reads the limits after the schema has checked them
+func parseConfig(params map[string]interface{}) (guardConfig, error) {
+	var cfg guardConfig
+	var errs paramErrors
+
+	paths, _ := params["paths"].([]interface{})
+	for i, item := range paths {
+		s, _ := item.(string)
+		if !strings.HasPrefix(s, "/") || strings.Contains(s, "?") {
+			errs.add(fmt.Sprintf("paths[%d]", i), "must be a path starting with / and without a query string")
+		}
+		cfg.Paths = append(cfg.Paths, s)
+	}
+	args, _ := params["listSizeArguments"].([]interface{})
+	for _, item := range args {
+		s, _ := item.(string)
+		cfg.ListSizeArguments = append(cfg.ListSizeArguments, s)
+	}
+
+	depth, _ := params["maxDepth"].(float64)
+	aliases, _ := params["maxAliases"].(float64)
+	complexity, _ := params["maxComplexity"].(float64)
+	batch, _ := params["maxBatchSize"].(float64)
+	status, _ := params["rejectStatus"].(float64)
+	cfg.MaxDepth = int64(depth)
+	cfg.MaxAliases = int64(aliases)
+	cfg.MaxComplexity = int64(complexity)
+	cfg.MaxBatchSize = int(batch)
+	cfg.RejectStatus = int(status)
+	cfg.BlockIntrospection, _ = params["blockIntrospection"].(bool)
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// baseMediaType returns the media type of a Content-Type value without its
+// parameters, in lower case
+func baseMediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// headerValue returns the first value of a header, matching its name without
+// regard to case
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
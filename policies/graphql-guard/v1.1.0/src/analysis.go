@@ -0,0 +1,155 @@
+package graphql_guard
+
+import (
+	"fmt"
+	"math"
+)
+
+// cost is what an operation, or a part of one, adds up to against the limits
+type cost struct {
+	// depth is the deepest field nesting, a top level field being at depth 1
+	depth int64
+	// aliases counts aliased fields, fragments counted at every spread
+	aliases int64
+	// complexity is the estimated number of fields resolved, see field
+	complexity int64
+	// introspection is set when __schema or __type is selected
+	introspection bool
+}
+
+// analyzer measures operations of one document. Fragments are measured once
+// and the result reused at every spread, so documents that spread the same
+// fragment many times do not cost more to measure than to parse.
+type analyzer struct {
+	doc *document
+	// listArgs are the arguments whose value is the number of items a field
+	// returns, such as first in a paginated connection
+	listArgs  map[string]bool
+	variables map[string]interface{}
+	measured  map[string]cost
+	visiting  map[string]bool
+}
+
+func newAnalyzer(doc *document, listArgs []string, variables map[string]interface{}) *analyzer {
+	a := &analyzer{
+		doc:       doc,
+		listArgs:  make(map[string]bool, len(listArgs)),
+		variables: variables,
+		measured:  map[string]cost{},
+		visiting:  map[string]bool{},
+	}
+	for _, name := range listArgs {
+		a.listArgs[name] = true
+	}
+	return a
+}
+
+func (a *analyzer) operation(op *operation) (cost, error) {
+	return a.selections(op.selections)
+}
+
+// selections adds up the cost of a selection set. Its depth is the deepest
+// of its selections; everything else is summed.
+func (a *analyzer) selections(sels []*selection) (cost, error) {
+	var total cost
+	for _, sel := range sels {
+		var c cost
+		var err error
+		switch sel.kind {
+		case selectionField:
+			c, err = a.field(sel)
+		case selectionInline:
+			c, err = a.selections(sel.selections)
+		case selectionSpread:
+			c, err = a.spread(sel.name)
+		}
+		if err != nil {
+			return cost{}, err
+		}
+		total.depth = max(total.depth, c.depth)
+		total.aliases = addCapped(total.aliases, c.aliases)
+		total.complexity = addCapped(total.complexity, c.complexity)
+		total.introspection = total.introspection || c.introspection
+	}
+	return total, nil
+}
+
+// field costs 1 plus the cost of its sub-selections, which are resolved once
+// for every item of a list field whose size argument is known
+func (a *analyzer) field(sel *selection) (cost, error) {
+	children, err := a.selections(sel.selections)
+	if err != nil {
+		return cost{}, err
+	}
+	c := cost{
+		depth:         children.depth + 1,
+		aliases:       children.aliases,
+		complexity:    addCapped(1, mulCapped(a.listSize(sel), children.complexity)),
+		introspection: children.introspection || sel.name == "__schema" || sel.name == "__type",
+	}
+	if sel.alias != "" {
+		c.aliases = addCapped(c.aliases, 1)
+	}
+	return c, nil
+}
+
+func (a *analyzer) spread(name string) (cost, error) {
+	if c, ok := a.measured[name]; ok {
+		return c, nil
+	}
+	f, ok := a.doc.fragments[name]
+	if !ok {
+		return cost{}, fmt.Errorf("fragment %q is not defined", name)
+	}
+	if a.visiting[name] {
+		return cost{}, fmt.Errorf("fragment %q spreads itself", name)
+	}
+	a.visiting[name] = true
+	c, err := a.selections(f.selections)
+	delete(a.visiting, name)
+	if err != nil {
+		return cost{}, err
+	}
+	a.measured[name] = c
+	return c, nil
+}
+
+// listSize returns the largest size argument of a field, or 1 when it has
+// none. Arguments given as variables are looked up in the request variables.
+func (a *analyzer) listSize(sel *selection) int64 {
+	size := int64(1)
+	for _, arg := range sel.args {
+		if !a.listArgs[arg.name] {
+			continue
+		}
+		var n int64
+		switch {
+		case arg.intValue != nil:
+			n = *arg.intValue
+		case arg.variable != "":
+			f, ok := a.variables[arg.variable].(float64)
+			if !ok {
+				continue
+			}
+			n = int64(min(max(f, 0), math.MaxInt64/2))
+		}
+		size = max(size, n)
+	}
+	return size
+}
+
+// addCapped and mulCapped saturate instead of overflowing, so costs that
+// grow out of range still exceed every limit
+func addCapped(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+func mulCapped(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
@@ -0,0 +1,47 @@
+package graphql_guard
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "definitions": {
+    "matcher": {
+      "oneOf": [
+        {"type": "string", "minLength": 1},
+        {
+          "type": "object",
+          "properties": {
+            "exact": {"type": "string"},
+            "prefix": {"type": "string"},
+            "glob": {"type": "string"},
+            "regex": {"type": "string"},
+            "ignoreCase": {"type": "boolean", "default": false}
+          },
+          "additionalProperties": false
+        }
+      ]
+    }
+  },
+  "properties": {
+    "paths": {
+      "type": "array",
+      "minItems": 1,
+      "items": {"$ref": "#/definitions/matcher"},
+      "default": ["/graphql"]
+    },
+    "maxDepth": {"type": "integer", "minimum": 1, "default": 10},
+    "maxAliases": {"type": "integer", "minimum": 0, "default": 15},
+    "maxComplexity": {"type": "integer", "minimum": 1, "default": 1000},
+    "listSizeArguments": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "default": ["first", "last", "limit"]
+    },
+    "blockIntrospection": {"type": "boolean", "default": false},
+    "maxBatchSize": {"type": "integer", "minimum": 1, "default": 10},
+    "rejectStatus": {"type": "integer", "minimum": 200, "maximum": 599, "default": 400}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,624 @@
+package hmac_auth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Initializer is implemented by policies that set up state for their
+// instance. The gateway calls Init once, with the parameters Validate
+// accepted and before the first request, and drops the instance if it
+// returns an error.
+type Initializer interface {
+	Init(params map[string]interface{}) error
+}
+
+// Rotator is implemented by policies that take new secret values in place.
+// When a secret the parameters refer to with $secretRef changes, the gateway
+// validates the parameters resolved anew and calls Rotate with them; an
+// error keeps the old values in use.
+type Rotator interface {
+	Rotate(params map[string]interface{}) error
+}
+
+const (
+	defaultHeaderName       = "Authorization"
+	defaultClockSkew        = 300 * time.Second
+	defaultRotationGrace    = 300 * time.Second
+	defaultUnauthorizedBody = `{"error": "Unauthorized"}`
+)
+
+var (
+	supportedAlgorithms    = []string{"hmac-sha256", "hmac-sha512"}
+	defaultRequiredHeaders = []string{"(request-target)", "date"}
+)
+
+var (
+	_ Initializer = (*HMACAuthPolicy)(nil)
+	_ Rotator     = (*HMACAuthPolicy)(nil)
+)
+
+type HMACAuthPolicy struct {
+	mu sync.Mutex
+	// keys are the secrets of the parameters Init or the last Rotate got
+	keys map[string][]byte
+	// retired are secrets Rotate replaced, still accepted until their time
+	retired []retiredKey
+}
+
+// retiredKey is the previous secret of a key ID, so clients that have not
+// picked up a rotated secret yet keep working for a while
+type retiredKey struct {
+	id     string
+	secret []byte
+	until  time.Time
+}
+
+type hmacConfig struct {
+	Keys             map[string][]byte
+	Algorithms       []string
+	RequiredHeaders  []string
+	ClockSkew        time.Duration
+	RotationGrace    time.Duration
+	HeaderName       string
+	UnauthorizedBody string
+}
+
+// Validate configuration parameters
+func (p *HMACAuthPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Init records the secrets, so Rotate can tell which of them change
+func (p *HMACAuthPolicy) Init(params map[string]interface{}) error {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = cfg.Keys
+	return nil
+}
+
+// Rotate takes new secret values. The secret a key ID had before stays valid
+// for rotationGraceSeconds, so clients can move to the new one without
+// failing requests in between.
+func (p *HMACAuthPolicy) Rotate(params map[string]interface{}) error {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = unexpired(p.retired, now)
+	for id, old := range p.keys {
+		if secret, ok := cfg.Keys[id]; ok && hmac.Equal(secret, old) {
+			continue
+		}
+		if cfg.RotationGrace > 0 {
+			p.retired = append(p.retired, retiredKey{id: id, secret: old, until: now.Add(cfg.RotationGrace)})
+		}
+	}
+	p.keys = cfg.Keys
+	return nil
+}
+
+// retiredSecrets returns the previous secrets of a key ID that are still
+// accepted
+func (p *HMACAuthPolicy) retiredSecrets(id string, now time.Time) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var secrets [][]byte
+	for _, k := range p.retired {
+		if k.id == id && now.Before(k.until) {
+			secrets = append(secrets, k.secret)
+		}
+	}
+	return secrets
+}
+
+func unexpired(keys []retiredKey, now time.Time) []retiredKey {
+	kept := keys[:0]
+	for _, k := range keys {
+		if now.Before(k.until) {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+// Declare processing behavior
+func (p *HMACAuthPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		// The body is needed to check the Digest header
+		RequestBodyMode:  BodyModeBuffer,
+		ResponseBodyMode: BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *HMACAuthPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody, defaultRequiredHeaders)
+	}
+
+	raw := headerValue(ctx.Headers, cfg.HeaderName)
+	if len(raw) < 10 || !strings.EqualFold(raw[:10], "Signature ") {
+		return unauthorized(cfg.UnauthorizedBody, cfg.RequiredHeaders)
+	}
+	sig, err := parseSignature(raw[10:])
+	if err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.RequiredHeaders)
+	}
+	now := time.Now()
+	if err := cfg.verify(ctx, sig, now); err != nil && !p.verifyRetired(ctx, cfg, sig, now) {
+		return unauthorized(cfg.UnauthorizedBody, cfg.RequiredHeaders)
+	}
+
+	ctx.SharedContext.Set(ConsumerIDKey, sig.KeyID)
+	return UpstreamRequestModifications{}
+}
+
+// verifyRetired checks the signature against the secrets its key ID had
+// before the last rotations
+func (p *HMACAuthPolicy) verifyRetired(ctx *RequestContext, cfg hmacConfig, sig *signature, now time.Time) bool {
+	if _, ok := cfg.Keys[sig.KeyID]; !ok {
+		return false
+	}
+	for _, secret := range p.retiredSecrets(sig.KeyID, now) {
+		cfg.Keys = map[string][]byte{sig.KeyID: secret}
+		if cfg.verify(ctx, sig, now) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Response phase (not used)
+func (p *HMACAuthPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+func parseConfig(params map[string]interface{}) (hmacConfig, error) {
+	cfg := hmacConfig{
+		Algorithms:       supportedAlgorithms,
+		RequiredHeaders:  defaultRequiredHeaders,
+		ClockSkew:        defaultClockSkew,
+		RotationGrace:    defaultRotationGrace,
+		HeaderName:       defaultHeaderName,
+		UnauthorizedBody: defaultUnauthorizedBody,
+	}
+
+	keys, ok := params["keys"].(map[string]interface{})
+	if !ok || len(keys) == 0 {
+		return cfg, errors.New("keys is required and must map key IDs to secrets")
+	}
+	cfg.Keys = make(map[string][]byte, len(keys))
+	for id, v := range keys {
+		secret, ok := v.(string)
+		if !ok || secret == "" {
+			return cfg, fmt.Errorf("keys.%s must be a non-empty string", id)
+		}
+		cfg.Keys[id] = []byte(secret)
+	}
+
+	var err error
+	if _, ok := params["algorithms"]; ok {
+		if cfg.Algorithms, err = stringList(params, "algorithms"); err != nil {
+			return cfg, err
+		}
+		if len(cfg.Algorithms) == 0 {
+			return cfg, errors.New("algorithms must not be empty")
+		}
+		for i, alg := range cfg.Algorithms {
+			alg = strings.ToLower(alg)
+			if !contains(supportedAlgorithms, alg) {
+				return cfg, fmt.Errorf("algorithms: unsupported algorithm %q", alg)
+			}
+			cfg.Algorithms[i] = alg
+		}
+	}
+	if _, ok := params["requiredHeaders"]; ok {
+		if cfg.RequiredHeaders, err = stringList(params, "requiredHeaders"); err != nil {
+			return cfg, err
+		}
+		for i, name := range cfg.RequiredHeaders {
+			if name == "" || strings.ContainsAny(name, " \t,\"") {
+				return cfg, fmt.Errorf("requiredHeaders: invalid header name %q", name)
+			}
+			cfg.RequiredHeaders[i] = strings.ToLower(name)
+		}
+	}
+
+	if v, ok := params["clockSkewSeconds"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int64(f)) {
+			return cfg, errors.New("clockSkewSeconds must be a positive integer")
+		}
+		cfg.ClockSkew = time.Duration(f) * time.Second
+	}
+	if v, ok := params["rotationGraceSeconds"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, errors.New("rotationGraceSeconds must be a non-negative integer")
+		}
+		cfg.RotationGrace = time.Duration(f) * time.Second
+	}
+	// Without a signed time a captured request could be replayed forever
+	if !contains(cfg.RequiredHeaders, "date") && !contains(cfg.RequiredHeaders, "(created)") {
+		return cfg, errors.New("requiredHeaders must include date or (created)")
+	}
+
+	for name, dst := range map[string]*string{
+		"headerName":       &cfg.HeaderName,
+		"unauthorizedBody": &cfg.UnauthorizedBody,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+	return cfg, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+// unauthorized tells the client which headers a signature must cover. The
+// reason for a rejection is not revealed, so the policy cannot be used to
+// probe for valid key IDs.
+func unauthorized(body string, required []string) ImmediateResponse {
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type":     {"application/json"},
+			"WWW-Authenticate": {fmt.Sprintf(`Signature headers="%s"`, strings.Join(required, " "))},
+		},
+		Body: body,
+	}
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	if values, ok := headers[name]; ok {
+		return values
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
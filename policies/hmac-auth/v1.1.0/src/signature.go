@@ -0,0 +1,236 @@
+package hmac_auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signature holds the parameters of a Signature authorization header, as in
+// the HTTP Signatures draft:
+//
+//	Signature keyId="client-1",algorithm="hmac-sha256",headers="(request-target) date",signature="..."
+type signature struct {
+	KeyID     string
+	Algorithm string
+	// Headers lists the signed components in the order they were signed
+	Headers   []string
+	Signature []byte
+	Created   time.Time
+	Expires   time.Time
+}
+
+func parseSignature(s string) (*signature, error) {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, errors.New("malformed signature parameter")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimSpace(rest)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated signature parameter")
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+			rest = "," + rest
+		}
+		if _, dup := params[name]; dup {
+			return nil, fmt.Errorf("duplicate signature parameter %s", name)
+		}
+		params[name] = value
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" && rest[0] != ',' {
+			return nil, errors.New("malformed signature parameter")
+		}
+		s = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+
+	sig := &signature{
+		KeyID:     params["keyid"],
+		Algorithm: strings.ToLower(params["algorithm"]),
+		Headers:   strings.Fields(strings.ToLower(params["headers"])),
+	}
+	if sig.KeyID == "" {
+		return nil, errors.New("signature has no keyId")
+	}
+	if len(sig.Headers) == 0 {
+		// The draft's default when headers is omitted
+		sig.Headers = []string{"(created)"}
+	}
+	var err error
+	if sig.Signature, err = base64.StdEncoding.DecodeString(params["signature"]); err != nil || len(sig.Signature) == 0 {
+		return nil, errors.New("signature is not valid base64")
+	}
+	for name, dst := range map[string]*time.Time{"created": &sig.Created, "expires": &sig.Expires} {
+		if v, ok := params[name]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a Unix timestamp", name)
+			}
+			*dst = time.Unix(n, 0)
+		}
+	}
+	return sig, nil
+}
+
+// verify checks the signature against the request. Every failure is reported
+// the same way to the client, so the errors are only for debugging.
+func (cfg hmacConfig) verify(ctx *RequestContext, sig *signature, now time.Time) error {
+	secret, ok := cfg.Keys[sig.KeyID]
+	if !ok {
+		return errors.New("unknown key ID")
+	}
+	// hs2019 leaves the algorithm to the key; here the key is always HMAC
+	// and SHA-256 is used
+	alg := sig.Algorithm
+	if alg == "" || alg == "hs2019" {
+		alg = "hmac-sha256"
+	}
+	if !contains(cfg.Algorithms, alg) {
+		return errors.New("algorithm not allowed")
+	}
+	for _, name := range cfg.RequiredHeaders {
+		if !contains(sig.Headers, name) {
+			return fmt.Errorf("signature does not cover %s", name)
+		}
+	}
+
+	signingString, err := cfg.signingString(ctx, sig, now)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(hashFor(alg), secret)
+	mac.Write([]byte(signingString))
+	if !hmac.Equal(mac.Sum(nil), sig.Signature) {
+		return errors.New("signature mismatch")
+	}
+
+	if contains(sig.Headers, "digest") {
+		return checkDigest(ctx)
+	}
+	return nil
+}
+
+// signingString rebuilds the string the client signed, checking the signed
+// times on the way
+func (cfg hmacConfig) signingString(ctx *RequestContext, sig *signature, now time.Time) (string, error) {
+	lines := make([]string, 0, len(sig.Headers))
+	for _, name := range sig.Headers {
+		var value string
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(ctx.Method) + " " + ctx.Path
+		case "(created)":
+			if sig.Created.IsZero() {
+				return "", errors.New("signature covers (created) without a created parameter")
+			}
+			if err := cfg.checkTime(sig.Created, now); err != nil {
+				return "", err
+			}
+			value = strconv.FormatInt(sig.Created.Unix(), 10)
+		case "(expires)":
+			if sig.Expires.IsZero() {
+				return "", errors.New("signature covers (expires) without an expires parameter")
+			}
+			if !now.Before(sig.Expires) {
+				return "", errors.New("signature has expired")
+			}
+			value = strconv.FormatInt(sig.Expires.Unix(), 10)
+		default:
+			values := headerValues(ctx.Headers, name)
+			if len(values) == 0 {
+				return "", fmt.Errorf("signed header %s is missing", name)
+			}
+			if name == "date" {
+				t, err := http.ParseTime(values[0])
+				if err != nil {
+					return "", errors.New("date header is invalid")
+				}
+				if err := cfg.checkTime(t, now); err != nil {
+					return "", err
+				}
+			}
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.TrimSpace(v)
+			}
+			value = strings.Join(trimmed, ", ")
+		}
+		lines = append(lines, name+": "+value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// checkTime rejects signatures made too long ago, or too far in the future,
+// so captured requests cannot be replayed later
+func (cfg hmacConfig) checkTime(t, now time.Time) error {
+	if d := now.Sub(t); d > cfg.ClockSkew || d < -cfg.ClockSkew {
+		return errors.New("signature time is outside the allowed clock skew")
+	}
+	return nil
+}
+
+// checkDigest compares the Digest header with the request body. At least one
+// supported algorithm must be present and every supported one must match.
+func checkDigest(ctx *RequestContext) error {
+	var body []byte
+	if ctx.Body != nil {
+		if ctx.Body.Stream() != nil {
+			return errors.New("streamed bodies cannot be checked")
+		}
+		body = ctx.Body.Bytes()
+	}
+	checked := false
+	for _, v := range headerValues(ctx.Headers, "Digest") {
+		for _, item := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			var h hash.Hash
+			switch strings.ToUpper(alg) {
+			case "SHA-256":
+				h = sha256.New()
+			case "SHA-512":
+				h = sha512.New()
+			default:
+				continue
+			}
+			h.Write(body)
+			want := base64.StdEncoding.EncodeToString(h.Sum(nil))
+			if subtle.ConstantTimeCompare([]byte(want), []byte(value)) != 1 {
+				return errors.New("digest does not match the body")
+			}
+			checked = true
+		}
+	}
+	if !checked {
+		return errors.New("digest has no supported algorithm")
+	}
+	return nil
+}
+
+func hashFor(alg string) func() hash.Hash {
+	if alg == "hmac-sha512" {
+		return sha512.New
+	}
+	return sha256.New
+}
@@ -0,0 +1,110 @@
+package ip_restriction
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const (
+	sourceRemoteAddr    = "remoteAddr"
+	sourceXForwardedFor = "xForwardedFor"
+
+	defaultTrustedProxyDepth = 1
+)
+
+// clientSource decides which address is checked against the lists
+type clientSource struct {
+	Type              string
+	TrustedProxyDepth int
+	// TrustedProxies, when set, replaces the fixed depth: X-Forwarded-For is
+	// only read from a trusted peer, and trusted hops are skipped from the right.
+	TrustedProxies *ipSet
+}
+
+func parseClientSource(params map[string]interface{}) (clientSource, error) {
+	cs := clientSource{Type: sourceRemoteAddr, TrustedProxyDepth: defaultTrustedProxyDepth}
+	if v, ok := params["clientIpSource"]; ok {
+		s, ok := v.(string)
+		if !ok || (s != sourceRemoteAddr && s != sourceXForwardedFor) {
+			return cs, fmt.Errorf("clientIpSource must be one of: %s, %s", sourceRemoteAddr, sourceXForwardedFor)
+		}
+		cs.Type = s
+	}
+	if v, ok := params["trustedProxyDepth"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int(f)) {
+			return cs, errors.New("trustedProxyDepth must be a positive integer")
+		}
+		cs.TrustedProxyDepth = int(f)
+	}
+	return cs, nil
+}
+
+// clientIP returns the address of the caller. IPv4-mapped IPv6 addresses are
+// reported as IPv4 so they match IPv4 entries.
+func (cs clientSource) clientIP(ctx *RequestContext) (netip.Addr, bool) {
+	peer, peerOK := parseAddr(ctx.RemoteAddr)
+	if cs.Type != sourceXForwardedFor {
+		return peer, peerOK
+	}
+
+	hops := forwardedHops(ctx.Headers)
+	if cs.TrustedProxies != nil {
+		// A peer outside the trusted proxies may have written the header itself
+		if !peerOK || !cs.TrustedProxies.contains(peer) {
+			return peer, peerOK
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip, ok := parseAddr(hops[i])
+			if !ok {
+				return netip.Addr{}, false
+			}
+			if !cs.TrustedProxies.contains(ip) || i == 0 {
+				return ip, true
+			}
+		}
+		return peer, peerOK
+	}
+
+	// Each of the depth trusted proxies in front of the gateway appends one
+	// entry, so the client is the depth-th entry from the right; anything
+	// further left can be forged by the caller.
+	if len(hops) < cs.TrustedProxyDepth {
+		return netip.Addr{}, false
+	}
+	return parseAddr(hops[len(hops)-cs.TrustedProxyDepth])
+}
+
+func forwardedHops(headers map[string][]string) []string {
+	var hops []string
+	for k, values := range headers {
+		if !strings.EqualFold(k, "X-Forwarded-For") {
+			continue
+		}
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseAddr accepts a bare address or host:port, as found in RemoteAddr
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
@@ -0,0 +1,277 @@
+package ip_restriction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+type Body struct {
+	// Placeholder for body
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct{}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// clientIPKey exposes the resolved client address to later policies
+const clientIPKey = "client.ip"
+
+const (
+	defaultBlockedStatus = 403
+	defaultBlockedBody   = `{"error": "Forbidden"}`
+)
+
+type IPRestrictionPolicy struct {
+	mu   sync.Mutex
+	sets map[string]*ipSet
+}
+
+type restrictionConfig struct {
+	Allow         *ipSet
+	Deny          *ipSet
+	Client        clientSource
+	BlockedStatus int
+	BlockedBody   string
+}
+
+// Validate configuration parameters
+func (p *IPRestrictionPolicy) Validate(params map[string]interface{}) error {
+	_, err := p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *IPRestrictionPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *IPRestrictionPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return blocked(defaultBlockedStatus, defaultBlockedBody)
+	}
+
+	ip, ok := cfg.Client.clientIP(ctx)
+	if !ok {
+		// Without an address only a pure deny list can let the request through
+		if cfg.Allow != nil {
+			return blocked(cfg.BlockedStatus, cfg.BlockedBody)
+		}
+		return UpstreamRequestModifications{}
+	}
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(clientIPKey, ip.String())
+	}
+
+	// Deny entries win over allow entries
+	if cfg.Deny != nil && cfg.Deny.contains(ip) {
+		return blocked(cfg.BlockedStatus, cfg.BlockedBody)
+	}
+	if cfg.Allow != nil && !cfg.Allow.contains(ip) {
+		return blocked(cfg.BlockedStatus, cfg.BlockedBody)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (p *IPRestrictionPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+func (p *IPRestrictionPolicy) parseConfig(params map[string]interface{}) (restrictionConfig, error) {
+	cfg := restrictionConfig{
+		BlockedStatus: defaultBlockedStatus,
+		BlockedBody:   defaultBlockedBody,
+	}
+
+	var err error
+	if cfg.Allow, err = p.list(params, "allow"); err != nil {
+		return cfg, err
+	}
+	if cfg.Deny, err = p.list(params, "deny"); err != nil {
+		return cfg, err
+	}
+	if cfg.Allow == nil && cfg.Deny == nil {
+		return cfg, errors.New("at least one of allow and deny must list an address")
+	}
+
+	if cfg.Client, err = parseClientSource(params); err != nil {
+		return cfg, err
+	}
+	if cfg.Client.TrustedProxies, err = p.list(params, "trustedProxies"); err != nil {
+		return cfg, err
+	}
+
+	if v, ok := params["blockedStatus"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 400 || f > 599 || f != float64(int(f)) {
+			return cfg, errors.New("blockedStatus must be an HTTP error status between 400 and 599")
+		}
+		cfg.BlockedStatus = int(f)
+	}
+	if v, ok := params["blockedBody"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return cfg, errors.New("blockedBody must be a string")
+		}
+		cfg.BlockedBody = s
+	}
+	return cfg, nil
+}
+
+// list returns the set for params[name], or nil when the list is absent or
+// empty. Sets are built once per distinct list because large lists are
+// expensive to parse on every request.
+func (p *IPRestrictionPolicy) list(params map[string]interface{}, name string) (*ipSet, error) {
+	entries, err := stringList(params, name)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write([]byte(e))
+		h.Write([]byte{'\n'})
+	}
+	id := name + ":" + hex.EncodeToString(h.Sum(nil))
+
+	p.mu.Lock()
+	s, ok := p.sets[id]
+	p.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	s = &ipSet{}
+	for _, e := range entries {
+		if err := s.add(e); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sets == nil {
+		p.sets = make(map[string]*ipSet)
+	}
+	p.sets[id] = s
+	return s, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, strings.TrimSpace(s))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func blocked(status int, body string) ImmediateResponse {
+	return ImmediateResponse{
+		Status: status,
+		Headers: map[string][]string{
+			"Content-Type": {"application/json"},
+		},
+		Body: body,
+	}
+}
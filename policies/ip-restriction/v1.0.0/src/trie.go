@@ -0,0 +1,159 @@
+package ip_restriction
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ipSet is a set of address prefixes backed by one path-compressed binary
+// radix tree per address family. Lookups take at most one step per prefix
+// bit, independent of the number of entries.
+type ipSet struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+// trieNode covers the first bits of key. Nodes only exist where a prefix ends
+// or where two prefixes diverge, so chains of single children are collapsed.
+type trieNode struct {
+	key      [16]byte
+	bits     int
+	terminal bool
+	child    [2]*trieNode
+}
+
+// add inserts an address or a CIDR range
+func (s *ipSet) add(entry string) error {
+	var prefix netip.Prefix
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		prefix = p
+	} else {
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", entry)
+		}
+		prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+	if prefix.Addr().Zone() != "" {
+		return fmt.Errorf("address %q must not have a zone", entry)
+	}
+
+	prefix = prefix.Masked()
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		// ::ffff:10.0.0.0/104 is the same range as 10.0.0.0/8
+		addr, bits = addr.Unmap(), bits-96
+	}
+
+	root := &s.v6
+	if addr.Is4() {
+		root = &s.v4
+	}
+	insert(root, addrKey(addr), bits)
+	return nil
+}
+
+func (s *ipSet) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.Is4() {
+		return lookup(s.v4, addrKey(ip), 32)
+	}
+	return lookup(s.v6, addrKey(ip), 128)
+}
+
+func addrKey(ip netip.Addr) [16]byte {
+	var key [16]byte
+	if ip.Is4() {
+		a := ip.As4()
+		copy(key[:], a[:])
+		return key
+	}
+	return ip.As16()
+}
+
+func insert(np **trieNode, key [16]byte, bits int) {
+	for {
+		n := *np
+		if n == nil {
+			*np = &trieNode{key: key, bits: bits, terminal: true}
+			return
+		}
+
+		common := commonBits(n.key, key, min(n.bits, bits))
+		if common < n.bits {
+			// The new prefix leaves this node's path: split it where they diverge
+			split := &trieNode{key: maskKey(key, common), bits: common}
+			split.child[bitAt(n.key, common)] = n
+			if common == bits {
+				split.terminal = true
+			} else {
+				split.child[bitAt(key, common)] = &trieNode{key: key, bits: bits, terminal: true}
+			}
+			*np = split
+			return
+		}
+
+		if n.bits == bits {
+			n.terminal = true
+			return
+		}
+		if n.terminal {
+			// Already covered by a shorter prefix
+			return
+		}
+		np = &n.child[bitAt(key, n.bits)]
+	}
+}
+
+func lookup(n *trieNode, key [16]byte, width int) bool {
+	for n != nil {
+		if commonBits(n.key, key, n.bits) < n.bits {
+			return false
+		}
+		if n.terminal {
+			return true
+		}
+		if n.bits >= width {
+			return false
+		}
+		n = n.child[bitAt(key, n.bits)]
+	}
+	return false
+}
+
+// commonBits returns how many of the first limit bits a and b share
+func commonBits(a, b [16]byte, limit int) int {
+	n := 0
+	for i := 0; n < limit; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return min(n, limit)
+}
+
+func bitAt(key [16]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+func maskKey(key [16]byte, bits int) [16]byte {
+	var out [16]byte
+	full := bits / 8
+	copy(out[:full], key[:full])
+	if rem := bits % 8; rem > 0 {
+		out[full] = key[full] & (0xff << (8 - rem))
+	}
+	return out
+}
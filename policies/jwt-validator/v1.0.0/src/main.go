@@ -0,0 +1,382 @@
+package jwt_validator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+type Body struct {
+	// Placeholder for body
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct{}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// claimsKey stores the verified claims in the SharedContext for later policies
+const claimsKey = "jwt.claims"
+
+const (
+	defaultHeaderName         = "Authorization"
+	defaultClockSkew          = 60 * time.Second
+	defaultJWKSCacheTTL       = 5 * time.Minute
+	defaultJWKSRefreshMinimum = 30 * time.Second
+	defaultJWKSTimeout        = 2 * time.Second
+	defaultUnauthorizedBody   = `{"error": "Unauthorized"}`
+)
+
+type JWTValidatorPolicy struct {
+	mu   sync.Mutex
+	jwks map[string]*jwksCache
+}
+
+type validatorConfig struct {
+	JWKSURL           string
+	Issuers           []string
+	Audiences         []string
+	Algorithms        []string
+	ClockSkew         time.Duration
+	HeaderName        string
+	CacheTTL          time.Duration
+	RefreshMinimum    time.Duration
+	Timeout           time.Duration
+	ClaimHeaders      map[string]string
+	UnauthorizedBody  string
+	UnauthorizedType  string
+	ForwardToken      bool
+	RequireExpiration bool
+}
+
+// Validate configuration parameters
+func (j *JWTValidatorPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (j *JWTValidatorPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (j *JWTValidatorPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody, "application/json", "invalid_token", "policy is misconfigured")
+	}
+
+	raw, ok := bearerToken(ctx.Headers, cfg.HeaderName)
+	if !ok {
+		// RFC 6750: no error code when the request carries no credentials
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "", "")
+	}
+
+	tok, err := parseToken(raw)
+	if err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if !contains(cfg.Algorithms, tok.Header.Alg) {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", "algorithm not allowed")
+	}
+
+	key, err := j.cache(cfg).key(tok.Header.Kid, tok.Header.Alg)
+	if err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if err := tok.verify(key); err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if err := checkClaims(tok.Claims, cfg, time.Now()); err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(claimsKey, tok.Claims)
+	}
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	for header, claim := range cfg.ClaimHeaders {
+		if v, ok := claimString(tok.Claims, claim); ok {
+			mods.SetHeaders[header] = v
+		} else {
+			// Never let a client supply a header the upstream trusts as a claim
+			mods.RemoveHeaders = append(mods.RemoveHeaders, header)
+		}
+	}
+	if !cfg.ForwardToken {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.HeaderName)
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (j *JWTValidatorPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// cache returns the key cache for the configured JWKS URL
+func (j *JWTValidatorPolicy) cache(cfg validatorConfig) *jwksCache {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jwks == nil {
+		j.jwks = make(map[string]*jwksCache)
+	}
+	c, ok := j.jwks[cfg.JWKSURL]
+	if !ok {
+		c = newJWKSCache(cfg.JWKSURL, cfg.Timeout)
+		j.jwks[cfg.JWKSURL] = c
+	}
+	c.setTimings(cfg.CacheTTL, cfg.RefreshMinimum)
+	return c
+}
+
+func parseConfig(params map[string]interface{}) (validatorConfig, error) {
+	cfg := validatorConfig{
+		Algorithms:        supportedAlgorithms,
+		ClockSkew:         defaultClockSkew,
+		HeaderName:        defaultHeaderName,
+		CacheTTL:          defaultJWKSCacheTTL,
+		RefreshMinimum:    defaultJWKSRefreshMinimum,
+		Timeout:           defaultJWKSTimeout,
+		UnauthorizedBody:  defaultUnauthorizedBody,
+		UnauthorizedType:  "application/json",
+		ForwardToken:      true,
+		RequireExpiration: true,
+	}
+
+	url, ok := params["jwksUrl"].(string)
+	if !ok || !(strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")) {
+		return cfg, errors.New("jwksUrl is required and must be an http(s) URL")
+	}
+	cfg.JWKSURL = url
+
+	var err error
+	if cfg.Issuers, err = stringList(params, "issuer"); err != nil {
+		return cfg, err
+	}
+	if cfg.Audiences, err = stringList(params, "audience"); err != nil {
+		return cfg, err
+	}
+	if _, ok := params["allowedAlgorithms"]; ok {
+		if cfg.Algorithms, err = stringList(params, "allowedAlgorithms"); err != nil {
+			return cfg, err
+		}
+		if len(cfg.Algorithms) == 0 {
+			return cfg, errors.New("allowedAlgorithms must not be empty")
+		}
+		for _, alg := range cfg.Algorithms {
+			if !contains(supportedAlgorithms, alg) {
+				return cfg, fmt.Errorf("allowedAlgorithms: unsupported algorithm %q", alg)
+			}
+		}
+	}
+
+	for name, dst := range map[string]*time.Duration{
+		"clockSkewSeconds":           &cfg.ClockSkew,
+		"jwksCacheTtlSeconds":        &cfg.CacheTTL,
+		"jwksRefreshIntervalSeconds": &cfg.RefreshMinimum,
+		"jwksTimeoutMs":              &cfg.Timeout,
+	} {
+		v, ok := params[name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		unit := time.Second
+		if strings.HasSuffix(name, "Ms") {
+			unit = time.Millisecond
+		}
+		*dst = time.Duration(f) * unit
+	}
+
+	for name, dst := range map[string]*string{
+		"headerName":              &cfg.HeaderName,
+		"unauthorizedBody":        &cfg.UnauthorizedBody,
+		"unauthorizedContentType": &cfg.UnauthorizedType,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+
+	for name, dst := range map[string]*bool{
+		"forwardToken":      &cfg.ForwardToken,
+		"requireExpiration": &cfg.RequireExpiration,
+	} {
+		if v, ok := params[name]; ok {
+			b, ok := v.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a boolean", name)
+			}
+			*dst = b
+		}
+	}
+
+	if v, ok := params["claimHeaders"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("claimHeaders must be an object mapping header names to claim names")
+		}
+		cfg.ClaimHeaders = make(map[string]string, len(m))
+		for header, claim := range m {
+			s, ok := claim.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("claimHeaders.%s must be a claim name", header)
+			}
+			cfg.ClaimHeaders[header] = s
+		}
+	}
+	return cfg, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func bearerToken(headers map[string][]string, name string) (string, bool) {
+	var value string
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			value = values[0]
+			break
+		}
+	}
+	if len(value) < 7 || !strings.EqualFold(value[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(value[7:])
+	return token, token != ""
+}
+
+func unauthorized(body, contentType, code, description string) ImmediateResponse {
+	challenge := `Bearer`
+	if code != "" {
+		challenge += fmt.Sprintf(` error="%s", error_description="%s"`, code, strings.ReplaceAll(description, `"`, `'`))
+	}
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type":     {contentType},
+			"WWW-Authenticate": {challenge},
+		},
+		Body: body,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
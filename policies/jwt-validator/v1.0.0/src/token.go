@@ -0,0 +1,260 @@
+package jwt_validator
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// supportedAlgorithms lists the asymmetric JWS algorithms the policy verifies.
+// Symmetric algorithms are left out on purpose: a JWKS only publishes public keys.
+var supportedAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+type token struct {
+	Header       tokenHeader
+	Claims       map[string]interface{}
+	signingInput []byte
+	signature    []byte
+}
+
+// parseToken splits a compact JWS and decodes its header and claims. It does
+// not check the signature.
+func parseToken(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	tok := &token{
+		signingInput: []byte(parts[0] + "." + parts[1]),
+		signature:    signature,
+	}
+	if err := json.Unmarshal(headerJSON, &tok.Header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	// Numbers stay json.Number so large integer claims keep their precision
+	dec := json.NewDecoder(bytes.NewReader(claimsJSON))
+	dec.UseNumber()
+	if err := dec.Decode(&tok.Claims); err != nil || tok.Claims == nil {
+		return nil, errors.New("malformed token payload")
+	}
+	return tok, nil
+}
+
+func (t *token) verify(key crypto.PublicKey) error {
+	alg := t.Header.Alg
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, t.signingInput, t.signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	hash, err := algorithmHash(alg)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(t.signingInput)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, hash, digest, t.signature) != nil {
+			return errors.New("invalid signature")
+		}
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+		if !ok || rsa.VerifyPSS(pub, hash, digest, t.signature, opts) != nil {
+			return errors.New("invalid signature")
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("invalid signature")
+		}
+		// JWS encodes ECDSA signatures as fixed-size r || s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil
+}
+
+func algorithmHash(alg string) (crypto.Hash, error) {
+	if len(alg) != 5 {
+		return 0, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// checkClaims applies the time, issuer and audience checks from RFC 7519
+func checkClaims(claims map[string]interface{}, cfg validatorConfig, now time.Time) error {
+	if exp, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok {
+		if !now.Before(exp.Add(cfg.ClockSkew)) {
+			return errors.New("token is expired")
+		}
+	} else if cfg.RequireExpiration {
+		return errors.New("token has no expiration")
+	}
+
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(cfg.ClockSkew).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok, err := numericDate(claims, "iat"); err != nil {
+		return err
+	} else if ok && now.Add(cfg.ClockSkew).Before(iat) {
+		return errors.New("token was issued in the future")
+	}
+
+	if len(cfg.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(cfg.Issuers, iss) {
+			return errors.New("token issuer is not accepted")
+		}
+	}
+
+	if len(cfg.Audiences) > 0 {
+		var auds []string
+		switch v := claims["aud"].(type) {
+		case string:
+			auds = []string{v}
+		case []interface{}:
+			for _, a := range v {
+				if s, ok := a.(string); ok {
+					auds = append(auds, s)
+				}
+			}
+		}
+		matched := false
+		for _, aud := range auds {
+			if contains(cfg.Audiences, aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.New("token audience is not accepted")
+		}
+	}
+	return nil
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s must be a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %s must be a number", name)
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true, nil
+}
+
+// claimString renders a claim as a header value. Dots address nested claims
+// and lists are joined with commas.
+func claimString(claims map[string]interface{}, name string) (string, bool) {
+	s, ok := renderClaim(claims, name)
+	if !ok || strings.ContainsAny(s, "\r\n") {
+		return "", false
+	}
+	return s, true
+}
+
+func renderClaim(claims map[string]interface{}, name string) (string, bool) {
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				items = append(items, item)
+			case json.Number:
+				items = append(items, item.String())
+			}
+		}
+		return strings.Join(items, ","), true
+	}
+	return "", false
+}
@@ -0,0 +1,260 @@
+package jwt_validator
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxJWKSSize bounds how much of a JWKS response is read
+const maxJWKSSize = 1 << 20
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type cachedKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// jwksCache holds the keys published at one JWKS URL. Keys are refetched when
+// they are older than the TTL, and early when a token names an unknown key ID
+// so that key rotation is picked up without waiting for the TTL. Refetches are
+// spaced at least refreshMinimum apart so forged key IDs cannot flood the
+// identity provider.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu             sync.Mutex
+	keys           map[string]cachedKey
+	fetchedAt      time.Time
+	lastAttempt    time.Time
+	lastErr        error
+	inflight       chan struct{}
+	ttl            time.Duration
+	refreshMinimum time.Duration
+}
+
+func newJWKSCache(url string, timeout time.Duration) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *jwksCache) setTimings(ttl, refreshMinimum time.Duration) {
+	c.mu.Lock()
+	c.ttl = ttl
+	c.refreshMinimum = refreshMinimum
+	c.mu.Unlock()
+}
+
+// key returns the key for kid. An empty kid matches the only key in the set.
+func (c *jwksCache) key(kid, alg string) (crypto.PublicKey, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	key, found := c.lookup(kid, alg)
+	stale := now.Sub(c.fetchedAt) >= c.ttl
+	canRefresh := c.inflight != nil || now.Sub(c.lastAttempt) >= c.refreshMinimum
+	neverFetched := c.fetchedAt.IsZero()
+	c.mu.Unlock()
+
+	switch {
+	case found && stale && canRefresh:
+		// Serve the cached key while a fresh copy is fetched in the background
+		go c.refresh()
+		return key, nil
+	case found:
+		return key, nil
+	case !canRefresh && neverFetched:
+		return nil, errors.New("signing keys are unavailable")
+	case !canRefresh:
+		return nil, errors.New("unknown signing key")
+	}
+
+	if err := c.refresh(); err != nil {
+		return nil, fmt.Errorf("signing keys are unavailable: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, found = c.lookup(kid, alg); !found {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// lookup must be called with c.mu held
+func (c *jwksCache) lookup(kid, alg string) (crypto.PublicKey, bool) {
+	var k cachedKey
+	var ok bool
+	if kid != "" {
+		k, ok = c.keys[kid]
+	} else if len(c.keys) == 1 {
+		for _, only := range c.keys {
+			k, ok = only, true
+		}
+	}
+	// A key that declares its algorithm may only be used with that algorithm
+	if !ok || (k.alg != "" && k.alg != alg) {
+		return nil, false
+	}
+	return k.key, true
+}
+
+// refresh fetches the key set, or waits for the fetch already in progress
+func (c *jwksCache) refresh() error {
+	c.mu.Lock()
+	if ch := c.inflight; ch != nil {
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.lastErr
+	}
+	ch := make(chan struct{})
+	c.inflight = ch
+	c.lastAttempt = time.Now()
+	c.mu.Unlock()
+
+	keys, err := c.fetch()
+
+	c.mu.Lock()
+	// On failure keep serving the previous keys until the next successful fetch
+	if err == nil {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+	}
+	c.lastErr = err
+	c.inflight = nil
+	c.mu.Unlock()
+	close(ch)
+	return err
+}
+
+func (c *jwksCache) fetch() (map[string]cachedKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]cachedKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			// Skip keys of unknown types so one bad entry does not hide the rest
+			continue
+		}
+		keys[k.Kid] = cachedKey{alg: k.Alg, key: pub}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var check ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, check = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, check = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, check = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		// Reject points that are not on the curve before they reach ecdsa
+		size := (curve.Params().BitSize + 7) / 8
+		if x.BitLen() > 8*size || y.BitLen() > 8*size {
+			return nil, errors.New("invalid EC key")
+		}
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		x.FillBytes(point[1 : 1+size])
+		y.FillBytes(point[1+size:])
+		if _, err := check.NewPublicKey(point); err != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
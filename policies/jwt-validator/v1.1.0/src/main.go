@@ -0,0 +1,543 @@
+package jwt_validator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// claimsKey stores the verified claims in the SharedContext for later policies
+const claimsKey = "jwt.claims"
+
+const (
+	defaultHeaderName         = "Authorization"
+	defaultConsumerClaim      = "sub"
+	defaultClockSkew          = 60 * time.Second
+	defaultJWKSCacheTTL       = 5 * time.Minute
+	defaultJWKSRefreshMinimum = 30 * time.Second
+	defaultJWKSTimeout        = 2 * time.Second
+	defaultUnauthorizedBody   = `{"error": "Unauthorized"}`
+)
+
+type JWTValidatorPolicy struct {
+	mu   sync.Mutex
+	jwks map[string]*jwksCache
+}
+
+type validatorConfig struct {
+	JWKSURL           string
+	Issuers           []string
+	Audiences         []string
+	Algorithms        []string
+	ClockSkew         time.Duration
+	HeaderName        string
+	CacheTTL          time.Duration
+	RefreshMinimum    time.Duration
+	Timeout           time.Duration
+	ClaimHeaders      map[string]string
+	ConsumerClaim     string
+	UnauthorizedBody  string
+	UnauthorizedType  string
+	ForwardToken      bool
+	RequireExpiration bool
+}
+
+// Validate configuration parameters
+func (j *JWTValidatorPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (j *JWTValidatorPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (j *JWTValidatorPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody, "application/json", "invalid_token", "policy is misconfigured")
+	}
+
+	raw, ok := bearerToken(ctx.Headers, cfg.HeaderName)
+	if !ok {
+		// RFC 6750: no error code when the request carries no credentials
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "", "")
+	}
+
+	tok, err := parseToken(raw)
+	if err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if !contains(cfg.Algorithms, tok.Header.Alg) {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", "algorithm not allowed")
+	}
+
+	key, err := j.cache(cfg).key(tok.Header.Kid, tok.Header.Alg)
+	if err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if err := tok.verify(key); err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+	if err := checkClaims(tok.Claims, cfg, time.Now()); err != nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.UnauthorizedType, "invalid_token", err.Error())
+	}
+
+	ctx.SharedContext.Set(claimsKey, tok.Claims)
+	if v, ok := claimString(tok.Claims, cfg.ConsumerClaim); ok && v != "" {
+		ctx.SharedContext.Set(ConsumerIDKey, v)
+	}
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	for header, claim := range cfg.ClaimHeaders {
+		if v, ok := claimString(tok.Claims, claim); ok {
+			mods.SetHeaders[header] = v
+		} else {
+			// Never let a client supply a header the upstream trusts as a claim
+			mods.RemoveHeaders = append(mods.RemoveHeaders, header)
+		}
+	}
+	if !cfg.ForwardToken {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.HeaderName)
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (j *JWTValidatorPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// cache returns the key cache for the configured JWKS URL
+func (j *JWTValidatorPolicy) cache(cfg validatorConfig) *jwksCache {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jwks == nil {
+		j.jwks = make(map[string]*jwksCache)
+	}
+	c, ok := j.jwks[cfg.JWKSURL]
+	if !ok {
+		c = newJWKSCache(cfg.JWKSURL, cfg.Timeout)
+		j.jwks[cfg.JWKSURL] = c
+	}
+	c.setTimings(cfg.CacheTTL, cfg.RefreshMinimum)
+	return c
+}
+
+func parseConfig(params map[string]interface{}) (validatorConfig, error) {
+	cfg := validatorConfig{
+		Algorithms:        supportedAlgorithms,
+		ClockSkew:         defaultClockSkew,
+		HeaderName:        defaultHeaderName,
+		ConsumerClaim:     defaultConsumerClaim,
+		CacheTTL:          defaultJWKSCacheTTL,
+		RefreshMinimum:    defaultJWKSRefreshMinimum,
+		Timeout:           defaultJWKSTimeout,
+		UnauthorizedBody:  defaultUnauthorizedBody,
+		UnauthorizedType:  "application/json",
+		ForwardToken:      true,
+		RequireExpiration: true,
+	}
+
+	url, ok := params["jwksUrl"].(string)
+	if !ok || !(strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")) {
+		return cfg, errors.New("jwksUrl is required and must be an http(s) URL")
+	}
+	cfg.JWKSURL = url
+
+	var err error
+	if cfg.Issuers, err = stringList(params, "issuer"); err != nil {
+		return cfg, err
+	}
+	if cfg.Audiences, err = stringList(params, "audience"); err != nil {
+		return cfg, err
+	}
+	if _, ok := params["allowedAlgorithms"]; ok {
+		if cfg.Algorithms, err = stringList(params, "allowedAlgorithms"); err != nil {
+			return cfg, err
+		}
+		if len(cfg.Algorithms) == 0 {
+			return cfg, errors.New("allowedAlgorithms must not be empty")
+		}
+		for _, alg := range cfg.Algorithms {
+			if !contains(supportedAlgorithms, alg) {
+				return cfg, fmt.Errorf("allowedAlgorithms: unsupported algorithm %q", alg)
+			}
+		}
+	}
+
+	for name, dst := range map[string]*time.Duration{
+		"clockSkewSeconds":           &cfg.ClockSkew,
+		"jwksCacheTtlSeconds":        &cfg.CacheTTL,
+		"jwksRefreshIntervalSeconds": &cfg.RefreshMinimum,
+		"jwksTimeoutMs":              &cfg.Timeout,
+	} {
+		v, ok := params[name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		unit := time.Second
+		if strings.HasSuffix(name, "Ms") {
+			unit = time.Millisecond
+		}
+		*dst = time.Duration(f) * unit
+	}
+
+	for name, dst := range map[string]*string{
+		"headerName":              &cfg.HeaderName,
+		"consumerClaim":           &cfg.ConsumerClaim,
+		"unauthorizedBody":        &cfg.UnauthorizedBody,
+		"unauthorizedContentType": &cfg.UnauthorizedType,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+
+	for name, dst := range map[string]*bool{
+		"forwardToken":      &cfg.ForwardToken,
+		"requireExpiration": &cfg.RequireExpiration,
+	} {
+		if v, ok := params[name]; ok {
+			b, ok := v.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a boolean", name)
+			}
+			*dst = b
+		}
+	}
+
+	if v, ok := params["claimHeaders"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("claimHeaders must be an object mapping header names to claim names")
+		}
+		cfg.ClaimHeaders = make(map[string]string, len(m))
+		for header, claim := range m {
+			s, ok := claim.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("claimHeaders.%s must be a claim name", header)
+			}
+			cfg.ClaimHeaders[header] = s
+		}
+	}
+	return cfg, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func bearerToken(headers map[string][]string, name string) (string, bool) {
+	var value string
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			value = values[0]
+			break
+		}
+	}
+	if len(value) < 7 || !strings.EqualFold(value[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(value[7:])
+	return token, token != ""
+}
+
+func unauthorized(body, contentType, code, description string) ImmediateResponse {
+	challenge := `Bearer`
+	if code != "" {
+		challenge += fmt.Sprintf(` error="%s", error_description="%s"`, code, strings.ReplaceAll(description, `"`, `'`))
+	}
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type":     {contentType},
+			"WWW-Authenticate": {challenge},
+		},
+		Body: body,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
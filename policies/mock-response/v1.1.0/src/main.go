@@ -0,0 +1,575 @@
+package mock_response
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+type MockResponsePolicy struct {
+	matchers Matchers
+}
+
+// variant is one canned response
+type variant struct {
+	Name    string
+	Status  int
+	Headers map[string][]string
+	Body    string
+	Delay   time.Duration
+	Jitter  time.Duration
+	// Match selects the variant for the requests it applies to. Variants
+	// without it are picked by Weight.
+	Match  *variantMatch
+	Weight float64
+}
+
+// variantMatch holds the conditions of a variant's match, which must all
+// hold
+type variantMatch struct {
+	// Path is nil when any path matches
+	Path    *Matcher
+	Headers []HeaderMatcher
+}
+
+type mockConfig struct {
+	Variants []variant
+}
+
+// Validate configuration parameters
+func (p *MockResponsePolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *MockResponsePolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *MockResponsePolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	v, ok := cfg.choose(ctx, rand.Float64)
+	if !ok {
+		// Nothing is mocked for this request, so the upstream answers it
+		return UpstreamRequestModifications{}
+	}
+	if delay := v.delay(rand.Int63n); delay > 0 {
+		time.Sleep(delay)
+	}
+	headers := make(map[string][]string, len(v.Headers))
+	for k, values := range v.Headers {
+		headers[k] = append([]string(nil), values...)
+	}
+	return ImmediateResponse{Status: v.Status, Headers: headers, Body: v.Body}
+}
+
+// Response phase (not used)
+func (p *MockResponsePolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// choose returns the first variant whose match applies to the request. When
+// none does, one of the variants without a match is picked at random in
+// proportion to its weight.
+func (cfg mockConfig) choose(ctx *RequestContext, random func() float64) (variant, bool) {
+	var total float64
+	for _, v := range cfg.Variants {
+		if v.Match == nil {
+			total += v.Weight
+			continue
+		}
+		if v.Match.applies(ctx) {
+			return v, true
+		}
+	}
+	if total <= 0 {
+		return variant{}, false
+	}
+	r := random() * total
+	var last variant
+	for _, v := range cfg.Variants {
+		if v.Match != nil || v.Weight <= 0 {
+			continue
+		}
+		if r < v.Weight {
+			return v, true
+		}
+		r -= v.Weight
+		last = v
+	}
+	// Rounding can leave r just above the last weight
+	return last, true
+}
+
+// applies reports whether the request satisfies every condition of the match
+func (m *variantMatch) applies(ctx *RequestContext) bool {
+	if m.Path != nil && !m.Path.Match(RequestPath(ctx.Path)) {
+		return false
+	}
+	for _, h := range m.Headers {
+		if !h.Match(ctx.Headers) {
+			return false
+		}
+	}
+	return true
+}
+
+// delay returns the variant's latency with up to Jitter added
+func (v variant) delay(random func(int64) int64) time.Duration {
+	d := v.Delay
+	if v.Jitter > 0 {
+		d += time.Duration(random(int64(v.Jitter) + 1))
+	}
+	return d
+}
+
+// parseConfig reads the variants after the schema has checked them
+func (p *MockResponsePolicy) parseConfig(params map[string]interface{}) (mockConfig, error) {
+	var cfg mockConfig
+	var errs paramErrors
+	names := map[string]bool{}
+
+	list, _ := params["responses"].([]interface{})
+	for i, item := range list {
+		m, _ := item.(map[string]interface{})
+		path := fmt.Sprintf("responses[%d]", i)
+		v := variant{Headers: map[string][]string{}}
+		v.Name, _ = m["name"].(string)
+		if v.Name != "" {
+			if names[v.Name] {
+				errs.add(path+".name", fmt.Sprintf("duplicates %q", v.Name))
+			}
+			names[v.Name] = true
+		}
+		status, _ := m["status"].(float64)
+		v.Status = int(status)
+		delay, _ := m["delayMs"].(float64)
+		jitter, _ := m["delayJitterMs"].(float64)
+		v.Delay = time.Duration(delay) * time.Millisecond
+		v.Jitter = time.Duration(jitter) * time.Millisecond
+		v.Weight, _ = m["weight"].(float64)
+
+		headers, _ := m["headers"].(map[string]interface{})
+		for name, value := range headers {
+			s, _ := value.(string)
+			switch {
+			case !validHeaderName(name):
+				errs.add(path+".headers."+name, "must be a valid header name")
+			case strings.ContainsAny(s, "\r\n"):
+				errs.add(path+".headers."+name, "must not contain line breaks")
+			default:
+				v.Headers[name] = []string{s}
+			}
+		}
+
+		contentType := "text/plain; charset=utf-8"
+		switch body := m["body"].(type) {
+		case string:
+			v.Body = body
+			if json.Valid([]byte(body)) {
+				contentType = "application/json"
+			}
+		case nil:
+		default:
+			// Bodies written as YAML or JSON structures are sent as JSON
+			out, err := json.Marshal(body)
+			if err != nil {
+				errs.add(path+".body", "cannot be encoded as JSON: "+err.Error())
+			}
+			v.Body = string(out)
+			contentType = "application/json"
+		}
+		if _, ok := headerValues(v.Headers, "Content-Type"); !ok && v.Body != "" {
+			v.Headers["Content-Type"] = []string{contentType}
+		}
+
+		if match, ok := m["match"].(map[string]interface{}); ok {
+			v.Match = p.parseMatch(match, path+".match", &errs)
+		}
+		cfg.Variants = append(cfg.Variants, v)
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// parseMatch reads the conditions of a variant's match
+func (p *MockResponsePolicy) parseMatch(m map[string]interface{}, path string, errs *paramErrors) *variantMatch {
+	vm := &variantMatch{}
+	raw, hasPath := m["path"]
+	if hasPath {
+		matcher, err := p.matchers.Parse(raw, MatchGlob)
+		if err != nil {
+			errs.add(path+".path", err.Error())
+		}
+		vm.Path = matcher
+	}
+	name, hasHeader := m["header"].(string)
+	if hasHeader {
+		h := HeaderMatcher{Name: name, Present: true}
+		if !validHeaderName(name) {
+			errs.add(path+".header", "must be a valid header name")
+		}
+		if value, ok := m["value"].(string); ok {
+			// value is compared with the whitespace around the header
+			// value left out
+			h.Value, _ = p.matchers.Compile(MatcherSpec{
+				Kind:    MatchRegex,
+				Pattern: `^[ \t]*` + regexp.QuoteMeta(value) + `[ \t]*$`,
+			})
+		}
+		vm.Headers = append(vm.Headers, h)
+	} else if _, ok := m["value"]; ok {
+		errs.add(path+".value", "requires header")
+	}
+	headers, _ := m["headers"].([]interface{})
+	for i, raw := range headers {
+		h, err := p.matchers.ParseHeader(raw)
+		if err != nil {
+			errs.add(fmt.Sprintf("%s.headers[%d]", path, i), err.Error())
+			continue
+		}
+		vm.Headers = append(vm.Headers, h)
+	}
+	if !hasPath && !hasHeader && len(headers) == 0 {
+		errs.add(path, "must set at least one of path, header and headers")
+	}
+	return vm
+}
+
+// headerValues returns the values of a header, matching its name without
+// regard to case
+func headerValues(headers map[string][]string, name string) ([]string, bool) {
+	if values, ok := headers[name]; ok {
+		return values, true
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values, true
+		}
+	}
+	return nil, false
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
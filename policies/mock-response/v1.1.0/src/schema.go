@@ -0,0 +1,70 @@
+package mock_response
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "definitions": {
+    "matcher": {
+      "oneOf": [
+        {"type": "string", "minLength": 1},
+        {
+          "type": "object",
+          "properties": {
+            "exact": {"type": "string"},
+            "prefix": {"type": "string"},
+            "glob": {"type": "string"},
+            "regex": {"type": "string"},
+            "ignoreCase": {"type": "boolean", "default": false}
+          },
+          "additionalProperties": false
+        }
+      ]
+    },
+    "headerMatcher": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string", "minLength": 1},
+        "exact": {"type": "string"},
+        "prefix": {"type": "string"},
+        "glob": {"type": "string"},
+        "regex": {"type": "string"},
+        "ignoreCase": {"type": "boolean", "default": false},
+        "present": {"type": "boolean", "default": true}
+      },
+      "required": ["name"],
+      "additionalProperties": false
+    }
+  },
+  "properties": {
+    "responses": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "status": {"type": "integer", "minimum": 100, "maximum": 599, "default": 200},
+          "headers": {"type": "object", "additionalProperties": {"type": "string"}},
+          "body": {"type": ["string", "object", "array"]},
+          "delayMs": {"type": "integer", "minimum": 0, "maximum": 60000, "default": 0},
+          "delayJitterMs": {"type": "integer", "minimum": 0, "maximum": 60000, "default": 0},
+          "match": {
+            "type": "object",
+            "properties": {
+              "path": {"$ref": "#/definitions/matcher"},
+              "header": {"type": "string", "minLength": 1},
+              "value": {"type": "string"},
+              "headers": {"type": "array", "items": {"$ref": "#/definitions/headerMatcher"}}
+            }
+          },
+          "weight": {"type": "number", "minimum": 0, "default": 1}
+        }
+      }
+    }
+  },
+  "required": ["responses"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
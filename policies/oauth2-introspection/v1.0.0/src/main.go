@@ -0,0 +1,616 @@
+package oauth2_introspection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// claimsKey stores the introspection response in the SharedContext for later
+// policies
+const claimsKey = "oauth2-introspection.claims"
+
+const (
+	defaultHeaderName       = "Authorization"
+	defaultTokenTypeHint    = "access_token"
+	defaultConsumerClaim    = "sub"
+	defaultCacheTTL         = 5 * time.Minute
+	defaultMaxCacheEntries  = 10000
+	defaultTimeout          = 2 * time.Second
+	defaultUnauthorizedBody = `{"error": "Unauthorized"}`
+	defaultForbiddenBody    = `{"error": "Forbidden"}`
+
+	unavailableBody = `{"error": "Service unavailable"}`
+)
+
+type IntrospectionPolicy struct {
+	mu            sync.Mutex
+	introspectors map[introspectorKey]*introspector
+}
+
+type introspectionConfig struct {
+	URL              string
+	ClientID         string
+	ClientSecret     string
+	TokenTypeHint    string
+	RequiredScopes   []string
+	HeaderName       string
+	ForwardToken     bool
+	ClaimHeaders     map[string]string
+	ConsumerClaim    string
+	CacheTTL         time.Duration
+	MaxCacheEntries  int
+	Timeout          time.Duration
+	UnauthorizedBody string
+	ForbiddenBody    string
+	ContentType      string
+}
+
+// Validate configuration parameters
+func (p *IntrospectionPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *IntrospectionPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *IntrospectionPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unauthorized(defaultUnauthorizedBody, "application/json", "invalid_token", "policy is misconfigured")
+	}
+
+	token, ok := bearerToken(ctx.Headers, cfg.HeaderName)
+	if !ok {
+		// RFC 6750: no error code when the request carries no credentials
+		return unauthorized(cfg.UnauthorizedBody, cfg.ContentType, "", "")
+	}
+
+	claims, err := p.introspector(cfg).introspect(token, time.Now())
+	if err != nil {
+		// The token may well be valid; the client should retry rather than
+		// discard it
+		return ImmediateResponse{
+			Status:  503,
+			Headers: map[string][]string{"Content-Type": {"application/json"}},
+			Body:    unavailableBody,
+		}
+	}
+	if claims == nil {
+		return unauthorized(cfg.UnauthorizedBody, cfg.ContentType, "invalid_token", "token is not active")
+	}
+	if !hasScopes(claims, cfg.RequiredScopes) {
+		return forbidden(cfg.ForbiddenBody, cfg.ContentType, cfg.RequiredScopes)
+	}
+
+	ctx.SharedContext.Set(claimsKey, claims)
+	if v, ok := claimString(claims, cfg.ConsumerClaim); ok && v != "" {
+		ctx.SharedContext.Set(ConsumerIDKey, v)
+	}
+
+	mods := UpstreamRequestModifications{SetHeaders: map[string]string{}}
+	for header, claim := range cfg.ClaimHeaders {
+		if v, ok := claimString(claims, claim); ok {
+			mods.SetHeaders[header] = v
+		} else {
+			// Never let a client supply a header the upstream trusts as a claim
+			mods.RemoveHeaders = append(mods.RemoveHeaders, header)
+		}
+	}
+	if !cfg.ForwardToken {
+		mods.RemoveHeaders = append(mods.RemoveHeaders, cfg.HeaderName)
+	}
+	return mods
+}
+
+// Response phase (not used)
+func (p *IntrospectionPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// introspector returns the client and cache for the configured endpoint and
+// credentials
+func (p *IntrospectionPolicy) introspector(cfg introspectionConfig) *introspector {
+	key := introspectorKey{url: cfg.URL, clientID: cfg.ClientID, clientSecret: cfg.ClientSecret, hint: cfg.TokenTypeHint}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.introspectors == nil {
+		p.introspectors = make(map[introspectorKey]*introspector)
+	}
+	in, ok := p.introspectors[key]
+	if !ok {
+		in = newIntrospector(key)
+		p.introspectors[key] = in
+	}
+	in.setLimits(cfg.Timeout, cfg.CacheTTL, cfg.MaxCacheEntries)
+	return in
+}
+
+func parseConfig(params map[string]interface{}) (introspectionConfig, error) {
+	cfg := introspectionConfig{
+		TokenTypeHint:    defaultTokenTypeHint,
+		HeaderName:       defaultHeaderName,
+		ForwardToken:     true,
+		ConsumerClaim:    defaultConsumerClaim,
+		CacheTTL:         defaultCacheTTL,
+		MaxCacheEntries:  defaultMaxCacheEntries,
+		Timeout:          defaultTimeout,
+		UnauthorizedBody: defaultUnauthorizedBody,
+		ForbiddenBody:    defaultForbiddenBody,
+		ContentType:      "application/json",
+	}
+
+	url, ok := params["introspectionUrl"].(string)
+	if !ok || !(strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")) {
+		return cfg, errors.New("introspectionUrl is required and must be an http(s) URL")
+	}
+	cfg.URL = url
+
+	for name, dst := range map[string]*string{
+		"clientId":         &cfg.ClientID,
+		"clientSecret":     &cfg.ClientSecret,
+		"tokenTypeHint":    &cfg.TokenTypeHint,
+		"headerName":       &cfg.HeaderName,
+		"consumerClaim":    &cfg.ConsumerClaim,
+		"unauthorizedBody": &cfg.UnauthorizedBody,
+		"forbiddenBody":    &cfg.ForbiddenBody,
+		"errorContentType": &cfg.ContentType,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+	if (cfg.ClientID == "") != (cfg.ClientSecret == "") {
+		return cfg, errors.New("clientId and clientSecret must be set together")
+	}
+
+	var err error
+	if cfg.RequiredScopes, err = stringList(params, "requiredScopes"); err != nil {
+		return cfg, err
+	}
+	for _, scope := range cfg.RequiredScopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\"\\") {
+			return cfg, fmt.Errorf("requiredScopes: invalid scope %q", scope)
+		}
+	}
+
+	if v, ok := params["forwardToken"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("forwardToken must be a boolean")
+		}
+		cfg.ForwardToken = b
+	}
+
+	for name, dst := range map[string]*time.Duration{
+		"cacheTtlSeconds": &cfg.CacheTTL,
+		"timeoutMs":       &cfg.Timeout,
+	} {
+		v, ok := params[name]
+		if !ok {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int64(f)) {
+			return cfg, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		unit := time.Second
+		if strings.HasSuffix(name, "Ms") {
+			unit = time.Millisecond
+		}
+		*dst = time.Duration(f) * unit
+	}
+	if cfg.Timeout == 0 {
+		return cfg, errors.New("timeoutMs must be positive")
+	}
+	if v, ok := params["maxCacheEntries"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int(f)) {
+			return cfg, errors.New("maxCacheEntries must be a positive integer")
+		}
+		cfg.MaxCacheEntries = int(f)
+	}
+
+	if v, ok := params["claimHeaders"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("claimHeaders must be an object mapping header names to claim names")
+		}
+		cfg.ClaimHeaders = make(map[string]string, len(m))
+		for header, claim := range m {
+			s, ok := claim.(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("claimHeaders.%s must be a claim name", header)
+			}
+			cfg.ClaimHeaders[header] = s
+		}
+	}
+	return cfg, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func bearerToken(headers map[string][]string, name string) (string, bool) {
+	var value string
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			value = values[0]
+			break
+		}
+	}
+	if len(value) < 7 || !strings.EqualFold(value[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(value[7:])
+	return token, token != ""
+}
+
+// hasScopes reports whether the token was granted every required scope
+func hasScopes(claims map[string]interface{}, required []string) bool {
+	scope, _ := claims["scope"].(string)
+	granted := strings.Fields(scope)
+	for _, s := range required {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func unauthorized(body, contentType, code, description string) ImmediateResponse {
+	challenge := `Bearer`
+	if code != "" {
+		challenge += fmt.Sprintf(` error="%s", error_description="%s"`, code, strings.ReplaceAll(description, `"`, `'`))
+	}
+	return ImmediateResponse{
+		Status: 401,
+		Headers: map[string][]string{
+			"Content-Type":     {contentType},
+			"WWW-Authenticate": {challenge},
+		},
+		Body: body,
+	}
+}
+
+// forbidden names every scope the resource needs, as RFC 6750 section 3.1
+// suggests, so the client can request a suitable token
+func forbidden(body, contentType string, scopes []string) ImmediateResponse {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_scope", error_description="token lacks a required scope", scope="%s"`, strings.Join(scopes, " "))
+	return ImmediateResponse{
+		Status: 403,
+		Headers: map[string][]string{
+			"Content-Type":     {contentType},
+			"WWW-Authenticate": {challenge},
+		},
+		Body: body,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package oauth2_introspection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseSize bounds how much of an introspection response is read
+const maxResponseSize = 1 << 20
+
+// introspectorKey identifies configurations that share a client and cache.
+// Tokens are only ever looked up with the client they were checked by; a
+// rotated secret of the same client keeps the cache.
+type introspectorKey struct {
+	url          string
+	clientID     string
+	clientSecret string
+	hint         string
+}
+
+// sameClient reports whether two keys differ at most in the client secret
+func (k introspectorKey) sameClient(other introspectorKey) bool {
+	k.clientSecret = other.clientSecret
+	return k == other
+}
+
+type cachedResult struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+// introspector asks an RFC 7662 endpoint about tokens and remembers active
+// ones until they expire or the cache TTL passes, whichever comes first.
+// Inactive tokens are not cached, so a token that is looked up before the
+// authorization server knows about it is not rejected for long.
+type introspector struct {
+	key introspectorKey
+
+	mu         sync.Mutex
+	client     *http.Client
+	ttl        time.Duration
+	maxEntries int
+	// cache is keyed by a hash of the token so raw tokens are not kept
+	cache map[[sha256.Size]byte]cachedResult
+	// clientSecret starts as key.clientSecret and is replaced by rotations
+	clientSecret string
+}
+
+func newIntrospector(key introspectorKey) *introspector {
+	return &introspector{
+		key:          key,
+		client:       &http.Client{},
+		cache:        make(map[[sha256.Size]byte]cachedResult),
+		clientSecret: key.clientSecret,
+	}
+}
+
+// setClientSecret replaces the secret sent to the endpoint
+func (in *introspector) setClientSecret(secret string) {
+	in.mu.Lock()
+	in.clientSecret = secret
+	in.mu.Unlock()
+}
+
+func (in *introspector) setLimits(timeout, ttl time.Duration, maxEntries int) {
+	in.mu.Lock()
+	in.client.Timeout = timeout
+	in.ttl = ttl
+	in.maxEntries = maxEntries
+	in.mu.Unlock()
+}
+
+// introspect returns the claims of an active token, or nil claims for a
+// token the authorization server does not consider active
+func (in *introspector) introspect(token string, now time.Time) (map[string]interface{}, error) {
+	sum := sha256.Sum256([]byte(token))
+
+	in.mu.Lock()
+	if r, ok := in.cache[sum]; ok {
+		if now.Before(r.expires) {
+			in.mu.Unlock()
+			return r.claims, nil
+		}
+		delete(in.cache, sum)
+	}
+	client, ttl, secret := in.client, in.ttl, in.clientSecret
+	in.mu.Unlock()
+
+	claims, err := in.fetch(client, secret, token)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+
+	expires := now.Add(ttl)
+	if exp, ok := numericDate(claims, "exp"); ok {
+		if !now.Before(exp) {
+			// Some servers report expired tokens as active until they clean up
+			return nil, nil
+		}
+		if exp.Before(expires) {
+			expires = exp
+		}
+	}
+	if ttl > 0 {
+		in.store(sum, cachedResult{claims: claims, expires: expires}, now)
+	}
+	return claims, nil
+}
+
+func (in *introspector) fetch(client *http.Client, clientSecret, token string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}}
+	if in.key.hint != "" {
+		form.Set("token_type_hint", in.key.hint)
+	}
+	req, err := http.NewRequest(http.MethodPost, in.key.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.key.clientID != "" {
+		// RFC 6749 section 2.3.1: credentials are form-encoded before use
+		req.SetBasicAuth(url.QueryEscape(in.key.clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	// Numbers stay json.Number so large integer claims keep their precision
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil || claims == nil {
+		return nil, errors.New("malformed introspection response")
+	}
+	active, ok := claims["active"].(bool)
+	if !ok {
+		return nil, errors.New("introspection response has no active member")
+	}
+	if !active {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// store adds a result, making room by dropping expired entries and, if the
+// cache is still full, arbitrary ones
+func (in *introspector) store(sum [sha256.Size]byte, r cachedResult, now time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.cache) >= in.maxEntries {
+		for k, old := range in.cache {
+			if !now.Before(old.expires) {
+				delete(in.cache, k)
+			}
+		}
+		for k := range in.cache {
+			if len(in.cache) < in.maxEntries {
+				break
+			}
+			delete(in.cache, k)
+		}
+	}
+	in.cache[sum] = r
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// claimString renders a claim as a header value. Dots address nested claims
+// and lists are joined with commas.
+func claimString(claims map[string]interface{}, name string) (string, bool) {
+	s, ok := renderClaim(claims, name)
+	if !ok || strings.ContainsAny(s, "\r\n") {
+		return "", false
+	}
+	return s, true
+}
+
+func renderClaim(claims map[string]interface{}, name string) (string, bool) {
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				items = append(items, item)
+			case json.Number:
+				items = append(items, item.String())
+			}
+		}
+		return strings.Join(items, ","), true
+	}
+	return "", false
+}
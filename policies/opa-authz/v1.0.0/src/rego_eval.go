@@ -0,0 +1,822 @@
+package opa_authz
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Values are those of encoding/json: nil, bool, float64, string,
+// []interface{} and map[string]interface{}, plus *regoSet. Object keys are
+// always strings.
+
+// regoSet is a Rego set. Elements are keyed by their canonical encoding.
+type regoSet struct {
+	items map[string]interface{}
+}
+
+func newSet() *regoSet {
+	return &regoSet{items: make(map[string]interface{})}
+}
+
+func (s *regoSet) add(v interface{}) {
+	s.items[canonical(v)] = v
+}
+
+func (s *regoSet) has(v interface{}) bool {
+	_, ok := s.items[canonical(v)]
+	return ok
+}
+
+// sorted returns the elements in Rego's order, so iteration is stable
+func (s *regoSet) sorted() []interface{} {
+	out := make([]interface{}, 0, len(s.items))
+	for _, v := range s.items {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return compareValues(out[i], out[j]) < 0 })
+	return out
+}
+
+// canonical encodes a value so that equal values encode the same
+func canonical(v interface{}) string {
+	var b strings.Builder
+	writeCanonical(&b, v)
+	return b.String()
+}
+
+func writeCanonical(b *strings.Builder, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case float64:
+		b.WriteString(formatNumber(v))
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case []interface{}:
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeCanonical(b, item)
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(k))
+			b.WriteByte(':')
+			writeCanonical(b, v[k])
+		}
+		b.WriteByte('}')
+	case *regoSet:
+		keys := make([]string, 0, len(v.items))
+		for k := range v.items {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("set(")
+		b.WriteString(strings.Join(keys, ","))
+		b.WriteByte(')')
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// typeRank orders values of different types the way Rego does
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	case map[string]interface{}:
+		return 5
+	}
+	return 6
+}
+
+func compareValues(a, b interface{}) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case bool:
+		switch bb := b.(bool); {
+		case a == bb:
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case float64:
+		bf := b.(float64)
+		switch {
+		case a < bf:
+			return -1
+		case a > bf:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		bl := b.([]interface{})
+		for i := 0; i < len(a) && i < len(bl); i++ {
+			if c := compareValues(a[i], bl[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(bl)
+	case map[string]interface{}:
+		bm := b.(map[string]interface{})
+		ak, bk := sortedKeys(a), sortedKeys(bm)
+		for i := 0; i < len(ak) && i < len(bk); i++ {
+			if c := strings.Compare(ak[i], bk[i]); c != 0 {
+				return c
+			}
+			if c := compareValues(a[ak[i]], bm[bk[i]]); c != 0 {
+				return c
+			}
+		}
+		return len(ak) - len(bk)
+	case *regoSet:
+		al, bl := a.sorted(), b.(*regoSet).sorted()
+		for i := 0; i < len(al) && i < len(bl); i++ {
+			if c := compareValues(al[i], bl[i]); c != 0 {
+				return c
+			}
+		}
+		return len(al) - len(bl)
+	}
+	return 0
+}
+
+// maxEvalSteps bounds the work of one evaluation, so a policy that iterates
+// over large inputs cannot hold up a request indefinitely
+const maxEvalSteps = 1_000_000
+
+var errEvalLimit = errors.New("evaluation took too many steps")
+
+// binding holds the variables bound in a body. It is immutable; bind
+// returns a new binding, so alternatives explored by backtracking never see each other's
+// bindings.
+type binding struct {
+	name string
+	val  interface{}
+	next *binding
+}
+
+// declared marks a variable declared with some but not yet bound
+var declared = &struct{}{}
+
+func (e *binding) bind(name string, val interface{}) *binding {
+	return &binding{name: name, val: val, next: e}
+}
+
+// lookup reports the value of a variable, and whether the body knows it at
+// all, bound or declared
+func (e *binding) lookup(name string) (val interface{}, bound, known bool) {
+	for ; e != nil; e = e.next {
+		if e.name == name {
+			if e.val == declared {
+				return nil, false, true
+			}
+			return e.val, true, true
+		}
+	}
+	return nil, false, false
+}
+
+type ruleResult struct {
+	val     interface{}
+	defined bool
+}
+
+// evaluator runs one query against an engine. It is used by one goroutine.
+type evaluator struct {
+	engine *regoEngine
+	input  interface{}
+	rules  map[string]ruleResult
+	// evaluating holds the rules being evaluated, to catch recursion
+	evaluating map[string]bool
+	steps      int
+	err        error
+}
+
+// fail records the first error and stops the search
+func (ev *evaluator) fail(err error) bool {
+	if ev.err == nil {
+		ev.err = err
+	}
+	return false
+}
+
+// The evaluation functions pass each solution to yield, which returns false
+// to stop the search. They return false when the search was stopped, by
+// yield or by an error.
+
+func (ev *evaluator) evalBody(body []*expr, env *binding, mod *module, yield func(*binding) bool) bool {
+	if len(body) == 0 {
+		return yield(env)
+	}
+	e, rest := body[0], body[1:]
+	next := func(env *binding) bool { return ev.evalBody(rest, env, mod, yield) }
+
+	switch e.kind {
+	case exprTerm:
+		return ev.evalTerm(e.term, env, mod, func(v interface{}, env *binding) bool {
+			if v == false {
+				return true
+			}
+			return next(env)
+		})
+	case exprNot:
+		found := false
+		ev.evalBody([]*expr{e.not}, env, mod, func(*binding) bool {
+			found = true
+			return false
+		})
+		if ev.err != nil {
+			return false
+		}
+		if found {
+			return true
+		}
+		return next(env)
+	case exprAssign:
+		name := e.lhs.(*ref).head
+		return ev.evalTerm(e.rhs, env, mod, func(v interface{}, env *binding) bool {
+			return next(env.bind(name, v))
+		})
+	case exprUnify:
+		if name, ok := ev.unboundVar(e.lhs, env, mod); ok {
+			return ev.evalTerm(e.rhs, env, mod, func(v interface{}, env *binding) bool {
+				return next(env.bind(name, v))
+			})
+		}
+		if name, ok := ev.unboundVar(e.rhs, env, mod); ok {
+			return ev.evalTerm(e.lhs, env, mod, func(v interface{}, env *binding) bool {
+				return next(env.bind(name, v))
+			})
+		}
+		return ev.evalTerm(e.lhs, env, mod, func(l interface{}, env *binding) bool {
+			return ev.evalTerm(e.rhs, env, mod, func(r interface{}, env *binding) bool {
+				if compareValues(l, r) != 0 {
+					return true
+				}
+				return next(env)
+			})
+		})
+	case exprSomeDecl:
+		for _, name := range e.vars {
+			env = env.bind(name, declared)
+		}
+		return next(env)
+	case exprSomeIn:
+		return ev.evalTerm(e.coll, env, mod, func(coll interface{}, env *binding) bool {
+			return iterate(coll, func(k, v interface{}) bool {
+				inner := env.bind(e.val, v)
+				if e.key != "" {
+					inner = inner.bind(e.key, k)
+				}
+				return next(inner)
+			})
+		})
+	case exprEvery:
+		return ev.evalTerm(e.coll, env, mod, func(coll interface{}, env *binding) bool {
+			all := true
+			iterate(coll, func(k, v interface{}) bool {
+				inner := env.bind(e.val, v)
+				if e.key != "" {
+					inner = inner.bind(e.key, k)
+				}
+				ok := false
+				ev.evalBody(e.body, inner, mod, func(*binding) bool {
+					ok = true
+					return false
+				})
+				all = ok
+				return ok && ev.err == nil
+			})
+			if ev.err != nil {
+				return false
+			}
+			if !all {
+				return true
+			}
+			return next(env)
+		})
+	}
+	return ev.fail(fmt.Errorf("line %d: unknown expression", e.line))
+}
+
+// unboundVar reports whether t is a variable that has no value yet and does
+// not name anything else, so = binds it
+func (ev *evaluator) unboundVar(t term, env *binding, mod *module) (string, bool) {
+	r, ok := t.(*ref)
+	if !ok || len(r.path) > 0 {
+		return "", false
+	}
+	_, bound, known := env.lookup(r.head)
+	if bound {
+		return "", false
+	}
+	if known {
+		return r.head, true
+	}
+	if r.head == "input" || r.head == "data" || mod.aliases[r.head] != nil || ev.engine.hasRule(mod.pkgPath(), r.head) {
+		return "", false
+	}
+	return r.head, true
+}
+
+// iterate calls fn with the keys and values of a collection: indexes of
+// arrays, keys of objects and elements of sets. Other values have none.
+func iterate(coll interface{}, fn func(k, v interface{}) bool) bool {
+	switch c := coll.(type) {
+	case []interface{}:
+		for i, v := range c {
+			if !fn(float64(i), v) {
+				return false
+			}
+		}
+	case map[string]interface{}:
+		for _, k := range sortedKeys(c) {
+			if !fn(k, c[k]) {
+				return false
+			}
+		}
+	case *regoSet:
+		for _, v := range c.sorted() {
+			if !fn(v, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (ev *evaluator) evalTerm(t term, env *binding, mod *module, yield func(interface{}, *binding) bool) bool {
+	if ev.steps++; ev.steps > maxEvalSteps {
+		return ev.fail(errEvalLimit)
+	}
+	switch t := t.(type) {
+	case *scalar:
+		return yield(t.v, env)
+	case *ref:
+		return ev.evalRef(t, env, mod, yield)
+	case *arrayLit:
+		return ev.evalTerms(t.items, env, mod, func(vals []interface{}, env *binding) bool {
+			return yield(vals, env)
+		})
+	case *setLit:
+		return ev.evalTerms(t.items, env, mod, func(vals []interface{}, env *binding) bool {
+			s := newSet()
+			for _, v := range vals {
+				s.add(v)
+			}
+			return yield(s, env)
+		})
+	case *objectLit:
+		return ev.evalTerms(append(append([]term{}, t.keys...), t.values...), env, mod, func(vals []interface{}, env *binding) bool {
+			n := len(t.keys)
+			obj := make(map[string]interface{}, n)
+			for i := 0; i < n; i++ {
+				k, ok := vals[i].(string)
+				if !ok {
+					return ev.fail(errors.New("object keys must be strings"))
+				}
+				obj[k] = vals[n+i]
+			}
+			return yield(obj, env)
+		})
+	case *call:
+		return ev.evalTerms(t.args, env, mod, func(args []interface{}, env *binding) bool {
+			v, ok := t.fn.fn(args)
+			if !ok {
+				// As in OPA, a builtin given values it cannot handle is
+				// undefined rather than an error
+				return true
+			}
+			return yield(v, env)
+		})
+	case *binary:
+		return ev.evalTerm(t.l, env, mod, func(l interface{}, env *binding) bool {
+			return ev.evalTerm(t.r, env, mod, func(r interface{}, env *binding) bool {
+				v, ok := applyBinary(t.op, l, r)
+				if !ok {
+					return true
+				}
+				return yield(v, env)
+			})
+		})
+	case *membership:
+		return ev.evalTerm(t.coll, env, mod, func(coll interface{}, env *binding) bool {
+			return ev.evalTerm(t.val, env, mod, func(v interface{}, env *binding) bool {
+				found := false
+				iterate(coll, func(_, item interface{}) bool {
+					found = compareValues(item, v) == 0
+					return !found
+				})
+				return yield(found, env)
+			})
+		})
+	case *comprehension:
+		return ev.evalComprehension(t, env, mod, yield)
+	}
+	return ev.fail(fmt.Errorf("unknown term %T", t))
+}
+
+// evalTerms evaluates a list of terms, calling yield with every combination
+// of their values
+func (ev *evaluator) evalTerms(ts []term, env *binding, mod *module, yield func([]interface{}, *binding) bool) bool {
+	var walk func(i int, vals []interface{}, env *binding) bool
+	walk = func(i int, vals []interface{}, env *binding) bool {
+		if i == len(ts) {
+			return yield(append([]interface{}{}, vals...), env)
+		}
+		return ev.evalTerm(ts[i], env, mod, func(v interface{}, env *binding) bool {
+			return walk(i+1, append(vals[:i:i], v), env)
+		})
+	}
+	return walk(0, make([]interface{}, 0, len(ts)), env)
+}
+
+func (ev *evaluator) evalComprehension(c *comprehension, env *binding, mod *module, yield func(interface{}, *binding) bool) bool {
+	var arr []interface{}
+	set := newSet()
+	obj := make(map[string]interface{})
+	ok := ev.evalBody(c.body, env, mod, func(inner *binding) bool {
+		if c.kind == '{' {
+			return ev.evalTerm(c.key, inner, mod, func(k interface{}, inner *binding) bool {
+				return ev.evalTerm(c.head, inner, mod, func(v interface{}, _ *binding) bool {
+					ks, ok := k.(string)
+					if !ok {
+						return ev.fail(errors.New("object keys must be strings"))
+					}
+					if old, ok := obj[ks]; ok && compareValues(old, v) != 0 {
+						return ev.fail(fmt.Errorf("object comprehension produced conflicting values for %q", ks))
+					}
+					obj[ks] = v
+					return true
+				})
+			})
+		}
+		return ev.evalTerm(c.head, inner, mod, func(v interface{}, _ *binding) bool {
+			if c.kind == '[' {
+				arr = append(arr, v)
+			} else {
+				set.add(v)
+			}
+			return true
+		})
+	})
+	if !ok && ev.err != nil {
+		return false
+	}
+	switch c.kind {
+	case '[':
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		return yield(arr, env)
+	case 's':
+		return yield(set, env)
+	}
+	return yield(obj, env)
+}
+
+func (ev *evaluator) evalRef(r *ref, env *binding, mod *module, yield func(interface{}, *binding) bool) bool {
+	val, bound, known := env.lookup(r.head)
+	switch {
+	case bound:
+		return ev.applyPath(val, r.path, env, mod, yield)
+	case known:
+		return ev.fail(fmt.Errorf("line %d: variable %s is used before it has a value", r.line, r.head))
+	case r.head == "input":
+		if ev.input == nil {
+			return true
+		}
+		return ev.applyPath(ev.input, r.path, env, mod, yield)
+	case r.head == "data":
+		return ev.evalData(nil, ev.engine.data, r.path, env, mod, yield)
+	}
+	if alias := mod.aliases[r.head]; alias != nil {
+		joined := &ref{head: alias.head, path: append(append([]term{}, alias.path...), r.path...), line: r.line}
+		return ev.evalRef(joined, env, mod, yield)
+	}
+	if ev.engine.hasRule(mod.pkgPath(), r.head) {
+		res := ev.ruleValue(mod.pkgPath(), r.head)
+		if ev.err != nil {
+			return false
+		}
+		if !res.defined {
+			return true
+		}
+		return ev.applyPath(res.val, r.path, env, mod, yield)
+	}
+	return ev.fail(fmt.Errorf("line %d: variable %s is used before it has a value", r.line, r.head))
+}
+
+// applyPath looks the remaining path elements up in v. An element that is an
+// unbound variable iterates over the collection, binding the variable.
+func (ev *evaluator) applyPath(v interface{}, path []term, env *binding, mod *module, yield func(interface{}, *binding) bool) bool {
+	if len(path) == 0 {
+		return yield(v, env)
+	}
+	if name, ok := ev.unboundVar(path[0], env, mod); ok {
+		return iterate(v, func(k, item interface{}) bool {
+			return ev.applyPath(item, path[1:], env.bind(name, k), mod, yield)
+		})
+	}
+	return ev.evalTerm(path[0], env, mod, func(key interface{}, env *binding) bool {
+		item, ok := lookupValue(v, key)
+		if !ok {
+			return true
+		}
+		return ev.applyPath(item, path[1:], env, mod, yield)
+	})
+}
+
+func lookupValue(v, key interface{}) (interface{}, bool) {
+	switch c := v.(type) {
+	case []interface{}:
+		f, ok := key.(float64)
+		if !ok || f != math.Trunc(f) || f < 0 || f >= float64(len(c)) {
+			return nil, false
+		}
+		return c[int(f)], true
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, false
+		}
+		item, ok := c[k]
+		return item, ok
+	case *regoSet:
+		if c.has(key) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// evalData looks path up under data. Packages and plain data from data.json
+// files share the tree: at each level a rule of the package named by prefix
+// is tried first, then a deeper package, then plain data.
+func (ev *evaluator) evalData(prefix []string, plain interface{}, path []term, env *binding, mod *module, yield func(interface{}, *binding) bool) bool {
+	pkg := strings.Join(prefix, ".")
+	if len(path) == 0 {
+		v, ok := ev.virtualDoc(prefix, plain)
+		if ev.err != nil {
+			return false
+		}
+		if !ok {
+			return true
+		}
+		return yield(v, env)
+	}
+	if _, ok := ev.unboundVar(path[0], env, mod); ok {
+		// Iteration covers plain data only
+		return ev.applyPath(plain, path, env, mod, yield)
+	}
+	return ev.evalTerm(path[0], env, mod, func(key interface{}, env *binding) bool {
+		name, ok := key.(string)
+		if !ok {
+			return true
+		}
+		if ev.engine.hasRule(pkg, name) {
+			res := ev.ruleValue(pkg, name)
+			if ev.err != nil {
+				return false
+			}
+			if !res.defined {
+				return true
+			}
+			return ev.applyPath(res.val, path[1:], env, mod, yield)
+		}
+		child, hasChild := lookupValue(plain, name)
+		deeper := append(append([]string{}, prefix...), name)
+		if ev.engine.prefixes[strings.Join(deeper, ".")] {
+			return ev.evalData(deeper, child, path[1:], env, mod, yield)
+		}
+		if !hasChild {
+			return true
+		}
+		return ev.applyPath(child, path[1:], env, mod, yield)
+	})
+}
+
+// virtualDoc builds the object a package prefix stands for: its plain data,
+// the values of its rules and the documents of the packages below it
+func (ev *evaluator) virtualDoc(prefix []string, plain interface{}) (interface{}, bool) {
+	pkg := strings.Join(prefix, ".")
+	if !ev.engine.prefixes[pkg] && pkg != "" {
+		return plain, plain != nil
+	}
+	doc := make(map[string]interface{})
+	if m, ok := plain.(map[string]interface{}); ok {
+		for k, v := range m {
+			doc[k] = v
+		}
+	}
+	for _, name := range ev.engine.ruleNames(pkg) {
+		res := ev.ruleValue(pkg, name)
+		if ev.err != nil {
+			return nil, false
+		}
+		if res.defined {
+			doc[name] = res.val
+		}
+	}
+	for _, child := range ev.engine.children(pkg) {
+		childPrefix := append(append([]string{}, prefix...), child)
+		v, ok := ev.virtualDoc(childPrefix, doc[child])
+		if ev.err != nil {
+			return nil, false
+		}
+		if ok {
+			doc[child] = v
+		}
+	}
+	return doc, true
+}
+
+// ruleValue evaluates all definitions of a rule, once per query
+func (ev *evaluator) ruleValue(pkg, name string) ruleResult {
+	id := pkg + "." + name
+	if res, ok := ev.rules[id]; ok {
+		return res
+	}
+	if ev.evaluating[id] {
+		ev.fail(fmt.Errorf("rule data.%s refers to itself", id))
+		return ruleResult{}
+	}
+	ev.evaluating[id] = true
+	defer delete(ev.evaluating, id)
+
+	rules := ev.engine.packages[pkg][name]
+	var res ruleResult
+	var set *regoSet
+	var obj map[string]interface{}
+	switch rules[0].kind {
+	case rulePartialSet:
+		set = newSet()
+		res = ruleResult{val: set, defined: true}
+	case rulePartialObject:
+		obj = make(map[string]interface{})
+		res = ruleResult{val: obj, defined: true}
+	}
+
+	var def *rule
+	for _, r := range rules {
+		if r.isDefault {
+			def = r
+			continue
+		}
+		r := r
+		ev.evalBody(r.body, nil, r.mod, func(env *binding) bool {
+			switch r.kind {
+			case rulePartialSet:
+				return ev.evalTerm(r.key, env, r.mod, func(v interface{}, _ *binding) bool {
+					set.add(v)
+					return true
+				})
+			case rulePartialObject:
+				return ev.evalTerm(r.key, env, r.mod, func(k interface{}, env *binding) bool {
+					return ev.evalTerm(r.value, env, r.mod, func(v interface{}, _ *binding) bool {
+						ks, ok := k.(string)
+						if !ok {
+							return ev.fail(fmt.Errorf("line %d: object keys must be strings", r.line))
+						}
+						if old, ok := obj[ks]; ok && compareValues(old, v) != 0 {
+							return ev.fail(fmt.Errorf("line %d: rule %s produced conflicting values for %q", r.line, name, ks))
+						}
+						obj[ks] = v
+						return true
+					})
+				})
+			}
+			if r.value == nil {
+				return ev.setComplete(&res, true, r, name)
+			}
+			return ev.evalTerm(r.value, env, r.mod, func(v interface{}, _ *binding) bool {
+				return ev.setComplete(&res, v, r, name)
+			})
+		})
+		if ev.err != nil {
+			return ruleResult{}
+		}
+	}
+	if !res.defined && def != nil {
+		ev.evalTerm(def.value, nil, def.mod, func(v interface{}, _ *binding) bool {
+			res = ruleResult{val: v, defined: true}
+			return false
+		})
+		if ev.err != nil {
+			return ruleResult{}
+		}
+	}
+	ev.rules[id] = res
+	return res
+}
+
+func (ev *evaluator) setComplete(res *ruleResult, v interface{}, r *rule, name string) bool {
+	if res.defined && compareValues(res.val, v) != 0 {
+		return ev.fail(fmt.Errorf("line %d: rule %s produced conflicting values", r.line, name))
+	}
+	*res = ruleResult{val: v, defined: true}
+	return true
+}
+
+func applyBinary(op string, l, r interface{}) (interface{}, bool) {
+	switch op {
+	case "==":
+		return compareValues(l, r) == 0, true
+	case "!=":
+		return compareValues(l, r) != 0, true
+	case "<":
+		return compareValues(l, r) < 0, true
+	case "<=":
+		return compareValues(l, r) <= 0, true
+	case ">":
+		return compareValues(l, r) > 0, true
+	case ">=":
+		return compareValues(l, r) >= 0, true
+	}
+
+	if ls, ok := l.(*regoSet); ok {
+		rs, ok := r.(*regoSet)
+		if !ok {
+			return nil, false
+		}
+		out := newSet()
+		switch op {
+		case "|":
+			for k, v := range ls.items {
+				out.items[k] = v
+			}
+			for k, v := range rs.items {
+				out.items[k] = v
+			}
+		case "&", "-":
+			for k, v := range ls.items {
+				if _, in := rs.items[k]; in == (op == "&") {
+					out.items[k] = v
+				}
+			}
+		default:
+			return nil, false
+		}
+		return out, true
+	}
+
+	a, ok1 := l.(float64)
+	b, ok2 := r.(float64)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		if b == 0 {
+			return nil, false
+		}
+		return a / b, true
+	case "%":
+		if b == 0 || a != math.Trunc(a) || b != math.Trunc(b) {
+			return nil, false
+		}
+		return math.Mod(a, b), true
+	}
+	return nil, false
+}
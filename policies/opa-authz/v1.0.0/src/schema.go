@@ -0,0 +1,25 @@
+package opa_authz
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "opaUrl": {"type": "string", "minLength": 1},
+    "opaToken": {"type": "string"},
+    "timeoutMs": {"type": "integer", "minimum": 1, "default": 500},
+    "policy": {"type": "string", "minLength": 1},
+    "bundlePath": {"type": "string", "minLength": 1},
+    "decisionPath": {"type": "string", "minLength": 1, "default": "authz/allow"},
+    "inputHeaders": {"type": "array", "items": {"type": "string"}, "default": []},
+    "sharedKeys": {"type": "array", "items": {"type": "string", "minLength": 1}, "default": []},
+    "cacheTtlSeconds": {"type": "integer", "minimum": 0, "default": 0},
+    "cacheMaxEntries": {"type": "integer", "minimum": 1, "default": 10000},
+    "denyStatus": {"type": "integer", "minimum": 400, "maximum": 599, "default": 403},
+    "denyBody": {"type": "string", "default": "{\"error\": \"Forbidden\"}"},
+    "failOpen": {"type": "boolean", "default": false}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
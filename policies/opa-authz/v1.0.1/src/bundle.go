@@ -0,0 +1,289 @@
+package opa_authz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxBundleSize bounds how much a bundle may hold once unpacked
+const maxBundleSize = 32 << 20
+
+// regoEngine holds compiled Rego modules and the data they can refer to. It
+// is not changed after it is built, so queries can run concurrently.
+type regoEngine struct {
+	// packages maps package paths such as authz.http to their rules by name
+	packages map[string]map[string][]*rule
+	// prefixes holds every package path and all of its prefixes
+	prefixes map[string]bool
+	data     map[string]interface{}
+}
+
+// newRegoEngine compiles modules, keyed by file name for error messages. An
+// inline policy has the empty name.
+func newRegoEngine(sources map[string]string, data map[string]interface{}) (*regoEngine, error) {
+	e := &regoEngine{
+		packages: make(map[string]map[string][]*rule),
+		prefixes: make(map[string]bool),
+		data:     data,
+	}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		inFile := func(err error) error {
+			if name == "" {
+				return err
+			}
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		mod, err := parseModule(sources[name])
+		if err != nil {
+			return nil, inFile(err)
+		}
+		pkg := mod.pkgPath()
+		for i := range mod.pkg {
+			e.prefixes[strings.Join(mod.pkg[:i+1], ".")] = true
+		}
+		if e.packages[pkg] == nil {
+			e.packages[pkg] = make(map[string][]*rule)
+		}
+		for _, r := range mod.rules {
+			rules := e.packages[pkg][r.name]
+			if len(rules) > 0 && rules[0].kind != r.kind {
+				return nil, inFile(fmt.Errorf("line %d: %s is defined as a %s rule elsewhere", r.line, r.name, ruleKindNames[rules[0].kind]))
+			}
+			if r.isDefault {
+				for _, other := range rules {
+					if other.isDefault {
+						return nil, inFile(fmt.Errorf("line %d: %s has more than one default", r.line, r.name))
+					}
+				}
+			}
+			e.packages[pkg][r.name] = append(rules, r)
+		}
+	}
+	return e, nil
+}
+
+func (m *module) pkgPath() string {
+	return strings.Join(m.pkg, ".")
+}
+
+func (e *regoEngine) hasRule(pkg, name string) bool {
+	return len(e.packages[pkg][name]) > 0
+}
+
+func (e *regoEngine) ruleNames(pkg string) []string {
+	names := make([]string, 0, len(e.packages[pkg]))
+	for name := range e.packages[pkg] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// children returns the next path elements of the packages below pkg
+func (e *regoEngine) children(pkg string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for p := range e.prefixes {
+		rest := p
+		if pkg != "" {
+			if !strings.HasPrefix(p, pkg+".") {
+				continue
+			}
+			rest = p[len(pkg)+1:]
+		}
+		if child := strings.SplitN(rest, ".", 2)[0]; !seen[child] {
+			seen[child] = true
+			out = append(out, child)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// eval returns the document at path under data, such as the value of the
+// rule authz.allow for ["authz", "allow"]
+func (e *regoEngine) eval(docPath []string, input interface{}) (interface{}, bool, error) {
+	ev := &evaluator{
+		engine:     e,
+		input:      input,
+		rules:      make(map[string]ruleResult),
+		evaluating: make(map[string]bool),
+	}
+	terms := make([]term, len(docPath))
+	for i, p := range docPath {
+		terms[i] = &scalar{p}
+	}
+	var result interface{}
+	defined := false
+	ev.evalData(nil, e.data, terms, nil, &module{}, func(v interface{}, _ *binding) bool {
+		result, defined = v, true
+		return false
+	})
+	if ev.err != nil {
+		return nil, false, ev.err
+	}
+	return result, defined, nil
+}
+
+// loadBundle reads the Rego modules and data.json documents of a bundle: a
+// single .rego file, a directory, or a .tar.gz file as built by opa build.
+// A data.json document is placed under data at the path of its directory.
+func loadBundle(name string) (*regoEngine, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	b := &bundleFiles{sources: make(map[string]string), data: make(map[string]interface{})}
+	switch {
+	case info.IsDir():
+		err = filepath.WalkDir(name, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(name, file)
+			if err != nil {
+				return err
+			}
+			return b.addFile(filepath.ToSlash(rel), func() ([]byte, error) { return os.ReadFile(file) })
+		})
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		err = b.addArchive(name)
+	default:
+		var src []byte
+		if src, err = os.ReadFile(name); err == nil {
+			b.sources[filepath.Base(name)] = string(src)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b.sources) == 0 {
+		return nil, fmt.Errorf("%s holds no .rego files", name)
+	}
+	return newRegoEngine(b.sources, b.data)
+}
+
+type bundleFiles struct {
+	sources map[string]string
+	data    map[string]interface{}
+	size    int64
+}
+
+// addFile takes .rego and data.json files and ignores all others, such as
+// the bundle .manifest
+func (b *bundleFiles) addFile(name string, read func() ([]byte, error)) error {
+	base := path.Base(name)
+	if !strings.HasSuffix(base, ".rego") && base != "data.json" {
+		return nil
+	}
+	content, err := read()
+	if err != nil {
+		return err
+	}
+	if b.size += int64(len(content)); b.size > maxBundleSize {
+		return errors.New("bundle is too large")
+	}
+	if base != "data.json" {
+		b.sources[name] = string(content)
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	var at []string
+	if dir := path.Dir(name); dir != "." {
+		at = strings.Split(dir, "/")
+	}
+	return mergeData(b.data, at, doc, name)
+}
+
+func (b *bundleFiles) addArchive(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		file := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		err = b.addFile(file, func() ([]byte, error) {
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, io.LimitReader(tr, maxBundleSize+1)); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mergeData places doc under root at the given path, merging objects. Two
+// documents may not set the same value.
+func mergeData(root map[string]interface{}, at []string, doc interface{}, file string) error {
+	node := root
+	for _, key := range at {
+		child, ok := node[key]
+		if !ok {
+			m := make(map[string]interface{})
+			node[key] = m
+			node = m
+			continue
+		}
+		if node, ok = child.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s: data.%s is not an object", file, strings.Join(at, "."))
+		}
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: must hold a JSON object", file)
+	}
+	for k, v := range m {
+		old, exists := node[k]
+		if !exists {
+			node[k] = v
+			continue
+		}
+		oldMap, ok1 := old.(map[string]interface{})
+		if _, ok2 := v.(map[string]interface{}); !ok1 || !ok2 {
+			return fmt.Errorf("%s: conflicting values for %s", file, k)
+		}
+		if err := mergeData(oldMap, nil, v, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
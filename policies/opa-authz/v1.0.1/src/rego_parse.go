@@ -0,0 +1,828 @@
+package opa_authz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file parses the subset of Rego the embedded engine evaluates:
+// packages, imports of data and input, complete rules with defaults,
+// partial set and object rules, some, every, not, comprehensions and the
+// builtins listed in rego_builtins.go, in both the v0 syntax and the v1
+// syntax with if and contains. Functions, else, with and rules with dotted
+// names are rejected when the module is parsed.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNewline
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+// operators are matched longest first
+var operators = []string{":=", "==", "!=", "<=", ">=", "<", ">", "=", "+", "-", "*", "/", "%",
+	"(", ")", "[", "]", "{", "}", ",", ";", ".", "|", "&", ":"}
+
+var keywords = map[string]bool{
+	"package": true, "import": true, "default": true, "if": true, "contains": true,
+	"some": true, "every": true, "not": true, "in": true, "with": true, "else": true,
+	"as": true, "true": true, "false": true, "null": true,
+}
+
+func lexRego(src string) ([]token, error) {
+	var toks []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			toks = append(toks, token{kind: tokNewline, line: line})
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[i:j], line: line})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				((src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E'))) {
+				j++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:j], line: line})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid string %s", line, src[i:j+1])
+			}
+			toks = append(toks, token{kind: tokString, text: s, line: line})
+			i = j + 1
+		case c == '`':
+			j := strings.IndexByte(src[i+1:], '`')
+			if j < 0 {
+				return nil, fmt.Errorf("line %d: unterminated raw string", line)
+			}
+			s := src[i+1 : i+1+j]
+			toks = append(toks, token{kind: tokString, text: s, line: line})
+			line += strings.Count(s, "\n")
+			i += j + 2
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, line: line}), nil
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// module is one parsed .rego file
+type module struct {
+	pkg []string
+	// aliases maps names imported with import data... or import input...
+	// to what they stand for
+	aliases map[string]*ref
+	rules   []*rule
+}
+
+type ruleKind int
+
+const (
+	ruleComplete ruleKind = iota
+	rulePartialSet
+	rulePartialObject
+)
+
+var ruleKindNames = map[ruleKind]string{
+	ruleComplete:      "complete",
+	rulePartialSet:    "partial set",
+	rulePartialObject: "partial object",
+}
+
+type rule struct {
+	name      string
+	kind      ruleKind
+	isDefault bool
+	// key is the element of a partial set or the key of a partial object
+	key term
+	// value is the value of a complete rule or partial object; nil means true
+	value term
+	body  []*expr
+	mod   *module
+	line  int
+}
+
+type exprKind int
+
+const (
+	exprTerm exprKind = iota
+	exprNot
+	exprAssign
+	exprUnify
+	exprSomeDecl
+	exprSomeIn
+	exprEvery
+)
+
+type expr struct {
+	kind exprKind
+	line int
+	// term is the expression of exprTerm
+	term term
+	// not is the negated expression
+	not *expr
+	// lhs and rhs are the sides of := and =
+	lhs, rhs term
+	// vars are declared by some; key and val name the variables bound by
+	// some ... in and every, key being empty without one
+	vars     []string
+	key, val string
+	coll     term
+	body     []*expr
+}
+
+// term is one of the types below
+type term interface{}
+
+type scalar struct {
+	v interface{}
+}
+
+// ref is a variable followed by any number of .name or [term] lookups
+type ref struct {
+	head string
+	path []term
+	line int
+}
+
+type arrayLit struct {
+	items []term
+}
+
+type setLit struct {
+	items []term
+}
+
+type objectLit struct {
+	keys, values []term
+}
+
+type call struct {
+	name string
+	args []term
+	fn   builtin
+	line int
+}
+
+type binary struct {
+	op   string
+	l, r term
+}
+
+// membership is x in coll
+type membership struct {
+	val, coll term
+}
+
+type comprehension struct {
+	// kind is '[' for arrays, 's' for sets and '{' for objects
+	kind      byte
+	key, head term
+	body      []*expr
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	mod  *module
+	// noBar stops | from being read as set union while the head of a
+	// comprehension is parsed
+	noBar bool
+	// wildcards numbers the _ variables, which are all distinct
+	wildcards int
+}
+
+// parseModule parses the source of one .rego file
+func parseModule(src string) (mod *module, err error) {
+	toks, err := lexRego(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, mod: &module{aliases: make(map[string]*ref)}}
+	// Syntax errors unwind the parser, which is deeply recursive
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			mod, err = nil, perr
+		}
+	}()
+	p.parseModule()
+	return p.mod, nil
+}
+
+type parseError struct {
+	line int
+	msg  string
+}
+
+func (e parseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(parseError{line: p.peek().line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) isIdent(name string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && t.text == name
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if p.isOp(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptIdent(name string) bool {
+	if p.isIdent(name) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOp(op string) {
+	if !p.acceptOp(op) {
+		p.fail("expected %s, found %s", op, describeToken(p.peek()))
+	}
+}
+
+// expectName reads an identifier that is not a keyword
+func (p *parser) expectName() string {
+	t := p.peek()
+	if t.kind != tokIdent || keywords[t.text] {
+		p.fail("expected a name, found %s", describeToken(t))
+	}
+	p.pos++
+	return t.text
+}
+
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokNewline {
+		p.pos++
+	}
+}
+
+// endStatement requires a statement to end where it does
+func (p *parser) endStatement() {
+	switch t := p.peek(); {
+	case t.kind == tokNewline || t.kind == tokEOF:
+	case t.kind == tokOp && (t.text == ";" || t.text == "}"):
+	case t.kind == tokIdent && t.text == "else":
+		p.fail("else is not supported")
+	case t.kind == tokIdent && t.text == "with":
+		p.fail("with is not supported")
+	default:
+		p.fail("unexpected %s", describeToken(t))
+	}
+}
+
+func describeToken(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokNewline:
+		return "end of line"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+func (p *parser) parseModule() {
+	p.skipNewlines()
+	if !p.acceptIdent("package") {
+		p.fail("expected package")
+	}
+	p.mod.pkg = []string{p.expectName()}
+	for p.acceptOp(".") {
+		p.mod.pkg = append(p.mod.pkg, p.expectName())
+	}
+	p.endStatement()
+	for {
+		p.skipNewlines()
+		for p.acceptOp(";") {
+			p.skipNewlines()
+		}
+		if p.peek().kind == tokEOF {
+			return
+		}
+		if p.acceptIdent("import") {
+			p.parseImport()
+		} else {
+			p.parseRule()
+		}
+	}
+}
+
+func (p *parser) parseImport() {
+	line := p.peek().line
+	parts := []string{p.expectName()}
+	for p.acceptOp(".") {
+		parts = append(parts, p.expectName())
+	}
+	switch parts[0] {
+	case "rego", "future":
+		// Keyword imports; the keywords are always available
+		p.endStatement()
+		return
+	case "data", "input":
+	default:
+		p.fail("only data and input can be imported")
+	}
+	alias := parts[len(parts)-1]
+	if p.acceptIdent("as") {
+		alias = p.expectName()
+	}
+	r := &ref{head: parts[0], line: line}
+	for _, part := range parts[1:] {
+		r.path = append(r.path, &scalar{part})
+	}
+	p.mod.aliases[alias] = r
+	p.endStatement()
+}
+
+func (p *parser) parseRule() {
+	r := &rule{mod: p.mod, line: p.peek().line}
+	r.isDefault = p.acceptIdent("default")
+	r.name = p.expectName()
+	switch {
+	case p.isOp("("):
+		p.fail("functions are not supported")
+	case p.isOp("."):
+		p.fail("rule names with dots are not supported")
+	}
+
+	if r.isDefault {
+		if !p.acceptOp(":=") && !p.acceptOp("=") {
+			p.fail("expected := after default %s", r.name)
+		}
+		r.value = p.parseTerm()
+		p.endStatement()
+		p.mod.rules = append(p.mod.rules, r)
+		return
+	}
+
+	bracket := false
+	if p.acceptOp("[") {
+		p.skipNewlines()
+		r.key = p.parseTerm()
+		p.skipNewlines()
+		p.expectOp("]")
+		r.kind = rulePartialSet
+		bracket = true
+	} else if p.acceptIdent("contains") {
+		r.key = p.parseTerm()
+		r.kind = rulePartialSet
+	}
+	if p.acceptOp(":=") || p.acceptOp("=") {
+		if r.kind == rulePartialSet && !bracket {
+			p.fail("a contains rule has no value")
+		}
+		r.value = p.parseTerm()
+		if bracket {
+			r.kind = rulePartialObject
+		}
+	}
+
+	if p.acceptIdent("if") {
+		if p.isOp("{") {
+			r.body = p.parseBraceBody()
+		} else {
+			r.body = []*expr{p.parseExpr()}
+		}
+	} else if p.isOp("{") {
+		r.body = p.parseBraceBody()
+	}
+	p.endStatement()
+	p.mod.rules = append(p.mod.rules, r)
+}
+
+func (p *parser) parseBraceBody() []*expr {
+	p.expectOp("{")
+	var body []*expr
+	for {
+		p.skipNewlines()
+		for p.acceptOp(";") {
+			p.skipNewlines()
+		}
+		if p.acceptOp("}") {
+			return body
+		}
+		body = append(body, p.parseExpr())
+		p.endStatement()
+	}
+}
+
+func (p *parser) parseExpr() *expr {
+	line := p.peek().line
+	switch {
+	case p.acceptIdent("not"):
+		return &expr{kind: exprNot, line: line, not: p.parseExpr()}
+	case p.acceptIdent("some"):
+		vars := []string{p.expectName()}
+		for p.acceptOp(",") {
+			vars = append(vars, p.expectName())
+		}
+		if !p.acceptIdent("in") {
+			return &expr{kind: exprSomeDecl, line: line, vars: vars}
+		}
+		e := &expr{kind: exprSomeIn, line: line, vars: vars, coll: p.parseTerm()}
+		e.key, e.val = splitIterVars(p, vars)
+		return e
+	case p.acceptIdent("every"):
+		vars := []string{p.expectName()}
+		for p.acceptOp(",") {
+			vars = append(vars, p.expectName())
+		}
+		if !p.acceptIdent("in") {
+			p.fail("expected in")
+		}
+		e := &expr{kind: exprEvery, line: line, vars: vars, coll: p.parseTerm()}
+		e.key, e.val = splitIterVars(p, vars)
+		e.body = p.parseBraceBody()
+		return e
+	}
+
+	t := p.parseTerm()
+	switch {
+	case p.acceptOp(":="):
+		v, ok := t.(*ref)
+		if !ok || len(v.path) > 0 {
+			p.fail("only variables can be assigned with :=")
+		}
+		return &expr{kind: exprAssign, line: line, lhs: t, rhs: p.parseTerm()}
+	case p.acceptOp("="):
+		return &expr{kind: exprUnify, line: line, lhs: t, rhs: p.parseTerm()}
+	}
+	return &expr{kind: exprTerm, line: line, term: t}
+}
+
+func splitIterVars(p *parser, vars []string) (key, val string) {
+	switch len(vars) {
+	case 1:
+		return "", vars[0]
+	case 2:
+		return vars[0], vars[1]
+	}
+	p.fail("expected one or two variables")
+	return "", ""
+}
+
+// parseTerm reads a term, lowest precedence first: in, comparisons, |, &,
+// + and -, then *, / and %
+func (p *parser) parseTerm() term {
+	l := p.parseRelation()
+	if p.acceptIdent("in") {
+		p.skipNewlines()
+		return &membership{val: l, coll: p.parseRelation()}
+	}
+	return l
+}
+
+func (p *parser) parseRelation() term {
+	l := p.parseBinary(0)
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.acceptOp(op) {
+			p.skipNewlines()
+			return &binary{op: op, l: l, r: p.parseBinary(0)}
+		}
+	}
+	return l
+}
+
+var binaryLevels = [][]string{{"|"}, {"&"}, {"+", "-"}, {"*", "/", "%"}}
+
+func (p *parser) parseBinary(level int) term {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+	l := p.parseBinary(level + 1)
+	for {
+		op := ""
+		for _, o := range binaryLevels[level] {
+			if p.isOp(o) && !(o == "|" && p.noBar) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return l
+		}
+		p.next()
+		p.skipNewlines()
+		l = &binary{op: op, l: l, r: p.parseBinary(level + 1)}
+	}
+}
+
+func (p *parser) parseUnary() term {
+	if p.acceptOp("-") {
+		t := p.parseUnary()
+		if s, ok := t.(*scalar); ok {
+			if f, ok := s.v.(float64); ok {
+				return &scalar{-f}
+			}
+		}
+		return &binary{op: "-", l: &scalar{float64(0)}, r: t}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() term {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			p.fail("invalid number %s", t.text)
+		}
+		return &scalar{f}
+	case tokString:
+		p.next()
+		return &scalar{t.text}
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return &scalar{t.text == "true"}
+		case "null":
+			p.next()
+			return &scalar{nil}
+		}
+		return p.parseRef()
+	case tokOp:
+		switch t.text {
+		case "(":
+			p.next()
+			saved := p.noBar
+			p.noBar = false
+			p.skipNewlines()
+			inner := p.parseTerm()
+			p.skipNewlines()
+			p.expectOp(")")
+			p.noBar = saved
+			return inner
+		case "[":
+			p.next()
+			return p.parseArray()
+		case "{":
+			p.next()
+			return p.parseBraces()
+		}
+	}
+	p.fail("expected a term, found %s", describeToken(t))
+	return nil
+}
+
+func (p *parser) parseRef() term {
+	line := p.peek().line
+	head := p.expectName()
+	if head == "_" {
+		p.wildcards++
+		head = "_" + strconv.Itoa(p.wildcards)
+	}
+	r := &ref{head: head, line: line}
+	for {
+		switch {
+		case p.isOp(".") && p.toks[p.pos+1].kind == tokIdent:
+			p.next()
+			r.path = append(r.path, &scalar{p.next().text})
+			continue
+		case p.acceptOp("["):
+			saved := p.noBar
+			p.noBar = false
+			p.skipNewlines()
+			r.path = append(r.path, p.parseTerm())
+			p.skipNewlines()
+			p.expectOp("]")
+			p.noBar = saved
+			continue
+		}
+		break
+	}
+	if !p.isOp("(") {
+		return r
+	}
+
+	// A call: the reference names the builtin
+	name := []string{r.head}
+	for _, part := range r.path {
+		s, ok := part.(*scalar)
+		if !ok {
+			p.fail("invalid function name")
+		}
+		name = append(name, fmt.Sprint(s.v))
+	}
+	c := &call{name: strings.Join(name, "."), line: line}
+	b, ok := builtins[c.name]
+	if !ok {
+		p.fail("unknown function %s", c.name)
+	}
+	c.fn = b
+	p.next()
+	saved := p.noBar
+	p.noBar = false
+	p.skipNewlines()
+	for !p.acceptOp(")") {
+		c.args = append(c.args, p.parseTerm())
+		p.skipNewlines()
+		if !p.isOp(")") {
+			p.expectOp(",")
+			p.skipNewlines()
+		}
+	}
+	p.noBar = saved
+	if len(c.args) != b.arity {
+		if b.arity == 1 {
+			p.fail("%s takes 1 argument", c.name)
+		}
+		p.fail("%s takes %d arguments", c.name, b.arity)
+	}
+	return c
+}
+
+// parseArray reads an array literal or comprehension after its [
+func (p *parser) parseArray() term {
+	saved := p.noBar
+	defer func() { p.noBar = saved }()
+	p.skipNewlines()
+	if p.acceptOp("]") {
+		return &arrayLit{}
+	}
+	p.noBar = true
+	first := p.parseTerm()
+	p.noBar = false
+	p.skipNewlines()
+	if p.acceptOp("|") {
+		c := &comprehension{kind: '[', head: first, body: p.parseCompBody("]")}
+		return c
+	}
+	a := &arrayLit{items: []term{first}}
+	for !p.acceptOp("]") {
+		p.expectOp(",")
+		p.skipNewlines()
+		if p.acceptOp("]") {
+			break
+		}
+		a.items = append(a.items, p.parseTerm())
+		p.skipNewlines()
+	}
+	return a
+}
+
+// parseBraces reads an object or set literal or comprehension after its {
+func (p *parser) parseBraces() term {
+	saved := p.noBar
+	defer func() { p.noBar = saved }()
+	p.skipNewlines()
+	if p.acceptOp("}") {
+		return &objectLit{}
+	}
+	p.noBar = true
+	first := p.parseTerm()
+	p.skipNewlines()
+
+	if p.acceptOp(":") {
+		p.skipNewlines()
+		value := p.parseTerm()
+		p.noBar = false
+		p.skipNewlines()
+		if p.acceptOp("|") {
+			return &comprehension{kind: '{', key: first, head: value, body: p.parseCompBody("}")}
+		}
+		o := &objectLit{keys: []term{first}, values: []term{value}}
+		for !p.acceptOp("}") {
+			p.expectOp(",")
+			p.skipNewlines()
+			if p.acceptOp("}") {
+				break
+			}
+			o.keys = append(o.keys, p.parseTerm())
+			p.skipNewlines()
+			p.expectOp(":")
+			p.skipNewlines()
+			o.values = append(o.values, p.parseTerm())
+			p.skipNewlines()
+		}
+		return o
+	}
+
+	p.noBar = false
+	if p.acceptOp("|") {
+		return &comprehension{kind: 's', head: first, body: p.parseCompBody("}")}
+	}
+	s := &setLit{items: []term{first}}
+	for !p.acceptOp("}") {
+		p.expectOp(",")
+		p.skipNewlines()
+		if p.acceptOp("}") {
+			break
+		}
+		s.items = append(s.items, p.parseTerm())
+		p.skipNewlines()
+	}
+	return s
+}
+
+// parseCompBody reads the body of a comprehension up to its closing bracket.
+// Expressions are separated by ; or line breaks.
+func (p *parser) parseCompBody(end string) []*expr {
+	var body []*expr
+	for {
+		p.skipNewlines()
+		for p.acceptOp(";") {
+			p.skipNewlines()
+		}
+		if p.acceptOp(end) {
+			if len(body) == 0 {
+				p.fail("empty comprehension body")
+			}
+			return body
+		}
+		body = append(body, p.parseExpr())
+		if t := p.peek(); !(t.kind == tokNewline || t.kind == tokOp && (t.text == ";" || t.text == end)) {
+			p.fail("unexpected %s", describeToken(t))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package opa_authz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxResponseSize bounds how much of an OPA response is read
+const maxResponseSize = 1 << 20
+
+// decision is the outcome of a query. A policy returns either a boolean or
+// an object with allow (or allowed, as for OPA's Envoy plugin) and optional
+// http_status, headers and body.
+type decision struct {
+	Allow bool
+	// Status, Body and Headers shape the response to a denied request;
+	// Headers are sent to the upstream for an allowed one
+	Status  int
+	Body    string
+	Headers map[string]string
+}
+
+// parseDecision reads the value of the decision document. An undefined
+// decision denies the request.
+func parseDecision(v interface{}, defined bool) (decision, error) {
+	var d decision
+	if !defined {
+		return d, nil
+	}
+	switch v := v.(type) {
+	case bool:
+		d.Allow = v
+		return d, nil
+	case map[string]interface{}:
+		allow, ok := v["allow"].(bool)
+		if !ok {
+			if allow, ok = v["allowed"].(bool); !ok {
+				return d, errors.New("decision has no boolean allow member")
+			}
+		}
+		d.Allow = allow
+		if s, ok := v["http_status"]; ok {
+			f, ok := s.(float64)
+			if !ok || f < 100 || f > 599 {
+				return d, errors.New("decision http_status must be a status code")
+			}
+			d.Status = int(f)
+		}
+		if b, ok := v["body"]; ok {
+			if d.Body, ok = b.(string); !ok {
+				return d, errors.New("decision body must be a string")
+			}
+		}
+		if h, ok := v["headers"]; ok {
+			m, ok := h.(map[string]interface{})
+			if !ok {
+				return d, errors.New("decision headers must be an object")
+			}
+			d.Headers = make(map[string]string, len(m))
+			for name, value := range m {
+				s, ok := value.(string)
+				if !ok || !validHeaderName(name) || strings.ContainsAny(s, "\r\n") {
+					return d, fmt.Errorf("decision header %q is invalid", name)
+				}
+				d.Headers[name] = s
+			}
+		}
+		return d, nil
+	}
+	return d, fmt.Errorf("decision must be a boolean or an object, not %s", typeName(v))
+}
+
+func typeName(v interface{}) string {
+	return [...]string{"null", "boolean", "number", "string", "array", "object", "set"}[typeRank(v)]
+}
+
+// opaClient queries the Data API of an OPA server
+type opaClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// query asks for the decision document with input, which is JSON
+func (c *opaClient) query(docPath []string, input []byte) (interface{}, bool, error) {
+	body := make([]byte, 0, len(input)+10)
+	body = append(body, `{"input":`...)
+	body = append(body, input...)
+	body = append(body, '}')
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.url, "/")+"/v1/data/"+strings.Join(docPath, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("OPA returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, false, err
+	}
+	var out struct {
+		Result *json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, false, errors.New("malformed OPA response")
+	}
+	// OPA leaves result out when the document is undefined
+	if out.Result == nil {
+		return nil, false, nil
+	}
+	var result interface{}
+	if err := json.Unmarshal(*out.Result, &result); err != nil {
+		return nil, false, errors.New("malformed OPA response")
+	}
+	return result, true, nil
+}
+
+type cachedDecision struct {
+	d       decision
+	expires time.Time
+}
+
+// decisionCache remembers decisions by a hash of the configuration they were
+// made under and their input, so that identical requests skip the query
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedDecision
+}
+
+func (c *decisionCache) get(key [sha256.Size]byte, now time.Time) (decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return decision{}, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return decision{}, false
+	}
+	return e.d, true
+}
+
+// clear drops every decision
+func (c *decisionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// put adds a decision, making room by dropping expired entries and, if the
+// cache is still full, arbitrary ones
+func (c *decisionCache) put(key [sha256.Size]byte, d decision, expires time.Time, maxEntries int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]cachedDecision)
+	}
+	if len(c.entries) >= maxEntries {
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedDecision{d: d, expires: expires}
+}
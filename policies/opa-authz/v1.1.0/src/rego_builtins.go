@@ -0,0 +1,450 @@
+package opa_authz
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// builtin is a function Rego policies can call. fn reports false when the
+// arguments are of the wrong type, which leaves the call undefined.
+type builtin struct {
+	arity int
+	fn    func(args []interface{}) (interface{}, bool)
+}
+
+var builtins = map[string]builtin{
+	"count":             {1, builtinCount},
+	"sum":               {1, builtinSum},
+	"max":               {1, func(a []interface{}) (interface{}, bool) { return extreme(a[0], 1) }},
+	"min":               {1, func(a []interface{}) (interface{}, bool) { return extreme(a[0], -1) }},
+	"sort":              {1, builtinSort},
+	"startswith":        {2, stringPredicate(strings.HasPrefix)},
+	"endswith":          {2, stringPredicate(strings.HasSuffix)},
+	"contains":          {2, stringPredicate(strings.Contains)},
+	"lower":             {1, stringMap(strings.ToLower)},
+	"upper":             {1, stringMap(strings.ToUpper)},
+	"trim_space":        {1, stringMap(strings.TrimSpace)},
+	"trim":              {2, stringMap2(strings.Trim)},
+	"trim_prefix":       {2, stringMap2(strings.TrimPrefix)},
+	"trim_suffix":       {2, stringMap2(strings.TrimSuffix)},
+	"split":             {2, builtinSplit},
+	"concat":            {2, builtinConcat},
+	"replace":           {3, builtinReplace},
+	"indexof":           {2, builtinIndexOf},
+	"substring":         {3, builtinSubstring},
+	"sprintf":           {2, builtinSprintf},
+	"format_int":        {2, builtinFormatInt},
+	"to_number":         {1, builtinToNumber},
+	"regex.match":       {2, builtinRegexMatch},
+	"net.cidr_contains": {2, builtinCIDRContains},
+	"object.get":        {3, builtinObjectGet},
+	"object.keys":       {1, builtinObjectKeys},
+	"array.concat":      {2, builtinArrayConcat},
+	"is_string":         {1, isType(3)},
+	"is_number":         {1, isType(2)},
+	"is_boolean":        {1, isType(1)},
+	"is_array":          {1, isType(4)},
+	"is_object":         {1, isType(5)},
+	"is_set":            {1, isType(6)},
+	"is_null":           {1, isType(0)},
+	"set":               {0, func([]interface{}) (interface{}, bool) { return newSet(), true }},
+	"time.now_ns":       {0, func([]interface{}) (interface{}, bool) { return float64(time.Now().UnixNano()), true }},
+}
+
+func builtinCount(a []interface{}) (interface{}, bool) {
+	switch v := a[0].(type) {
+	case string:
+		return float64(utf8.RuneCountInString(v)), true
+	case []interface{}:
+		return float64(len(v)), true
+	case map[string]interface{}:
+		return float64(len(v)), true
+	case *regoSet:
+		return float64(len(v.items)), true
+	}
+	return nil, false
+}
+
+// elements returns the items of an array or set
+func elements(v interface{}) ([]interface{}, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		return v, true
+	case *regoSet:
+		return v.sorted(), true
+	}
+	return nil, false
+}
+
+func builtinSum(a []interface{}) (interface{}, bool) {
+	items, ok := elements(a[0])
+	if !ok {
+		return nil, false
+	}
+	var sum float64
+	for _, item := range items {
+		f, ok := item.(float64)
+		if !ok {
+			return nil, false
+		}
+		sum += f
+	}
+	return sum, true
+}
+
+func extreme(v interface{}, sign int) (interface{}, bool) {
+	items, ok := elements(v)
+	if !ok || len(items) == 0 {
+		return nil, false
+	}
+	best := items[0]
+	for _, item := range items[1:] {
+		if compareValues(item, best)*sign > 0 {
+			best = item
+		}
+	}
+	return best, true
+}
+
+func builtinSort(a []interface{}) (interface{}, bool) {
+	items, ok := elements(a[0])
+	if !ok {
+		return nil, false
+	}
+	out := append([]interface{}{}, items...)
+	sort.SliceStable(out, func(i, j int) bool { return compareValues(out[i], out[j]) < 0 })
+	return out, true
+}
+
+func stringPredicate(fn func(s, t string) bool) func([]interface{}) (interface{}, bool) {
+	return func(a []interface{}) (interface{}, bool) {
+		s, ok1 := a[0].(string)
+		t, ok2 := a[1].(string)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return fn(s, t), true
+	}
+}
+
+func stringMap(fn func(string) string) func([]interface{}) (interface{}, bool) {
+	return func(a []interface{}) (interface{}, bool) {
+		s, ok := a[0].(string)
+		if !ok {
+			return nil, false
+		}
+		return fn(s), true
+	}
+}
+
+func stringMap2(fn func(s, t string) string) func([]interface{}) (interface{}, bool) {
+	return func(a []interface{}) (interface{}, bool) {
+		s, ok1 := a[0].(string)
+		t, ok2 := a[1].(string)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return fn(s, t), true
+	}
+}
+
+func builtinSplit(a []interface{}) (interface{}, bool) {
+	s, ok1 := a[0].(string)
+	sep, ok2 := a[1].(string)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	parts := strings.Split(s, sep)
+	out := make([]interface{}, len(parts))
+	for i, p := range parts {
+		out[i] = p
+	}
+	return out, true
+}
+
+func builtinConcat(a []interface{}) (interface{}, bool) {
+	sep, ok := a[0].(string)
+	items, ok2 := elements(a[1])
+	if !ok || !ok2 {
+		return nil, false
+	}
+	parts := make([]string, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, sep), true
+}
+
+func builtinReplace(a []interface{}) (interface{}, bool) {
+	s, ok1 := a[0].(string)
+	old, ok2 := a[1].(string)
+	repl, ok3 := a[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, false
+	}
+	return strings.ReplaceAll(s, old, repl), true
+}
+
+// builtinIndexOf counts in characters, not bytes, and gives -1 when sub is
+// not found
+func builtinIndexOf(a []interface{}) (interface{}, bool) {
+	s, ok1 := a[0].(string)
+	sub, ok2 := a[1].(string)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	i := strings.Index(s, sub)
+	if i < 0 {
+		return float64(-1), true
+	}
+	return float64(utf8.RuneCountInString(s[:i])), true
+}
+
+// builtinSubstring takes length characters from start; a negative length
+// takes the rest of the string
+func builtinSubstring(a []interface{}) (interface{}, bool) {
+	s, ok1 := a[0].(string)
+	start, ok2 := integer(a[1])
+	length, ok3 := integer(a[2])
+	if !ok1 || !ok2 || !ok3 || start < 0 {
+		return nil, false
+	}
+	runes := []rune(s)
+	if start >= len(runes) {
+		return "", true
+	}
+	end := len(runes)
+	if length >= 0 && start+length < end {
+		end = start + length
+	}
+	return string(runes[start:end]), true
+}
+
+func integer(v interface{}) (int, bool) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func builtinSprintf(a []interface{}) (interface{}, bool) {
+	format, ok := a[0].(string)
+	items, ok2 := a[1].([]interface{})
+	if !ok || !ok2 {
+		return nil, false
+	}
+	args := make([]interface{}, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				args[i] = int64(v)
+			} else {
+				args[i] = v
+			}
+		case string, bool:
+			args[i] = v
+		default:
+			args[i] = regoText(v)
+		}
+	}
+	return fmt.Sprintf(format, args...), true
+}
+
+// regoText writes a composite value the way OPA prints it in sprintf, with a
+// space after each comma and colon, e.g. ["a", "b"] and {"n": 1}, and sets
+// as {"a"}, or set() when empty
+func regoText(v interface{}) string {
+	var b strings.Builder
+	writeRegoText(&b, v)
+	return b.String()
+}
+
+func writeRegoText(b *strings.Builder, v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRegoText(b, item)
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		b.WriteByte('{')
+		for i, k := range sortedKeys(v) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(k))
+			b.WriteString(": ")
+			writeRegoText(b, v[k])
+		}
+		b.WriteByte('}')
+	case *regoSet:
+		if len(v.items) == 0 {
+			b.WriteString("set()")
+			return
+		}
+		b.WriteByte('{')
+		for i, item := range v.sorted() {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRegoText(b, item)
+		}
+		b.WriteByte('}')
+	default:
+		writeCanonical(b, v)
+	}
+}
+
+func builtinFormatInt(a []interface{}) (interface{}, bool) {
+	f, ok1 := a[0].(float64)
+	base, ok2 := integer(a[1])
+	if !ok1 || !ok2 || (base != 2 && base != 8 && base != 10 && base != 16) {
+		return nil, false
+	}
+	return strconv.FormatInt(int64(f), base), true
+}
+
+func builtinToNumber(a []interface{}) (interface{}, bool) {
+	switch v := a[0].(type) {
+	case nil:
+		return float64(0), true
+	case bool:
+		if v {
+			return float64(1), true
+		}
+		return float64(0), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, false
+		}
+		return f, true
+	}
+	return nil, false
+}
+
+// regexCache keeps compiled patterns. Patterns built from input could grow
+// it without bound, so it stops taking new ones when full.
+var regexCache struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}
+
+const regexCacheSize = 256
+
+func builtinRegexMatch(a []interface{}) (interface{}, bool) {
+	pattern, ok1 := a[0].(string)
+	s, ok2 := a[1].(string)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	regexCache.Lock()
+	re, ok := regexCache.m[pattern]
+	regexCache.Unlock()
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, false
+		}
+		regexCache.Lock()
+		if regexCache.m == nil {
+			regexCache.m = make(map[string]*regexp.Regexp)
+		}
+		if len(regexCache.m) < regexCacheSize {
+			regexCache.m[pattern] = re
+		}
+		regexCache.Unlock()
+	}
+	return re.MatchString(s), true
+}
+
+// builtinCIDRContains reports whether the network holds an address or a
+// whole other network
+func builtinCIDRContains(a []interface{}) (interface{}, bool) {
+	cidr, ok1 := a[0].(string)
+	s, ok2 := a[1].(string)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	network, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, false
+	}
+	network = network.Masked()
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return network.Contains(addr.Unmap()), true
+	}
+	other, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, false
+	}
+	return other.Bits() >= network.Bits() && network.Contains(other.Addr()), true
+}
+
+// builtinObjectGet looks up a key, or a path given as an array, and returns
+// the default when it is missing
+func builtinObjectGet(a []interface{}) (interface{}, bool) {
+	if _, ok := a[0].(map[string]interface{}); !ok {
+		return nil, false
+	}
+	path, ok := a[1].([]interface{})
+	if !ok {
+		path = []interface{}{a[1]}
+	}
+	v := a[0]
+	for _, key := range path {
+		item, ok := lookupValue(v, key)
+		if !ok {
+			return a[2], true
+		}
+		v = item
+	}
+	return v, true
+}
+
+func builtinObjectKeys(a []interface{}) (interface{}, bool) {
+	m, ok := a[0].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	s := newSet()
+	for k := range m {
+		s.add(k)
+	}
+	return s, true
+}
+
+func builtinArrayConcat(a []interface{}) (interface{}, bool) {
+	x, ok1 := a[0].([]interface{})
+	y, ok2 := a[1].([]interface{})
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	return append(append([]interface{}{}, x...), y...), true
+}
+
+func isType(rank int) func([]interface{}) (interface{}, bool) {
+	return func(a []interface{}) (interface{}, bool) {
+		return typeRank(a[0]) == rank, true
+	}
+}
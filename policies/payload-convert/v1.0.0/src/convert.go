@@ -0,0 +1,389 @@
+package payload_convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Both directions go through ordered values so that element order survives
+// the conversion; SOAP-style backends often validate it. A value is one of
+// object, []interface{}, string, json.Number, bool or nil.
+
+// object is a JSON object with its members in document order
+type object []member
+
+type member struct {
+	key   string
+	value interface{}
+}
+
+// xmlElement is an element being read, with its attributes and children
+// collected as members
+type xmlElement struct {
+	name    string
+	members object
+	// index maps a child name to its member, so repeated children are merged
+	// into one list
+	index map[string]int
+	text  strings.Builder
+}
+
+// add adds a child value, turning repeated children into a list
+func (e *xmlElement) add(cfg convertConfig, name string, value interface{}) {
+	if i, ok := e.index[name]; ok {
+		if list, ok := e.members[i].value.([]interface{}); ok {
+			e.members[i].value = append(list, value)
+		} else {
+			e.members[i].value = []interface{}{e.members[i].value, value}
+		}
+		return
+	}
+	if cfg.ForceArrays[name] {
+		value = []interface{}{value}
+	}
+	if e.index == nil {
+		e.index = map[string]int{}
+	}
+	e.index[name] = len(e.members)
+	e.members = append(e.members, member{key: name, value: value})
+}
+
+// value returns what the element converts to: its text when it has neither
+// attributes nor children, otherwise an object holding them and any text
+// under TextKey
+func (e *xmlElement) value(cfg convertConfig) interface{} {
+	text := strings.TrimSpace(e.text.String())
+	if len(e.members) == 0 {
+		return cfg.scalar(text)
+	}
+	if text != "" {
+		e.members = append(e.members, member{key: cfg.TextKey, value: cfg.scalar(text)})
+	}
+	return e.members
+}
+
+// scalar converts element text, inferring booleans and numbers if enabled
+func (cfg convertConfig) scalar(text string) interface{} {
+	if !cfg.InferTypes {
+		return text
+	}
+	switch text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if text != "" && (text[0] == '-' || text[0] >= '0' && text[0] <= '9') && json.Valid([]byte(text)) {
+		// JSON's number grammar keeps values such as 007 or 1. as text
+		return json.Number(text)
+	}
+	return text
+}
+
+// xmlToJSON converts an XML document to JSON. Namespaces are not carried
+// over: elements and attributes keep their local names and namespace
+// declarations are dropped.
+func xmlToJSON(cfg convertConfig, body []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var stack []*xmlElement
+	var root interface{}
+	var rootName string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && rootName != "" {
+				return nil, errors.New("the document has more than one root element")
+			}
+			e := &xmlElement{name: t.Name.Local}
+			if !cfg.IgnoreAttributes {
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" && attr.Name.Space == "" {
+						continue
+					}
+					e.add(convertConfig{}, cfg.AttributePrefix+attr.Name.Local, cfg.scalar(attr.Value))
+				}
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				root, rootName = e.value(cfg), e.name
+			} else {
+				stack[len(stack)-1].add(cfg, e.name, e.value(cfg))
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("the document has text outside the root element")
+			}
+		}
+		// Comments, processing instructions and DOCTYPE declarations carry
+		// no data
+	}
+	if rootName == "" {
+		return nil, errors.New("the document has no root element")
+	}
+	if cfg.KeepRoot {
+		root = object{{key: rootName, value: root}}
+	}
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON encodes an ordered value
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case object:
+		buf.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, m.key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, m.value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case string:
+		writeJSONString(buf, v)
+	case json.Number:
+		buf.WriteString(string(v))
+	case bool:
+		fmt.Fprint(buf, v)
+	case nil:
+		buf.WriteString("null")
+	default:
+		return fmt.Errorf("cannot encode %T", v)
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode ends the value with a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+// readJSON decodes a JSON document into ordered values
+func readJSON(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	v, err := readJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+func readJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// jsonToXML converts a JSON document to XML. The document is wrapped in
+// RootElement, or, when that is empty, must be an object with a single
+// member that becomes the root.
+func jsonToXML(cfg convertConfig, body []byte) ([]byte, error) {
+	v, err := readJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.RootElement
+	if name == "" {
+		obj, ok := v.(object)
+		if !ok || len(obj) != 1 {
+			return nil, errors.New("without a root element the JSON document must be an object with one member")
+		}
+		name, v = obj[0].key, obj[0].value
+	}
+	if list, ok := v.([]interface{}); ok {
+		// A list at the root becomes a root element of repeated items
+		v = object{{key: cfg.ItemElement, value: list}}
+	}
+
+	var buf bytes.Buffer
+	if cfg.XMLDeclaration {
+		buf.WriteString(xml.Header)
+	}
+	if err := cfg.writeElement(&buf, name, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeElement writes a value as an element named name. A list writes one
+// element per item; lists nested in lists use ItemElement.
+func (cfg convertConfig) writeElement(buf *bytes.Buffer, name string, v interface{}) error {
+	if !validXMLName(name) {
+		return fmt.Errorf("%q is not a valid XML element name", name)
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if nested, ok := item.([]interface{}); ok {
+				item = object{{key: cfg.ItemElement, value: nested}}
+			}
+			if err := cfg.writeElement(buf, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case object:
+		return cfg.writeObject(buf, name, v)
+	case nil:
+		buf.WriteString("<" + name + "/>")
+		return nil
+	}
+	buf.WriteString("<" + name + ">")
+	xml.EscapeText(buf, []byte(scalarText(v)))
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+func (cfg convertConfig) writeObject(buf *bytes.Buffer, name string, obj object) error {
+	buf.WriteString("<" + name)
+	var children object
+	var text *string
+	for _, m := range obj {
+		switch {
+		case m.key == cfg.TextKey:
+			if !isScalar(m.value) {
+				return fmt.Errorf("%s of %q must be a string, number or boolean", cfg.TextKey, name)
+			}
+			s := scalarText(m.value)
+			text = &s
+		case !cfg.IgnoreAttributes && strings.HasPrefix(m.key, cfg.AttributePrefix):
+			attr := strings.TrimPrefix(m.key, cfg.AttributePrefix)
+			if !validXMLName(attr) {
+				return fmt.Errorf("%q is not a valid XML attribute name", attr)
+			}
+			if !isScalar(m.value) {
+				return fmt.Errorf("attribute %q of %q must be a string, number or boolean", attr, name)
+			}
+			buf.WriteString(" " + attr + `="`)
+			xml.EscapeText(buf, []byte(scalarText(m.value)))
+			buf.WriteString(`"`)
+		default:
+			children = append(children, m)
+		}
+	}
+	if text == nil && len(children) == 0 {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteString(">")
+	if text != nil {
+		xml.EscapeText(buf, []byte(*text))
+	}
+	for _, m := range children {
+		if err := cfg.writeElement(buf, m.key, m.value); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, json.Number, bool, nil:
+		return true
+	}
+	return false
+}
+
+func scalarText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// validXMLName reports whether s can be used as an element or attribute
+// name. Colons are not allowed since namespaces are not supported.
+func validXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_' || unicode.IsLetter(c):
+		case i > 0 && (c == '-' || c == '.' || unicode.IsDigit(c)):
+		default:
+			return false
+		}
+	}
+	return true
+}
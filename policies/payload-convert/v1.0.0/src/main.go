@@ -0,0 +1,510 @@
+package payload_convert
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Conversion directions
+const (
+	xmlToJSONConversion = "xmlToJson"
+	jsonToXMLConversion = "jsonToXml"
+	noConversion        = "none"
+)
+
+type PayloadConvertPolicy struct{}
+
+type convertConfig struct {
+	Request          string
+	Response         string
+	RootElement      string
+	KeepRoot         bool
+	ItemElement      string
+	IgnoreAttributes bool
+	AttributePrefix  string
+	TextKey          string
+	ForceArrays      map[string]bool
+	InferTypes       bool
+	XMLDeclaration   bool
+	JSONContentType  string
+	XMLContentType   string
+	RejectInvalid    bool
+}
+
+// Validate configuration parameters
+func (p *PayloadConvertPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *PayloadConvertPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *PayloadConvertPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	contentType := ctx.Body.ContentType()
+	if contentType == "" {
+		contentType = headerValue(ctx.Headers, "Content-Type")
+	}
+	out, outType, ok, err := cfg.convert(cfg.Request, ctx.Body, contentType)
+	if err != nil {
+		if cfg.RejectInvalid {
+			return invalidBody(cfg.Request)
+		}
+		return UpstreamRequestModifications{}
+	}
+	if !ok {
+		return UpstreamRequestModifications{}
+	}
+	return UpstreamRequestModifications{
+		Body:      out,
+		HeaderOps: []HeaderOp{{Op: HeaderOpSet, Name: "Content-Type", Value: outType}},
+	}
+}
+
+// Response phase execution
+func (p *PayloadConvertPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	contentType := ctx.ResponseBody.ContentType()
+	if contentType == "" {
+		contentType = headerValue(ctx.ResponseHeaders, "Content-Type")
+	}
+	out, outType, ok, err := cfg.convert(cfg.Response, ctx.ResponseBody, contentType)
+	if err != nil || !ok {
+		// A response that cannot be converted is passed on as the upstream sent it
+		return UpstreamResponseModifications{}
+	}
+	return UpstreamResponseModifications{
+		Body:      out,
+		HeaderOps: []HeaderOp{{Op: HeaderOpSet, Name: "Content-Type", Value: outType}},
+	}
+}
+
+// convert converts a body in the given direction and returns it with its new
+// content type. ok is false when the body is not in the source format of the
+// direction, or is empty, and is left as it is.
+func (cfg convertConfig) convert(direction string, body *Body, contentType string) (out []byte, outType string, ok bool, err error) {
+	content := body.Bytes()
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, "", false, nil
+	}
+	mediaType := baseMediaType(contentType)
+	switch {
+	case direction == xmlToJSONConversion && isXML(mediaType):
+		out, err = xmlToJSON(cfg, content)
+		return out, cfg.JSONContentType, err == nil, err
+	case direction == jsonToXMLConversion && isJSON(mediaType):
+		out, err = jsonToXML(cfg, content)
+		return out, cfg.XMLContentType, err == nil, err
+	}
+	return nil, "", false, nil
+}
+
+// invalidBody answers a request whose body could not be converted, in the
+// format the client sent
+func invalidBody(direction string) ImmediateResponse {
+	if direction == xmlToJSONConversion {
+		return ImmediateResponse{
+			Status:  400,
+			Headers: map[string][]string{"Content-Type": {"application/xml"}},
+			Body:    "<error>Invalid request body</error>",
+		}
+	}
+	return ImmediateResponse{
+		Status:  400,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    `{"error": "Invalid request body"}`,
+	}
+}
+
+// parseConfig reads the conversion settings after the schema has checked them
+func parseConfig(params map[string]interface{}) (convertConfig, error) {
+	cfg := convertConfig{ForceArrays: map[string]bool{}}
+	var errs paramErrors
+
+	cfg.Request, _ = params["request"].(string)
+	cfg.Response, _ = params["response"].(string)
+	cfg.RootElement, _ = params["rootElement"].(string)
+	cfg.KeepRoot, _ = params["keepRoot"].(bool)
+	cfg.ItemElement, _ = params["itemElement"].(string)
+	attributes, _ := params["attributes"].(string)
+	cfg.IgnoreAttributes = attributes == "ignore"
+	cfg.AttributePrefix, _ = params["attributePrefix"].(string)
+	cfg.TextKey, _ = params["textKey"].(string)
+	cfg.InferTypes, _ = params["inferTypes"].(bool)
+	cfg.XMLDeclaration, _ = params["xmlDeclaration"].(bool)
+	cfg.JSONContentType, _ = params["jsonContentType"].(string)
+	cfg.XMLContentType, _ = params["xmlContentType"].(string)
+	cfg.RejectInvalid, _ = params["rejectInvalidBody"].(bool)
+	names, _ := params["forceArrays"].([]interface{})
+	for _, item := range names {
+		s, _ := item.(string)
+		cfg.ForceArrays[s] = true
+	}
+
+	if cfg.Request == noConversion && cfg.Response == noConversion {
+		errs.add("request", "at least one of request and response must convert")
+	}
+	if cfg.RootElement != "" && !validXMLName(cfg.RootElement) {
+		errs.add("rootElement", "must be a valid XML element name")
+	}
+	if !validXMLName(cfg.ItemElement) {
+		errs.add("itemElement", "must be a valid XML element name")
+	}
+	if !cfg.IgnoreAttributes && strings.HasPrefix(cfg.TextKey, cfg.AttributePrefix) {
+		errs.add("textKey", fmt.Sprintf("must not start with the attribute prefix %q", cfg.AttributePrefix))
+	}
+	for _, name := range []string{"jsonContentType", "xmlContentType"} {
+		if s, _ := params[name].(string); strings.ContainsAny(s, "\r\n") {
+			errs.add(name, "must not contain line breaks")
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// baseMediaType returns the media type of a Content-Type value without its
+// parameters, in lower case
+func baseMediaType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isXML(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// headerValue returns the first value of a header, matching its name without
+// regard to case
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
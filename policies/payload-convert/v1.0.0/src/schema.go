@@ -0,0 +1,26 @@
+package payload_convert
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "request": {"type": "string", "enum": ["xmlToJson", "jsonToXml", "none"], "default": "xmlToJson"},
+    "response": {"type": "string", "enum": ["jsonToXml", "xmlToJson", "none"], "default": "jsonToXml"},
+    "rootElement": {"type": "string", "default": "root"},
+    "keepRoot": {"type": "boolean", "default": false},
+    "itemElement": {"type": "string", "minLength": 1, "default": "item"},
+    "attributes": {"type": "string", "enum": ["prefix", "ignore"], "default": "prefix"},
+    "attributePrefix": {"type": "string", "minLength": 1, "default": "@"},
+    "textKey": {"type": "string", "minLength": 1, "default": "#text"},
+    "forceArrays": {"type": "array", "items": {"type": "string", "minLength": 1}, "default": []},
+    "inferTypes": {"type": "boolean", "default": false},
+    "xmlDeclaration": {"type": "boolean", "default": true},
+    "jsonContentType": {"type": "string", "minLength": 1, "default": "application/json"},
+    "xmlContentType": {"type": "string", "minLength": 1, "default": "application/xml"},
+    "rejectInvalidBody": {"type": "boolean", "default": false}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,80 @@
+package quota
+
+import (
+	"sync"
+	"time"
+	// Embedded so time zones work on gateways without a zoneinfo database
+	_ "time/tzdata"
+)
+
+const (
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+
+	weekStartMonday = "monday"
+	weekStartSunday = "sunday"
+
+	// counterGrace keeps a counter for a while after its period ends, so the
+	// usage of responses that finish after midnight still lands somewhere
+	counterGrace = time.Hour
+)
+
+// window is one calendar period. Usage is counted per window and starts over
+// when the next one begins.
+type window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// currentWindow returns the period holding now. Periods begin at midnight in
+// the configured time zone, so a day may be 23 or 25 hours long around
+// daylight saving changes.
+func (cfg quotaConfig) currentWindow(now time.Time) window {
+	now = now.In(cfg.Location)
+	y, m, d := now.Date()
+	var start, end time.Time
+	switch cfg.Period {
+	case periodMonth:
+		start = time.Date(y, m, 1, 0, 0, 0, 0, cfg.Location)
+		end = start.AddDate(0, 1, 0)
+	case periodWeek:
+		first := time.Monday
+		if cfg.WeekStart == weekStartSunday {
+			first = time.Sunday
+		}
+		back := (int(now.Weekday()) - int(first) + 7) % 7
+		start = time.Date(y, m, d-back, 0, 0, 0, 0, cfg.Location)
+		end = start.AddDate(0, 0, 7)
+	default:
+		start = time.Date(y, m, d, 0, 0, 0, 0, cfg.Location)
+		end = start.AddDate(0, 0, 1)
+	}
+	return window{Start: start, End: end}
+}
+
+// key names the counter of a client in the window. The period is part of the
+// key so that changing it does not carry usage over.
+func (w window) key(client, period string) string {
+	return client + ":" + period + ":" + w.Start.Format("20060102")
+}
+
+// expiresAt is when the counter of the window can be dropped
+func (w window) expiresAt() time.Time {
+	return w.End.Add(counterGrace)
+}
+
+// locations caches loaded time zones, as parameters are read on every request
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
@@ -0,0 +1,43 @@
+package quota
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "limit": {"type": "integer", "minimum": 1},
+    "unit": {"type": "string", "enum": ["requests", "bytes"], "default": "requests"},
+    "period": {"type": "string", "enum": ["day", "week", "month"], "default": "month"},
+    "timeZone": {"type": "string", "minLength": 1, "default": "UTC"},
+    "weekStart": {"type": "string", "enum": ["monday", "sunday"], "default": "monday"},
+    "consumerLimits": {
+      "type": "object",
+      "additionalProperties": {"type": "integer", "minimum": 0},
+      "default": {}
+    },
+    "withoutConsumer": {"type": "string", "enum": ["clientIp", "allow", "deny"], "default": "clientIp"},
+    "onExhausted": {"type": "string", "enum": ["block", "tag"], "default": "block"},
+    "includeHeaders": {"type": "boolean", "default": true},
+    "failOpen": {"type": "boolean", "default": true},
+    "store": {
+      "type": "object",
+      "properties": {
+        "type": {"type": "string", "enum": ["memory", "file", "redis"], "default": "memory"},
+        "path": {"type": "string", "minLength": 1},
+        "address": {"type": "string", "minLength": 1},
+        "username": {"type": "string"},
+        "password": {"type": "string"},
+        "database": {"type": "integer", "minimum": 0, "default": 0},
+        "tls": {"type": "boolean", "default": false},
+        "tlsServerName": {"type": "string"},
+        "keyPrefix": {"type": "string", "default": "quota:"},
+        "timeoutMs": {"type": "integer", "minimum": 1, "default": 100}
+      },
+      "additionalProperties": false
+    }
+  },
+  "required": ["limit"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,486 @@
+package quota
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UsageStore keeps the usage of every consumer in the current period.
+// Implementations must be safe for concurrent use.
+type UsageStore interface {
+	// IncrementBy adds n to the counter stored under key and returns the new
+	// value. A counter created by IncrementBy expires at expiresAt.
+	IncrementBy(key string, n int64, expiresAt time.Time) (int64, error)
+	// Get returns the current value of the counter stored under key, or zero
+	// if there is none.
+	Get(key string) (int64, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+const (
+	storeTypeMemory = "memory"
+	storeTypeFile   = "file"
+	storeTypeRedis  = "redis"
+
+	defaultKeyPrefix    = "quota:"
+	defaultRedisTimeout = 100 * time.Millisecond
+	redisMaxIdleConns   = 8
+
+	// fileSaveInterval is the longest time changes to a file store stay
+	// unsaved
+	fileSaveInterval = time.Second
+)
+
+type storeConfig struct {
+	Type          string
+	Path          string
+	Address       string
+	Username      string
+	Password      string
+	Database      int
+	TLS           bool
+	TLSServerName string
+	KeyPrefix     string
+	Timeout       time.Duration
+}
+
+// parseStoreConfig reads params["store"] after the schema has checked it. A
+// missing value selects the in-memory store.
+func parseStoreConfig(raw interface{}, errs *paramErrors) storeConfig {
+	cfg := storeConfig{
+		Type:      storeTypeMemory,
+		KeyPrefix: defaultKeyPrefix,
+		Timeout:   defaultRedisTimeout,
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg
+	}
+	for name, dst := range map[string]*string{
+		"type":          &cfg.Type,
+		"path":          &cfg.Path,
+		"keyPrefix":     &cfg.KeyPrefix,
+		"address":       &cfg.Address,
+		"username":      &cfg.Username,
+		"password":      &cfg.Password,
+		"tlsServerName": &cfg.TLSServerName,
+	} {
+		if s, ok := m[name].(string); ok {
+			*dst = s
+		}
+	}
+	if f, ok := m["database"].(float64); ok {
+		cfg.Database = int(f)
+	}
+	if b, ok := m["tls"].(bool); ok {
+		cfg.TLS = b
+	}
+	if f, ok := m["timeoutMs"].(float64); ok {
+		cfg.Timeout = time.Duration(f) * time.Millisecond
+	}
+
+	switch cfg.Type {
+	case storeTypeFile:
+		if cfg.Path == "" {
+			errs.add("store.path", "is required for the file store")
+		}
+	case storeTypeRedis:
+		if cfg.Address == "" {
+			errs.add("store.address", "is required for the redis store")
+		} else if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			errs.add("store.address", "must be host:port")
+		}
+	}
+	return cfg
+}
+
+// newUsageStore builds the store described by cfg
+func newUsageStore(cfg storeConfig) (UsageStore, error) {
+	switch cfg.Type {
+	case storeTypeFile:
+		return openFileStore(cfg.Path)
+	case storeTypeRedis:
+		return newRedisStore(cfg), nil
+	}
+	return newMemoryStore(), nil
+}
+
+// memoryStore keeps usage in process memory. Usage is not shared between
+// gateway replicas and starts over when the gateway restarts.
+type memoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	nextSweep time.Time
+}
+
+type memoryCounter struct {
+	Value     int64     `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{counters: make(map[string]*memoryCounter)}
+}
+
+func (s *memoryStore) IncrementBy(key string, n int64, expiresAt time.Time) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incrementLocked(key, n, expiresAt, now), nil
+}
+
+func (s *memoryStore) incrementLocked(key string, n int64, expiresAt, now time.Time) int64 {
+	// Drop expired counters at most once a minute
+	if now.After(s.nextSweep) {
+		s.sweepLocked(now)
+		s.nextSweep = now.Add(time.Minute)
+	}
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.ExpiresAt) {
+		c = &memoryCounter{ExpiresAt: expiresAt}
+		s.counters[key] = c
+	}
+	c.Value += n
+	return c.Value
+}
+
+func (s *memoryStore) sweepLocked(now time.Time) {
+	for k, c := range s.counters {
+		if !now.Before(c.ExpiresAt) {
+			delete(s.counters, k)
+		}
+	}
+}
+
+func (s *memoryStore) Get(key string) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.ExpiresAt) {
+		return 0, nil
+	}
+	return c.Value, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore is a memory store that is saved to a JSON file, so usage
+// survives restarts of a single gateway. Changes are saved at most
+// fileSaveInterval after they are made, on the request path, by writing a
+// new file and renaming it over the old one.
+type fileStore struct {
+	*memoryStore
+	path     string
+	dirty    bool
+	nextSave time.Time
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.counters); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if s.counters == nil {
+		s.counters = make(map[string]*memoryCounter)
+	}
+	return s, nil
+}
+
+func (s *fileStore) IncrementBy(key string, n int64, expiresAt time.Time) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.incrementLocked(key, n, expiresAt, now)
+	s.dirty = true
+	if now.After(s.nextSave) {
+		s.nextSave = now.Add(fileSaveInterval)
+		if err := s.saveLocked(now); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func (s *fileStore) saveLocked(now time.Time) error {
+	s.sweepLocked(now)
+	data, err := json.Marshal(s.counters)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close saves what has not been saved yet
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.saveLocked(time.Now())
+}
+
+// incrementScript adds to a counter and sets its expiry in one atomic step,
+// so a counter can never be left without one.
+const incrementScript = `local c = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) == -1 then redis.call('PEXPIREAT', KEYS[1], ARGV[2]) end
+return c`
+
+// redisStore keeps usage in Redis, so every gateway replica sees the same
+// usage and it survives restarts.
+type redisStore struct {
+	cfg  storeConfig
+	idle chan *redisConn
+}
+
+func newRedisStore(cfg storeConfig) *redisStore {
+	return &redisStore{
+		cfg:  cfg,
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+func (s *redisStore) IncrementBy(key string, n int64, expiresAt time.Time) (int64, error) {
+	reply, err := s.do("EVAL", incrementScript, "1", s.cfg.KeyPrefix+key,
+		strconv.FormatInt(n, 10), strconv.FormatInt(expiresAt.UnixMilli(), 10))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %T to EVAL", reply)
+	}
+	return count, nil
+}
+
+func (s *redisStore) Get(key string) (int64, error) {
+	reply, err := s.do("GET", s.cfg.KeyPrefix+key)
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+}
+
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection. Connections that fail are
+// discarded rather than returned to the pool.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.cfg.Timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+func (s *redisStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLS {
+		serverName := s.cfg.TLSServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(s.cfg.Address)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.cfg.Password != "" {
+		args := []string{"AUTH", s.cfg.Password}
+		if s.cfg.Username != "" {
+			args = []string{"AUTH", s.cfg.Username, s.cfg.Password}
+		}
+		if _, err := c.do(s.cfg.Timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.Database != 0 {
+		if _, err := c.do(s.cfg.Timeout, "SELECT", strconv.Itoa(s.cfg.Database)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply sent by the server. The connection that
+// received it is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the subset of RESP needed by the store.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
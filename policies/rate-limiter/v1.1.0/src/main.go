@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Define policy types locally
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers map[string][]string
+	Body    *Body
+	Path    string
+	Method  string
+	// SharedContext would be here
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	// SharedContext would be here
+}
+
+type Body struct {
+	// Placeholder
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct{}
+
+type UpstreamResponseModifications struct{}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+type RateLimiterPolicy struct {
+	mu       sync.Mutex
+	store    CounterStore
+	storeCfg storeConfig
+}
+
+// Validate configuration parameters
+func (r *RateLimiterPolicy) Validate(params map[string]interface{}) error {
+	if _, ok := params["requestsPerMinute"].(float64); !ok {
+		return errors.New("requestsPerMinute is required and must be an integer")
+	}
+	if _, ok := params["burstLimit"].(float64); !ok {
+		return errors.New("burstLimit is required and must be an integer")
+	}
+	if _, err := parseStoreConfig(params["store"]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Declare processing behavior
+func (r *RateLimiterPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (r *RateLimiterPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	rpm := int(params["requestsPerMinute"].(float64))
+	burst := int(params["burstLimit"].(float64))
+
+	// Simple rate limiting logic (use client IP or something)
+	clientIP := "127.0.0.1" // Placeholder, in real use get from headers
+
+	store, err := r.counterStore(params)
+	if err != nil {
+		// Configuration is checked by Validate; never block traffic on it here
+		return UpstreamRequestModifications{}
+	}
+
+	// Counters are bucketed per minute and expire with their window
+	now := time.Now()
+	window := now.Truncate(time.Minute)
+	key := windowKey(clientIP, window)
+
+	count, err := store.Increment(key, window.Add(time.Minute).Sub(now))
+	if err != nil {
+		// The store is unavailable and has no fallback; fail open
+		return UpstreamRequestModifications{}
+	}
+	if count > int64(rpm+burst) {
+		// Rate limit exceeded
+		return ImmediateResponse{
+			Status: 429,
+			Headers: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: `{"error": "Rate limit exceeded"}`,
+		}
+	}
+
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (r *RateLimiterPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// counterStore returns the store for the given parameters, creating it on first
+// use and replacing it whenever the store configuration changes.
+func (r *RateLimiterPolicy) counterStore(params map[string]interface{}) (CounterStore, error) {
+	cfg, err := parseStoreConfig(params["store"])
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store != nil && r.storeCfg == cfg {
+		return r.store, nil
+	}
+	if r.store != nil {
+		r.store.Close()
+	}
+	r.store = newCounterStore(cfg)
+	r.storeCfg = cfg
+	return r.store, nil
+}
+
+func windowKey(client string, window time.Time) string {
+	return client + ":" + window.UTC().Format("200601021504")
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	algorithmFixedWindow          = "fixedWindow"
+	algorithmSlidingWindowLog     = "slidingWindowLog"
+	algorithmSlidingWindowCounter = "slidingWindowCounter"
+	algorithmTokenBucket          = "tokenBucket"
+
+	limitWindow = time.Minute
+)
+
+// Limiter decides whether a request charged to key fits in its budget.
+// Implementations must be safe for concurrent use.
+type Limiter interface {
+	Allow(key string, now time.Time) (Decision, error)
+	// Close releases the state the limiter keeps itself. A store passed to
+	// newLimiter is left open, as other limiters may share it.
+	Close() error
+}
+
+// Decision is the outcome of a single Allow call.
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests the budget holds
+	Limit int64
+	// Remaining is the number of requests still available
+	Remaining int64
+	// ResetAfter is how long until the budget is fully or partially restored
+	ResetAfter time.Duration
+}
+
+type limiterConfig struct {
+	Algorithm         string
+	RequestsPerMinute int
+	BurstLimit        int
+	Store             storeConfig
+	// Rules hold the budgets of particular routes; the fields above are the
+	// budget of all other requests
+	Rules []ruleConfig
+}
+
+// parseLimiterConfig reads the parameters that shape the limiter after the
+// schema has checked them and filled in defaults. The window algorithms allow
+// requestsPerMinute+burstLimit requests per minute; the token bucket holds
+// burstLimit tokens and refills requestsPerMinute per minute.
+func parseLimiterConfig(params map[string]interface{}) (limiterConfig, error) {
+	cfg := limiterConfig{Algorithm: algorithmFixedWindow}
+	if f, ok := params["requestsPerMinute"].(float64); ok {
+		cfg.RequestsPerMinute = int(f)
+	}
+	if f, ok := params["burstLimit"].(float64); ok {
+		cfg.BurstLimit = int(f)
+	}
+	if s, ok := params["algorithm"].(string); ok {
+		cfg.Algorithm = s
+	}
+
+	store, err := parseStoreConfig(params["store"])
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Store = store
+
+	var errs paramErrors
+	cfg.Rules = parseRules(params["rules"], cfg.Algorithm, &errs)
+	if store.Type != storeTypeMemory {
+		if memoryOnly(cfg.Algorithm) {
+			errs.add("algorithm", cfg.Algorithm+" only supports the memory store")
+		}
+		for i, rule := range cfg.Rules {
+			if memoryOnly(rule.Algorithm) && rule.Algorithm != cfg.Algorithm {
+				errs.add(fmt.Sprintf("rules[%d].algorithm", i), rule.Algorithm+" only supports the memory store")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// memoryOnly reports whether the algorithm keeps its state in the limiter
+// rather than in the counter store
+func memoryOnly(algorithm string) bool {
+	return algorithm == algorithmSlidingWindowLog || algorithm == algorithmTokenBucket
+}
+
+// scale shrinks the budget by factor, keeping at least one request per
+// minute and, where there is a burst, a burst of one
+func (cfg limiterConfig) scale(factor float64) limiterConfig {
+	cfg.RequestsPerMinute = int(math.Ceil(float64(cfg.RequestsPerMinute) * factor))
+	cfg.BurstLimit = int(math.Ceil(float64(cfg.BurstLimit) * factor))
+	return cfg
+}
+
+// newLimiter builds the limiter for cfg. The counter-based algorithms keep
+// their state in store; the others keep it in process memory.
+func newLimiter(cfg limiterConfig, store CounterStore) Limiter {
+	limit := int64(cfg.RequestsPerMinute + cfg.BurstLimit)
+	switch cfg.Algorithm {
+	case algorithmSlidingWindowLog:
+		return newSlidingLogLimiter(limit, limitWindow)
+	case algorithmSlidingWindowCounter:
+		return &slidingCounterLimiter{store: store, limit: limit, window: limitWindow}
+	case algorithmTokenBucket:
+		return newTokenBucketLimiter(float64(cfg.BurstLimit), float64(cfg.RequestsPerMinute)/limitWindow.Seconds())
+	}
+	return &fixedWindowLimiter{store: store, limit: limit, window: limitWindow}
+}
+
+// fixedWindowLimiter counts requests in aligned windows. A client can send up
+// to twice the limit across a window boundary.
+type fixedWindowLimiter struct {
+	store  CounterStore
+	limit  int64
+	window time.Duration
+}
+
+func (l *fixedWindowLimiter) Allow(key string, now time.Time) (Decision, error) {
+	start := now.Truncate(l.window)
+	reset := start.Add(l.window).Sub(now)
+
+	count, err := l.store.Increment(windowKey(key, start), reset)
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{
+		Allowed:    count <= l.limit,
+		Limit:      l.limit,
+		Remaining:  remaining(l.limit, count),
+		ResetAfter: reset,
+	}, nil
+}
+
+func (l *fixedWindowLimiter) Close() error {
+	return nil
+}
+
+// slidingCounterLimiter approximates a sliding window by weighting the count of
+// the previous fixed window by how much of it still overlaps the sliding one.
+type slidingCounterLimiter struct {
+	store  CounterStore
+	limit  int64
+	window time.Duration
+}
+
+func (l *slidingCounterLimiter) Allow(key string, now time.Time) (Decision, error) {
+	start := now.Truncate(l.window)
+	elapsed := now.Sub(start)
+
+	previous, err := l.store.Get(windowKey(key, start.Add(-l.window)))
+	if err != nil {
+		return Decision{}, err
+	}
+	// The current window's counter is read again by the next window
+	current, err := l.store.Increment(windowKey(key, start), 2*l.window-elapsed)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	weight := 1 - float64(elapsed)/float64(l.window)
+	estimate := int64(math.Ceil(float64(previous)*weight)) + current
+	return Decision{
+		Allowed:    estimate <= l.limit,
+		Limit:      l.limit,
+		Remaining:  remaining(l.limit, estimate),
+		ResetAfter: l.window - elapsed,
+	}, nil
+}
+
+func (l *slidingCounterLimiter) Close() error {
+	return nil
+}
+
+// slidingLogLimiter remembers the time of every allowed request in the last
+// window, giving an exact count at the cost of memory per request.
+type slidingLogLimiter struct {
+	limit  int64
+	window time.Duration
+
+	logs    *shardedMap[*requestLog]
+	janitor *janitor
+}
+
+// requestLog holds the times of a client's allowed requests, oldest first. It
+// is guarded by the lock of its shard.
+type requestLog struct {
+	times []time.Time
+}
+
+func newSlidingLogLimiter(limit int64, window time.Duration) *slidingLogLimiter {
+	l := &slidingLogLimiter{
+		limit:  limit,
+		window: window,
+		logs:   newShardedMap[*requestLog](),
+	}
+	l.janitor = startJanitor(expiryInterval, func(now time.Time) {
+		cutoff := now.Add(-l.window)
+		l.logs.removeIf(func(log *requestLog) bool {
+			return len(log.times) == 0 || !log.times[len(log.times)-1].After(cutoff)
+		})
+	})
+	return l
+}
+
+func (l *slidingLogLimiter) Allow(key string, now time.Time) (Decision, error) {
+	cutoff := now.Add(-l.window)
+	shard := l.logs.shard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	log, ok := shard.entries[key]
+	if !ok {
+		log = &requestLog{}
+		shard.entries[key] = log
+	}
+	i := 0
+	for i < len(log.times) && !log.times[i].After(cutoff) {
+		i++
+	}
+	log.times = log.times[i:]
+
+	d := Decision{Limit: l.limit}
+	if int64(len(log.times)) < l.limit {
+		log.times = append(log.times, now)
+		d.Allowed = true
+	}
+
+	d.Remaining = remaining(l.limit, int64(len(log.times)))
+	d.ResetAfter = log.times[0].Add(l.window).Sub(now)
+	return d, nil
+}
+
+// Close stops the background removal of idle logs
+func (l *slidingLogLimiter) Close() error {
+	l.janitor.stop()
+	return nil
+}
+
+// tokenBucketLimiter refills capacity tokens at rate per second and spends one
+// token per request, allowing bursts of up to capacity requests.
+type tokenBucketLimiter struct {
+	capacity float64
+	rate     float64
+
+	buckets *shardedMap[*tokenBucket]
+	janitor *janitor
+}
+
+// tokenBucket is guarded by the lock of its shard
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucketLimiter(capacity, rate float64) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{
+		capacity: capacity,
+		rate:     rate,
+		buckets:  newShardedMap[*tokenBucket](),
+	}
+	// A bucket idle long enough to be full again is the same as no bucket
+	full := time.Duration(capacity / rate * float64(time.Second))
+	l.janitor = startJanitor(expiryInterval, func(now time.Time) {
+		l.buckets.removeIf(func(b *tokenBucket) bool {
+			return now.Sub(b.last) >= full
+		})
+	})
+	return l
+}
+
+func (l *tokenBucketLimiter) Allow(key string, now time.Time) (Decision, error) {
+	shard := l.buckets.shard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	b, ok := shard.entries[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, last: now}
+		shard.entries[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.capacity, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+
+	d := Decision{Limit: int64(l.capacity)}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	}
+	d.Remaining = int64(b.tokens)
+	// Time until the next whole token is available
+	d.ResetAfter = time.Duration((1 - (b.tokens - math.Floor(b.tokens))) / l.rate * float64(time.Second))
+	return d, nil
+}
+
+// Close stops the background removal of full buckets
+func (l *tokenBucketLimiter) Close() error {
+	l.janitor.stop()
+	return nil
+}
+
+func remaining(limit, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+func windowKey(client string, window time.Time) string {
+	return client + ":" + window.UTC().Format("200601021504")
+}
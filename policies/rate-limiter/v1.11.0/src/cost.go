@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chargeKey stores the charge of an allowed request in the SharedContext so
+// the response phase can refund it
+const chargeKey = "rate-limiter.charge"
+
+// costConfig decides how much of the budget each request uses
+type costConfig struct {
+	// Amount is the cost of requests that match no rule with a cost of its
+	// own, when neither Header nor BytesPerUnit gives one
+	Amount int64
+	// Header names a request header holding the cost
+	Header string
+	// TrustHeader confirms that Header is set or removed before the rate
+	// limiter, so clients cannot choose their own cost
+	TrustHeader bool
+	// BytesPerUnit charges one per this many bytes of Content-Length
+	BytesPerUnit int64
+	// Max bounds the cost taken from Header or BytesPerUnit; 0 is no bound.
+	// It is also the cost of a body whose length is not known.
+	Max int64
+	// RefundStatuses are response statuses, such as "404", and classes, such
+	// as "5xx", for which the cost is given back
+	RefundStatuses []string
+}
+
+// charge is what an allowed request was charged, kept until its response
+type charge struct {
+	limiter Limiter
+	key     string
+	cost    int64
+	at      time.Time
+}
+
+// parseCostConfig reads params["cost"] and params["refundStatuses"] after the
+// schema has checked them
+func parseCostConfig(params map[string]interface{}) (costConfig, error) {
+	cfg := costConfig{Amount: 1}
+	var errs paramErrors
+	if m, ok := params["cost"].(map[string]interface{}); ok {
+		if f, ok := m["amount"].(float64); ok {
+			cfg.Amount = int64(f)
+		}
+		cfg.Header, _ = m["header"].(string)
+		cfg.TrustHeader, _ = m["trustHeader"].(bool)
+		if f, ok := m["bytesPerUnit"].(float64); ok {
+			cfg.BytesPerUnit = int64(f)
+		}
+		if f, ok := m["max"].(float64); ok {
+			cfg.Max = int64(f)
+		}
+		if cfg.Max > 0 && cfg.Header == "" && cfg.BytesPerUnit == 0 {
+			errs.add("cost.max", "is only used with cost.header or cost.bytesPerUnit")
+		}
+		if cfg.Header != "" && !cfg.TrustHeader {
+			errs.add("cost.header", "can be set by clients; set cost.trustHeader once a policy or proxy in front of the rate limiter sets or removes it")
+		}
+		if cfg.BytesPerUnit > 0 && cfg.Max == 0 {
+			errs.add("cost.max", "is required with cost.bytesPerUnit, as the cost of bodies without a Content-Length")
+		}
+	}
+
+	statuses, _ := params["refundStatuses"].([]interface{})
+	for i, v := range statuses {
+		var status string
+		switch v := v.(type) {
+		case float64:
+			status = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			status = strings.ToLower(v)
+		}
+		if !validRefundStatus(status) {
+			errs.add(fmt.Sprintf("refundStatuses[%d]", i), "must be a status code such as 404 or a class such as 5xx")
+			continue
+		}
+		cfg.RefundStatuses = append(cfg.RefundStatuses, status)
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+func validRefundStatus(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	return s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
+
+// of returns the cost of the request. fixed is the cost of the matching rule,
+// or Amount. A cost header wins over the body size, and the body size over
+// the fixed cost; headers that do not hold a whole number are ignored. Costs
+// from the header or the body size are never below the fixed cost or one, so
+// neither makes a request cheaper than its rule. A body of unknown length,
+// such as a chunked upload, costs Max: the request is counted before the
+// body is read.
+func (cfg costConfig) of(ctx *RequestContext, fixed int64) int64 {
+	floor := max(fixed, 1)
+	if cfg.Header != "" {
+		if n, err := strconv.ParseInt(strings.TrimSpace(headerValue(ctx.Headers, cfg.Header)), 10, 64); err == nil {
+			return max(cfg.bounded(n), floor)
+		}
+	}
+	if cfg.BytesPerUnit > 0 {
+		length := strings.TrimSpace(headerValue(ctx.Headers, "Content-Length"))
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n >= 0 {
+			units := n / cfg.BytesPerUnit
+			if n%cfg.BytesPerUnit != 0 {
+				units++
+			}
+			return max(cfg.bounded(units), floor)
+		}
+		if length != "" || headerValue(ctx.Headers, "Transfer-Encoding") != "" {
+			return max(cfg.Max, floor)
+		}
+	}
+	return fixed
+}
+
+func (cfg costConfig) bounded(n int64) int64 {
+	if cfg.Max > 0 && n > cfg.Max {
+		return cfg.Max
+	}
+	return n
+}
+
+// refunds reports whether a response with the given status gets its cost back
+func (cfg costConfig) refunds(status int) bool {
+	code := strconv.Itoa(status)
+	for _, s := range cfg.RefundStatuses {
+		if s == code || len(code) == 3 && s[0] == code[0] && s[1:] == "xx" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	keyRemoteAddr    = "remoteAddr"
+	keyXForwardedFor = "xForwardedFor"
+	keyHeader        = "header"
+	keyJWTClaim      = "jwtClaim"
+	keyConsumer      = "consumer"
+	keyComposite     = "composite"
+
+	defaultTrustedProxyDepth = 1
+)
+
+// keyStrategy decides which counter a request is charged against.
+type keyStrategy struct {
+	Type              string
+	TrustedProxyDepth int
+	HeaderName        string
+	Claim             string
+	// Client identifies the caller for the composite strategy
+	Client *keyStrategy
+}
+
+// parseKeyStrategy reads params["keyStrategy"] after the schema has checked
+// it. The value is either a strategy name or an object; a missing value
+// selects remoteAddr.
+func parseKeyStrategy(raw interface{}, path string) (*keyStrategy, error) {
+	ks := &keyStrategy{Type: keyRemoteAddr, TrustedProxyDepth: defaultTrustedProxyDepth}
+	if raw == nil {
+		return ks, nil
+	}
+	if name, ok := raw.(string); ok {
+		raw = map[string]interface{}{"type": name}
+	}
+	m, _ := raw.(map[string]interface{})
+	if s, ok := m["type"].(string); ok {
+		ks.Type = s
+	}
+
+	switch ks.Type {
+	case keyXForwardedFor:
+		if f, ok := m["trustedProxyDepth"].(float64); ok {
+			ks.TrustedProxyDepth = int(f)
+		}
+	case keyHeader:
+		ks.HeaderName, _ = m["headerName"].(string)
+		if ks.HeaderName == "" {
+			return nil, invalidParam(path+".headerName", "is required for the header strategy")
+		}
+	case keyJWTClaim:
+		ks.Claim, _ = m["claim"].(string)
+		if ks.Claim == "" {
+			return nil, invalidParam(path+".claim", "must not be empty")
+		}
+	case keyComposite:
+		// The client is a strategy of its own, so it is checked against the
+		// keyStrategy schema here rather than by the top level schema
+		var client interface{}
+		if raw, ok := m["client"]; ok {
+			var err error
+			if client, err = parameters.property("keyStrategy").applyAt(raw, path+".client"); err != nil {
+				return nil, err
+			}
+		}
+		c, err := parseKeyStrategy(client, path+".client")
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == keyComposite {
+			return nil, invalidParam(path+".client", "cannot be composite")
+		}
+		ks.Client = c
+	}
+	return ks, nil
+}
+
+// key returns the counter key for the request. Identifiers that are missing
+// from the request fall back to the remote address so one misbehaving client
+// cannot exhaust a shared anonymous bucket unnoticed.
+func (ks *keyStrategy) key(ctx *RequestContext) string {
+	switch ks.Type {
+	case keyXForwardedFor:
+		if ip := forwardedClientIP(ctx, ks.TrustedProxyDepth); ip != "" {
+			return "ip:" + ip
+		}
+	case keyHeader:
+		if v := headerValue(ctx.Headers, ks.HeaderName); v != "" {
+			return "hdr:" + hashKey(v)
+		}
+	case keyJWTClaim:
+		if v := bearerClaim(ctx.Headers, ks.Claim); v != "" {
+			return "jwt:" + hashKey(v)
+		}
+	case keyConsumer:
+		// Set by an authentication policy earlier in the chain
+		if v, ok := SharedValue[string](ctx.SharedContext, ConsumerIDKey); ok && v != "" {
+			return "consumer:" + hashKey(v)
+		}
+	case keyComposite:
+		return "path:" + requestPath(ctx.Path) + "|" + ks.Client.key(ctx)
+	}
+	return "ip:" + remoteIP(ctx)
+}
+
+func remoteIP(ctx *RequestContext) string {
+	if ctx.RemoteAddr == "" {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		return host
+	}
+	return ctx.RemoteAddr
+}
+
+// forwardedClientIP picks the client address from X-Forwarded-For. Each of the
+// depth trusted proxies in front of the gateway appends one entry, so the
+// client is the depth-th entry from the right; anything further left can be
+// forged by the caller.
+func forwardedClientIP(ctx *RequestContext, depth int) string {
+	var hops []string
+	for k, values := range ctx.Headers {
+		if !strings.EqualFold(k, "X-Forwarded-For") {
+			continue
+		}
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	if len(hops) < depth {
+		return ""
+	}
+	ip := net.ParseIP(hops[len(hops)-depth])
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// bearerClaim reads a claim from the bearer token without verifying it.
+// Signature checks belong to an authentication policy earlier in the chain.
+func bearerClaim(headers map[string][]string, claim string) string {
+	auth := headerValue(headers, "Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	// Dotted names address nested claims, e.g. "org.id"
+	var v interface{} = claims
+	for _, name := range strings.Split(claim, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[name]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// hashKey keeps caller-supplied identifiers such as API keys out of counter
+// keys and bounds their length.
+func hashKey(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+	// Metrics is nil when the gateway does not collect metrics, see
+	// MetricsOrNop
+	Metrics Metrics
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+	Metrics         Metrics
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Metrics creates the instruments a policy records measurements with. The
+// gateway hands each policy instance its own Metrics and exports what is
+// recorded, e.g. to Prometheus, labelled with the policy name and version,
+// so policies only add labels of their own. Names follow the Prometheus
+// conventions, such as rate_limiter_requests_total. Asking again for an
+// instrument with the same name and labels returns the same one.
+type Metrics interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	// Histogram uses buckets as upper bounds; nil chooses default buckets
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Labels are label names with their values. Every instrument of one name
+// must use the same label names.
+type Labels map[string]string
+
+// Counter is a value that only goes up, such as a number of requests
+type Counter interface {
+	// Add increases the counter; negative deltas are ignored
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down, such as requests in flight
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations, such as latencies, in buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// MetricsOrNop returns m, or a Metrics whose instruments discard everything
+// when m is nil because the gateway does not collect metrics
+func MetricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, Labels) Counter { return nopInstrument{} }
+
+func (nopMetrics) Gauge(string, string, Labels) Gauge { return nopInstrument{} }
+
+func (nopMetrics) Histogram(string, string, []float64, Labels) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64) {}
+
+func (nopInstrument) Set(float64) {}
+
+func (nopInstrument) Observe(float64) {}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// decisionKey stores the request phase Decision in the SharedContext
+const decisionKey = "rate-limiter.decision"
+
+// limitFactorKey is set by earlier policies to a float64 between 0 and 1 to
+// shrink the budget of a request's client, e.g. 0.5 for suspected bots.
+// Such requests are counted against a separate, scaled budget.
+const limitFactorKey = "rate-limiter.limitFactor"
+
+// Names of the metrics the policy records
+const (
+	requestsMetric     = "rate_limiter_requests_total"
+	storeLatencyMetric = "rate_limiter_decision_duration_seconds"
+)
+
+type RateLimiterPolicy struct {
+	mu         sync.Mutex
+	store      CounterStore
+	limiterCfg limiterConfig
+	// fallback is the budget of requests that match none of the rules
+	fallback *budget
+	rules    []*rule
+}
+
+// budget holds the limiter of one budget, and the limiters for the budget
+// shrunk by a limit factor
+type budget struct {
+	cfg limiterConfig
+	// keyPrefix keeps the counters of different budgets in one store apart
+	keyPrefix string
+	// cost is the fixed cost of the budget's requests, or -1 for cost.amount
+	cost    int64
+	limiter Limiter
+	scaled  map[float64]Limiter
+}
+
+// Validate configuration parameters
+func (r *RateLimiterPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseLimiterConfig(params)
+	if err != nil {
+		return err
+	}
+	if _, err := compileRules(cfg); err != nil {
+		return err
+	}
+	if _, err := parseCostConfig(params); err != nil {
+		return err
+	}
+	_, err = parseKeyStrategy(params["keyStrategy"], "keyStrategy")
+	return err
+}
+
+// Declare processing behavior
+func (r *RateLimiterPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (r *RateLimiterPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	// Configuration is checked by Validate; never block traffic on it here
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	keys, err := parseKeyStrategy(params["keyStrategy"], "keyStrategy")
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	costs, err := parseCostConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	factor := limitFactor(ctx.SharedContext)
+	limiter, b, err := r.rateLimiter(params, ctx, factor)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	cost := b.cost
+	if cost < 0 {
+		cost = costs.Amount
+	}
+	cost = costs.of(ctx, cost)
+
+	key := b.keyPrefix + keys.key(ctx)
+	if factor < 1 {
+		key = "scaled:" + strconv.FormatFloat(factor, 'g', -1, 64) + "|" + key
+	}
+	metrics := MetricsOrNop(ctx.Metrics)
+	start := time.Now()
+	decision, err := limiter.Allow(key, cost, start)
+	metrics.Histogram(storeLatencyMetric, "Time taken to decide on a request, including store round trips", nil, nil).
+		Observe(time.Since(start).Seconds())
+	if err != nil {
+		// The store is unavailable and has no fallback; fail open
+		countRequest(metrics, "error")
+		return UpstreamRequestModifications{}
+	}
+	if !decision.Allowed {
+		countRequest(metrics, "limited")
+		// Rate limit exceeded
+		headers := map[string][]string{
+			"Content-Type": {"application/json"},
+			"Retry-After":  {strconv.FormatInt(seconds(decision.ResetAfter), 10)},
+		}
+		if includeHeaders(params) {
+			for name, value := range rateLimitHeaders(decision) {
+				headers[name] = []string{value}
+			}
+		}
+		return ImmediateResponse{
+			Status:  429,
+			Headers: headers,
+			Body:    `{"error": "Rate limit exceeded"}`,
+		}
+	}
+
+	countRequest(metrics, "allowed")
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(decisionKey, decision)
+		if len(costs.RefundStatuses) > 0 && cost > 0 {
+			ctx.SharedContext.Set(chargeKey, &charge{limiter: limiter, key: key, cost: cost, at: start})
+		}
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (r *RateLimiterPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil || ctx.SharedContext == nil {
+		return UpstreamResponseModifications{}
+	}
+	decision, ok := SharedValue[Decision](ctx.SharedContext, decisionKey)
+	if !ok {
+		return UpstreamResponseModifications{}
+	}
+	costs, err := parseCostConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	if c, ok := SharedValue[*charge](ctx.SharedContext, chargeKey); ok && costs.refunds(ctx.ResponseStatus) {
+		// A failed refund leaves the request charged, as it would have been
+		// without refunds
+		if c.limiter.Refund(c.key, c.cost, c.at) == nil {
+			decision.Remaining = min(decision.Limit, decision.Remaining+c.cost)
+			countRequest(MetricsOrNop(ctx.Metrics), "refunded")
+		}
+		ctx.SharedContext.Delete(chargeKey)
+	}
+	if !includeHeaders(params) {
+		return UpstreamResponseModifications{}
+	}
+	return UpstreamResponseModifications{
+		SetHeaders: rateLimitHeaders(decision),
+	}
+}
+
+// rateLimiter returns the limiter of the first rule that matches the request,
+// or of the top level budget, with the budget it belongs to. Limiters
+// are created on first use and replaced whenever the limiter configuration
+// changes. A factor below 1 selects a limiter with the budget scaled down,
+// sharing the store of the full one.
+func (r *RateLimiterPolicy) rateLimiter(params map[string]interface{}, ctx *RequestContext, factor float64) (Limiter, *budget, error) {
+	cfg, err := parseLimiterConfig(params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fallback == nil || !reflect.DeepEqual(r.limiterCfg, cfg) {
+		rules, err := compileRules(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.fallback != nil {
+			r.fallback.close()
+			for _, rule := range r.rules {
+				rule.budget.close()
+			}
+			r.store.Close()
+		}
+		r.store = newCounterStore(cfg.Store)
+		r.fallback = newBudget(cfg, "", -1, r.store)
+		for _, rule := range rules {
+			rule.budget = newBudget(rule.limits(cfg), "rule:"+rule.Name+"|", rule.Cost, r.store)
+		}
+		r.rules = rules
+		r.limiterCfg = cfg
+	}
+
+	b := r.fallback
+	path := requestPath(ctx.Path)
+	for _, rule := range r.rules {
+		if rule.matches(ctx.Method, path) {
+			b = rule.budget
+			break
+		}
+	}
+	return b.limiterFor(factor, r.store), b, nil
+}
+
+func newBudget(cfg limiterConfig, keyPrefix string, cost int64, store CounterStore) *budget {
+	return &budget{cfg: cfg, keyPrefix: keyPrefix, cost: cost, limiter: newLimiter(cfg, store)}
+}
+
+// limiterFor returns the limiter for the budget scaled by factor. The caller
+// holds the policy lock.
+func (b *budget) limiterFor(factor float64, store CounterStore) Limiter {
+	if factor >= 1 {
+		return b.limiter
+	}
+	if l, ok := b.scaled[factor]; ok {
+		return l
+	}
+	if b.scaled == nil {
+		b.scaled = make(map[float64]Limiter)
+	}
+	l := newLimiter(b.cfg.scale(factor), store)
+	b.scaled[factor] = l
+	return l
+}
+
+func (b *budget) close() {
+	b.limiter.Close()
+	for _, l := range b.scaled {
+		l.Close()
+	}
+}
+
+// limitFactor returns the budget factor set for the request, or 1. Values
+// outside (0, 1] are ignored, so no policy can raise a client's budget.
+func limitFactor(shared *SharedContext) float64 {
+	f, ok := SharedValue[float64](shared, limitFactorKey)
+	if !ok || f <= 0 || f >= 1 || math.IsNaN(f) {
+		return 1
+	}
+	// Rounded so that nearly equal factors share a limiter
+	return math.Max(math.Round(f*100)/100, 0.01)
+}
+
+// countRequest counts a request by its decision: allowed, limited, or error
+// when the store failed and the request was let through. Allowed requests whose
+// cost is given back are also counted as refunded.
+func countRequest(metrics Metrics, decision string) {
+	metrics.Counter(requestsMetric, "Requests checked against the rate limit", Labels{"decision": decision}).Add(1)
+}
+
+func includeHeaders(params map[string]interface{}) bool {
+	if v, ok := params["includeHeaders"].(bool); ok {
+		return v
+	}
+	return true
+}
+
+// rateLimitHeaders describes the decision with the fields from
+// draft-ietf-httpapi-ratelimit-headers.
+func rateLimitHeaders(d Decision) map[string]string {
+	return map[string]string{
+		"RateLimit-Limit":     strconv.FormatInt(d.Limit, 10),
+		"RateLimit-Remaining": strconv.FormatInt(d.Remaining, 10),
+		"RateLimit-Reset":     strconv.FormatInt(seconds(d.ResetAfter), 10),
+	}
+}
+
+// seconds rounds up so clients never retry before the budget is restored
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ruleConfig is a budget for the requests whose path and method match it.
+// Rules are tried in order and the first match wins; requests that match no
+// rule use the top level budget.
+type ruleConfig struct {
+	Name       string
+	PathPrefix string
+	PathRegex  string
+	// Methods are upper case; empty matches every method
+	Methods           []string
+	Algorithm         string
+	RequestsPerMinute int
+	BurstLimit        int
+	// Cost is the cost of each request of the rule, or -1 for cost.amount
+	Cost int64
+}
+
+// parseRules reads params["rules"] after the schema has checked it. A rule
+// without an algorithm uses the top level one.
+func parseRules(raw interface{}, algorithm string, errs *paramErrors) []ruleConfig {
+	list, _ := raw.([]interface{})
+	rules := make([]ruleConfig, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for i, v := range list {
+		m, _ := v.(map[string]interface{})
+		path := fmt.Sprintf("rules[%d]", i)
+		rule := ruleConfig{Algorithm: algorithm, Cost: -1}
+		rule.Name, _ = m["name"].(string)
+		rule.PathPrefix, _ = m["pathPrefix"].(string)
+		rule.PathRegex, _ = m["pathRegex"].(string)
+		if s, ok := m["algorithm"].(string); ok {
+			rule.Algorithm = s
+		}
+		if f, ok := m["requestsPerMinute"].(float64); ok {
+			rule.RequestsPerMinute = int(f)
+		}
+		if f, ok := m["burstLimit"].(float64); ok {
+			rule.BurstLimit = int(f)
+		}
+		if f, ok := m["cost"].(float64); ok {
+			rule.Cost = int64(f)
+		}
+		methods, _ := m["methods"].([]interface{})
+		for _, method := range methods {
+			if s, ok := method.(string); ok {
+				rule.Methods = append(rule.Methods, strings.ToUpper(s))
+			}
+		}
+
+		if seen[rule.Name] {
+			errs.add(path+".name", fmt.Sprintf("duplicates %q", rule.Name))
+		}
+		seen[rule.Name] = true
+		if rule.PathPrefix != "" && rule.PathRegex != "" {
+			errs.add(path, "cannot have both pathPrefix and pathRegex")
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// limits returns the budget of the rule, kept in the same store as the top
+// level one
+func (rule ruleConfig) limits(cfg limiterConfig) limiterConfig {
+	return limiterConfig{
+		Algorithm:         rule.Algorithm,
+		RequestsPerMinute: rule.RequestsPerMinute,
+		BurstLimit:        rule.BurstLimit,
+		Store:             cfg.Store,
+	}
+}
+
+// rule is a compiled ruleConfig with the limiters of its budget
+type rule struct {
+	ruleConfig
+	pathRegex *regexp.Regexp
+	budget    *budget
+}
+
+// compileRules compiles the path expressions of cfg.Rules. It is called when
+// the configuration is validated or changes, not for every request.
+func compileRules(cfg limiterConfig) ([]*rule, error) {
+	var errs paramErrors
+	rules := make([]*rule, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+		rules[i] = &rule{ruleConfig: rc}
+		if rc.PathRegex == "" {
+			continue
+		}
+		re, err := regexp.Compile(rc.PathRegex)
+		if err != nil {
+			errs.add(fmt.Sprintf("rules[%d].pathRegex", i), "must be a valid regular expression: "+err.Error())
+			continue
+		}
+		rules[i].pathRegex = re
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return rules, nil
+}
+
+// matches reports whether the request, with path stripped of its query, is
+// covered by the rule
+func (r *rule) matches(method, path string) bool {
+	if len(r.Methods) > 0 && !containsParam(r.Methods, strings.ToUpper(method)) {
+		return false
+	}
+	switch {
+	case r.PathPrefix != "":
+		return strings.HasPrefix(path, r.PathPrefix)
+	case r.pathRegex != nil:
+		return r.pathRegex.MatchString(path)
+	}
+	return true
+}
+
+// requestPath returns the path of a request target without its query
+func requestPath(target string) string {
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		return target[:i]
+	}
+	return target
+}
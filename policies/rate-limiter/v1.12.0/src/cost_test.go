@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCostConfigRequiresTrustAndMax(t *testing.T) {
+	tests := []struct {
+		name string
+		cost map[string]interface{}
+		err  string
+	}{
+		{"untrusted header", map[string]interface{}{"header": "X-Cost"}, "cost.header can be set by clients"},
+		{"trusted header", map[string]interface{}{"header": "X-Cost", "trustHeader": true}, ""},
+		{"body size without max", map[string]interface{}{"bytesPerUnit": float64(1024)}, "cost.max is required"},
+		{"body size with max", map[string]interface{}{"bytesPerUnit": float64(1024), "max": float64(10)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCostConfig(map[string]interface{}{"cost": tt.cost})
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("parseCostConfig: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("parseCostConfig error = %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCostOf(t *testing.T) {
+	header := costConfig{Header: "X-Cost", TrustHeader: true, Max: 50}
+	size := costConfig{BytesPerUnit: 1024, Max: 50}
+	tests := []struct {
+		name    string
+		cfg     costConfig
+		headers map[string][]string
+		fixed   int64
+		want    int64
+	}{
+		{"header", header, map[string][]string{"X-Cost": {"7"}}, 1, 7},
+		{"header above max", header, map[string][]string{"X-Cost": {"500"}}, 1, 50},
+		{"zero header", header, map[string][]string{"X-Cost": {"0"}}, 1, 1},
+		{"negative header", header, map[string][]string{"X-Cost": {"-5"}}, 1, 1},
+		{"header below the rule cost", header, map[string][]string{"X-Cost": {"2"}}, 4, 4},
+		{"malformed header", header, map[string][]string{"X-Cost": {"lots"}}, 3, 3},
+		{"content length", size, map[string][]string{"Content-Length": {"3000"}}, 1, 3},
+		{"empty body", size, map[string][]string{"Content-Length": {"0"}}, 2, 2},
+		{"no body", size, map[string][]string{}, 2, 2},
+		{"chunked body", size, map[string][]string{"Transfer-Encoding": {"chunked"}}, 1, 50},
+		{"malformed content length", size, map[string][]string{"Content-Length": {"big"}}, 1, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &RequestContext{Headers: tt.headers}
+			if got := tt.cfg.of(ctx, tt.fixed); got != tt.want {
+				t.Errorf("cost = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// limiterEpoch is the start of a fixed window, so offsets from it fall in the
+// window they name
+var limiterEpoch = time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+
+func at(offset time.Duration) time.Time {
+	return limiterEpoch.Add(offset)
+}
+
+func testLimiter(t *testing.T, algorithm string, requestsPerMinute, burstLimit int) Limiter {
+	t.Helper()
+	store := newMemoryStore(defaultKeyPrefix)
+	l := newLimiter(limiterConfig{
+		Algorithm:         algorithm,
+		RequestsPerMinute: requestsPerMinute,
+		BurstLimit:        burstLimit,
+	}, store)
+	t.Cleanup(func() {
+		l.Close()
+		store.Close()
+	})
+	return l
+}
+
+// allowN sends n requests of cost one at now and returns how many were allowed
+func allowN(t *testing.T, l Limiter, key string, n int, now time.Time) int {
+	t.Helper()
+	allowed := 0
+	for i := 0; i < n; i++ {
+		d, err := l.Allow(key, 1, now)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		if d.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestFixedWindowBoundary(t *testing.T) {
+	l := testLimiter(t, algorithmFixedWindow, 10, 0)
+
+	if got := allowN(t, l, "client", 11, at(50*time.Second)); got != 10 {
+		t.Fatalf("allowed %d requests at the end of the window, want 10", got)
+	}
+	d, _ := l.Allow("client", 1, at(50*time.Second))
+	if d.Remaining != 0 || d.ResetAfter != 10*time.Second {
+		t.Errorf("rejected decision = %+v, want 0 remaining and a reset after 10s", d)
+	}
+	// The fixed window's known weakness: the next window starts empty
+	if got := allowN(t, l, "client", 11, at(60*time.Second)); got != 10 {
+		t.Errorf("allowed %d requests at the start of the next window, want 10", got)
+	}
+}
+
+func TestSlidingWindowCounterBoundary(t *testing.T) {
+	l := testLimiter(t, algorithmSlidingWindowCounter, 10, 0)
+
+	if got := allowN(t, l, "client", 10, at(50*time.Second)); got != 10 {
+		t.Fatalf("allowed %d requests in the first window, want 10", got)
+	}
+	// The previous window still counts in full right after the boundary
+	if got := allowN(t, l, "client", 1, at(60*time.Second)); got != 0 {
+		t.Errorf("allowed %d requests right after the boundary, want 0", got)
+	}
+	// Halfway through, half of the previous window's requests still count
+	if got := allowN(t, l, "client", 10, at(90*time.Second)); got != 5 {
+		t.Errorf("allowed %d requests halfway through the next window, want 5", got)
+	}
+}
+
+func TestSlidingWindowLogBoundary(t *testing.T) {
+	l := testLimiter(t, algorithmSlidingWindowLog, 10, 0)
+
+	if got := allowN(t, l, "client", 10, at(50*time.Second)); got != 10 {
+		t.Fatalf("allowed %d requests, want 10", got)
+	}
+	if got := allowN(t, l, "client", 1, at(60*time.Second)); got != 0 {
+		t.Errorf("allowed %d requests across the window boundary, want 0", got)
+	}
+	d, _ := l.Allow("client", 1, at(109*time.Second))
+	if d.Allowed || d.ResetAfter != time.Second {
+		t.Errorf("decision a second before the requests expire = %+v, want rejected with a reset after 1s", d)
+	}
+	// A full window after the requests were made, all of them have expired
+	if got := allowN(t, l, "client", 11, at(110*time.Second)); got != 10 {
+		t.Errorf("allowed %d requests a window later, want 10", got)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	// One token a second, up to five
+	l := testLimiter(t, algorithmTokenBucket, 60, 5)
+
+	if got := allowN(t, l, "client", 6, at(0)); got != 5 {
+		t.Fatalf("allowed %d requests from a full bucket, want 5", got)
+	}
+	if got := allowN(t, l, "client", 3, at(2*time.Second)); got != 2 {
+		t.Errorf("allowed %d requests after two seconds, want 2", got)
+	}
+	// The bucket never holds more than its capacity
+	if got := allowN(t, l, "client", 6, at(time.Hour)); got != 5 {
+		t.Errorf("allowed %d requests after an hour, want 5", got)
+	}
+}
+
+func TestLimitersChargeWholeCost(t *testing.T) {
+	for _, algorithm := range []string{
+		algorithmFixedWindow,
+		algorithmSlidingWindowLog,
+		algorithmSlidingWindowCounter,
+		algorithmTokenBucket,
+	} {
+		t.Run(algorithm, func(t *testing.T) {
+			l := testLimiter(t, algorithm, 60, 5)
+			limit := int64(65)
+			if algorithm == algorithmTokenBucket {
+				limit = 5
+			}
+			now := at(30 * time.Second)
+
+			d, err := l.Allow("client", limit-2, now)
+			if err != nil || !d.Allowed {
+				t.Fatalf("Allow(%d) = %+v, %v; want allowed", limit-2, d, err)
+			}
+			// A request is only allowed if all of its cost fits, and a
+			// rejected request is not charged
+			if d, _ := l.Allow("client", 3, now); d.Allowed {
+				t.Errorf("Allow(3) with 2 remaining = %+v, want rejected", d)
+			}
+			if d, _ := l.Allow("client", 2, now); !d.Allowed || d.Remaining != 0 {
+				t.Errorf("Allow(2) with 2 remaining = %+v, want allowed with 0 remaining", d)
+			}
+
+			if err := l.Refund("client", 2, now); err != nil {
+				t.Fatalf("Refund: %v", err)
+			}
+			if d, _ := l.Allow("client", 2, now); !d.Allowed {
+				t.Errorf("Allow(2) after a refund of 2 = %+v, want allowed", d)
+			}
+		})
+	}
+}
+
+func TestLimitersKeepClientsApart(t *testing.T) {
+	for _, algorithm := range []string{
+		algorithmFixedWindow,
+		algorithmSlidingWindowLog,
+		algorithmSlidingWindowCounter,
+		algorithmTokenBucket,
+	} {
+		t.Run(algorithm, func(t *testing.T) {
+			l := testLimiter(t, algorithm, 60, 5)
+			now := at(30 * time.Second)
+			allowN(t, l, "a", 100, now)
+			if d, _ := l.Allow("b", 1, now); !d.Allowed {
+				t.Errorf("Allow for another client = %+v, want allowed", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// distinctKeys is the number of clients the benchmarks spread requests over,
+// enough that state does not fit in a few shards' worth of cache lines
+const distinctKeys = 100_000
+
+var algorithms = []string{
+	algorithmFixedWindow,
+	algorithmSlidingWindowLog,
+	algorithmSlidingWindowCounter,
+	algorithmTokenBucket,
+}
+
+// exactLimiter returns a limiter that allows budget requests from each client
+// at one instant
+func exactLimiter(t *testing.T, algorithm string, budget int) Limiter {
+	t.Helper()
+	if algorithm == algorithmTokenBucket {
+		return testLimiter(t, algorithm, budget, budget)
+	}
+	return testLimiter(t, algorithm, budget, 0)
+}
+
+func clientKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "client-" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+// TestConcurrentAllowIsExact sends more requests than the budget holds from
+// many goroutines at once. Run with -race; every algorithm must allow exactly
+// the budget, for each client.
+func TestConcurrentAllowIsExact(t *testing.T) {
+	const (
+		goroutines = 16
+		perClient  = 40
+		budget     = 25
+	)
+	keys := clientKeys(50)
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			l := exactLimiter(t, algorithm, budget)
+			now := at(30 * time.Second)
+			allowed := make([]atomic.Int64, len(keys))
+
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < perClient*len(keys)/goroutines; i++ {
+						k := (g + i*goroutines) % len(keys)
+						d, err := l.Allow(keys[k], 1, now)
+						if err != nil {
+							t.Errorf("Allow: %v", err)
+							return
+						}
+						if d.Allowed {
+							allowed[k].Add(1)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			for k := range keys {
+				if got := allowed[k].Load(); got != budget {
+					t.Errorf("%s: allowed %d of %d concurrent requests, want %d", keys[k], got, perClient, budget)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentRefundsKeepBudget(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			l := exactLimiter(t, algorithm, 10)
+			now := at(30 * time.Second)
+
+			// Each goroutine takes one unit and gives it back, so the budget
+			// ends up where it started
+			var wg sync.WaitGroup
+			for g := 0; g < 10; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						if d, err := l.Allow("client", 1, now); err == nil && d.Allowed {
+							if err := l.Refund("client", 1, now); err != nil {
+								t.Errorf("Refund: %v", err)
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := allowN(t, l, "client", 11, now); got != 10 {
+				t.Errorf("allowed %d requests after balanced refunds, want 10", got)
+			}
+		})
+	}
+}
+
+func TestShardedMapRemoveIf(t *testing.T) {
+	m := newShardedMap[int]()
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		s := m.shard(key)
+		s.Lock()
+		s.entries[key] = i
+		s.Unlock()
+	}
+	used := 0
+	for i := range m.shards {
+		if len(m.shards[i].entries) > 0 {
+			used++
+		}
+	}
+	if used < shardCount/2 {
+		t.Errorf("1000 keys landed in %d of %d shards", used, shardCount)
+	}
+
+	m.removeIf(func(v int) bool { return v%2 == 0 })
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		s := m.shard(key)
+		if _, ok := s.entries[key]; ok != (i%2 == 1) {
+			t.Fatalf("key %s present = %v after removing even values", key, ok)
+		}
+	}
+}
+
+func TestJanitorSweepsUntilStopped(t *testing.T) {
+	sweeps := make(chan time.Time, 1)
+	j := startJanitor(time.Millisecond, func(now time.Time) {
+		select {
+		case sweeps <- now:
+		default:
+		}
+	})
+	select {
+	case <-sweeps:
+	case <-time.After(time.Second):
+		t.Fatal("no sweep within a second")
+	}
+	j.stop()
+	// Stopping twice is allowed
+	j.stop()
+
+	// A sweep already in progress may still deliver, any later one must not
+	time.Sleep(5 * time.Millisecond)
+	select {
+	case <-sweeps:
+	default:
+	}
+	time.Sleep(5 * time.Millisecond)
+	select {
+	case <-sweeps:
+		t.Error("the janitor swept after it was stopped")
+	default:
+	}
+}
+
+func TestMemoryStoreIgnoresExpiredCounters(t *testing.T) {
+	s := newMemoryStore(defaultKeyPrefix)
+	defer s.Close()
+
+	if _, err := s.Increment("client", 3, time.Millisecond); err != nil {
+		t.Fatalf("Increment: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if n, _ := s.Get("client"); n != 0 {
+		t.Errorf("Get of an expired counter = %d, want 0", n)
+	}
+	// An expired counter starts over rather than adding to the old count
+	if n, _ := s.Increment("client", 1, time.Minute); n != 1 {
+		t.Errorf("Increment of an expired counter = %d, want 1", n)
+	}
+}
+
+// BenchmarkAllowDistinctKeys spreads requests from all processors over
+// distinctKeys clients, which is where sharding pays off: requests for
+// different clients rarely meet on a lock. Each client may make ten requests,
+// so the state stays the size it has with real traffic, and most requests
+// take the path of a client over its limit.
+func BenchmarkAllowDistinctKeys(b *testing.B) {
+	keys := clientKeys(distinctKeys)
+	for _, algorithm := range algorithms {
+		b.Run(algorithm, func(b *testing.B) {
+			store := newMemoryStore(defaultKeyPrefix)
+			defer store.Close()
+			l := newLimiter(limiterConfig{
+				Algorithm:         algorithm,
+				RequestsPerMinute: 10,
+				BurstLimit:        10,
+			}, store)
+			defer l.Close()
+			now := time.Now()
+			for _, key := range keys {
+				l.Allow(key, 1, now)
+			}
+
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the keys from its own offset
+				i := int(next.Add(distinctKeys / 16))
+				for pb.Next() {
+					if _, err := l.Allow(keys[i%distinctKeys], 1, now); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSweepDistinctKeys measures one background sweep over distinctKeys
+// live counters, which holds each shard's lock in turn
+func BenchmarkSweepDistinctKeys(b *testing.B) {
+	store := newMemoryStore(defaultKeyPrefix)
+	defer store.Close()
+	for _, key := range clientKeys(distinctKeys) {
+		store.Increment(key, 1, time.Hour)
+	}
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.counters.removeIf(func(c *memoryCounter) bool {
+			return !now.Before(c.expiresAt)
+		})
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/distinctKeys, "ns/key")
+}
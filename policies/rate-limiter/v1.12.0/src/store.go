@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CounterStore keeps request counters shared by all requests a policy instance
+// sees. Implementations must be safe for concurrent use.
+type CounterStore interface {
+	// Increment adds n to the counter stored under key and returns the new
+	// value. A counter created by Increment expires after ttl.
+	Increment(key string, n int64, ttl time.Duration) (int64, error)
+	// Decrement takes up to n from the counter stored under key without going
+	// below zero. A counter that does not exist is not created.
+	Decrement(key string, n int64) error
+	// Get returns the current value of the counter stored under key, or zero
+	// if there is none.
+	Get(key string) (int64, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+const (
+	storeTypeMemory = "memory"
+	storeTypeRedis  = "redis"
+
+	defaultKeyPrefix    = "ratelimit:"
+	defaultRedisTimeout = 100 * time.Millisecond
+	redisRetryInterval  = 5 * time.Second
+	redisMaxIdleConns   = 8
+)
+
+type storeConfig struct {
+	Type          string
+	Address       string
+	Username      string
+	Password      string
+	Database      int
+	TLS           bool
+	TLSServerName string
+	KeyPrefix     string
+	Timeout       time.Duration
+}
+
+// parseStoreConfig reads params["store"] after the schema has checked it. A
+// missing value selects the in-memory store.
+func parseStoreConfig(raw interface{}) (storeConfig, error) {
+	cfg := storeConfig{
+		Type:      storeTypeMemory,
+		KeyPrefix: defaultKeyPrefix,
+		Timeout:   defaultRedisTimeout,
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg, nil
+	}
+	for name, dst := range map[string]*string{
+		"type":          &cfg.Type,
+		"keyPrefix":     &cfg.KeyPrefix,
+		"address":       &cfg.Address,
+		"username":      &cfg.Username,
+		"password":      &cfg.Password,
+		"tlsServerName": &cfg.TLSServerName,
+	} {
+		if s, ok := m[name].(string); ok {
+			*dst = s
+		}
+	}
+	if f, ok := m["database"].(float64); ok {
+		cfg.Database = int(f)
+	}
+	if b, ok := m["tls"].(bool); ok {
+		cfg.TLS = b
+	}
+	if f, ok := m["timeoutMs"].(float64); ok {
+		cfg.Timeout = time.Duration(f) * time.Millisecond
+	}
+	if cfg.Type == storeTypeMemory {
+		return cfg, nil
+	}
+
+	if cfg.Address == "" {
+		return cfg, invalidParam("store.address", "is required for the redis store")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return cfg, invalidParam("store.address", "must be host:port: %v", err)
+	}
+	return cfg, nil
+}
+
+// newCounterStore builds the store described by cfg. A redis store falls back
+// to local counting while the server cannot be reached.
+func newCounterStore(cfg storeConfig) CounterStore {
+	local := newMemoryStore(cfg.KeyPrefix)
+	if cfg.Type != storeTypeRedis {
+		return local
+	}
+	return &fallbackStore{
+		primary: newRedisStore(cfg),
+		local:   local,
+	}
+}
+
+// memoryStore counts requests in process memory. Counts are not shared between
+// gateway replicas. Counters are spread over shards, and a counter that
+// already exists is incremented atomically under a read lock, so concurrent
+// requests only wait on each other to create counters in the same shard.
+type memoryStore struct {
+	prefix   string
+	counters *shardedMap[*memoryCounter]
+	janitor  *janitor
+}
+
+type memoryCounter struct {
+	value atomic.Int64
+	// expiresAt is not changed once the counter is stored
+	expiresAt time.Time
+}
+
+func newMemoryStore(prefix string) *memoryStore {
+	s := &memoryStore{
+		prefix:   prefix,
+		counters: newShardedMap[*memoryCounter](),
+	}
+	s.janitor = startJanitor(expiryInterval, func(now time.Time) {
+		s.counters.removeIf(func(c *memoryCounter) bool {
+			return !now.Before(c.expiresAt)
+		})
+	})
+	return s
+}
+
+func (s *memoryStore) Increment(key string, n int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	key = s.prefix + key
+	shard := s.counters.shard(key)
+
+	shard.RLock()
+	c, ok := shard.entries[key]
+	if ok && now.Before(c.expiresAt) {
+		count := c.value.Add(n)
+		shard.RUnlock()
+		return count, nil
+	}
+	shard.RUnlock()
+
+	// Another request may have created the counter since the read
+	shard.Lock()
+	defer shard.Unlock()
+	c, ok = shard.entries[key]
+	if !ok || !now.Before(c.expiresAt) {
+		c = &memoryCounter{expiresAt: now.Add(ttl)}
+		shard.entries[key] = c
+	}
+	return c.value.Add(n), nil
+}
+
+func (s *memoryStore) Decrement(key string, n int64) error {
+	now := time.Now()
+	key = s.prefix + key
+	shard := s.counters.shard(key)
+
+	shard.RLock()
+	defer shard.RUnlock()
+	c, ok := shard.entries[key]
+	if !ok || !now.Before(c.expiresAt) {
+		return nil
+	}
+	for {
+		old := c.value.Load()
+		if c.value.CompareAndSwap(old, old-min(old, n)) {
+			return nil
+		}
+	}
+}
+
+func (s *memoryStore) Get(key string) (int64, error) {
+	now := time.Now()
+	key = s.prefix + key
+	shard := s.counters.shard(key)
+
+	shard.RLock()
+	defer shard.RUnlock()
+	c, ok := shard.entries[key]
+	if !ok || !now.Before(c.expiresAt) {
+		return 0, nil
+	}
+	return c.value.Load(), nil
+}
+
+// Close stops the background removal of expired counters
+func (s *memoryStore) Close() error {
+	s.janitor.stop()
+	return nil
+}
+
+// fallbackStore sends increments to primary and switches to local counting for
+// redisRetryInterval after primary fails.
+type fallbackStore struct {
+	primary CounterStore
+	local   CounterStore
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (s *fallbackStore) Increment(key string, n int64, ttl time.Duration) (int64, error) {
+	if s.primaryUp() {
+		count, err := s.primary.Increment(key, n, ttl)
+		if err == nil {
+			return count, nil
+		}
+		s.markDown()
+	}
+	return s.local.Increment(key, n, ttl)
+}
+
+func (s *fallbackStore) Decrement(key string, n int64) error {
+	if s.primaryUp() {
+		err := s.primary.Decrement(key, n)
+		if err == nil {
+			return nil
+		}
+		s.markDown()
+	}
+	return s.local.Decrement(key, n)
+}
+
+func (s *fallbackStore) Get(key string) (int64, error) {
+	if s.primaryUp() {
+		count, err := s.primary.Get(key)
+		if err == nil {
+			return count, nil
+		}
+		s.markDown()
+	}
+	return s.local.Get(key)
+}
+
+func (s *fallbackStore) primaryUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !time.Now().Before(s.downUntil)
+}
+
+func (s *fallbackStore) markDown() {
+	s.mu.Lock()
+	s.downUntil = time.Now().Add(redisRetryInterval)
+	s.mu.Unlock()
+}
+
+func (s *fallbackStore) Close() error {
+	s.local.Close()
+	return s.primary.Close()
+}
+
+// incrementScript increments a counter and sets its expiry in one atomic step,
+// so a counter can never be left without a TTL.
+const incrementScript = `local c = redis.call('INCRBY', KEYS[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) == -1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return c`
+
+// decrementScript takes from a counter without creating it or going below
+// zero, which would hand out more than the budget.
+const decrementScript = `local c = tonumber(redis.call('GET', KEYS[1]))
+if c == nil or c <= 0 then return 0 end
+return redis.call('DECRBY', KEYS[1], math.min(c, tonumber(ARGV[1])))`
+
+// redisStore keeps counters in Redis so every gateway replica sees the same
+// counts.
+type redisStore struct {
+	cfg  storeConfig
+	idle chan *redisConn
+}
+
+func newRedisStore(cfg storeConfig) *redisStore {
+	return &redisStore{
+		cfg:  cfg,
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+func (s *redisStore) Increment(key string, n int64, ttl time.Duration) (int64, error) {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	reply, err := s.do("EVAL", incrementScript, "1", s.cfg.KeyPrefix+key, strconv.FormatInt(ms, 10), strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %T to EVAL", reply)
+	}
+	return count, nil
+}
+
+func (s *redisStore) Decrement(key string, n int64) error {
+	_, err := s.do("EVAL", decrementScript, "1", s.cfg.KeyPrefix+key, strconv.FormatInt(n, 10))
+	return err
+}
+
+func (s *redisStore) Get(key string) (int64, error) {
+	reply, err := s.do("GET", s.cfg.KeyPrefix+key)
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+}
+
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection. Connections that fail are
+// discarded rather than returned to the pool.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.cfg.Timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+func (s *redisStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLS {
+		serverName := s.cfg.TLSServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(s.cfg.Address)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.cfg.Password != "" {
+		args := []string{"AUTH", s.cfg.Password}
+		if s.cfg.Username != "" {
+			args = []string{"AUTH", s.cfg.Username, s.cfg.Password}
+		}
+		if _, err := c.do(s.cfg.Timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.Database != 0 {
+		if _, err := c.do(s.cfg.Timeout, "SELECT", strconv.Itoa(s.cfg.Database)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply sent by the server. The connection that
+// received it is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the subset of RESP needed by the store.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
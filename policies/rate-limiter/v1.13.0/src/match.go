@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Matchers compare request paths and header values against patterns from the
+// policy parameters. Policies that match nothing can delete this file.
+//
+// In the parameters a pattern is either a string, read as the kind the
+// policy chooses for it, or an object naming exactly one kind:
+//
+//	path: /users/*                       # the policy's shorthand kind
+//	path: {prefix: /api/}
+//	path: {glob: /files/**}
+//	path: {regex: "^/v[0-9]+/", ignoreCase: true}
+//
+// Headers add a name, and match when any of their values does. Without a
+// pattern they match when present, and with present: false when absent:
+//
+//	headers:
+//	  - {name: X-Env, exact: canary}
+//	  - {name: Authorization, present: false}
+//
+// The parameters schema declares them with these definitions, referenced
+// through "$ref": "#/definitions/matcher" and "#/definitions/headerMatcher":
+//
+//	"matcher": {"oneOf": [
+//	  {"type": "string"},
+//	  {"type": "object", "properties": {
+//	    "exact": {"type": "string"}, "prefix": {"type": "string"},
+//	    "glob": {"type": "string"}, "regex": {"type": "string"},
+//	    "ignoreCase": {"type": "boolean", "default": false}
+//	  }, "additionalProperties": false}
+//	]},
+//	"headerMatcher": {"type": "object", "properties": {
+//	  "name": {"type": "string", "minLength": 1},
+//	  "exact": {"type": "string"}, "prefix": {"type": "string"},
+//	  "glob": {"type": "string"}, "regex": {"type": "string"},
+//	  "ignoreCase": {"type": "boolean", "default": false},
+//	  "present": {"type": "boolean", "default": true}
+//	}, "required": ["name"], "additionalProperties": false}
+
+// MatchKind is how a pattern is compared
+type MatchKind string
+
+const (
+	// MatchExact matches the whole string
+	MatchExact MatchKind = "exact"
+	// MatchPrefix matches strings that start with the pattern
+	MatchPrefix MatchKind = "prefix"
+	// MatchGlob matches the whole string, where * stands for any characters
+	// but / and ** as a whole path segment for any number of segments, so
+	// /files/** matches /files and everything below it
+	MatchGlob MatchKind = "glob"
+	// MatchRegex matches strings that contain a match of the regular
+	// expression; anchor it with ^ and $ to match the whole string
+	MatchRegex MatchKind = "regex"
+)
+
+var matchKinds = []MatchKind{MatchExact, MatchPrefix, MatchGlob, MatchRegex}
+
+// MatcherSpec is a pattern as configured
+type MatcherSpec struct {
+	Kind       MatchKind
+	Pattern    string
+	IgnoreCase bool
+}
+
+// Matcher is a compiled MatcherSpec. It is safe for concurrent use.
+type Matcher struct {
+	spec MatcherSpec
+	// re is set for glob and regex patterns
+	re *regexp.Regexp
+}
+
+// HeaderMatcher matches a request header by name. A nil Value matches any
+// value.
+type HeaderMatcher struct {
+	Name    string
+	Value   *Matcher
+	Present bool
+}
+
+// Matchers compiles patterns once per policy instance. The zero value is
+// ready to use and it is safe for concurrent use.
+type Matchers struct {
+	mu       sync.Mutex
+	compiled map[MatcherSpec]*Matcher
+}
+
+// ParseMatcherSpec reads a pattern from the parameters. A string is read as
+// shorthand.
+func ParseMatcherSpec(raw interface{}, shorthand MatchKind) (MatcherSpec, error) {
+	switch v := raw.(type) {
+	case string:
+		return MatcherSpec{Kind: shorthand, Pattern: v}, nil
+	case map[string]interface{}:
+		spec, ok, err := matcherSpecOf(v)
+		if err != nil {
+			return spec, err
+		}
+		if !ok {
+			return spec, errors.New("must set one of exact, prefix, glob or regex")
+		}
+		return spec, nil
+	}
+	return MatcherSpec{}, errors.New("must be a string or an object")
+}
+
+// matcherSpecOf reads the kind keys of an object. ok is false when none is
+// set.
+func matcherSpecOf(m map[string]interface{}) (spec MatcherSpec, ok bool, err error) {
+	for _, kind := range matchKinds {
+		p, set := m[string(kind)].(string)
+		if !set {
+			continue
+		}
+		if ok {
+			return spec, false, errors.New("must set only one of exact, prefix, glob or regex")
+		}
+		spec.Kind, spec.Pattern, ok = kind, p, true
+	}
+	spec.IgnoreCase, _ = m["ignoreCase"].(bool)
+	return spec, ok, nil
+}
+
+// Compile returns the matcher for spec, compiling it on first use
+func (c *Matchers) Compile(spec MatcherSpec) (*Matcher, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.compiled[spec]; ok {
+		return m, nil
+	}
+	m, err := compileMatcher(spec)
+	if err != nil {
+		return nil, err
+	}
+	if c.compiled == nil {
+		c.compiled = make(map[MatcherSpec]*Matcher)
+	}
+	c.compiled[spec] = m
+	return m, nil
+}
+
+// Parse reads a pattern from the parameters and compiles it
+func (c *Matchers) Parse(raw interface{}, shorthand MatchKind) (*Matcher, error) {
+	spec, err := ParseMatcherSpec(raw, shorthand)
+	if err != nil {
+		return nil, err
+	}
+	return c.Compile(spec)
+}
+
+// ParseHeader reads a header matcher from the parameters. Values are
+// compared case-sensitively unless ignoreCase is set; names never are.
+func (c *Matchers) ParseHeader(raw interface{}) (HeaderMatcher, error) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return HeaderMatcher{}, errors.New("must be an object")
+	}
+	h := HeaderMatcher{Present: true}
+	h.Name, _ = m["name"].(string)
+	if h.Name == "" {
+		return h, errors.New("name is required")
+	}
+	if present, ok := m["present"].(bool); ok {
+		h.Present = present
+	}
+	spec, ok, err := matcherSpecOf(m)
+	if err != nil || !ok {
+		return h, err
+	}
+	if !h.Present {
+		return h, errors.New("cannot set a value pattern with present: false")
+	}
+	h.Value, err = c.Compile(spec)
+	return h, err
+}
+
+func compileMatcher(spec MatcherSpec) (*Matcher, error) {
+	m := &Matcher{spec: spec}
+	if spec.IgnoreCase && (spec.Kind == MatchExact || spec.Kind == MatchPrefix) {
+		m.spec.Pattern = strings.ToLower(spec.Pattern)
+	}
+	var expr string
+	switch spec.Kind {
+	case MatchExact, MatchPrefix:
+		return m, nil
+	case MatchGlob:
+		var err error
+		if expr, err = globExpression(spec.Pattern); err != nil {
+			return nil, err
+		}
+	case MatchRegex:
+		expr = spec.Pattern
+	default:
+		return nil, fmt.Errorf("unknown match kind %q", spec.Kind)
+	}
+	if spec.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	m.re = re
+	return m, nil
+}
+
+// Match reports whether s matches the pattern
+func (m *Matcher) Match(s string) bool {
+	if m.re != nil {
+		return m.re.MatchString(s)
+	}
+	if m.spec.IgnoreCase {
+		s = strings.ToLower(s)
+	}
+	if m.spec.Kind == MatchPrefix {
+		return strings.HasPrefix(s, m.spec.Pattern)
+	}
+	return s == m.spec.Pattern
+}
+
+// Regexp returns the compiled expression of a glob or regex pattern, for
+// policies that use its groups, or nil
+func (m *Matcher) Regexp() *regexp.Regexp {
+	return m.re
+}
+
+// Spec returns the pattern the matcher was compiled from
+func (m *Matcher) Spec() MatcherSpec {
+	return m.spec
+}
+
+// Match reports whether the headers satisfy h
+func (h HeaderMatcher) Match(headers map[string][]string) bool {
+	var values []string
+	found := false
+	for k, v := range headers {
+		if strings.EqualFold(k, h.Name) {
+			values, found = append(values, v...), true
+		}
+	}
+	if !h.Present {
+		return !found
+	}
+	if !found {
+		return false
+	}
+	if h.Value == nil {
+		return true
+	}
+	for _, v := range values {
+		if h.Value.Match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestPath returns the path of a request target without its query string
+func RequestPath(target string) string {
+	path, _, _ := strings.Cut(target, "?")
+	return path
+}
+
+// globExpression translates a glob pattern to an anchored regular expression
+func globExpression(pattern string) (string, error) {
+	segments := strings.Split(pattern, "/")
+	var b strings.Builder
+	b.WriteString("^")
+	for i, seg := range segments {
+		if seg == "**" && i > 0 {
+			// The / before ** is optional, so /files/** matches /files
+			if i == len(segments)-1 {
+				b.WriteString("(?:/.*)?")
+			} else {
+				b.WriteString("(?:/[^/]*)*")
+			}
+			continue
+		}
+		if seg == "**" {
+			b.WriteString(".*")
+			continue
+		}
+		if strings.Contains(seg, "**") {
+			return "", errors.New("** must be a whole path segment")
+		}
+		if i > 0 {
+			b.WriteString("/")
+		}
+		for j, part := range strings.Split(seg, "*") {
+			if j > 0 {
+				b.WriteString("[^/]*")
+			}
+			b.WriteString(regexp.QuoteMeta(part))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ruleConfig is a budget for the requests whose path, method and headers
+// match it. Rules are tried in order and the first match wins; requests that
+// match no rule use the top level budget.
+type ruleConfig struct {
+	Name string
+	// Path is nil for rules that match every path. pathPrefix and pathRegex
+	// are read as a path with that kind.
+	Path *MatcherSpec
+	// PathParam is the parameter Path was read from, for errors
+	PathParam string
+	// Methods are upper case; empty matches every method
+	Methods []string
+	// Headers are the header matchers as configured, compiled with the path
+	Headers           []interface{}
+	Algorithm         string
+	RequestsPerMinute int
+	BurstLimit        int
+	// Cost is the cost of each request of the rule, or -1 for cost.amount
+	Cost int64
+}
+
+// parseRules reads params["rules"] after the schema has checked it. A rule
+// without an algorithm uses the top level one.
+func parseRules(raw interface{}, algorithm string, errs *paramErrors) []ruleConfig {
+	list, _ := raw.([]interface{})
+	rules := make([]ruleConfig, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for i, v := range list {
+		m, _ := v.(map[string]interface{})
+		path := fmt.Sprintf("rules[%d]", i)
+		rule := ruleConfig{Algorithm: algorithm, Cost: -1}
+		rule.Name, _ = m["name"].(string)
+		rule.Path, rule.PathParam = parseRulePath(m, path, errs)
+		rule.Headers, _ = m["headers"].([]interface{})
+		if s, ok := m["algorithm"].(string); ok {
+			rule.Algorithm = s
+		}
+		if f, ok := m["requestsPerMinute"].(float64); ok {
+			rule.RequestsPerMinute = int(f)
+		}
+		if f, ok := m["burstLimit"].(float64); ok {
+			rule.BurstLimit = int(f)
+		}
+		if f, ok := m["cost"].(float64); ok {
+			rule.Cost = int64(f)
+		}
+		methods, _ := m["methods"].([]interface{})
+		for _, method := range methods {
+			if s, ok := method.(string); ok {
+				rule.Methods = append(rule.Methods, strings.ToUpper(s))
+			}
+		}
+
+		if seen[rule.Name] {
+			errs.add(path+".name", fmt.Sprintf("duplicates %q", rule.Name))
+		}
+		seen[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseRulePath reads the one of path, pathPrefix and pathRegex a rule sets.
+// A string path is a prefix, as pathPrefix is.
+func parseRulePath(m map[string]interface{}, at string, errs *paramErrors) (*MatcherSpec, string) {
+	var spec *MatcherSpec
+	var param string
+	for _, name := range []string{"path", "pathPrefix", "pathRegex"} {
+		raw, ok := m[name]
+		if !ok {
+			continue
+		}
+		if spec != nil {
+			errs.add(at, "can have only one of path, pathPrefix and pathRegex")
+			return nil, ""
+		}
+		var s MatcherSpec
+		var err error
+		switch name {
+		case "path":
+			s, err = ParseMatcherSpec(raw, MatchPrefix)
+		case "pathPrefix":
+			s = MatcherSpec{Kind: MatchPrefix, Pattern: raw.(string)}
+		case "pathRegex":
+			s = MatcherSpec{Kind: MatchRegex, Pattern: raw.(string)}
+		}
+		if err != nil {
+			errs.add(at+"."+name, err.Error())
+			return nil, ""
+		}
+		spec, param = &s, name
+	}
+	return spec, param
+}
+
+// limits returns the budget of the rule, kept in the same store as the top
+// level one
+func (rule ruleConfig) limits(cfg limiterConfig) limiterConfig {
+	return limiterConfig{
+		Algorithm:         rule.Algorithm,
+		RequestsPerMinute: rule.RequestsPerMinute,
+		BurstLimit:        rule.BurstLimit,
+		Store:             cfg.Store,
+	}
+}
+
+// rule is a compiled ruleConfig with the limiters of its budget
+type rule struct {
+	ruleConfig
+	path    *Matcher
+	headers []HeaderMatcher
+	budget  *budget
+}
+
+// compileRules compiles the path and header patterns of cfg.Rules. It is
+// called when the configuration is validated or an instance is set up, not
+// for every request.
+func compileRules(cfg limiterConfig, matchers *Matchers) ([]*rule, error) {
+	var errs paramErrors
+	rules := make([]*rule, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+		at := fmt.Sprintf("rules[%d]", i)
+		rules[i] = &rule{ruleConfig: rc}
+		if rc.Path != nil {
+			m, err := matchers.Compile(*rc.Path)
+			if err != nil {
+				errs.add(at+"."+rc.PathParam, err.Error())
+			}
+			rules[i].path = m
+		}
+		for j, raw := range rc.Headers {
+			h, err := matchers.ParseHeader(raw)
+			if err != nil {
+				errs.add(fmt.Sprintf("%s.headers[%d]", at, j), err.Error())
+				continue
+			}
+			rules[i].headers = append(rules[i].headers, h)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return rules, nil
+}
+
+// matches reports whether the request, with path stripped of its query, is
+// covered by the rule
+func (r *rule) matches(ctx *RequestContext, path string) bool {
+	if len(r.Methods) > 0 && !containsParam(r.Methods, strings.ToUpper(ctx.Method)) {
+		return false
+	}
+	if r.path != nil && !r.path.Match(path) {
+		return false
+	}
+	for _, h := range r.headers {
+		if !h.Match(ctx.Headers) {
+			return false
+		}
+	}
+	return true
+}
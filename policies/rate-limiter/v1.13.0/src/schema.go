@@ -0,0 +1,123 @@
+package main
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "definitions": {
+    "matcher": {
+      "oneOf": [
+        {"type": "string", "minLength": 1},
+        {
+          "type": "object",
+          "properties": {
+            "exact": {"type": "string"},
+            "prefix": {"type": "string"},
+            "glob": {"type": "string"},
+            "regex": {"type": "string"},
+            "ignoreCase": {"type": "boolean", "default": false}
+          },
+          "additionalProperties": false
+        }
+      ]
+    },
+    "headerMatcher": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string", "minLength": 1},
+        "exact": {"type": "string"},
+        "prefix": {"type": "string"},
+        "glob": {"type": "string"},
+        "regex": {"type": "string"},
+        "ignoreCase": {"type": "boolean", "default": false},
+        "present": {"type": "boolean", "default": true}
+      },
+      "required": ["name"],
+      "additionalProperties": false
+    }
+  },
+  "properties": {
+    "requestsPerMinute": {"type": "integer", "minimum": 1},
+    "burstLimit": {"type": "integer", "minimum": 1},
+    "includeHeaders": {"type": "boolean", "default": true},
+    "algorithm": {
+      "type": "string",
+      "enum": ["fixedWindow", "slidingWindowLog", "slidingWindowCounter", "tokenBucket"],
+      "default": "fixedWindow"
+    },
+    "keyStrategy": {
+      "oneOf": [
+        {
+          "type": "string",
+          "enum": ["remoteAddr", "xForwardedFor", "header", "jwtClaim", "consumer", "composite"]
+        },
+        {
+          "type": "object",
+          "properties": {
+            "type": {
+              "type": "string",
+              "enum": ["remoteAddr", "xForwardedFor", "header", "jwtClaim", "consumer", "composite"],
+              "default": "remoteAddr"
+            },
+            "trustedProxyDepth": {"type": "integer", "minimum": 1, "default": 1},
+            "headerName": {"type": "string"},
+            "claim": {"type": "string", "default": "sub"},
+            "client": {"oneOf": [{"type": "string"}, {"type": "object"}]}
+          },
+          "required": ["type"]
+        }
+      ]
+    },
+    "rules": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "path": {"$ref": "#/definitions/matcher"},
+          "pathPrefix": {"type": "string", "minLength": 1},
+          "pathRegex": {"type": "string", "minLength": 1},
+          "methods": {"type": "array", "minItems": 1, "items": {"type": "string", "minLength": 1}},
+          "headers": {"type": "array", "items": {"$ref": "#/definitions/headerMatcher"}},
+          "requestsPerMinute": {"type": "integer", "minimum": 1},
+          "burstLimit": {"type": "integer", "minimum": 1},
+          "algorithm": {
+            "type": "string",
+            "enum": ["fixedWindow", "slidingWindowLog", "slidingWindowCounter", "tokenBucket"]
+          },
+          "cost": {"type": "integer", "minimum": 0}
+        },
+        "required": ["name", "requestsPerMinute", "burstLimit"]
+      }
+    },
+    "cost": {
+      "type": "object",
+      "properties": {
+        "amount": {"type": "integer", "minimum": 0, "default": 1},
+        "header": {"type": "string", "minLength": 1},
+        "trustHeader": {"type": "boolean", "default": false},
+        "bytesPerUnit": {"type": "integer", "minimum": 1},
+        "max": {"type": "integer", "minimum": 1}
+      }
+    },
+    "refundStatuses": {"type": "array", "items": {"type": ["integer", "string"]}},
+    "store": {
+      "type": "object",
+      "properties": {
+        "type": {"type": "string", "enum": ["memory", "redis"], "default": "memory"},
+        "address": {"type": "string"},
+        "username": {"type": "string"},
+        "password": {"type": "string"},
+        "database": {"type": "integer", "minimum": 0, "default": 0},
+        "tls": {"type": "boolean", "default": false},
+        "tlsServerName": {"type": "string"},
+        "keyPrefix": {"type": "string", "default": "ratelimit:"},
+        "timeoutMs": {"type": "integer", "minimum": 1, "default": 100}
+      }
+    }
+  },
+  "required": ["requestsPerMinute", "burstLimit"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const (
+	// shardCount is the number of independently locked parts per-key state
+	// is split into
+	shardCount = 64
+	// expiryInterval is how often expired state is removed in the background.
+	// Expired entries are ignored when read, so this only bounds memory.
+	expiryInterval = 10 * time.Second
+)
+
+// shardedMap spreads per-key state over shardCount maps, each with its own
+// lock, so requests for different keys rarely wait on each other.
+type shardedMap[V any] struct {
+	seed   maphash.Seed
+	shards [shardCount]mapShard[V]
+}
+
+type mapShard[V any] struct {
+	sync.RWMutex
+	entries map[string]V
+}
+
+func newShardedMap[V any]() *shardedMap[V] {
+	m := &shardedMap[V]{seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]V)
+	}
+	return m
+}
+
+// shard returns the part of the map that holds key
+func (m *shardedMap[V]) shard(key string) *mapShard[V] {
+	return &m.shards[maphash.String(m.seed, key)%shardCount]
+}
+
+// removeIf deletes the entries for which expired returns true, locking one
+// shard at a time so requests for keys in other shards are not held up
+func (m *shardedMap[V]) removeIf(expired func(V) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		for k, v := range s.entries {
+			if expired(v) {
+				delete(s.entries, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// janitor calls sweep every interval on its own goroutine until stopped
+type janitor struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func startJanitor(interval time.Duration, sweep func(now time.Time)) *janitor {
+	j := &janitor{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sweep(now)
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+// stop ends the janitor's goroutine. It may be called more than once.
+func (j *janitor) stop() {
+	j.once.Do(func() { close(j.done) })
+}
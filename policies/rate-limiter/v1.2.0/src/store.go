@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CounterStore keeps request counters shared by all requests a policy instance
+// sees. Implementations must be safe for concurrent use.
+type CounterStore interface {
+	// Increment adds one to the counter stored under key and returns the new
+	// value. A counter created by Increment expires after ttl.
+	Increment(key string, ttl time.Duration) (int64, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+const (
+	storeTypeMemory = "memory"
+	storeTypeRedis  = "redis"
+
+	defaultKeyPrefix    = "ratelimit:"
+	defaultRedisTimeout = 100 * time.Millisecond
+	redisRetryInterval  = 5 * time.Second
+	redisMaxIdleConns   = 8
+)
+
+type storeConfig struct {
+	Type          string
+	Address       string
+	Username      string
+	Password      string
+	Database      int
+	TLS           bool
+	TLSServerName string
+	KeyPrefix     string
+	Timeout       time.Duration
+}
+
+// parseStoreConfig reads params["store"]. A missing value selects the
+// in-memory store.
+func parseStoreConfig(raw interface{}) (storeConfig, error) {
+	cfg := storeConfig{
+		Type:      storeTypeMemory,
+		KeyPrefix: defaultKeyPrefix,
+		Timeout:   defaultRedisTimeout,
+	}
+	if raw == nil {
+		return cfg, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg, errors.New("store must be an object")
+	}
+
+	if v, ok := m["type"]; ok {
+		s, ok := v.(string)
+		if !ok || (s != storeTypeMemory && s != storeTypeRedis) {
+			return cfg, errors.New("store.type must be one of: memory, redis")
+		}
+		cfg.Type = s
+	}
+	if v, ok := m["keyPrefix"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return cfg, errors.New("store.keyPrefix must be a string")
+		}
+		cfg.KeyPrefix = s
+	}
+	if cfg.Type == storeTypeMemory {
+		return cfg, nil
+	}
+
+	address, ok := m["address"].(string)
+	if !ok || address == "" {
+		return cfg, errors.New("store.address is required for the redis store and must be a string")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return cfg, fmt.Errorf("store.address must be host:port: %v", err)
+	}
+	cfg.Address = address
+
+	for name, dst := range map[string]*string{
+		"username":      &cfg.Username,
+		"password":      &cfg.Password,
+		"tlsServerName": &cfg.TLSServerName,
+	} {
+		if v, ok := m[name]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("store.%s must be a string", name)
+			}
+			*dst = s
+		}
+	}
+	if v, ok := m["database"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return cfg, errors.New("store.database must be a non-negative integer")
+		}
+		cfg.Database = int(f)
+	}
+	if v, ok := m["tls"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("store.tls must be a boolean")
+		}
+		cfg.TLS = b
+	}
+	if v, ok := m["timeoutMs"]; ok {
+		f, ok := v.(float64)
+		if !ok || f <= 0 {
+			return cfg, errors.New("store.timeoutMs must be a positive integer")
+		}
+		cfg.Timeout = time.Duration(f) * time.Millisecond
+	}
+	return cfg, nil
+}
+
+// newCounterStore builds the store described by cfg. A redis store falls back
+// to local counting while the server cannot be reached.
+func newCounterStore(cfg storeConfig) CounterStore {
+	local := newMemoryStore(cfg.KeyPrefix)
+	if cfg.Type != storeTypeRedis {
+		return local
+	}
+	return &fallbackStore{
+		primary: newRedisStore(cfg),
+		local:   local,
+	}
+}
+
+// memoryStore counts requests in process memory. Counts are not shared between
+// gateway replicas.
+type memoryStore struct {
+	mu        sync.Mutex
+	prefix    string
+	counters  map[string]*memoryCounter
+	nextSweep time.Time
+}
+
+type memoryCounter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+func newMemoryStore(prefix string) *memoryStore {
+	return &memoryStore{
+		prefix:   prefix,
+		counters: make(map[string]*memoryCounter),
+	}
+}
+
+func (s *memoryStore) Increment(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	key = s.prefix + key
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired counters at most once per second
+	if now.After(s.nextSweep) {
+		for k, c := range s.counters {
+			if !now.Before(c.expiresAt) {
+				delete(s.counters, k)
+			}
+		}
+		s.nextSweep = now.Add(time.Second)
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expiresAt) {
+		c = &memoryCounter{expiresAt: now.Add(ttl)}
+		s.counters[key] = c
+	}
+	c.value++
+	return c.value, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fallbackStore sends increments to primary and switches to local counting for
+// redisRetryInterval after primary fails.
+type fallbackStore struct {
+	primary CounterStore
+	local   CounterStore
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (s *fallbackStore) Increment(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	down := time.Now().Before(s.downUntil)
+	s.mu.Unlock()
+
+	if !down {
+		count, err := s.primary.Increment(key, ttl)
+		if err == nil {
+			return count, nil
+		}
+		s.mu.Lock()
+		s.downUntil = time.Now().Add(redisRetryInterval)
+		s.mu.Unlock()
+	}
+	return s.local.Increment(key, ttl)
+}
+
+func (s *fallbackStore) Close() error {
+	s.local.Close()
+	return s.primary.Close()
+}
+
+// incrementScript increments a counter and sets its expiry in one atomic step,
+// so a counter can never be left without a TTL.
+const incrementScript = `local c = redis.call('INCR', KEYS[1])
+if c == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return c`
+
+// redisStore keeps counters in Redis so every gateway replica sees the same
+// counts.
+type redisStore struct {
+	cfg  storeConfig
+	idle chan *redisConn
+}
+
+func newRedisStore(cfg storeConfig) *redisStore {
+	return &redisStore{
+		cfg:  cfg,
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+func (s *redisStore) Increment(key string, ttl time.Duration) (int64, error) {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	reply, err := s.do("EVAL", incrementScript, "1", s.cfg.KeyPrefix+key, strconv.FormatInt(ms, 10))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %T to EVAL", reply)
+	}
+	return count, nil
+}
+
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection. Connections that fail are
+// discarded rather than returned to the pool.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.cfg.Timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+func (s *redisStore) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLS {
+		serverName := s.cfg.TLSServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(s.cfg.Address)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.cfg.Password != "" {
+		args := []string{"AUTH", s.cfg.Password}
+		if s.cfg.Username != "" {
+			args = []string{"AUTH", s.cfg.Username, s.cfg.Password}
+		}
+		if _, err := c.do(s.cfg.Timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.Database != 0 {
+		if _, err := c.do(s.cfg.Timeout, "SELECT", strconv.Itoa(s.cfg.Database)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply sent by the server. The connection that
+// received it is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the subset of RESP needed by the store.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
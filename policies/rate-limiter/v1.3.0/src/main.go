@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Define policy types locally
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext would be here
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	// SharedContext would be here
+}
+
+type Body struct {
+	// Placeholder
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct{}
+
+type UpstreamResponseModifications struct{}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+type RateLimiterPolicy struct {
+	mu         sync.Mutex
+	limiter    Limiter
+	store      CounterStore
+	limiterCfg limiterConfig
+}
+
+// Validate configuration parameters
+func (r *RateLimiterPolicy) Validate(params map[string]interface{}) error {
+	if _, err := parseLimiterConfig(params); err != nil {
+		return err
+	}
+	if _, err := parseKeyStrategy(params["keyStrategy"]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Declare processing behavior
+func (r *RateLimiterPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (r *RateLimiterPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	// Configuration is checked by Validate; never block traffic on it here
+	keys, err := parseKeyStrategy(params["keyStrategy"])
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	limiter, err := r.rateLimiter(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	decision, err := limiter.Allow(keys.key(ctx), time.Now())
+	if err != nil {
+		// The store is unavailable and has no fallback; fail open
+		return UpstreamRequestModifications{}
+	}
+	if !decision.Allowed {
+		// Rate limit exceeded
+		return ImmediateResponse{
+			Status: 429,
+			Headers: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: `{"error": "Rate limit exceeded"}`,
+		}
+	}
+
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (r *RateLimiterPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// rateLimiter returns the limiter for the given parameters, creating it on
+// first use and replacing it whenever the limiter configuration changes.
+func (r *RateLimiterPolicy) rateLimiter(params map[string]interface{}) (Limiter, error) {
+	cfg, err := parseLimiterConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiter != nil && r.limiterCfg == cfg {
+		return r.limiter, nil
+	}
+	if r.store != nil {
+		r.store.Close()
+	}
+	r.store = newCounterStore(cfg.Store)
+	r.limiter = newLimiter(cfg, r.store)
+	r.limiterCfg = cfg
+	return r.limiter, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	keyRemoteAddr    = "remoteAddr"
+	keyXForwardedFor = "xForwardedFor"
+	keyHeader        = "header"
+	keyJWTClaim      = "jwtClaim"
+	keyComposite     = "composite"
+
+	defaultTrustedProxyDepth = 1
+)
+
+// keyStrategy decides which counter a request is charged against.
+type keyStrategy struct {
+	Type              string
+	TrustedProxyDepth int
+	HeaderName        string
+	Claim             string
+	// Client identifies the caller for the composite strategy
+	Client *keyStrategy
+}
+
+// parseKeyStrategy reads params["keyStrategy"], which is either a strategy name
+// or an object. A missing value selects remoteAddr.
+func parseKeyStrategy(raw interface{}) (*keyStrategy, error) {
+	ks := &keyStrategy{Type: keyRemoteAddr, TrustedProxyDepth: defaultTrustedProxyDepth}
+	if raw == nil {
+		return ks, nil
+	}
+	if name, ok := raw.(string); ok {
+		raw = map[string]interface{}{"type": name}
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("keyStrategy must be a string or an object")
+	}
+
+	if v, ok := m["type"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("keyStrategy.type must be a string")
+		}
+		ks.Type = s
+	}
+
+	switch ks.Type {
+	case keyRemoteAddr:
+	case keyXForwardedFor:
+		if v, ok := m["trustedProxyDepth"]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 1 || f != float64(int(f)) {
+				return nil, errors.New("keyStrategy.trustedProxyDepth must be a positive integer")
+			}
+			ks.TrustedProxyDepth = int(f)
+		}
+	case keyHeader:
+		name, ok := m["headerName"].(string)
+		if !ok || name == "" {
+			return nil, errors.New("keyStrategy.headerName is required for the header strategy and must be a string")
+		}
+		ks.HeaderName = name
+	case keyJWTClaim:
+		ks.Claim = "sub"
+		if v, ok := m["claim"]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, errors.New("keyStrategy.claim must be a non-empty string")
+			}
+			ks.Claim = s
+		}
+	case keyComposite:
+		client, err := parseKeyStrategy(m["client"])
+		if err != nil {
+			return nil, fmt.Errorf("keyStrategy.client: %v", err)
+		}
+		if client.Type == keyComposite {
+			return nil, errors.New("keyStrategy.client cannot be composite")
+		}
+		ks.Client = client
+	default:
+		return nil, fmt.Errorf("keyStrategy.type must be one of: %s, %s, %s, %s, %s",
+			keyRemoteAddr, keyXForwardedFor, keyHeader, keyJWTClaim, keyComposite)
+	}
+	return ks, nil
+}
+
+// key returns the counter key for the request. Identifiers that are missing
+// from the request fall back to the remote address so one misbehaving client
+// cannot exhaust a shared anonymous bucket unnoticed.
+func (ks *keyStrategy) key(ctx *RequestContext) string {
+	switch ks.Type {
+	case keyXForwardedFor:
+		if ip := forwardedClientIP(ctx, ks.TrustedProxyDepth); ip != "" {
+			return "ip:" + ip
+		}
+	case keyHeader:
+		if v := headerValue(ctx.Headers, ks.HeaderName); v != "" {
+			return "hdr:" + hashKey(v)
+		}
+	case keyJWTClaim:
+		if v := bearerClaim(ctx.Headers, ks.Claim); v != "" {
+			return "jwt:" + hashKey(v)
+		}
+	case keyComposite:
+		path := ctx.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		return "path:" + path + "|" + ks.Client.key(ctx)
+	}
+	return "ip:" + remoteIP(ctx)
+}
+
+func remoteIP(ctx *RequestContext) string {
+	if ctx.RemoteAddr == "" {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		return host
+	}
+	return ctx.RemoteAddr
+}
+
+// forwardedClientIP picks the client address from X-Forwarded-For. Each of the
+// depth trusted proxies in front of the gateway appends one entry, so the
+// client is the depth-th entry from the right; anything further left can be
+// forged by the caller.
+func forwardedClientIP(ctx *RequestContext, depth int) string {
+	var hops []string
+	for k, values := range ctx.Headers {
+		if !strings.EqualFold(k, "X-Forwarded-For") {
+			continue
+		}
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	if len(hops) < depth {
+		return ""
+	}
+	ip := net.ParseIP(hops[len(hops)-depth])
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// bearerClaim reads a claim from the bearer token without verifying it.
+// Signature checks belong to an authentication policy earlier in the chain.
+func bearerClaim(headers map[string][]string, claim string) string {
+	auth := headerValue(headers, "Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	// Dotted names address nested claims, e.g. "org.id"
+	var v interface{} = claims
+	for _, name := range strings.Split(claim, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[name]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// hashKey keeps caller-supplied identifiers such as API keys out of counter
+// keys and bounds their length.
+func hashKey(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:16])
+}
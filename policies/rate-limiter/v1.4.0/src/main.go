@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define policy types locally
+
+type HeaderProcessingMode string
+
+const (
+	HeaderModeSkip    HeaderProcessingMode = "SKIP"
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	BodyModeSkip   BodyProcessingMode = "SKIP"
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+type Body struct {
+	// Placeholder
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct{}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// decisionKey stores the request phase Decision in the SharedContext
+const decisionKey = "rate-limiter.decision"
+
+type RateLimiterPolicy struct {
+	mu         sync.Mutex
+	limiter    Limiter
+	store      CounterStore
+	limiterCfg limiterConfig
+}
+
+// Validate configuration parameters
+func (r *RateLimiterPolicy) Validate(params map[string]interface{}) error {
+	if _, err := parseLimiterConfig(params); err != nil {
+		return err
+	}
+	if _, err := parseKeyStrategy(params["keyStrategy"]); err != nil {
+		return err
+	}
+	if v, ok := params["includeHeaders"]; ok {
+		if _, ok := v.(bool); !ok {
+			return errors.New("includeHeaders must be a boolean")
+		}
+	}
+	return nil
+}
+
+// Declare processing behavior
+func (r *RateLimiterPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (r *RateLimiterPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	// Configuration is checked by Validate; never block traffic on it here
+	keys, err := parseKeyStrategy(params["keyStrategy"])
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	limiter, err := r.rateLimiter(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+
+	decision, err := limiter.Allow(keys.key(ctx), time.Now())
+	if err != nil {
+		// The store is unavailable and has no fallback; fail open
+		return UpstreamRequestModifications{}
+	}
+	if !decision.Allowed {
+		// Rate limit exceeded
+		headers := map[string][]string{
+			"Content-Type": {"application/json"},
+			"Retry-After":  {strconv.FormatInt(seconds(decision.ResetAfter), 10)},
+		}
+		if includeHeaders(params) {
+			for name, value := range rateLimitHeaders(decision) {
+				headers[name] = []string{value}
+			}
+		}
+		return ImmediateResponse{
+			Status:  429,
+			Headers: headers,
+			Body:    `{"error": "Rate limit exceeded"}`,
+		}
+	}
+
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(decisionKey, decision)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (r *RateLimiterPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	if !includeHeaders(params) || ctx.SharedContext == nil {
+		return UpstreamResponseModifications{}
+	}
+	v, ok := ctx.SharedContext.Get(decisionKey)
+	if !ok {
+		return UpstreamResponseModifications{}
+	}
+	decision, ok := v.(Decision)
+	if !ok {
+		return UpstreamResponseModifications{}
+	}
+	return UpstreamResponseModifications{
+		SetHeaders: rateLimitHeaders(decision),
+	}
+}
+
+// rateLimiter returns the limiter for the given parameters, creating it on
+// first use and replacing it whenever the limiter configuration changes.
+func (r *RateLimiterPolicy) rateLimiter(params map[string]interface{}) (Limiter, error) {
+	cfg, err := parseLimiterConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiter != nil && r.limiterCfg == cfg {
+		return r.limiter, nil
+	}
+	if r.store != nil {
+		r.store.Close()
+	}
+	r.store = newCounterStore(cfg.Store)
+	r.limiter = newLimiter(cfg, r.store)
+	r.limiterCfg = cfg
+	return r.limiter, nil
+}
+
+func includeHeaders(params map[string]interface{}) bool {
+	if v, ok := params["includeHeaders"].(bool); ok {
+		return v
+	}
+	return true
+}
+
+// rateLimitHeaders describes the decision with the fields from
+// draft-ietf-httpapi-ratelimit-headers.
+func rateLimitHeaders(d Decision) map[string]string {
+	return map[string]string{
+		"RateLimit-Limit":     strconv.FormatInt(d.Limit, 10),
+		"RateLimit-Remaining": strconv.FormatInt(d.Remaining, 10),
+		"RateLimit-Reset":     strconv.FormatInt(seconds(d.ResetAfter), 10),
+	}
+}
+
+// seconds rounds up so clients never retry before the budget is restored
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
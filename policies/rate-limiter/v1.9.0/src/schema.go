@@ -0,0 +1,58 @@
+package main
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "requestsPerMinute": {"type": "integer", "minimum": 1},
+    "burstLimit": {"type": "integer", "minimum": 1},
+    "includeHeaders": {"type": "boolean", "default": true},
+    "algorithm": {
+      "type": "string",
+      "enum": ["fixedWindow", "slidingWindowLog", "slidingWindowCounter", "tokenBucket"],
+      "default": "fixedWindow"
+    },
+    "keyStrategy": {
+      "oneOf": [
+        {
+          "type": "string",
+          "enum": ["remoteAddr", "xForwardedFor", "header", "jwtClaim", "consumer", "composite"]
+        },
+        {
+          "type": "object",
+          "properties": {
+            "type": {
+              "type": "string",
+              "enum": ["remoteAddr", "xForwardedFor", "header", "jwtClaim", "consumer", "composite"],
+              "default": "remoteAddr"
+            },
+            "trustedProxyDepth": {"type": "integer", "minimum": 1, "default": 1},
+            "headerName": {"type": "string"},
+            "claim": {"type": "string", "default": "sub"},
+            "client": {"oneOf": [{"type": "string"}, {"type": "object"}]}
+          },
+          "required": ["type"]
+        }
+      ]
+    },
+    "store": {
+      "type": "object",
+      "properties": {
+        "type": {"type": "string", "enum": ["memory", "redis"], "default": "memory"},
+        "address": {"type": "string"},
+        "username": {"type": "string"},
+        "password": {"type": "string"},
+        "database": {"type": "integer", "minimum": 0, "default": 0},
+        "tls": {"type": "boolean", "default": false},
+        "tlsServerName": {"type": "string"},
+        "keyPrefix": {"type": "string", "default": "ratelimit:"},
+        "timeoutMs": {"type": "integer", "minimum": 1, "default": 100}
+      }
+    }
+  },
+  "required": ["requestsPerMinute", "burstLimit"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
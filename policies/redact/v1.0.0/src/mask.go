@@ -0,0 +1,160 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type maskMode string
+
+const (
+	// maskFull replaces the whole value
+	maskFull maskMode = "full"
+	// maskPartial keeps the last characters and stars out the rest
+	maskPartial maskMode = "partial"
+	// maskHash replaces the value with its SHA-256 digest, so equal values
+	// can still be correlated
+	maskHash maskMode = "hash"
+)
+
+// masker hides one value as configured for a field or pattern
+type masker struct {
+	Mode     maskMode
+	KeepLast int
+	// Mask replaces values in full mode
+	Mask string
+	// Salt is prepended before hashing
+	Salt string
+}
+
+func (m masker) maskString(s string) string {
+	switch m.Mode {
+	case maskPartial:
+		return maskAllButLast(s, m.KeepLast)
+	case maskHash:
+		sum := sha256.Sum256([]byte(m.Salt + s))
+		return hex.EncodeToString(sum[:])
+	}
+	return m.Mask
+}
+
+// maskValue masks a JSON value. Numbers and booleans are masked through their
+// text; objects and arrays are replaced as a whole in full mode and have
+// every value inside masked otherwise. null is left alone, it holds nothing.
+func (m masker) maskValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return m.maskString(val)
+	case json.Number:
+		return m.maskString(val.String())
+	case bool:
+		if val {
+			return m.maskString("true")
+		}
+		return m.maskString("false")
+	}
+	if m.Mode == maskFull {
+		return m.Mask
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = m.maskValue(child)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = m.maskValue(child)
+		}
+	}
+	return v
+}
+
+// maskAllButLast replaces letters and digits with * except for the last keep
+// of them. Separators stay, so 4111 1111 1111 1111 becomes
+// **** **** **** 1111. Values too short to hide anything are masked fully.
+func maskAllButLast(s string, keep int) string {
+	runes := []rune(s)
+	count := 0
+	for _, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			count++
+		}
+	}
+	if count <= keep {
+		keep = 0
+	}
+	seen := 0
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+		seen++
+		if seen <= count-keep {
+			runes[i] = '*'
+		}
+	}
+	return string(runes)
+}
+
+// textPattern finds sensitive values in text
+type textPattern struct {
+	re *regexp.Regexp
+	// valid confirms a match, to rule out numbers that only look right
+	valid  func(string) bool
+	masker masker
+}
+
+func (p textPattern) redact(s string) string {
+	return p.re.ReplaceAllStringFunc(s, func(match string) string {
+		if p.valid != nil && !p.valid(match) {
+			return match
+		}
+		return p.masker.maskString(match)
+	})
+}
+
+var builtinPatterns = map[string]struct {
+	re    *regexp.Regexp
+	valid func(string) bool
+}{
+	"email":      {regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`), nil},
+	"creditCard": {regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`), luhnValid},
+	"ssn":        {regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), ssnValid},
+}
+
+// luhnValid checks the card number checksum, ignoring separators
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ssnValid rules out numbers the US Social Security Administration never
+// issues: area 000, 666 or 900-999, group 00 and serial 0000
+func ssnValid(s string) bool {
+	parts := strings.Split(s, "-")
+	if len(parts) != 3 {
+		return false
+	}
+	area := parts[0]
+	return area != "000" && area != "666" && area[0] != '9' && parts[1] != "00" && parts[2] != "0000"
+}
@@ -0,0 +1,39 @@
+package redact
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "fields": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "path": {"type": "string", "minLength": 1},
+          "mode": {"type": "string", "enum": ["full", "partial", "hash"], "default": "full"},
+          "keepLast": {"type": "integer", "minimum": 0, "default": 4}
+        },
+        "required": ["path"]
+      }
+    },
+    "patterns": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["email", "creditCard", "ssn", "custom"]},
+          "regex": {"type": "string", "minLength": 1},
+          "mode": {"type": "string", "enum": ["full", "partial", "hash"], "default": "full"},
+          "keepLast": {"type": "integer", "minimum": 0, "default": 4}
+        },
+        "required": ["type"]
+      }
+    },
+    "mask": {"type": "string", "default": "[REDACTED]"},
+    "hashSalt": {"type": "string"}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,153 @@
+package redact
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath selects values in a decoded JSON document. It supports the part
+// of JSONPath that addresses fields:
+//
+//	$.user.email          child fields
+//	$['user']['e-mail']   quoted field names
+//	$.items[0].card       array indexes, negative ones counting from the end
+//	$.items[*].card       every element or field
+//	$..email              fields of that name at any depth
+type jsonPath []pathSegment
+
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+	// descendant matches the segment at any depth below the current value
+	descendant bool
+}
+
+func parseJSONPath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, errors.New("must start with $")
+	}
+	rest := s[1:]
+	var path jsonPath
+	for rest != "" {
+		var seg pathSegment
+		var err error
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			seg.descendant = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				rest, err = parseBracket(rest, &seg)
+			} else {
+				rest, err = parseName(rest, &seg)
+			}
+		case rest[0] == '.':
+			rest, err = parseName(rest[1:], &seg)
+		case rest[0] == '[':
+			rest, err = parseBracket(rest, &seg)
+		default:
+			err = fmt.Errorf("has an unexpected %q", rest[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seg.descendant && seg.wildcard {
+			// Every value would be selected again at each level below
+			return nil, errors.New("must name the field after ..")
+		}
+		path = append(path, seg)
+	}
+	if len(path) == 0 {
+		return nil, errors.New("must select a field, not the whole document")
+	}
+	return path, nil
+}
+
+func parseName(s string, seg *pathSegment) (string, error) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[:end]
+	switch name {
+	case "":
+		return "", errors.New("has an empty field name")
+	case "*":
+		seg.wildcard = true
+	default:
+		seg.key = name
+	}
+	return s[end:], nil
+}
+
+func parseBracket(s string, seg *pathSegment) (string, error) {
+	s = s[1:]
+	if s != "" && (s[0] == '\'' || s[0] == '"') {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 || !strings.HasPrefix(s[end+2:], "]") {
+			return "", errors.New("has an unterminated quoted name")
+		}
+		seg.key = s[1 : end+1]
+		return s[end+3:], nil
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return "", errors.New("has an unterminated [")
+	}
+	inner := strings.TrimSpace(s[:end])
+	if inner == "*" {
+		seg.wildcard = true
+		return s[end+1:], nil
+	}
+	i, err := strconv.Atoi(inner)
+	if err != nil {
+		return "", fmt.Errorf("has an invalid index %q", inner)
+	}
+	seg.index, seg.isIndex = i, true
+	return s[end+1:], nil
+}
+
+// apply replaces every value the path selects with f of the value and
+// returns the updated document
+func (p jsonPath) apply(doc interface{}, f func(interface{}) interface{}) interface{} {
+	if len(p) == 0 {
+		return f(doc)
+	}
+	seg, rest := p[0], p[1:]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if !seg.isIndex && (seg.wildcard || seg.key == k) {
+				node[k] = rest.apply(child, f)
+			}
+		}
+		if seg.descendant {
+			for k, child := range node {
+				node[k] = p.apply(child, f)
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if seg.wildcard || (seg.isIndex && seg.resolve(len(node)) == i) {
+				node[i] = rest.apply(child, f)
+			}
+		}
+		if seg.descendant {
+			for i, child := range node {
+				node[i] = p.apply(child, f)
+			}
+		}
+	}
+	return doc
+}
+
+// resolve turns a negative index into a position counted from the end
+func (seg pathSegment) resolve(n int) int {
+	if seg.index < 0 {
+		return n + seg.index
+	}
+	return seg.index
+}
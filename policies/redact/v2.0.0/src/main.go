@@ -0,0 +1,574 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+type RedactPolicy struct {
+	mu      sync.Mutex
+	regexes map[string]*regexp.Regexp
+}
+
+type fieldRule struct {
+	Path   jsonPath
+	Masker masker
+}
+
+type redactConfig struct {
+	Fields   []fieldRule
+	Patterns []textPattern
+	// OnUnprocessable is reject or passthrough
+	OnUnprocessable string
+}
+
+// Validate configuration parameters
+func (p *RedactPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *RedactPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *RedactPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	// Compressed responses cannot be searched, so ask the upstream for an
+	// uncompressed one
+	return UpstreamRequestModifications{RemoveHeaders: []string{"Accept-Encoding"}}
+}
+
+// Response phase execution
+func (p *RedactPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	body := ctx.ResponseBody
+	if body == nil || (body.Stream() == nil && len(body.Bytes()) == 0) {
+		return UpstreamResponseModifications{}
+	}
+	// Streamed and encoded bodies cannot be searched. Passing them on would
+	// let personal data through, so unless told otherwise the response is
+	// replaced.
+	if body.Stream() != nil || encoded(ctx.ResponseHeaders) {
+		if cfg.OnUnprocessable == "passthrough" {
+			return UpstreamResponseModifications{}
+		}
+		return unprocessable()
+	}
+
+	var out []byte
+	switch kind := bodyKind(body.ContentType()); {
+	case kind == "json":
+		if out, err = cfg.redactJSON(body.Bytes()); err != nil {
+			// Fields cannot be found in a broken document, but patterns
+			// still apply to its text
+			out = cfg.redactText(body.Bytes())
+		}
+	case kind == "text":
+		out = cfg.redactText(body.Bytes())
+	default:
+		return UpstreamResponseModifications{}
+	}
+	if bytes.Equal(out, body.Bytes()) {
+		return UpstreamResponseModifications{}
+	}
+	return UpstreamResponseModifications{Body: out}
+}
+
+func (p *RedactPolicy) parseConfig(params map[string]interface{}) (redactConfig, error) {
+	var cfg redactConfig
+	var errs paramErrors
+	cfg.OnUnprocessable, _ = params["onUnprocessable"].(string)
+	mask, _ := params["mask"].(string)
+	salt, _ := params["hashSalt"].(string)
+	newMasker := func(m map[string]interface{}) masker {
+		mode, _ := m["mode"].(string)
+		keep, _ := m["keepLast"].(float64)
+		return masker{Mode: maskMode(mode), KeepLast: int(keep), Mask: mask, Salt: salt}
+	}
+
+	fields, _ := params["fields"].([]interface{})
+	for i, item := range fields {
+		m, _ := item.(map[string]interface{})
+		raw, _ := m["path"].(string)
+		path, err := parseJSONPath(raw)
+		if err != nil {
+			errs.add(fmt.Sprintf("fields[%d].path", i), err.Error())
+			continue
+		}
+		cfg.Fields = append(cfg.Fields, fieldRule{Path: path, Masker: newMasker(m)})
+	}
+
+	patterns, _ := params["patterns"].([]interface{})
+	for i, item := range patterns {
+		m, _ := item.(map[string]interface{})
+		path := fmt.Sprintf("patterns[%d]", i)
+		typ, _ := m["type"].(string)
+		expr, hasRegex := m["regex"].(string)
+		pattern := textPattern{masker: newMasker(m)}
+		if typ == "custom" {
+			if !hasRegex {
+				errs.add(path+".regex", "is required for the custom type")
+				continue
+			}
+			re, err := p.regex(expr)
+			if err != nil {
+				errs.add(path+".regex", "is not a valid regular expression: "+err.Error())
+				continue
+			}
+			pattern.re = re
+		} else {
+			if hasRegex {
+				errs.add(path+".regex", "only applies to the custom type")
+				continue
+			}
+			builtin := builtinPatterns[typ]
+			pattern.re, pattern.valid = builtin.re, builtin.valid
+		}
+		cfg.Patterns = append(cfg.Patterns, pattern)
+	}
+
+	if len(fields) == 0 && len(patterns) == 0 {
+		errs.add("fields", "or patterns must list something to redact")
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// regex compiles a custom pattern once per policy instance
+func (p *RedactPolicy) regex(expr string) (*regexp.Regexp, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if re, ok := p.regexes[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if p.regexes == nil {
+		p.regexes = make(map[string]*regexp.Regexp)
+	}
+	p.regexes[expr] = re
+	return re, nil
+}
+
+// redactJSON masks the configured fields, then runs the patterns over every
+// string left in the document, so the result is still valid JSON. A document
+// with nothing to redact is returned as it came.
+func (cfg redactConfig) redactJSON(content []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	// Numbers keep their exact text, e.g. 16 digit card numbers
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after the JSON document")
+	}
+	changed := false
+	for _, rule := range cfg.Fields {
+		doc = rule.Path.apply(doc, func(v interface{}) interface{} {
+			if v != nil {
+				changed = true
+			}
+			return rule.Masker.maskValue(v)
+		})
+	}
+	if len(cfg.Patterns) > 0 {
+		doc = cfg.redactStrings(doc, &changed)
+	}
+	if !changed {
+		return content, nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// Keep <, > and & as they are rather than as \u escapes
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (cfg redactConfig) redactStrings(v interface{}, changed *bool) interface{} {
+	switch val := v.(type) {
+	case string:
+		out := val
+		for _, p := range cfg.Patterns {
+			out = p.redact(out)
+		}
+		if out != val {
+			*changed = true
+		}
+		return out
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = cfg.redactStrings(child, changed)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = cfg.redactStrings(child, changed)
+		}
+	}
+	return v
+}
+
+func (cfg redactConfig) redactText(content []byte) []byte {
+	s := string(content)
+	for _, p := range cfg.Patterns {
+		s = p.redact(s)
+	}
+	return []byte(s)
+}
+
+// bodyKind classifies a media type as json, text or other. Bodies without a
+// Content-Type are treated as JSON, the common case for APIs.
+func bodyKind(contentType string) string {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch {
+	case mediaType == "", mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/x-www-form-urlencoded":
+		return "text"
+	}
+	return "other"
+}
+
+// unprocessable is the response sent instead of a body that cannot be
+// redacted
+func unprocessable() ImmediateResponse {
+	return ImmediateResponse{
+		Status:  502,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    `{"error": "Response cannot be redacted"}`,
+	}
+}
+
+// encoded reports whether the response body is compressed or otherwise
+// encoded
+func encoded(headers map[string][]string) bool {
+	for k, values := range headers {
+		if strings.EqualFold(k, "Content-Encoding") {
+			for _, v := range values {
+				if v = strings.TrimSpace(strings.ToLower(v)); v != "" && v != "identity" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
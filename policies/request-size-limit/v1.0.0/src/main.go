@@ -0,0 +1,464 @@
+package request_size_limit
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+const tooLargeBody = `{"error": "Payload too large"}`
+
+type SizeLimitPolicy struct{}
+
+type limitConfig struct {
+	MaxBytes int64
+	// ContentTypes maps lower-cased media types, or type/* ranges, to limits
+	ContentTypes map[string]int64
+}
+
+// Validate configuration parameters
+func (p *SizeLimitPolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *SizeLimitPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		// Streaming lets the Content-Length check refuse a request before any
+		// of its body is read, and counts the rest without holding it in
+		// memory. Gateways that buffer the body or skip it are handled too.
+		RequestBodyMode:  BodyModeStream,
+		ResponseBodyMode: BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *SizeLimitPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	contentType := ctx.Body.ContentType()
+	if contentType == "" {
+		contentType = headerValue(ctx.Headers, "Content-Type")
+	}
+	limit := cfg.limit(contentType)
+
+	// The declared length is checked first, so oversized uploads are refused
+	// before any of the body is read
+	if v := headerValue(ctx.Headers, "Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil && n > limit {
+			return tooLarge()
+		}
+	}
+	if ctx.Body.ContentLength() > limit {
+		return tooLarge()
+	}
+
+	switch {
+	case ctx.Body == nil:
+		// Header-only mode: Content-Length is all there is
+	case ctx.Body.Stream() != nil:
+		// Chunked uploads and bodies longer than declared are counted as
+		// they arrive
+		if !forwardWithin(ctx.Body.Stream(), limit) {
+			return tooLarge()
+		}
+	case int64(len(ctx.Body.Bytes())) > limit:
+		return tooLarge()
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase (not used)
+func (p *SizeLimitPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// limit returns the limit for a Content-Type: an exact media type override,
+// then a type/* override, then maxBodyBytes
+func (cfg limitConfig) limit(contentType string) int64 {
+	if contentType == "" || len(cfg.ContentTypes) == 0 {
+		return cfg.MaxBytes
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return cfg.MaxBytes
+	}
+	if n, ok := cfg.ContentTypes[mediaType]; ok {
+		return n
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	if n, ok := cfg.ContentTypes[major+"/*"]; ok {
+		return n
+	}
+	return cfg.MaxBytes
+}
+
+// forwardWithin passes a streamed body on chunk by chunk and stops as soon as
+// it grows past the limit, before the rest is read
+func forwardWithin(stream Stream, limit int64) bool {
+	var total int64
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			// io.EOF ends the body; broken streams are the gateway's to report
+			return true
+		}
+		if total += int64(len(chunk)); total > limit {
+			return false
+		}
+		if err := stream.Send(chunk); err != nil {
+			return true
+		}
+	}
+}
+
+func tooLarge() ImmediateResponse {
+	return ImmediateResponse{
+		Status:  413,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    tooLargeBody,
+	}
+}
+
+func parseConfig(params map[string]interface{}) (limitConfig, error) {
+	var cfg limitConfig
+	n, err := byteLimit(params["maxBodyBytes"])
+	if err != nil {
+		return cfg, fmt.Errorf("maxBodyBytes is required and %v", err)
+	}
+	cfg.MaxBytes = n
+
+	if v, ok := params["contentTypeLimits"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("contentTypeLimits must be an object mapping media types to byte limits")
+		}
+		cfg.ContentTypes = make(map[string]int64, len(m))
+		for mediaType, raw := range m {
+			key := strings.ToLower(strings.TrimSpace(mediaType))
+			major, minor, ok := strings.Cut(key, "/")
+			if !ok || major == "" || minor == "" || major == "*" || strings.ContainsAny(key, " ;,") {
+				return cfg, fmt.Errorf("contentTypeLimits: invalid media type %q", mediaType)
+			}
+			if n, err = byteLimit(raw); err != nil {
+				return cfg, fmt.Errorf("contentTypeLimits.%s %v", mediaType, err)
+			}
+			cfg.ContentTypes[key] = n
+		}
+	}
+	return cfg, nil
+}
+
+func byteLimit(v interface{}) (int64, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != float64(int64(f)) {
+		return 0, errors.New("must be a non-negative integer")
+	}
+	return int64(f), nil
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,520 @@
+package response_cache
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. It is safe for concurrent use.
+type SharedContext struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// lookupKey carries the request phase lookup to the response phase
+const lookupKey = "response-cache.lookup"
+
+const (
+	defaultTTL          = 60 * time.Second
+	defaultMaxBodyBytes = 1 << 20
+	defaultStatusHeader = "X-Cache"
+
+	statusHit    = "HIT"
+	statusMiss   = "MISS"
+	statusBypass = "BYPASS"
+)
+
+// defaultStatuses are the status codes HTTP treats as cacheable by default
+var defaultStatuses = []int{200, 203, 204, 300, 301, 404, 405, 410, 414, 501}
+
+type ResponseCachePolicy struct {
+	mu       sync.Mutex
+	store    CacheStore
+	storeCfg storeConfig
+}
+
+type cacheConfig struct {
+	TTL                 time.Duration
+	MaxBodyBytes        int64
+	Statuses            []int
+	VaryHeaders         []string
+	RespectCacheControl bool
+	PurgeHeader         string
+	PurgeToken          string
+	StatusHeader        string
+	Store               storeConfig
+}
+
+// lookup is what the request phase knows about a request that was not served
+// from the cache
+type lookup struct {
+	key        string
+	status     string
+	store      bool
+	authorized bool
+	headers    map[string][]string
+}
+
+// Validate configuration parameters
+func (p *ResponseCachePolicy) Validate(params map[string]interface{}) error {
+	_, err := parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *ResponseCachePolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeBuffer,
+	}
+}
+
+// Request phase execution
+func (p *ResponseCachePolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	store := p.cacheStore(cfg.Store)
+	path, query, _ := strings.Cut(ctx.Path, "?")
+
+	if cfg.PurgeHeader != "" {
+		if token := headerValue(ctx.Headers, cfg.PurgeHeader); token != "" {
+			return purge(store, path, token, cfg.PurgeToken)
+		}
+	}
+
+	method := strings.ToUpper(ctx.Method)
+	if method != "GET" && method != "HEAD" {
+		return UpstreamRequestModifications{}
+	}
+
+	l := &lookup{
+		key:        variantKey(path, method, query, cfg.VaryHeaders, ctx.Headers),
+		status:     statusMiss,
+		store:      true,
+		authorized: headerValue(ctx.Headers, "Authorization") != "",
+		headers:    ctx.Headers,
+	}
+	maxAge := time.Duration(-1)
+	if cfg.RespectCacheControl {
+		cc := parseCacheControl(headerValues(ctx.Headers, "Cache-Control"))
+		switch {
+		case cc.has("no-store"):
+			l.status, l.store = statusBypass, false
+		case cc.has("no-cache"), len(cc) == 0 && pragmaNoCache(ctx.Headers):
+			// Go to the upstream, but keep its answer for later requests
+			l.status = statusBypass
+		default:
+			if d, ok := cc.seconds("max-age"); ok {
+				maxAge = d
+			}
+		}
+	}
+
+	if l.status != statusBypass {
+		now := time.Now()
+		// A store failure is treated as a miss
+		if data, err := store.Get(l.key); err == nil && data != nil {
+			if e, err := decodeEntry(data); err == nil && e.usable(now, ctx.Headers, maxAge) {
+				return e.response(now, cfg.StatusHeader)
+			}
+		}
+	}
+
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(lookupKey, l)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (p *ResponseCachePolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	if ctx.SharedContext == nil {
+		return UpstreamResponseModifications{}
+	}
+	v, _ := ctx.SharedContext.Get(lookupKey)
+	l, ok := v.(*lookup)
+	if !ok {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+
+	mods := UpstreamResponseModifications{}
+	if cfg.StatusHeader != "" {
+		mods.SetHeaders = map[string]string{cfg.StatusHeader: l.status}
+	}
+	if !l.store {
+		return mods
+	}
+	ttl, ok := cfg.freshness(ctx, l)
+	if !ok {
+		return mods
+	}
+	data, err := json.Marshal(cfg.newEntry(ctx, l, ttl))
+	if err != nil {
+		return mods
+	}
+	// The response is delivered whether or not it could be stored
+	p.cacheStore(cfg.Store).Set(l.key, data, ttl)
+	return mods
+}
+
+// purge removes every cached variant of a path when the admin token matches
+func purge(store CacheStore, path, token, want string) ImmediateResponse {
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return ImmediateResponse{Status: 403, Headers: headers, Body: `{"error": "Forbidden"}`}
+	}
+	n, err := store.DeletePrefix(pathKey(path))
+	if err != nil {
+		return ImmediateResponse{Status: 503, Headers: headers, Body: `{"error": "Cache unavailable"}`}
+	}
+	return ImmediateResponse{Status: 200, Headers: headers, Body: fmt.Sprintf(`{"purged": %d}`, n)}
+}
+
+// pathKey is shared by every variant of a path, so a purge can find them all
+func pathKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:16]) + ":"
+}
+
+// variantKey identifies one cached response: the method, the query string and
+// the values of the configured vary headers
+func variantKey(path, method, query string, vary []string, headers map[string][]string) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(query))
+	for _, name := range vary {
+		h.Write([]byte{0})
+		h.Write([]byte(name + ":" + strings.Join(headerValues(headers, name), ",")))
+	}
+	return pathKey(path) + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// cacheStore returns the store for the given configuration, creating it on
+// first use and replacing it whenever the configuration changes.
+func (p *ResponseCachePolicy) cacheStore(cfg storeConfig) CacheStore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.store != nil && p.storeCfg == cfg {
+		return p.store
+	}
+	if p.store != nil {
+		p.store.Close()
+	}
+	p.store = newCacheStore(cfg)
+	p.storeCfg = cfg
+	return p.store
+}
+
+func parseConfig(params map[string]interface{}) (cacheConfig, error) {
+	cfg := cacheConfig{
+		TTL:                 defaultTTL,
+		MaxBodyBytes:        defaultMaxBodyBytes,
+		Statuses:            defaultStatuses,
+		RespectCacheControl: true,
+		StatusHeader:        defaultStatusHeader,
+	}
+
+	if v, ok := params["ttlSeconds"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int64(f)) {
+			return cfg, errors.New("ttlSeconds must be a positive integer")
+		}
+		cfg.TTL = time.Duration(f) * time.Second
+	}
+	if v, ok := params["maxBodyBytes"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int64(f)) {
+			return cfg, errors.New("maxBodyBytes must be a positive integer")
+		}
+		cfg.MaxBodyBytes = int64(f)
+	}
+	if v, ok := params["statusCodes"]; ok {
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return cfg, errors.New("statusCodes must be a non-empty list of status codes")
+		}
+		cfg.Statuses = nil
+		for _, item := range list {
+			f, ok := item.(float64)
+			if !ok || f < 200 || f > 599 || f != float64(int(f)) {
+				return cfg, fmt.Errorf("statusCodes: %v is not a status code between 200 and 599", item)
+			}
+			cfg.Statuses = append(cfg.Statuses, int(f))
+		}
+	}
+
+	var err error
+	if cfg.VaryHeaders, err = stringList(params, "varyHeaders"); err != nil {
+		return cfg, err
+	}
+	for i, name := range cfg.VaryHeaders {
+		if name == "" || strings.ContainsAny(name, " ,:\t") {
+			return cfg, fmt.Errorf("varyHeaders: invalid header name %q", name)
+		}
+		cfg.VaryHeaders[i] = strings.ToLower(name)
+	}
+
+	if v, ok := params["respectCacheControl"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("respectCacheControl must be a boolean")
+		}
+		cfg.RespectCacheControl = b
+	}
+	if v, ok := params["cacheStatusHeader"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return cfg, errors.New("cacheStatusHeader must be a string")
+		}
+		cfg.StatusHeader = s
+	}
+
+	if v, ok := params["purge"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("purge must be an object")
+		}
+		for name, dst := range map[string]*string{
+			"header": &cfg.PurgeHeader,
+			"token":  &cfg.PurgeToken,
+		} {
+			s, ok := m[name].(string)
+			if !ok || s == "" {
+				return cfg, fmt.Errorf("purge.%s is required and must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+
+	if cfg.Store, err = parseStoreConfig(params["store"]); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	if values, ok := headers[name]; ok {
+		return values
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,247 @@
+package response_cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopByHopHeaders describe the connection a response arrived on and are never
+// replayed from the cache
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// maxDeltaSeconds caps max-age and similar values, as HTTP recommends
+const maxDeltaSeconds = 1<<31 - 1
+
+// entry is a stored response
+type entry struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body,omitempty"`
+	// Vary holds the request header values named by the response's Vary
+	// header, which must match for the entry to be served
+	Vary map[string]string `json:"vary,omitempty"`
+	// Date is when the response was generated, which is earlier than when it
+	// was stored if the upstream reported an Age
+	Date    time.Time `json:"date"`
+	Expires time.Time `json:"expires"`
+}
+
+func decodeEntry(data []byte) (*entry, error) {
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// usable reports whether the entry is fresh, matches the request's Vary
+// headers and is no older than the client's max-age (negative for none)
+func (e *entry) usable(now time.Time, headers map[string][]string, maxAge time.Duration) bool {
+	if !now.Before(e.Expires) {
+		return false
+	}
+	if maxAge >= 0 && now.Sub(e.Date) > maxAge {
+		return false
+	}
+	for name, value := range e.Vary {
+		if strings.Join(headerValues(headers, name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *entry) response(now time.Time, statusHeader string) ImmediateResponse {
+	headers := make(map[string][]string, len(e.Headers)+2)
+	for name, values := range e.Headers {
+		headers[name] = values
+	}
+	headers["Age"] = []string{strconv.FormatInt(int64(now.Sub(e.Date)/time.Second), 10)}
+	if statusHeader != "" {
+		headers[statusHeader] = []string{statusHit}
+	}
+	return ImmediateResponse{Status: e.Status, Headers: headers, Body: string(e.Body)}
+}
+
+// freshness decides whether a response may be stored and for how long
+func (cfg cacheConfig) freshness(ctx *ResponseContext, l *lookup) (time.Duration, bool) {
+	if !containsStatus(cfg.Statuses, ctx.ResponseStatus) {
+		return 0, false
+	}
+	body := ctx.ResponseBody
+	if body.Stream() != nil || body.ContentLength() > cfg.MaxBodyBytes || int64(len(body.Bytes())) > cfg.MaxBodyBytes {
+		return 0, false
+	}
+	// Responses that set cookies are specific to one client
+	if len(headerValues(ctx.ResponseHeaders, "Set-Cookie")) > 0 {
+		return 0, false
+	}
+	for _, v := range headerValues(ctx.ResponseHeaders, "Vary") {
+		for _, name := range splitList(v) {
+			if name == "*" {
+				return 0, false
+			}
+		}
+	}
+
+	cc := parseCacheControl(headerValues(ctx.ResponseHeaders, "Cache-Control"))
+	// A shared cache may only store answers to authenticated requests when
+	// the upstream explicitly allows it
+	if l.authorized && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return 0, false
+	}
+	if !cfg.RespectCacheControl {
+		return cfg.TTL, true
+	}
+	if cc.has("no-store") || cc.has("private") || cc.has("no-cache") {
+		return 0, false
+	}
+
+	ttl := cfg.TTL
+	if d, ok := cc.seconds("s-maxage"); ok {
+		ttl = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		ttl = d
+	} else if expires := headerValue(ctx.ResponseHeaders, "Expires"); expires != "" {
+		// An invalid Expires value means the response is already stale
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(headerValue(ctx.ResponseHeaders, "Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = t.Sub(date)
+	}
+	ttl -= upstreamAge(ctx.ResponseHeaders)
+	return ttl, ttl >= time.Second
+}
+
+func (cfg cacheConfig) newEntry(ctx *ResponseContext, l *lookup, ttl time.Duration) *entry {
+	now := time.Now()
+	e := &entry{
+		Status:  ctx.ResponseStatus,
+		Headers: make(map[string][]string, len(ctx.ResponseHeaders)),
+		Body:    ctx.ResponseBody.Bytes(),
+		Date:    now.Add(-upstreamAge(ctx.ResponseHeaders)),
+		Expires: now.Add(ttl),
+	}
+
+	skip := append([]string{"Age", "Content-Length"}, hopByHopHeaders...)
+	if cfg.StatusHeader != "" {
+		skip = append(skip, cfg.StatusHeader)
+	}
+	for _, v := range headerValues(ctx.ResponseHeaders, "Connection") {
+		skip = append(skip, splitList(v)...)
+	}
+	for name, values := range ctx.ResponseHeaders {
+		if !containsFold(skip, name) {
+			e.Headers[name] = values
+		}
+	}
+
+	for _, v := range headerValues(ctx.ResponseHeaders, "Vary") {
+		for _, name := range splitList(v) {
+			name = strings.ToLower(name)
+			if contains(cfg.VaryHeaders, name) {
+				// Already part of the cache key
+				continue
+			}
+			if e.Vary == nil {
+				e.Vary = make(map[string]string)
+			}
+			e.Vary[name] = strings.Join(headerValues(l.headers, name), ",")
+		}
+	}
+	return e
+}
+
+func upstreamAge(headers map[string][]string) time.Duration {
+	n, err := strconv.ParseInt(strings.TrimSpace(headerValue(headers, "Age")), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(min(n, maxDeltaSeconds)) * time.Second
+}
+
+// pragmaNoCache reports a Pragma: no-cache request from an HTTP/1.0 client
+func pragmaNoCache(headers map[string][]string) bool {
+	for _, v := range headerValues(headers, "Pragma") {
+		if containsFold(splitList(v), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl maps lower-cased Cache-Control directives to their values
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, directive := range splitList(v) {
+			name, value, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := cc[name]; ok {
+				// The first occurrence wins
+				continue
+			}
+			cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds reads a delta-seconds directive such as max-age
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// Invalid values are treated as zero, i.e. already stale
+		return 0, true
+	}
+	return time.Duration(min(n, maxDeltaSeconds)) * time.Second, true
+}
+
+func containsStatus(list []int, status int) bool {
+	for _, s := range list {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
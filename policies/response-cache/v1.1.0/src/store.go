@@ -0,0 +1,543 @@
+package response_cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore holds cached responses shared by all requests a policy instance
+// sees. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the value stored under key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	// Set stores value under key. The value expires after ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+	// DeletePrefix removes every value whose key starts with prefix and
+	// returns how many were removed.
+	DeletePrefix(prefix string) (int, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+const (
+	storeTypeMemory = "memory"
+	storeTypeRedis  = "redis"
+
+	defaultMaxEntries   = 10000
+	defaultKeyPrefix    = "cache:"
+	defaultRedisTimeout = 100 * time.Millisecond
+	redisRetryInterval  = 5 * time.Second
+	redisMaxIdleConns   = 8
+	redisScanCount      = "500"
+)
+
+var errStoreUnavailable = errors.New("redis: store unavailable")
+
+type storeConfig struct {
+	Type          string
+	MaxEntries    int
+	Address       string
+	Username      string
+	Password      string
+	Database      int
+	TLS           bool
+	TLSServerName string
+	KeyPrefix     string
+	Timeout       time.Duration
+}
+
+// parseStoreConfig reads params["store"]. A missing value selects the
+// in-memory store.
+func parseStoreConfig(raw interface{}) (storeConfig, error) {
+	cfg := storeConfig{
+		Type:       storeTypeMemory,
+		MaxEntries: defaultMaxEntries,
+		KeyPrefix:  defaultKeyPrefix,
+		Timeout:    defaultRedisTimeout,
+	}
+	if raw == nil {
+		return cfg, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg, errors.New("store must be an object")
+	}
+
+	if v, ok := m["type"]; ok {
+		s, ok := v.(string)
+		if !ok || (s != storeTypeMemory && s != storeTypeRedis) {
+			return cfg, errors.New("store.type must be one of: memory, redis")
+		}
+		cfg.Type = s
+	}
+	if v, ok := m["keyPrefix"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return cfg, errors.New("store.keyPrefix must be a string")
+		}
+		cfg.KeyPrefix = s
+	}
+	if cfg.Type == storeTypeMemory {
+		if v, ok := m["maxEntries"]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 1 || f != float64(int(f)) {
+				return cfg, errors.New("store.maxEntries must be a positive integer")
+			}
+			cfg.MaxEntries = int(f)
+		}
+		return cfg, nil
+	}
+
+	address, ok := m["address"].(string)
+	if !ok || address == "" {
+		return cfg, errors.New("store.address is required for the redis store and must be a string")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return cfg, fmt.Errorf("store.address must be host:port: %v", err)
+	}
+	cfg.Address = address
+
+	for name, dst := range map[string]*string{
+		"username":      &cfg.Username,
+		"password":      &cfg.Password,
+		"tlsServerName": &cfg.TLSServerName,
+	} {
+		if v, ok := m[name]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("store.%s must be a string", name)
+			}
+			*dst = s
+		}
+	}
+	if v, ok := m["database"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return cfg, errors.New("store.database must be a non-negative integer")
+		}
+		cfg.Database = int(f)
+	}
+	if v, ok := m["tls"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("store.tls must be a boolean")
+		}
+		cfg.TLS = b
+	}
+	if v, ok := m["timeoutMs"]; ok {
+		f, ok := v.(float64)
+		if !ok || f <= 0 {
+			return cfg, errors.New("store.timeoutMs must be a positive integer")
+		}
+		cfg.Timeout = time.Duration(f) * time.Millisecond
+	}
+	return cfg, nil
+}
+
+func newCacheStore(cfg storeConfig) CacheStore {
+	if cfg.Type == storeTypeRedis {
+		return newRedisStore(cfg)
+	}
+	return newMemoryStore(cfg.KeyPrefix, cfg.MaxEntries)
+}
+
+// memoryStore keeps responses in process memory and evicts the least recently
+// used one when full. Entries are not shared between gateway replicas.
+type memoryStore struct {
+	mu         sync.Mutex
+	prefix     string
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newMemoryStore(prefix string, maxEntries int) *memoryStore {
+	return &memoryStore{
+		prefix:     prefix,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	now := time.Now()
+	key = s.prefix + key
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if !now.Before(e.expiresAt) {
+		s.remove(el)
+		return nil, nil
+	}
+	s.lru.MoveToFront(el)
+	return e.value, nil
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	e := &memoryEntry{key: s.prefix + key, value: value, expiresAt: time.Now().Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[e.key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return nil
+	}
+	s.entries[e.key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+func (s *memoryStore) DeletePrefix(prefix string) (int, error) {
+	prefix = s.prefix + prefix
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, el := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(el)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*memoryEntry).key)
+}
+
+// Close drops the entries, so a replaced store does not hold on to their
+// memory until the last reference to it is gone
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = map[string]*list.Element{}
+	s.lru.Init()
+	return nil
+}
+
+// redisStore keeps responses in Redis so every gateway replica serves the
+// same entries. While the server cannot be reached, requests skip the cache
+// for redisRetryInterval instead of waiting for a timeout each time.
+type redisStore struct {
+	cfg  storeConfig
+	idle chan *redisConn
+
+	mu        sync.Mutex
+	downUntil time.Time
+	// closed is set by Close; connections in use at the time are closed
+	// when their command completes instead of returning to the pool
+	closed bool
+}
+
+func newRedisStore(cfg storeConfig) *redisStore {
+	return &redisStore{
+		cfg:  cfg,
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", s.cfg.KeyPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := s.do("SET", s.cfg.KeyPrefix+key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// DeletePrefix walks the keyspace with SCAN, which does not block the server
+// the way KEYS does
+func (s *redisStore) DeletePrefix(prefix string) (int, error) {
+	pattern := escapeGlob(s.cfg.KeyPrefix+prefix) + "*"
+	cursor := "0"
+	n := 0
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount)
+		if err != nil {
+			return n, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return n, fmt.Errorf("redis: unexpected reply %T to SCAN", reply)
+		}
+		cursor, _ = items[0].(string)
+		keys, _ := items[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				if key, ok := k.(string); ok {
+					args = append(args, key)
+				}
+			}
+			reply, err := s.do(args...)
+			if err != nil {
+				return n, err
+			}
+			if deleted, ok := reply.(int64); ok {
+				n += int(deleted)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return n, nil
+		}
+	}
+}
+
+// escapeGlob quotes the characters SCAN MATCH treats as wildcards
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a single command on a pooled connection. Connections that fail are
+// discarded rather than returned to the pool.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	if !s.up() {
+		return nil, errStoreUnavailable
+	}
+	c, err := s.get()
+	if err != nil {
+		s.markDown()
+		return nil, err
+	}
+	reply, err := c.do(s.cfg.Timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			s.markDown()
+			return nil, err
+		}
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *redisStore) up() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !time.Now().Before(s.downUntil)
+}
+
+func (s *redisStore) markDown() {
+	s.mu.Lock()
+	s.downUntil = time.Now().Add(redisRetryInterval)
+	s.mu.Unlock()
+}
+
+func (s *redisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial()
+	}
+}
+
+func (s *redisStore) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.conn.Close()
+		return
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+	var conn net.Conn
+	var err error
+	if s.cfg.TLS {
+		serverName := s.cfg.TLSServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(s.cfg.Address)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, &tls.Config{
+			ServerName: serverName,
+			MinVersion: tls.VersionTLS12,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if s.cfg.Password != "" {
+		args := []string{"AUTH", s.cfg.Password}
+		if s.cfg.Username != "" {
+			args = []string{"AUTH", s.cfg.Username, s.cfg.Password}
+		}
+		if _, err := c.do(s.cfg.Timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.cfg.Database != 0 {
+		if _, err := c.do(s.cfg.Timeout, "SELECT", strconv.Itoa(s.cfg.Database)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply sent by the server. The connection that
+// received it is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the subset of RESP needed by the store.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
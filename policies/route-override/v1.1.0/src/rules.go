@@ -0,0 +1,331 @@
+package route_override
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rule sends matching requests to a target, or to one of several weighted
+// targets
+type rule struct {
+	methods []string
+	path    *Matcher
+	headers []HeaderMatcher
+
+	target       target
+	split        []weightedTarget
+	totalWeight  int
+	stickyHeader string
+}
+
+// target says where a request goes. Empty fields keep the route's value.
+type target struct {
+	Upstream string `json:"upstream,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Path     string `json:"path,omitempty"`
+}
+
+type weightedTarget struct {
+	target
+	weight int
+}
+
+// pathMatch holds the submatches of a regex or glob path so path templates
+// can use them
+type pathMatch struct {
+	re    *regexp.Regexp
+	path  string
+	index []int
+}
+
+// match reports whether every condition of the rule holds. A rule without
+// conditions matches every request.
+func (r *rule) match(ctx *RequestContext) (pathMatch, bool) {
+	path, _, _ := strings.Cut(ctx.Path, "?")
+	m := pathMatch{path: path}
+
+	if len(r.methods) > 0 && !containsFold(r.methods, ctx.Method) {
+		return m, false
+	}
+	for _, h := range r.headers {
+		if !h.Match(ctx.Headers) {
+			return m, false
+		}
+	}
+	if r.path == nil {
+		return m, true
+	}
+	if re := r.path.Regexp(); re != nil {
+		if m.index = re.FindStringSubmatchIndex(path); m.index == nil {
+			return m, false
+		}
+		m.re = re
+		return m, true
+	}
+	return m, r.path.Match(path)
+}
+
+// pick chooses the target for a request. With stickyHeader set, requests
+// carrying the same header value always get the same target.
+func (r *rule) pick(ctx *RequestContext) target {
+	if len(r.split) == 0 {
+		return r.target
+	}
+	var n int
+	if v := headerValue(ctx.Headers, r.stickyHeader); r.stickyHeader != "" && v != "" {
+		h := fnv.New32a()
+		h.Write([]byte(v))
+		n = int(h.Sum32() % uint32(r.totalWeight))
+	} else {
+		n = rand.IntN(r.totalWeight)
+	}
+	for _, wt := range r.split {
+		if n < wt.weight {
+			return wt.target
+		}
+		n -= wt.weight
+	}
+	return r.split[len(r.split)-1].target
+}
+
+func (t target) modifications(requestPath string, m pathMatch) UpstreamRequestModifications {
+	mods := UpstreamRequestModifications{
+		Upstream:  t.Upstream,
+		Authority: t.Host,
+	}
+	if t.Path != "" {
+		path := t.Path
+		if m.re != nil {
+			// $1, ${name} and so on refer to the groups of the path pattern
+			path = string(m.re.ExpandString(nil, t.Path, m.path, m.index))
+		}
+		if _, query, ok := strings.Cut(requestPath, "?"); ok && !strings.Contains(path, "?") {
+			path += "?" + query
+		}
+		mods.Path = path
+	}
+	return mods
+}
+
+func (p *RouteOverridePolicy) parseRule(m map[string]interface{}) (*rule, error) {
+	r := &rule{}
+	if raw, ok := m["match"]; ok {
+		match, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("match must be an object")
+		}
+		if err := p.parseMatch(r, match); err != nil {
+			return nil, fmt.Errorf("match.%v", err)
+		}
+	}
+
+	var err error
+	if r.target, err = parseTarget(m); err != nil {
+		return nil, err
+	}
+	rawSplit, hasSplit := m["split"]
+	if !hasSplit {
+		if r.target == (target{}) {
+			return nil, errors.New("must set at least one of upstream, host, path and split")
+		}
+		if _, ok := m["stickyHeader"]; ok {
+			return nil, errors.New("stickyHeader only applies to rules with a split")
+		}
+		return r, nil
+	}
+
+	if r.target != (target{}) {
+		return nil, errors.New("split cannot be combined with upstream, host or path on the rule")
+	}
+	list, ok := rawSplit.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("split must be a non-empty list")
+	}
+	for i, raw := range list {
+		entry, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("split[%d] must be an object", i)
+		}
+		f, ok := entry["weight"].(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, fmt.Errorf("split[%d].weight must be a non-negative integer", i)
+		}
+		t, err := parseTarget(entry)
+		if err != nil {
+			return nil, fmt.Errorf("split[%d].%v", i, err)
+		}
+		r.split = append(r.split, weightedTarget{target: t, weight: int(f)})
+		r.totalWeight += int(f)
+	}
+	if r.totalWeight == 0 {
+		return nil, errors.New("split must have at least one positive weight")
+	}
+	if v, ok := m["stickyHeader"]; ok {
+		if r.stickyHeader, ok = v.(string); !ok || r.stickyHeader == "" {
+			return nil, errors.New("stickyHeader must be a header name")
+		}
+	}
+	return r, nil
+}
+
+func (p *RouteOverridePolicy) parseMatch(r *rule, m map[string]interface{}) error {
+	var err error
+	if r.methods, err = stringList(m, "methods"); err != nil {
+		return err
+	}
+	if v, ok := m["path"]; ok {
+		if _, ok := m["pathPattern"]; ok {
+			return errors.New("path cannot be combined with pathPattern")
+		}
+		// A string is a regular expression, as pathPattern is
+		if r.path, err = p.matchers.Parse(v, MatchRegex); err != nil {
+			return fmt.Errorf("path: %v", err)
+		}
+	}
+	if v, ok := m["pathPattern"]; ok {
+		expr, ok := v.(string)
+		if !ok || expr == "" {
+			return errors.New("pathPattern must be a regular expression")
+		}
+		if r.path, err = p.matchers.Compile(MatcherSpec{Kind: MatchRegex, Pattern: expr}); err != nil {
+			return fmt.Errorf("pathPattern: %v", err)
+		}
+	}
+	switch headers := m["headers"].(type) {
+	case nil:
+	case []interface{}:
+		for i, raw := range headers {
+			h, err := p.matchers.ParseHeader(raw)
+			if err != nil {
+				return fmt.Errorf("headers[%d]: %v", i, err)
+			}
+			r.headers = append(r.headers, h)
+		}
+	case map[string]interface{}:
+		for _, name := range sortedKeys(headers) {
+			s, ok := headers[name].(string)
+			if !ok {
+				return fmt.Errorf("headers.%s must be a string", name)
+			}
+			if err := p.addHeader(r, name, MatcherSpec{Kind: MatchExact, Pattern: s}); err != nil {
+				return fmt.Errorf("headers.%s: %v", name, err)
+			}
+		}
+	default:
+		return errors.New("headers must be a list of header matchers or an object mapping header names to values")
+	}
+	if v, ok := m["headerPatterns"]; ok {
+		headers, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("headerPatterns must be an object mapping header names to regular expressions")
+		}
+		for _, name := range sortedKeys(headers) {
+			expr, ok := headers[name].(string)
+			if !ok || expr == "" {
+				return fmt.Errorf("headerPatterns.%s must be a regular expression", name)
+			}
+			if err := p.addHeader(r, name, MatcherSpec{Kind: MatchRegex, Pattern: expr}); err != nil {
+				return fmt.Errorf("headerPatterns.%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addHeader adds a matcher for one entry of the headers or headerPatterns
+// objects
+func (p *RouteOverridePolicy) addHeader(r *rule, name string, spec MatcherSpec) error {
+	value, err := p.matchers.Compile(spec)
+	if err != nil {
+		return err
+	}
+	r.headers = append(r.headers, HeaderMatcher{Name: name, Value: value, Present: true})
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func parseTarget(m map[string]interface{}) (target, error) {
+	var t target
+	for name, dst := range map[string]*string{
+		"upstream": &t.Upstream,
+		"host":     &t.Host,
+		"path":     &t.Path,
+	} {
+		if v, ok := m[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return t, fmt.Errorf("%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+	if t.Host != "" && strings.ContainsAny(t.Host, "/@ \t") {
+		return t, errors.New("host must be a host name with an optional port")
+	}
+	if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+		return t, errors.New("path must start with a slash")
+	}
+	return t, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values := headerValues(headers, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	if values, ok := headers[name]; ok {
+		return values
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package schema_validator
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var operationMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// openapiDoc holds the request body schemas of every operation in an OpenAPI
+// 3.x or Swagger 2.0 document
+type openapiDoc struct {
+	operations []*operation
+}
+
+type operation struct {
+	id       string
+	method   string
+	template string
+	pathRe   *regexp.Regexp
+	params   int
+
+	// hasBody is false when the operation does not describe a request body
+	hasBody      bool
+	bodyRequired bool
+	content      []mediaSchema
+}
+
+// mediaSchema is the schema for one media type range, e.g. application/json
+// or application/*. schema is nil when the media type is listed without one.
+type mediaSchema struct {
+	mediaType string
+	schema    *schema
+}
+
+func compileOpenAPI(doc interface{}, formats bool) (*openapiDoc, error) {
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("OpenAPI document must be an object")
+	}
+	paths, ok := root["paths"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("OpenAPI document has no paths")
+	}
+	_, swagger := root["swagger"]
+	c := newCompiler(root, formats)
+
+	out := &openapiDoc{}
+	for template, rawItem := range paths {
+		item, ok := rawItem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pathRe, params, err := compileTemplate(template)
+		if err != nil {
+			return nil, err
+		}
+		for _, method := range operationMethods {
+			rawOp, ok := item[method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			op := &operation{
+				method:   strings.ToUpper(method),
+				template: template,
+				pathRe:   pathRe,
+				params:   params,
+			}
+			op.id, _ = rawOp["operationId"].(string)
+			at := "#/paths/" + escapePointer(template) + "/" + method
+			if swagger {
+				err = c.swaggerBody(op, root, item, rawOp, at)
+			} else {
+				err = c.requestBody(op, rawOp, at)
+			}
+			if err != nil {
+				return nil, err
+			}
+			out.operations = append(out.operations, op)
+		}
+	}
+
+	// Concrete paths win over templated ones, as OpenAPI requires
+	sort.SliceStable(out.operations, func(i, j int) bool {
+		a, b := out.operations[i], out.operations[j]
+		if a.params != b.params {
+			return a.params < b.params
+		}
+		return len(a.template) > len(b.template)
+	})
+	return out, nil
+}
+
+// requestBody reads an OpenAPI 3.x requestBody
+func (c *compiler) requestBody(op *operation, rawOp map[string]interface{}, at string) error {
+	raw, ok := rawOp["requestBody"]
+	if !ok {
+		return nil
+	}
+	body, err := c.deref(raw)
+	if err != nil {
+		return fmt.Errorf("%s/requestBody: %v", at, err)
+	}
+	op.hasBody = true
+	op.bodyRequired, _ = body["required"].(bool)
+
+	content, _ := body["content"].(map[string]interface{})
+	for mediaType, rawMedia := range content {
+		ms := mediaSchema{mediaType: baseMediaType(mediaType)}
+		if media, ok := rawMedia.(map[string]interface{}); ok {
+			if rawSchema, ok := media["schema"]; ok {
+				if ms.schema, err = c.compile(rawSchema, at+"/requestBody/content/"+escapePointer(mediaType)+"/schema"); err != nil {
+					return err
+				}
+			}
+		}
+		op.content = append(op.content, ms)
+	}
+	return nil
+}
+
+// swaggerBody reads the body parameter of a Swagger 2.0 operation
+func (c *compiler) swaggerBody(op *operation, root, item, rawOp map[string]interface{}, at string) error {
+	var params []interface{}
+	if list, ok := item["parameters"].([]interface{}); ok {
+		params = append(params, list...)
+	}
+	if list, ok := rawOp["parameters"].([]interface{}); ok {
+		params = append(params, list...)
+	}
+	for _, raw := range params {
+		param, err := c.deref(raw)
+		if err != nil {
+			return fmt.Errorf("%s/parameters: %v", at, err)
+		}
+		if in, _ := param["in"].(string); in != "body" {
+			continue
+		}
+		op.hasBody = true
+		op.bodyRequired, _ = param["required"].(bool)
+		s, err := c.compile(param["schema"], at+"/parameters/body/schema")
+		if err != nil {
+			return err
+		}
+
+		consumes, _ := rawOp["consumes"].([]interface{})
+		if consumes == nil {
+			consumes, _ = root["consumes"].([]interface{})
+		}
+		if consumes == nil {
+			consumes = []interface{}{"application/json"}
+		}
+		for _, mt := range consumes {
+			if mediaType, ok := mt.(string); ok {
+				op.content = append(op.content, mediaSchema{mediaType: baseMediaType(mediaType), schema: s})
+			}
+		}
+	}
+	return nil
+}
+
+// deref follows a $ref to a request body or parameter object
+func (c *compiler) deref(raw interface{}) (map[string]interface{}, error) {
+	for i := 0; i < 10; i++ {
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("must be an object")
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m, nil
+		}
+		if !strings.HasPrefix(ref, "#") {
+			return nil, fmt.Errorf("$ref %q: only references within the same document are supported", ref)
+		}
+		target, err := lookupPointer(c.root, ref[1:])
+		if err != nil {
+			return nil, fmt.Errorf("$ref %q: %v", ref, err)
+		}
+		raw = target
+	}
+	return nil, errors.New("too many nested references")
+}
+
+// compileTemplate turns /pets/{petId} into a pattern matching one segment per
+// parameter
+func compileTemplate(template string) (*regexp.Regexp, int, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	params := 0
+	rest := template
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			expr.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, 0, fmt.Errorf("path %q has an unclosed parameter", template)
+		}
+		expr.WriteString(regexp.QuoteMeta(rest[:open]))
+		expr.WriteString("[^/]+")
+		params++
+		rest = rest[open+end+1:]
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	return re, params, err
+}
+
+// find returns the operation for a request. With an operationId the request
+// path is not consulted.
+func (d *openapiDoc) find(operationID, method, path string) *operation {
+	for _, op := range d.operations {
+		if operationID != "" {
+			if op.id == operationID {
+				return op
+			}
+			continue
+		}
+		if op.method == method && op.pathRe.MatchString(path) {
+			return op
+		}
+	}
+	return nil
+}
+
+func (d *openapiDoc) hasOperation(id string) bool {
+	return d.find(id, "", "") != nil
+}
+
+// media picks the schema for a request media type: an exact match first, then
+// type/*, then */*
+func (op *operation) media(mediaType string) (mediaSchema, bool) {
+	ranges := []string{mediaType}
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		ranges = append(ranges, mediaType[:i]+"/*")
+	}
+	ranges = append(ranges, "*/*")
+	for _, r := range ranges {
+		for _, ms := range op.content {
+			if ms.mediaType == r {
+				return ms, true
+			}
+		}
+	}
+	return mediaSchema{}, false
+}
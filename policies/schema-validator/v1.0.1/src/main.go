@@ -0,0 +1,541 @@
+package schema_validator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+type UpstreamResponseModifications struct {
+	SetHeaders map[string]string
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// violationsKey carries violations found in softFail mode to the response phase
+const violationsKey = "schema-validator.violations"
+
+const (
+	defaultWarningHeader = "X-Schema-Violations"
+	defaultMaxViolations = 10
+)
+
+type SchemaValidatorPolicy struct {
+	mu      sync.Mutex
+	entries map[string]*sourceEntry
+}
+
+type validatorConfig struct {
+	Source        schemaSource
+	SoftFail      bool
+	WarningHeader string
+	MaxViolations int
+	BodyRequired  bool
+}
+
+// Validate configuration parameters
+func (p *SchemaValidatorPolicy) Validate(params map[string]interface{}) error {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return err
+	}
+	// Inline schemas are compiled now so mistakes surface at deploy time;
+	// files and URLs are loaded on first use
+	if cfg.Source.static() {
+		c, err := p.entry(cfg.Source).get(cfg.Source)
+		if err != nil {
+			return err
+		}
+		if id := cfg.Source.OperationID; id != "" && !c.doc.hasOperation(id) {
+			return fmt.Errorf("openapi.operationId: operation %q not found", id)
+		}
+	}
+	return nil
+}
+
+// Declare processing behavior
+func (p *SchemaValidatorPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeBuffer,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *SchemaValidatorPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return unavailable()
+	}
+
+	c, err := p.entry(cfg.Source).get(cfg.Source)
+	var violations []violation
+	if err != nil {
+		if !cfg.SoftFail {
+			// Without a schema nothing can be vouched for
+			return unavailable()
+		}
+		violations = []violation{{Message: "schema is unavailable: " + err.Error()}}
+	} else {
+		violations = cfg.check(c, ctx)
+	}
+
+	if len(violations) == 0 {
+		return UpstreamRequestModifications{}
+	}
+	if !cfg.SoftFail {
+		return rejected(violations)
+	}
+	if ctx.SharedContext != nil {
+		ctx.SharedContext.Set(violationsKey, violations)
+	}
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (p *SchemaValidatorPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	if ctx.SharedContext == nil {
+		return UpstreamResponseModifications{}
+	}
+	v, ok := ctx.SharedContext.Get(violationsKey)
+	violations, _ := v.([]violation)
+	if !ok || len(violations) == 0 {
+		return UpstreamResponseModifications{}
+	}
+	header := defaultWarningHeader
+	if s, ok := params["warningHeader"].(string); ok && s != "" {
+		header = s
+	}
+	return UpstreamResponseModifications{SetHeaders: map[string]string{header: warning(violations)}}
+}
+
+// check validates the request body and returns what is wrong with it
+func (cfg validatorConfig) check(c *compiled, ctx *RequestContext) []violation {
+	body := ctx.Body.Bytes()
+	mediaType := baseMediaType(ctx.Body.ContentType())
+	if mediaType == "" {
+		mediaType = baseMediaType(headerValue(ctx.Headers, "Content-Type"))
+	}
+
+	s := c.schema
+	required := cfg.BodyRequired
+	if c.doc != nil {
+		path := ctx.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		if cfg.Source.BasePath != "" {
+			trimmed, ok := strings.CutPrefix(path, cfg.Source.BasePath)
+			if !ok || (trimmed != "" && trimmed[0] != '/') {
+				return nil
+			}
+			path = trimmed
+		}
+		op := c.doc.find(cfg.Source.OperationID, strings.ToUpper(ctx.Method), path)
+		if op == nil {
+			if cfg.Source.OperationID != "" {
+				return []violation{{Message: fmt.Sprintf("operation %q not found", cfg.Source.OperationID)}}
+			}
+			// Requests the document does not describe are not validated
+			return nil
+		}
+		if !op.hasBody {
+			return nil
+		}
+		if len(body) == 0 {
+			if op.bodyRequired {
+				return []violation{{Message: "request body is required"}}
+			}
+			return nil
+		}
+		ms, ok := op.media(mediaType)
+		if !ok {
+			return []violation{{Message: fmt.Sprintf("content type %q is not accepted", mediaType)}}
+		}
+		if ms.schema == nil || !isJSON(mediaType) {
+			// Only JSON bodies can be checked against a schema
+			return nil
+		}
+		s = ms.schema
+	} else {
+		if len(body) == 0 {
+			if required {
+				return []violation{{Message: "request body is required"}}
+			}
+			return nil
+		}
+		if mediaType != "" && !isJSON(mediaType) {
+			return []violation{{Message: fmt.Sprintf("content type %q is not JSON", mediaType)}}
+		}
+	}
+
+	instance, err := decodeJSON(body)
+	if err != nil {
+		return []violation{{Message: "request body is not valid JSON: " + err.Error()}}
+	}
+	errs := &collector{limit: cfg.MaxViolations}
+	s.validate(instance, "", errs)
+	return errs.list
+}
+
+// entry returns the cache slot for a source
+func (p *SchemaValidatorPolicy) entry(src schemaSource) *sourceEntry {
+	id := src.id()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.entries == nil {
+		p.entries = make(map[string]*sourceEntry)
+	}
+	e, ok := p.entries[id]
+	if !ok {
+		e = &sourceEntry{}
+		p.entries[id] = e
+	}
+	return e
+}
+
+func parseConfig(params map[string]interface{}) (validatorConfig, error) {
+	cfg := validatorConfig{
+		WarningHeader: defaultWarningHeader,
+		MaxViolations: defaultMaxViolations,
+		BodyRequired:  true,
+	}
+
+	formats := true
+	for name, dst := range map[string]*bool{
+		"softFail":        &cfg.SoftFail,
+		"bodyRequired":    &cfg.BodyRequired,
+		"validateFormats": &formats,
+	} {
+		if v, ok := params[name]; ok {
+			b, ok := v.(bool)
+			if !ok {
+				return cfg, fmt.Errorf("%s must be a boolean", name)
+			}
+			*dst = b
+		}
+	}
+
+	if v, ok := params["warningHeader"]; ok {
+		s, ok := v.(string)
+		if !ok || s == "" || strings.ContainsAny(s, " :\r\n") {
+			return cfg, errors.New("warningHeader must be a header name")
+		}
+		cfg.WarningHeader = s
+	}
+	if v, ok := params["maxViolations"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int(f)) {
+			return cfg, errors.New("maxViolations must be a positive integer")
+		}
+		cfg.MaxViolations = int(f)
+	}
+
+	src, err := parseSource(params, formats)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Source = src
+	return cfg, nil
+}
+
+func rejected(violations []violation) ImmediateResponse {
+	body, _ := json.Marshal(struct {
+		Error      string      `json:"error"`
+		Violations []violation `json:"violations"`
+	}{"Request validation failed", violations})
+	return ImmediateResponse{
+		Status:  400,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    string(body),
+	}
+}
+
+func unavailable() ImmediateResponse {
+	return ImmediateResponse{
+		Status:  500,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    `{"error": "Request validation is unavailable"}`,
+	}
+}
+
+// warning summarises violations in one header value, e.g.
+// "2 violations; /age: must be at least 0"
+func warning(violations []violation) string {
+	first := violations[0]
+	msg := first.Message
+	if first.Path != "" {
+		msg = first.Path + ": " + msg
+	}
+	noun := "violations"
+	if len(violations) == 1 {
+		noun = "violation"
+	}
+	s := fmt.Sprintf("%d %s; %s", len(violations), noun, msg)
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+func baseMediaType(ct string) string {
+	mediaType, _, _ := strings.Cut(ct, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,789 @@
+package schema_validator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// schema is a compiled JSON Schema. It covers the validation vocabulary of
+// draft 2020-12 and the draft-07 and OpenAPI 3.0 spellings that differ from it
+// (tuple items, boolean exclusive bounds, nullable). Annotations are ignored.
+type schema struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+	ref    *schema
+
+	types    []string
+	nullable bool
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties        map[string]*schema
+	patternProperties []patternSchema
+	additional        *schema
+	propertyNames     *schema
+	required          []string
+	dependentRequired map[string][]string
+	minProperties     int
+	maxProperties     int
+
+	prefixItems []*schema
+	items       *schema
+	contains    *schema
+	minItems    int
+	maxItems    int
+	uniqueItems bool
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+	format    string
+
+	minimum          *big.Rat
+	maximum          *big.Rat
+	exclusiveMinimum *big.Rat
+	exclusiveMaximum *big.Rat
+	multipleOf       *big.Rat
+
+	allOf []*schema
+	anyOf []*schema
+	oneOf []*schema
+	not   *schema
+	ifS   *schema
+	thenS *schema
+	elseS *schema
+}
+
+type patternSchema struct {
+	re     *regexp.Regexp
+	schema *schema
+}
+
+// compiler turns decoded schema documents into schemas. $ref pointers are
+// resolved against root, which is the schema itself or the OpenAPI document
+// that contains it.
+type compiler struct {
+	root    interface{}
+	byRef   map[string]*schema
+	formats bool
+}
+
+func newCompiler(root interface{}, formats bool) *compiler {
+	return &compiler{root: root, byRef: map[string]*schema{}, formats: formats}
+}
+
+func (c *compiler) compile(node interface{}, at string) (*schema, error) {
+	switch v := node.(type) {
+	case bool:
+		return &schema{always: &v}, nil
+	case map[string]interface{}:
+		s := &schema{minProperties: -1, maxProperties: -1, minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+		if err := c.compileObject(s, v, at); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s: a schema must be an object or a boolean", at)
+}
+
+func (c *compiler) compileObject(s *schema, m map[string]interface{}, at string) error {
+	var err error
+	if ref, ok := m["$ref"].(string); ok {
+		if s.ref, err = c.resolve(ref); err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("%s/type: must be a string or a list of strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fmt.Errorf("%s/type: must be a string or a list of strings", at)
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("%s/type: unknown type %q", at, t)
+		}
+	}
+	s.nullable, _ = m["nullable"].(bool)
+
+	if v, ok := m["enum"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s/enum: must be a list", at)
+		}
+		s.enum = list
+	}
+	if v, ok := m["const"]; ok {
+		s.constant, s.hasConst = v, true
+	}
+
+	// Object keywords
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/properties: must be an object", at)
+		}
+		s.properties = make(map[string]*schema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = c.compile(sub, at+"/properties/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	if v, ok := m["patternProperties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/patternProperties: must be an object", at)
+		}
+		for expr, sub := range props {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("%s/patternProperties: invalid pattern %q: %v", at, expr, err)
+			}
+			ss, err := c.compile(sub, at+"/patternProperties/"+escapePointer(expr))
+			if err != nil {
+				return err
+			}
+			s.patternProperties = append(s.patternProperties, patternSchema{re: re, schema: ss})
+		}
+	}
+	if s.additional, err = c.optional(m, "additionalProperties", at); err != nil {
+		return err
+	}
+	if s.propertyNames, err = c.optional(m, "propertyNames", at); err != nil {
+		return err
+	}
+	if s.required, err = stringsOf(m["required"], at+"/required"); err != nil {
+		return err
+	}
+	if v, ok := m["dependentRequired"]; ok {
+		deps, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/dependentRequired: must be an object", at)
+		}
+		s.dependentRequired = make(map[string][]string, len(deps))
+		for name, list := range deps {
+			if s.dependentRequired[name], err = stringsOf(list, at+"/dependentRequired/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	for name, dst := range map[string]*int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	} {
+		if v, ok := m[name]; ok {
+			n, ok := nonNegativeInt(v)
+			if !ok {
+				return fmt.Errorf("%s/%s: must be a non-negative integer", at, name)
+			}
+			*dst = n
+		}
+	}
+
+	// Array keywords. A list under items is the draft-07 tuple form.
+	if v, ok := m["prefixItems"]; ok {
+		if s.prefixItems, err = c.list(v, at+"/prefixItems"); err != nil {
+			return err
+		}
+	}
+	if v, ok := m["items"].([]interface{}); ok {
+		if s.prefixItems, err = c.list(v, at+"/items"); err != nil {
+			return err
+		}
+		if s.items, err = c.optional(m, "additionalItems", at); err != nil {
+			return err
+		}
+	} else if s.items, err = c.optional(m, "items", at); err != nil {
+		return err
+	}
+	if s.contains, err = c.optional(m, "contains", at); err != nil {
+		return err
+	}
+	s.uniqueItems, _ = m["uniqueItems"].(bool)
+
+	// String keywords
+	if v, ok := m["pattern"]; ok {
+		expr, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern: must be a string", at)
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("%s/pattern: invalid pattern %q: %v", at, expr, err)
+		}
+	}
+	if c.formats {
+		s.format, _ = m["format"].(string)
+	}
+
+	// Numeric keywords
+	for name, dst := range map[string]**big.Rat{
+		"minimum":    &s.minimum,
+		"maximum":    &s.maximum,
+		"multipleOf": &s.multipleOf,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = rat(v); !ok {
+				return fmt.Errorf("%s/%s: must be a number", at, name)
+			}
+		}
+	}
+	if s.multipleOf != nil && s.multipleOf.Sign() <= 0 {
+		return fmt.Errorf("%s/multipleOf: must be greater than 0", at)
+	}
+	for name, bound := range map[string]struct {
+		dst       **big.Rat
+		inclusive **big.Rat
+	}{
+		"exclusiveMinimum": {&s.exclusiveMinimum, &s.minimum},
+		"exclusiveMaximum": {&s.exclusiveMaximum, &s.maximum},
+	} {
+		switch v := m[name].(type) {
+		case nil:
+		case bool:
+			// Draft-04 and OpenAPI 3.0 turn the plain bound exclusive
+			if v && *bound.inclusive != nil {
+				*bound.dst, *bound.inclusive = *bound.inclusive, nil
+			}
+		default:
+			r, ok := rat(v)
+			if !ok {
+				return fmt.Errorf("%s/%s: must be a number", at, name)
+			}
+			*bound.dst = r
+		}
+	}
+
+	// Applicators
+	for name, dst := range map[string]*[]*schema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, err = c.list(v, at+"/"+name); err != nil {
+				return err
+			}
+			if len(*dst) == 0 {
+				return fmt.Errorf("%s/%s: must not be empty", at, name)
+			}
+		}
+	}
+	for name, dst := range map[string]**schema{
+		"not":  &s.not,
+		"if":   &s.ifS,
+		"then": &s.thenS,
+		"else": &s.elseS,
+	} {
+		if *dst, err = c.optional(m, name, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) optional(m map[string]interface{}, name, at string) (*schema, error) {
+	v, ok := m[name]
+	if !ok {
+		return nil, nil
+	}
+	return c.compile(v, at+"/"+name)
+}
+
+func (c *compiler) list(v interface{}, at string) ([]*schema, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a list of schemas", at)
+	}
+	out := make([]*schema, len(items))
+	for i, item := range items {
+		s, err := c.compile(item, at+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// resolve compiles the schema a local reference points to. The placeholder is
+// registered before compiling so recursive schemas terminate.
+func (c *compiler) resolve(ref string) (*schema, error) {
+	if s, ok := c.byRef[ref]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("$ref %q: only references within the same document are supported", ref)
+	}
+	target, err := lookupPointer(c.root, ref[1:])
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %v", ref, err)
+	}
+
+	s := &schema{minProperties: -1, maxProperties: -1, minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	c.byRef[ref] = s
+	switch v := target.(type) {
+	case bool:
+		s.always = &v
+	case map[string]interface{}:
+		if err := c.compileObject(s, v, ref); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("$ref %q does not point to a schema", ref)
+	}
+	return s, nil
+}
+
+// lookupPointer follows an RFC 6901 JSON pointer such as /components/schemas/Pet
+func lookupPointer(doc interface{}, pointer string) (interface{}, error) {
+	if pointer == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("fragment must be a JSON pointer")
+	}
+	v := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", token)
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("index %q not found", token)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("%q not found", token)
+		}
+	}
+	return v, nil
+}
+
+// violation is one reason an instance does not match
+type violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// collector gathers violations up to a limit. A limit of 1 is used to probe
+// subschemas of anyOf, oneOf, not and if, where only the verdict matters.
+type collector struct {
+	list  []violation
+	limit int
+}
+
+func (c *collector) add(path, format string, args ...interface{}) {
+	if len(c.list) < c.limit {
+		c.list = append(c.list, violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (c *collector) full() bool {
+	return len(c.list) >= c.limit
+}
+
+func (s *schema) matches(v interface{}) bool {
+	probe := &collector{limit: 1}
+	s.validate(v, "", probe)
+	return len(probe.list) == 0
+}
+
+// validate checks v, whose location in the document is the JSON pointer path
+func (s *schema) validate(v interface{}, path string, errs *collector) {
+	if errs.full() {
+		return
+	}
+	if s.always != nil {
+		if !*s.always {
+			errs.add(path, "no value is allowed here")
+		}
+		return
+	}
+	if s.ref != nil {
+		s.ref.validate(v, path, errs)
+	}
+
+	if v == nil && s.nullable {
+		return
+	}
+	if len(s.types) > 0 && !typeMatches(s.types, v) {
+		errs.add(path, "must be of type %s, got %s", strings.Join(s.types, " or "), typeName(v))
+		return
+	}
+	if s.hasConst && !jsonEqual(v, s.constant) {
+		errs.add(path, "must be %s", render(s.constant))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs.add(path, "must be one of %s", render(s.enum))
+		}
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(value, path, errs)
+	case []interface{}:
+		s.validateArray(value, path, errs)
+	case string:
+		s.validateString(value, path, errs)
+	case json.Number:
+		s.validateNumber(value, path, errs)
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.matches(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs.add(path, "must match at least one of the anyOf schemas")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.matches(v) {
+				n++
+			}
+		}
+		if n != 1 {
+			errs.add(path, "must match exactly one of the oneOf schemas, matched %d", n)
+		}
+	}
+	if s.not != nil && s.not.matches(v) {
+		errs.add(path, "must not match the not schema")
+	}
+	if s.ifS != nil {
+		if s.ifS.matches(v) {
+			if s.thenS != nil {
+				s.thenS.validate(v, path, errs)
+			}
+		} else if s.elseS != nil {
+			s.elseS.validate(v, path, errs)
+		}
+	}
+}
+
+func (s *schema) validateObject(obj map[string]interface{}, path string, errs *collector) {
+	if s.minProperties >= 0 && len(obj) < s.minProperties {
+		errs.add(path, "must have at least %d properties", s.minProperties)
+	}
+	if s.maxProperties >= 0 && len(obj) > s.maxProperties {
+		errs.add(path, "must have at most %d properties", s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			errs.add(path, "missing required property %q", name)
+		}
+	}
+	for name, deps := range s.dependentRequired {
+		if _, ok := obj[name]; !ok {
+			continue
+		}
+		for _, dep := range deps {
+			if _, ok := obj[dep]; !ok {
+				errs.add(path, "property %q requires property %q", name, dep)
+			}
+		}
+	}
+
+	// Sorted so the reported violations are stable between requests
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := obj[name]
+		at := path + "/" + escapePointer(name)
+		if s.propertyNames != nil && !s.propertyNames.matches(name) {
+			errs.add(at, "property name %q is not allowed", name)
+		}
+		known := false
+		if sub, ok := s.properties[name]; ok {
+			known = true
+			sub.validate(value, at, errs)
+		}
+		for _, ps := range s.patternProperties {
+			if ps.re.MatchString(name) {
+				known = true
+				ps.schema.validate(value, at, errs)
+			}
+		}
+		if !known && s.additional != nil {
+			if s.additional.always != nil && !*s.additional.always {
+				errs.add(at, "property %q is not allowed", name)
+			} else {
+				s.additional.validate(value, at, errs)
+			}
+		}
+	}
+}
+
+func (s *schema) validateArray(arr []interface{}, path string, errs *collector) {
+	if s.minItems >= 0 && len(arr) < s.minItems {
+		errs.add(path, "must have at least %d items", s.minItems)
+	}
+	if s.maxItems >= 0 && len(arr) > s.maxItems {
+		errs.add(path, "must have at most %d items", s.maxItems)
+	}
+	for i, item := range arr {
+		at := path + "/" + strconv.Itoa(i)
+		if i < len(s.prefixItems) {
+			s.prefixItems[i].validate(item, at, errs)
+		} else if s.items != nil {
+			if s.items.always != nil && !*s.items.always {
+				errs.add(path, "must have at most %d items", len(s.prefixItems))
+				break
+			}
+			s.items.validate(item, at, errs)
+		}
+	}
+	if s.contains != nil {
+		found := false
+		for _, item := range arr {
+			if s.contains.matches(item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs.add(path, "must contain an item matching the contains schema")
+		}
+	}
+	if s.uniqueItems {
+		for i := 1; i < len(arr); i++ {
+			for j := 0; j < i; j++ {
+				if jsonEqual(arr[i], arr[j]) {
+					errs.add(path, "items %d and %d are equal", j, i)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *schema) validateString(str, path string, errs *collector) {
+	n := utf8.RuneCountInString(str)
+	if s.minLength >= 0 && n < s.minLength {
+		errs.add(path, "must be at least %d characters long", s.minLength)
+	}
+	if s.maxLength >= 0 && n > s.maxLength {
+		errs.add(path, "must be at most %d characters long", s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		errs.add(path, "must match the pattern %q", s.pattern.String())
+	}
+	if s.format != "" {
+		if check, ok := formats[s.format]; ok && !check(str) {
+			errs.add(path, "must be a valid %s", s.format)
+		}
+	}
+}
+
+func (s *schema) validateNumber(num json.Number, path string, errs *collector) {
+	r, ok := rat(num)
+	if !ok {
+		return
+	}
+	if s.minimum != nil && r.Cmp(s.minimum) < 0 {
+		errs.add(path, "must be at least %s", decimal(s.minimum))
+	}
+	if s.maximum != nil && r.Cmp(s.maximum) > 0 {
+		errs.add(path, "must be at most %s", decimal(s.maximum))
+	}
+	if s.exclusiveMinimum != nil && r.Cmp(s.exclusiveMinimum) <= 0 {
+		errs.add(path, "must be greater than %s", decimal(s.exclusiveMinimum))
+	}
+	if s.exclusiveMaximum != nil && r.Cmp(s.exclusiveMaximum) >= 0 {
+		errs.add(path, "must be less than %s", decimal(s.exclusiveMaximum))
+	}
+	if s.multipleOf != nil && !new(big.Rat).Quo(r, s.multipleOf).IsInt() {
+		errs.add(path, "must be a multiple of %s", decimal(s.multipleOf))
+	}
+}
+
+func typeMatches(types []string, v interface{}) bool {
+	actual := typeName(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName reports the JSON type of a decoded value. Numbers with an integer
+// value are "integer", including 1.0.
+func typeName(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if r, ok := rat(value); ok && r.IsInt() {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares decoded values; numbers compare by value, so 1 equals 1.0
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number, float64:
+		r1, ok1 := rat(a)
+		r2, ok2 := rat(b)
+		return ok1 && ok2 && r1.Cmp(r2) == 0
+	}
+	return a == b
+}
+
+// rat converts a schema or instance number to an exact rational
+func rat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(n) == nil {
+			return nil, false
+		}
+		// Parameters arrive as float64; use their shortest decimal form so
+		// multipleOf: 0.1 means 1/10 rather than the nearest binary fraction
+		return r.SetString(strconv.FormatFloat(n, 'g', -1, 64))
+	}
+	return nil, false
+}
+
+// decimal formats a bound for messages, e.g. 0.01 rather than 1/100
+func decimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func nonNegativeInt(v interface{}) (int, bool) {
+	r, ok := rat(v)
+	if !ok || !r.IsInt() || r.Sign() < 0 || !r.Num().IsInt64() {
+		return 0, false
+	}
+	return int(r.Num().Int64()), true
+}
+
+func stringsOf(v interface{}, at string) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a list of strings", at)
+	}
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a list of strings", at)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+// render shows a schema value in a violation message
+func render(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(buf.String())
+}
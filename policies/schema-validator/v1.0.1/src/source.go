@@ -0,0 +1,247 @@
+package schema_validator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReloadInterval = 5 * time.Minute
+	fetchTimeout          = 5 * time.Second
+	retryInterval         = 5 * time.Second
+	maxDocumentSize       = 8 << 20
+)
+
+// schemaSource says where the schema for a request comes from: an inline JSON
+// Schema, or the request body schema of an operation in an OpenAPI document
+// given inline, as a file or as a URL.
+type schemaSource struct {
+	Schema      interface{}   `json:"schema,omitempty"`
+	Spec        interface{}   `json:"spec,omitempty"`
+	File        string        `json:"file,omitempty"`
+	URL         string        `json:"url,omitempty"`
+	Formats     bool          `json:"formats"`
+	Reload      time.Duration `json:"reload"`
+	OperationID string        `json:"-"`
+	BasePath    string        `json:"-"`
+}
+
+func (s schemaSource) openapi() bool {
+	return s.Schema == nil
+}
+
+// static sources never change, so they are compiled once
+func (s schemaSource) static() bool {
+	return s.File == "" && s.URL == ""
+}
+
+// id identifies sources that compile to the same result
+func (s schemaSource) id() string {
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func parseSource(params map[string]interface{}, formats bool) (schemaSource, error) {
+	src := schemaSource{Formats: formats, Reload: defaultReloadInterval}
+	rawSchema, hasSchema := params["schema"]
+	rawSpec, hasSpec := params["openapi"]
+	if hasSchema == hasSpec {
+		return src, errors.New("exactly one of schema and openapi must be set")
+	}
+
+	if hasSchema {
+		doc, err := documentValue(rawSchema, "schema")
+		if err != nil {
+			return src, err
+		}
+		src.Schema = doc
+		return src, nil
+	}
+
+	m, ok := rawSpec.(map[string]interface{})
+	if !ok {
+		return src, errors.New("openapi must be an object")
+	}
+	found := 0
+	if v, ok := m["spec"]; ok {
+		doc, err := documentValue(v, "openapi.spec")
+		if err != nil {
+			return src, err
+		}
+		src.Spec = doc
+		found++
+	}
+	if v, ok := m["file"]; ok {
+		if src.File, ok = v.(string); !ok || src.File == "" {
+			return src, errors.New("openapi.file must be a path")
+		}
+		found++
+	}
+	if v, ok := m["url"]; ok {
+		if src.URL, ok = v.(string); !ok || !(strings.HasPrefix(src.URL, "https://") || strings.HasPrefix(src.URL, "http://")) {
+			return src, errors.New("openapi.url must be an http(s) URL")
+		}
+		found++
+	}
+	if found != 1 {
+		return src, errors.New("openapi must set exactly one of spec, file and url")
+	}
+
+	for name, dst := range map[string]*string{
+		"operationId": &src.OperationID,
+		"basePath":    &src.BasePath,
+	} {
+		if v, ok := m[name]; ok {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return src, fmt.Errorf("openapi.%s must be a non-empty string", name)
+			}
+			*dst = s
+		}
+	}
+	if src.BasePath != "" && (!strings.HasPrefix(src.BasePath, "/") || strings.HasSuffix(src.BasePath, "/")) {
+		return src, errors.New("openapi.basePath must start with a slash and not end with one")
+	}
+	if v, ok := m["reloadIntervalSeconds"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int64(f)) {
+			return src, errors.New("openapi.reloadIntervalSeconds must be a positive integer")
+		}
+		src.Reload = time.Duration(f) * time.Second
+	}
+	return src, nil
+}
+
+// documentValue accepts a decoded document or JSON text
+func documentValue(v interface{}, name string) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s must be an object or a JSON document", name)
+		}
+		return v, nil
+	}
+	doc, err := decodeJSON([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid JSON: %v", name, err)
+	}
+	return doc, nil
+}
+
+// compiled is a ready-to-use schema source
+type compiled struct {
+	schema *schema
+	doc    *openapiDoc
+}
+
+// sourceEntry caches one compiled source. Reloads hold the entry lock, so
+// concurrent requests wait for a single fetch instead of starting their own.
+type sourceEntry struct {
+	mu          sync.Mutex
+	compiled    *compiled
+	loadedAt    time.Time
+	lastAttempt time.Time
+	lastErr     error
+}
+
+func (e *sourceEntry) get(src schemaSource) (*compiled, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.compiled != nil && (src.static() || now.Sub(e.loadedAt) < src.Reload) {
+		return e.compiled, nil
+	}
+	if e.lastErr != nil && now.Sub(e.lastAttempt) < retryInterval {
+		if e.compiled != nil {
+			return e.compiled, nil
+		}
+		return nil, e.lastErr
+	}
+
+	e.lastAttempt = now
+	c, err := load(src)
+	if err != nil {
+		e.lastErr = err
+		// A reload failure keeps the last good document in use
+		if e.compiled != nil {
+			return e.compiled, nil
+		}
+		return nil, err
+	}
+	e.compiled, e.loadedAt, e.lastErr = c, now, nil
+	return c, nil
+}
+
+func load(src schemaSource) (*compiled, error) {
+	if !src.openapi() {
+		s, err := newCompiler(src.Schema, src.Formats).compile(src.Schema, "#")
+		if err != nil {
+			return nil, fmt.Errorf("schema: %v", err)
+		}
+		return &compiled{schema: s}, nil
+	}
+
+	doc := src.Spec
+	if doc == nil {
+		data, err := fetchDocument(src)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = decodeJSON(data); err != nil {
+			return nil, fmt.Errorf("OpenAPI document is not valid JSON: %v", err)
+		}
+	}
+	d, err := compileOpenAPI(doc, src.Formats)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: %v", err)
+	}
+	return &compiled{doc: d}, nil
+}
+
+func fetchDocument(src schemaSource) ([]byte, error) {
+	if src.File != "" {
+		f, err := os.Open(src.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxDocumentSize))
+	}
+
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OpenAPI document URL returned %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+}
+
+// decodeJSON keeps numbers as json.Number so bounds and values compare exactly
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after the document")
+	}
+	return v, nil
+}
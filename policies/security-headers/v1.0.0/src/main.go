@@ -0,0 +1,460 @@
+package security_headers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// hstsPreloadMinAge is the shortest max-age the HSTS preload list accepts
+const hstsPreloadMinAge = 31536000
+
+type SecurityHeadersPolicy struct{}
+
+type securityConfig struct {
+	// Headers are set on every response, in a stable order
+	Headers []HeaderOp
+	// Remove lists headers stripped from every response
+	Remove   []string
+	Override bool
+}
+
+// Validate configuration parameters
+func (p *SecurityHeadersPolicy) Validate(params map[string]interface{}) error {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return err
+	}
+	_, err = parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *SecurityHeadersPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeSkip,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase (not used)
+func (p *SecurityHeadersPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	return UpstreamRequestModifications{}
+}
+
+// Response phase execution
+func (p *SecurityHeadersPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+
+	var ops []HeaderOp
+	for _, name := range cfg.Remove {
+		ops = append(ops, HeaderOp{Op: HeaderOpRemove, Name: name})
+	}
+	for _, op := range cfg.Headers {
+		if !cfg.Override && hasHeader(ctx.ResponseHeaders, op.Name) {
+			// The upstream chose its own value
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return UpstreamResponseModifications{HeaderOps: ops}
+}
+
+// parseConfig turns the parameters, after the schema has checked them, into
+// the header operations to apply
+func parseConfig(params map[string]interface{}) (securityConfig, error) {
+	cfg := securityConfig{}
+	var errs paramErrors
+	set := func(name, value string) {
+		cfg.Headers = append(cfg.Headers, HeaderOp{Op: HeaderOpSet, Name: name, Value: value})
+	}
+
+	if hsts, _ := params["hsts"].(map[string]interface{}); hsts != nil {
+		if enabled, _ := hsts["enabled"].(bool); enabled {
+			maxAge, _ := hsts["maxAgeSeconds"].(float64)
+			includeSub, _ := hsts["includeSubDomains"].(bool)
+			preload, _ := hsts["preload"].(bool)
+			value := fmt.Sprintf("max-age=%d", int64(maxAge))
+			if includeSub {
+				value += "; includeSubDomains"
+			}
+			if preload {
+				// Browsers only preload hosts that commit to HSTS for all
+				// subdomains and at least a year
+				if !includeSub {
+					errs.add("hsts.preload", "requires hsts.includeSubDomains")
+				}
+				if maxAge < hstsPreloadMinAge {
+					errs.add("hsts.preload", fmt.Sprintf("requires hsts.maxAgeSeconds of at least %d", hstsPreloadMinAge))
+				}
+				value += "; preload"
+			}
+			set("Strict-Transport-Security", value)
+		}
+	}
+	if nosniff, _ := params["contentTypeOptions"].(bool); nosniff {
+		set("X-Content-Type-Options", "nosniff")
+	}
+	if v, _ := params["frameOptions"].(string); v != "" && v != "none" {
+		set("X-Frame-Options", v)
+	}
+	if v, _ := params["referrerPolicy"].(string); v != "" && v != "none" {
+		set("Referrer-Policy", v)
+	}
+	if csp, ok := params["contentSecurityPolicy"].(string); ok {
+		if strings.ContainsAny(csp, "\r\n") {
+			errs.add("contentSecurityPolicy", "must not contain line breaks")
+		}
+		name := "Content-Security-Policy"
+		if reportOnly, _ := params["cspReportOnly"].(bool); reportOnly {
+			name = "Content-Security-Policy-Report-Only"
+		}
+		set(name, csp)
+	}
+	cfg.Override, _ = params["override"].(bool)
+
+	list, _ := params["removeHeaders"].([]interface{})
+	for i, item := range list {
+		name, _ := item.(string)
+		path := fmt.Sprintf("removeHeaders[%d]", i)
+		switch {
+		case !validHeaderName(name):
+			errs.add(path, "must be a valid header name")
+		case setsHeader(cfg.Headers, name):
+			errs.add(path, fmt.Sprintf("removes %s, which the policy sets", name))
+		default:
+			cfg.Remove = append(cfg.Remove, name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+func setsHeader(ops []HeaderOp, name string) bool {
+	for _, op := range ops {
+		if strings.EqualFold(op.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasHeader(headers map[string][]string, name string) bool {
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
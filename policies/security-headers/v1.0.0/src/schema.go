@@ -0,0 +1,40 @@
+package security_headers
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "hsts": {
+      "type": "object",
+      "properties": {
+        "enabled": {"type": "boolean", "default": true},
+        "maxAgeSeconds": {"type": "integer", "minimum": 0, "default": 31536000},
+        "includeSubDomains": {"type": "boolean", "default": true},
+        "preload": {"type": "boolean", "default": false}
+      },
+      "default": {"enabled": true, "maxAgeSeconds": 31536000, "includeSubDomains": true, "preload": false}
+    },
+    "contentTypeOptions": {"type": "boolean", "default": true},
+    "frameOptions": {"type": "string", "enum": ["DENY", "SAMEORIGIN", "none"], "default": "DENY"},
+    "referrerPolicy": {
+      "type": "string",
+      "enum": [
+        "no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+        "same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url", "none"
+      ],
+      "default": "strict-origin-when-cross-origin"
+    },
+    "contentSecurityPolicy": {"type": "string", "minLength": 1},
+    "cspReportOnly": {"type": "boolean", "default": false},
+    "override": {"type": "boolean", "default": true},
+    "removeHeaders": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "default": ["Server", "X-Powered-By"]
+    }
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
@@ -0,0 +1,27 @@
+package set_header
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "definitions": {
+    "headerOp": {
+      "type": "object",
+      "properties": {
+        "op": {"type": "string", "enum": ["set", "append", "remove"]},
+        "name": {"type": "string"},
+        "value": {"type": "string"}
+      },
+      "required": ["op", "name"]
+    }
+  },
+  "properties": {
+    "request": {"type": "array", "items": {"$ref": "#/definitions/headerOp"}},
+    "response": {"type": "array", "items": {"$ref": "#/definitions/headerOp"}},
+    "headerName": {"type": "string"},
+    "headerValue": {"type": "string"}
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
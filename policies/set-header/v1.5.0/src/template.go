@@ -0,0 +1,145 @@
+package set_header
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateInput is what header value templates can read. Templates see the
+// exported fields and methods, e.g. {{.Method}} or {{.Header "X-Tenant"}}.
+type templateInput struct {
+	Method string
+	Path   string
+	Status int
+
+	headers        map[string][]string
+	requestHeaders map[string][]string
+	query          url.Values
+	shared         *SharedContext
+}
+
+// Header reads a header of the current phase
+func (in *templateInput) Header(name string) string {
+	return headerValue(in.headers, name)
+}
+
+// RequestHeader reads a request header, also in the response phase
+func (in *templateInput) RequestHeader(name string) string {
+	return headerValue(in.requestHeaders, name)
+}
+
+// Query reads a query parameter of the request
+func (in *templateInput) Query(name string) string {
+	return in.query.Get(name)
+}
+
+// Shared reads a value another policy stored in the SharedContext, such as
+// "consumer.id"
+func (in *templateInput) Shared(key string) string {
+	v, ok := in.shared.Get(key)
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+	"now": func() time.Time {
+		return time.Now().UTC()
+	},
+	"timestamp": func() string {
+		return time.Now().UTC().Format(time.RFC3339Nano)
+	},
+	"unixMillis": func() int64 {
+		return time.Now().UnixMilli()
+	},
+	"uuid": newUUID,
+}
+
+// templated reports whether a header value needs rendering. Values without
+// actions are sent as they are.
+func templated(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// anyTemplated reports whether any operation value needs rendering
+func anyTemplated(ops []HeaderOp) bool {
+	for _, op := range ops {
+		if templated(op.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// render resolves templated values. An operation whose template fails, or
+// renders to a value that is not a valid header value, is dropped.
+func (s *SetHeaderPolicy) render(ops []HeaderOp, in *templateInput) []HeaderOp {
+	out := make([]HeaderOp, 0, len(ops))
+	for _, op := range ops {
+		if templated(op.Value) {
+			t, err := s.template(op.Value)
+			if err != nil {
+				continue
+			}
+			var b strings.Builder
+			if err := t.Execute(&b, in); err != nil {
+				continue
+			}
+			op.Value = b.String()
+			if strings.ContainsAny(op.Value, "\r\n") {
+				continue
+			}
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+// template parses a header value template once per policy instance
+func (s *SetHeaderPolicy) template(text string) (*template.Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.templates[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("value").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if s.templates == nil {
+		s.templates = make(map[string]*template.Template)
+	}
+	s.templates[text] = t
+	return t, nil
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
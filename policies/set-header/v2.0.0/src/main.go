@@ -0,0 +1,543 @@
+package set_header
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// Compiler is implemented by policies that read their parameters once, when
+// a route is configured, rather than on every request. The gateway calls
+// Compile after Validate succeeds and runs the phases of the CompiledPolicy
+// in place of OnRequest and OnResponse, so the parameters map is not decoded
+// and type-asserted on the hot path. OnRequest and OnResponse remain for
+// gateways that do not compile policies.
+type Compiler interface {
+	Compile(params map[string]interface{}) (CompiledPolicy, error)
+}
+
+// CompiledPolicy is a policy bound to the parameters of one route. Every
+// request of the route shares it, so it must be safe for concurrent use. The
+// gateway only reads the actions it returns, so a phase may return the same
+// *UpstreamRequestModifications for every request and allocate nothing.
+type CompiledPolicy interface {
+	OnRequest(ctx *RequestContext) RequestAction
+	OnResponse(ctx *ResponseContext) ResponseAction
+}
+
+// requestKey carries request attributes to response phase templates
+const requestKey = "set-header.request"
+
+type SetHeaderPolicy struct {
+	mu        sync.Mutex
+	templates map[string]*template.Template
+}
+
+type headerConfig struct {
+	Request  []HeaderOp
+	Response []HeaderOp
+	// EnvPrefix starts the names of the variables env may read
+	EnvPrefix string
+}
+
+// compiledHeaders is the policy bound to the parameters of one route
+type compiledHeaders struct {
+	policy *SetHeaderPolicy
+	cfg    headerConfig
+	// request and response are returned for every request when no value of
+	// the phase is templated, and are nil otherwise
+	request  *UpstreamRequestModifications
+	response *UpstreamResponseModifications
+}
+
+var _ Compiler = (*SetHeaderPolicy)(nil)
+
+// Validate configuration parameters
+func (s *SetHeaderPolicy) Validate(params map[string]interface{}) error {
+	_, err := s.compile(params)
+	return err
+}
+
+// Compile parameters once per route
+func (s *SetHeaderPolicy) Compile(params map[string]interface{}) (CompiledPolicy, error) {
+	c, err := s.compile(params)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *SetHeaderPolicy) compile(params map[string]interface{}) (*compiledHeaders, error) {
+	params, err := parameters.apply(params)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	var errs paramErrors
+	for _, phase := range []struct {
+		name string
+		ops  []HeaderOp
+	}{{"request", cfg.Request}, {"response", cfg.Response}} {
+		for i, op := range phase.ops {
+			if !templated(op.Value) {
+				continue
+			}
+			if _, err := s.template(op.Value, cfg.EnvPrefix); err != nil {
+				errs.add(fmt.Sprintf("%s[%d].value", phase.name, i), err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	c := &compiledHeaders{policy: s, cfg: cfg}
+	if !anyTemplated(cfg.Request) {
+		c.request = &UpstreamRequestModifications{HeaderOps: cfg.Request}
+	}
+	if !anyTemplated(cfg.Response) {
+		c.response = &UpstreamResponseModifications{HeaderOps: cfg.Response}
+	}
+	return c, nil
+}
+
+// Declare processing behavior
+func (s *SetHeaderPolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeProcess,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (s *SetHeaderPolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	c, err := s.compile(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	return c.OnRequest(ctx)
+}
+
+// Response phase execution
+func (s *SetHeaderPolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	c, err := s.compile(params)
+	if err != nil {
+		return UpstreamResponseModifications{}
+	}
+	return c.OnResponse(ctx)
+}
+
+// OnRequest returns the prepared modifications when no value needs the
+// request, so untemplated headers cost no allocations
+func (c *compiledHeaders) OnRequest(ctx *RequestContext) RequestAction {
+	// Response templates may read the request
+	keep := c.response == nil
+	if c.request != nil && !keep {
+		return c.request
+	}
+	in := &templateInput{
+		Method:         ctx.Method,
+		Path:           ctx.Path,
+		headers:        ctx.Headers,
+		requestHeaders: ctx.Headers,
+		shared:         ctx.SharedContext,
+	}
+	if i := strings.IndexByte(ctx.Path, '?'); i >= 0 {
+		in.Path = ctx.Path[:i]
+		in.query, _ = url.ParseQuery(ctx.Path[i+1:])
+	}
+	if keep {
+		ctx.SharedContext.Set(requestKey, *in)
+	}
+	if c.request != nil {
+		return c.request
+	}
+	return UpstreamRequestModifications{HeaderOps: c.policy.render(c.cfg.Request, c.cfg.EnvPrefix, in)}
+}
+
+func (c *compiledHeaders) OnResponse(ctx *ResponseContext) ResponseAction {
+	if c.response != nil {
+		return c.response
+	}
+	in := &templateInput{}
+	if req, ok := SharedValue[templateInput](ctx.SharedContext, requestKey); ok {
+		in = &req
+	}
+	in.Status = ctx.ResponseStatus
+	in.headers = ctx.ResponseHeaders
+	in.shared = ctx.SharedContext
+	return UpstreamResponseModifications{HeaderOps: c.policy.render(c.cfg.Response, c.cfg.EnvPrefix, in)}
+}
+
+// parseConfig reads the request and response operation lists after the
+// schema has checked them. The original headerName and headerValue pair is
+// still accepted and sets one request header.
+func parseConfig(params map[string]interface{}) (headerConfig, error) {
+	var cfg headerConfig
+	var errs paramErrors
+	_, hasName := params["headerName"]
+	_, hasValue := params["headerValue"]
+	if hasName || hasValue {
+		name, _ := params["headerName"].(string)
+		value, _ := params["headerValue"].(string)
+		switch {
+		case params["request"] != nil:
+			errs.add("headerName", "cannot be combined with request")
+		case !hasName:
+			errs.add("headerName", "is required with headerValue")
+		case !validHeaderName(name):
+			errs.add("headerName", "must be a valid header name")
+		case !hasValue:
+			errs.add("headerValue", "is required with headerName")
+		case strings.ContainsAny(value, "\r\n"):
+			errs.add("headerValue", "must not contain line breaks")
+		}
+		cfg.Request = []HeaderOp{{Op: HeaderOpSet, Name: name, Value: value}}
+	}
+
+	if list, ok := params["request"].([]interface{}); ok {
+		cfg.Request = parseOps(list, "request", &errs)
+	}
+	if list, ok := params["response"].([]interface{}); ok {
+		cfg.Response = parseOps(list, "response", &errs)
+	}
+	cfg.EnvPrefix, _ = params["envPrefix"].(string)
+	if len(errs) == 0 && len(cfg.Request) == 0 && len(cfg.Response) == 0 {
+		errs.add("parameters", "must configure at least one of request, response and headerName")
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+func parseOps(list []interface{}, name string, errs *paramErrors) []HeaderOp {
+	ops := make([]HeaderOp, 0, len(list))
+	for i, item := range list {
+		m, _ := item.(map[string]interface{})
+		path := fmt.Sprintf("%s[%d]", name, i)
+		kind, _ := m["op"].(string)
+		op := HeaderOp{Op: HeaderOpKind(kind)}
+		op.Name, _ = m["name"].(string)
+		if !validHeaderName(op.Name) {
+			errs.add(path+".name", "must be a valid header name")
+		}
+		if op.Op != HeaderOpRemove {
+			value, ok := m["value"].(string)
+			switch {
+			case !ok:
+				errs.add(path+".value", "is required for "+kind)
+			case strings.ContainsAny(value, "\r\n"):
+				errs.add(path+".value", "must not contain line breaks")
+			}
+			op.Value = value
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// validHeaderName reports whether s is an HTTP token
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+package timeout
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "timeoutMs": {"type": "integer", "minimum": 1, "maximum": 3600000},
+    "deadlineHeader": {"type": "string", "default": "X-Request-Deadline"},
+    "grpcTimeout": {"type": "boolean", "default": true},
+    "honorClientDeadline": {"type": "boolean", "default": true},
+    "enforce": {"type": "boolean", "default": true}
+  },
+  "required": ["timeoutMs"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
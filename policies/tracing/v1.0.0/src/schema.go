@@ -0,0 +1,20 @@
+package tracing
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "trustIncoming": {"type": "boolean", "default": true},
+    "sampleRatio": {"type": "number", "minimum": 0, "maximum": 1, "default": 1},
+    "responseHeader": {"type": "string", "default": ""},
+    "recordHeaders": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "default": []
+    }
+  }
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
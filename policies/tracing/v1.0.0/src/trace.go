@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// flagSampled is the sampled bit of the traceparent trace-flags
+const flagSampled = 0x01
+
+// maxStateMembers is the most list members tracestate may carry
+const maxStateMembers = 32
+
+// traceParent is a parsed W3C traceparent header
+type traceParent struct {
+	TraceID  string
+	ParentID string
+	Flags    byte
+}
+
+// parseTraceParent parses a traceparent header of the form
+// version-traceid-parentid-flags. Versions after 00 may append fields, which
+// are ignored as the specification asks.
+func parseTraceParent(header string) (traceParent, bool) {
+	header = strings.TrimSpace(header)
+	if len(header) < 55 || (len(header) > 55 && header[55] != '-') {
+		return traceParent{}, false
+	}
+	version := header[0:2]
+	if !lowerHex(version) || version == "ff" || (version == "00" && len(header) != 55) {
+		return traceParent{}, false
+	}
+	if header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return traceParent{}, false
+	}
+	tp := traceParent{TraceID: header[3:35], ParentID: header[36:52]}
+	flags := header[53:55]
+	if !lowerHex(tp.TraceID) || !lowerHex(tp.ParentID) || !lowerHex(flags) {
+		return traceParent{}, false
+	}
+	// All-zero IDs are invalid
+	if strings.Trim(tp.TraceID, "0") == "" || strings.Trim(tp.ParentID, "0") == "" {
+		return traceParent{}, false
+	}
+	b, _ := hex.DecodeString(flags)
+	tp.Flags = b[0]
+	return tp, true
+}
+
+// formatTraceParent writes a version 00 traceparent. Only the sampled flag is
+// propagated, as the meaning of the others depends on the version.
+func formatTraceParent(tc TraceContext) string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + flags
+}
+
+func lowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// cleanTraceState joins tracestate headers into one list and checks every
+// member. A list with a malformed member or a key given twice is dropped as
+// a whole, because which member to trust cannot be told; members beyond the
+// 32 allowed are cut off from the end.
+func cleanTraceState(values []string) (string, bool) {
+	var members []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			member = strings.Trim(member, " \t")
+			if member == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(member, "=")
+			if !ok || !validStateKey(key) || !validStateValue(val) || seen[key] {
+				return "", false
+			}
+			seen[key] = true
+			members = append(members, member)
+		}
+	}
+	if len(members) > maxStateMembers {
+		members = members[:maxStateMembers]
+	}
+	return strings.Join(members, ","), true
+}
+
+// validStateKey accepts simple keys and multi-tenant keys of the form
+// tenant@system
+func validStateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if !multi {
+		return len(key) <= 256 && stateKeyPart(key, false)
+	}
+	return len(tenant) <= 241 && len(system) <= 14 && stateKeyPart(tenant, false) && stateKeyPart(system, true)
+}
+
+// stateKeyPart checks lowercase letters, digits, _ - * and /; a system name
+// must start with a letter, anything else with a letter or digit
+func stateKeyPart(s string, system bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		letter := c >= 'a' && c <= 'z'
+		digit := c >= '0' && c <= '9'
+		switch {
+		case i == 0 && system && !letter:
+			return false
+		case i == 0 && !letter && !digit:
+			return false
+		case !letter && !digit && c != '_' && c != '-' && c != '*' && c != '/':
+			return false
+		}
+	}
+	return true
+}
+
+// validStateValue accepts printable ASCII except , and =, not ending in a
+// space
+func validStateValue(v string) bool {
+	if v == "" || len(v) > 256 || v[len(v)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() string {
+	return randomID(16)
+}
+
+func newSpanID() string {
+	return randomID(8)
+}
+
+// randomID returns n random bytes in hex, never all zero
+func randomID(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+// sampledByRatio decides on a new trace from the lower half of its ID, the
+// way OpenTelemetry's TraceIdRatioBased sampler does, so every gateway
+// instance decides alike for the same trace
+func sampledByRatio(traceID string, ratio float64) bool {
+	switch {
+	case ratio >= 1:
+		return true
+	case ratio <= 0:
+		return false
+	}
+	b, err := hex.DecodeString(traceID)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	bound := uint64(ratio * (1 << 63))
+	return binary.BigEndian.Uint64(b[8:])>>1 < bound
+}
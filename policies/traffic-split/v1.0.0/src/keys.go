@@ -0,0 +1,179 @@
+package traffic_split
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	keyRemoteAddr    = "remoteAddr"
+	keyXForwardedFor = "xForwardedFor"
+	keyHeader        = "header"
+	keyCookie        = "cookie"
+	keyConsumer      = "consumer"
+
+	defaultTrustedProxyDepth = 1
+)
+
+// hashKey decides which value of a request its variant is derived from
+type hashKey struct {
+	Type              string
+	TrustedProxyDepth int
+	HeaderName        string
+	CookieName        string
+}
+
+// parseHashKey reads params["hashKey"] after the schema has checked it. The
+// value is either a key type or an object; a missing value selects
+// remoteAddr.
+func parseHashKey(raw interface{}) (hashKey, error) {
+	hk := hashKey{Type: keyRemoteAddr, TrustedProxyDepth: defaultTrustedProxyDepth}
+	if raw == nil {
+		return hk, nil
+	}
+	if name, ok := raw.(string); ok {
+		raw = map[string]interface{}{"type": name}
+	}
+	m, _ := raw.(map[string]interface{})
+	if s, ok := m["type"].(string); ok {
+		hk.Type = s
+	}
+
+	switch hk.Type {
+	case keyXForwardedFor:
+		if f, ok := m["trustedProxyDepth"].(float64); ok {
+			hk.TrustedProxyDepth = int(f)
+		}
+	case keyHeader:
+		hk.HeaderName, _ = m["headerName"].(string)
+		if hk.HeaderName == "" {
+			return hk, invalidParam("hashKey.headerName", "is required for the header key")
+		}
+	case keyCookie:
+		hk.CookieName, _ = m["cookieName"].(string)
+		if hk.CookieName == "" {
+			return hk, invalidParam("hashKey.cookieName", "is required for the cookie key")
+		}
+	}
+	return hk, nil
+}
+
+// key returns the value the variant of the request is derived from. Keys
+// that are missing from the request fall back to the remote address, so
+// anonymous clients are still spread across the variants.
+func (hk hashKey) key(ctx *RequestContext) string {
+	switch hk.Type {
+	case keyXForwardedFor:
+		if ip := forwardedClientIP(ctx, hk.TrustedProxyDepth); ip != "" {
+			return ip
+		}
+	case keyHeader:
+		if v := headerValue(ctx.Headers, hk.HeaderName); v != "" {
+			return v
+		}
+	case keyCookie:
+		if v := cookieValue(ctx.Headers, hk.CookieName); v != "" {
+			return v
+		}
+	case keyConsumer:
+		// Set by an authentication policy earlier in the chain
+		if v, ok := SharedValue[string](ctx.SharedContext, ConsumerIDKey); ok && v != "" {
+			return v
+		}
+	}
+	return remoteIP(ctx)
+}
+
+func remoteIP(ctx *RequestContext) string {
+	if host, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		return host
+	}
+	return ctx.RemoteAddr
+}
+
+// forwardedClientIP picks the client address from X-Forwarded-For. Each of the
+// depth trusted proxies in front of the gateway appends one entry, so the
+// client is the depth-th entry from the right; anything further left can be
+// forged by the caller.
+func forwardedClientIP(ctx *RequestContext, depth int) string {
+	var hops []string
+	for k, values := range ctx.Headers {
+		if !strings.EqualFold(k, "X-Forwarded-For") {
+			continue
+		}
+		for _, v := range values {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	}
+	if len(hops) < depth {
+		return ""
+	}
+	ip := net.ParseIP(hops[len(hops)-depth])
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func headerValue(headers map[string][]string, name string) string {
+	if values, ok := headers[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	for k, values := range headers {
+		if strings.EqualFold(k, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// cookieValue returns the first cookie of the request with the given name
+func cookieValue(headers map[string][]string, name string) string {
+	for k, values := range headers {
+		if !strings.EqualFold(k, "Cookie") {
+			continue
+		}
+		for _, v := range values {
+			for v != "" {
+				var part string
+				part, v, _ = strings.Cut(v, ";")
+				n, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+				if ok && n == name {
+					return strings.Trim(value, `"`)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// fnv32a hashes s into h with 32-bit FNV-1a, without the allocation of
+// hash/fnv
+func fnv32a(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+const fnvOffset32 = 2166136261
+
+// bucket maps a key to [0, n). The finalizer of MurmurHash3 mixes the high
+// bits of the FNV hash into the low ones the modulo keeps, so similar keys
+// such as neighbouring IP addresses spread evenly.
+func bucket(salt, key string, n int) int {
+	h := fnv32a(fnvOffset32, salt)
+	h = fnv32a(h, "\x00")
+	h = fnv32a(h, key)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return int(h % uint32(n))
+}
@@ -0,0 +1,55 @@
+package traffic_split
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form. Keep the two in sync.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {
+    "variants": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "weight": {"type": "integer", "minimum": 0}
+        },
+        "required": ["name", "weight"],
+        "additionalProperties": false
+      }
+    },
+    "hashKey": {
+      "oneOf": [
+        {"type": "string", "enum": ["remoteAddr", "xForwardedFor", "header", "cookie", "consumer"]},
+        {
+          "type": "object",
+          "properties": {
+            "type": {"type": "string", "enum": ["remoteAddr", "xForwardedFor", "header", "cookie", "consumer"], "default": "remoteAddr"},
+            "trustedProxyDepth": {"type": "integer", "minimum": 1, "default": 1},
+            "headerName": {"type": "string"},
+            "cookieName": {"type": "string"}
+          },
+          "required": ["type"],
+          "additionalProperties": false
+        }
+      ]
+    },
+    "salt": {"type": "string", "default": ""},
+    "header": {"type": "string", "default": "X-Variant"},
+    "stickyCookie": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string", "default": "variant"},
+        "maxAgeSeconds": {"type": "integer", "minimum": 0, "default": 2592000},
+        "path": {"type": "string", "default": "/"},
+        "secure": {"type": "boolean", "default": true},
+        "sameSite": {"type": "string", "enum": ["Strict", "Lax", "None"], "default": "Lax"}
+      },
+      "additionalProperties": false
+    }
+  },
+  "required": ["variants"]
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
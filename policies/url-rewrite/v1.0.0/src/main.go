@@ -0,0 +1,513 @@
+package url_rewrite
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Define policy types locally to avoid external dependency
+
+type HeaderProcessingMode string
+
+const (
+	// HeaderModeSkip keeps the policy out of the header phase
+	HeaderModeSkip HeaderProcessingMode = "SKIP"
+	// HeaderModeProcess calls the policy with the message headers
+	HeaderModeProcess HeaderProcessingMode = "PROCESS"
+)
+
+type BodyProcessingMode string
+
+const (
+	// BodyModeSkip does not deliver the body; Body is nil
+	BodyModeSkip BodyProcessingMode = "SKIP"
+	// BodyModeBuffer collects the whole body before the policy runs. Read it
+	// with Body.Bytes and change it with Body.Replace.
+	BodyModeBuffer BodyProcessingMode = "BUFFER"
+	// BodyModeStream hands the body over in chunks through Body.Stream, so
+	// large bodies are never held in memory at once
+	BodyModeStream BodyProcessingMode = "STREAM"
+)
+
+type ProcessingMode struct {
+	RequestHeaderMode  HeaderProcessingMode
+	RequestBodyMode    BodyProcessingMode
+	ResponseHeaderMode HeaderProcessingMode
+	ResponseBodyMode   BodyProcessingMode
+}
+
+type RequestContext struct {
+	Headers    map[string][]string
+	Body       *Body
+	Path       string
+	Method     string
+	RemoteAddr string
+	// SharedContext is the same for both phases of a request
+	SharedContext *SharedContext
+}
+
+type ResponseContext struct {
+	ResponseHeaders map[string][]string
+	ResponseBody    *Body
+	ResponseStatus  int
+	SharedContext   *SharedContext
+}
+
+// Scope is a set of named values that is safe for concurrent use. A nil
+// Scope reads as empty and ignores writes.
+type Scope struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (s *Scope) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Scope) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *Scope) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SharedContext carries values between the phases of one request and between
+// policies in the same chain. Values set on it are dropped when the request
+// completes; values that must outlive the request go in the Instance scope.
+// Like Scope, a nil SharedContext reads as empty and ignores writes.
+type SharedContext struct {
+	request  Scope
+	instance *Scope
+}
+
+// NewSharedContext returns the context for one request. instance is the scope
+// of the policy instance handling it, or nil.
+func NewSharedContext(instance *Scope) *SharedContext {
+	return &SharedContext{instance: instance}
+}
+
+func (s *SharedContext) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.request.Get(key)
+}
+
+func (s *SharedContext) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.request.Set(key, value)
+}
+
+func (s *SharedContext) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.request.Delete(key)
+}
+
+// Instance returns the scope shared by every request of the policy instance,
+// or nil when the gateway does not keep one
+func (s *SharedContext) Instance() *Scope {
+	if s == nil {
+		return nil
+	}
+	return s.instance
+}
+
+// SharedValue returns the request value stored under key if it has type T
+func SharedValue[T any](s *SharedContext, key string) (T, bool) {
+	v, _ := s.Get(key)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Keys of the values policies exchange through the SharedContext
+const (
+	// ConsumerIDKey holds the authenticated caller's ID as a string.
+	// Authentication policies set it; policies that work per caller read it.
+	ConsumerIDKey = "consumer.id"
+)
+
+// Body is the message body. In BUFFER mode it holds the complete content; in
+// STREAM mode it wraps a Stream and Bytes returns nil.
+type Body struct {
+	content       []byte
+	contentType   string
+	contentLength int64
+	replaced      bool
+	stream        Stream
+}
+
+// Stream delivers a body in chunks in STREAM mode. Recv returns io.EOF after
+// the last chunk. Chunks passed to Send are forwarded in place of the
+// received ones; a policy that does not change a chunk sends it unchanged.
+type Stream interface {
+	Recv() ([]byte, error)
+	Send(chunk []byte) error
+}
+
+// NewBufferedBody wraps a fully received body
+func NewBufferedBody(content []byte, contentType string) *Body {
+	return &Body{content: content, contentType: contentType, contentLength: int64(len(content))}
+}
+
+// NewStreamBody wraps a streamed body. contentLength is -1 when unknown.
+func NewStreamBody(stream Stream, contentType string, contentLength int64) *Body {
+	return &Body{stream: stream, contentType: contentType, contentLength: contentLength}
+}
+
+// Bytes returns the buffered content, or nil for a missing or streamed body
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.content
+}
+
+// Replace sets new content. The gateway forwards it and updates
+// Content-Length. Streamed bodies cannot be replaced as a whole.
+func (b *Body) Replace(content []byte) {
+	if b == nil || b.stream != nil {
+		return
+	}
+	b.content = content
+	b.contentLength = int64(len(content))
+	b.replaced = true
+}
+
+// Replaced reports whether Replace was called
+func (b *Body) Replaced() bool {
+	return b != nil && b.replaced
+}
+
+// Stream returns the chunk stream in STREAM mode, otherwise nil
+func (b *Body) Stream() Stream {
+	if b == nil {
+		return nil
+	}
+	return b.stream
+}
+
+// ContentType returns the media type the message declared, if any
+func (b *Body) ContentType() string {
+	if b == nil {
+		return ""
+	}
+	return b.contentType
+}
+
+// ContentLength returns the body size in bytes, or -1 when it is not known
+// up front
+func (b *Body) ContentLength() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.contentLength
+}
+
+type RequestAction interface{}
+
+type ResponseAction interface{}
+
+type HeaderOpKind string
+
+const (
+	// HeaderOpSet replaces every value of the header
+	HeaderOpSet HeaderOpKind = "set"
+	// HeaderOpAppend adds a value and keeps the existing ones
+	HeaderOpAppend HeaderOpKind = "append"
+	// HeaderOpRemove deletes the header
+	HeaderOpRemove HeaderOpKind = "remove"
+)
+
+// HeaderOp is one header or trailer change. Value is ignored for removals.
+type HeaderOp struct {
+	Op    HeaderOpKind
+	Name  string
+	Value string
+}
+
+// UpstreamRequestModifications changes the request before it is forwarded.
+// Empty fields leave the request as it is. SetHeaders and RemoveHeaders are
+// applied first, then HeaderOps in order.
+type UpstreamRequestModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered request body when non-nil, and the gateway
+	// updates Content-Length. It takes precedence over Body.Replace.
+	Body []byte
+	// TrailerOps change the request trailers
+	TrailerOps []HeaderOp
+	// Path replaces the request path, including the query string
+	Path string
+	// Authority replaces the host the request is addressed to, i.e. the Host
+	// header or :authority
+	Authority string
+	// Upstream sends the request to the named upstream, or to the given URL,
+	// instead of the route's own
+	Upstream string
+}
+
+// UpstreamResponseModifications changes the response before it is returned to
+// the client, in the same order as UpstreamRequestModifications.
+type UpstreamResponseModifications struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	HeaderOps     []HeaderOp
+	// Body replaces the buffered response body when non-nil
+	Body []byte
+	// TrailerOps change the response trailers
+	TrailerOps []HeaderOp
+	// Status replaces the response status when non-zero
+	Status int
+}
+
+type ImmediateResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    string
+}
+
+// redactedValue stands in for query values in dry run log lines
+const redactedValue = "[REDACTED]"
+
+type URLRewritePolicy struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+type rewriteConfig struct {
+	StripPrefix string
+	Rewrites    []rewrite
+	AddPrefix   string
+	Query       queryOps
+	DryRun      bool
+}
+
+// rewrite replaces the parts of the path matching pattern. $1, ${name} and
+// so on in the replacement refer to the pattern's groups.
+type rewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Validate configuration parameters
+func (p *URLRewritePolicy) Validate(params map[string]interface{}) error {
+	_, err := p.parseConfig(params)
+	return err
+}
+
+// Declare processing behavior
+func (p *URLRewritePolicy) Mode() ProcessingMode {
+	return ProcessingMode{
+		RequestHeaderMode:  HeaderModeProcess,
+		ResponseHeaderMode: HeaderModeSkip,
+		RequestBodyMode:    BodyModeSkip,
+		ResponseBodyMode:   BodyModeSkip,
+	}
+}
+
+// Request phase execution
+func (p *URLRewritePolicy) OnRequest(ctx *RequestContext, params map[string]interface{}) RequestAction {
+	cfg, err := p.parseConfig(params)
+	if err != nil {
+		return UpstreamRequestModifications{}
+	}
+	target := cfg.apply(ctx.Path)
+	if target == ctx.Path {
+		return UpstreamRequestModifications{}
+	}
+	if cfg.DryRun {
+		log.Printf("url-rewrite: dry run: %s %s would be rewritten to %s", ctx.Method, redactQuery(ctx.Path), redactQuery(target))
+		return UpstreamRequestModifications{}
+	}
+	return UpstreamRequestModifications{Path: target}
+}
+
+// Response phase (not used)
+func (p *URLRewritePolicy) OnResponse(ctx *ResponseContext, params map[string]interface{}) ResponseAction {
+	return UpstreamResponseModifications{}
+}
+
+// redactQuery keeps the path of a request target and the names of its query
+// parameters. Query values can carry tokens, so they are not logged.
+func redactQuery(target string) string {
+	path, query, ok := strings.Cut(target, "?")
+	if !ok || query == "" {
+		return path
+	}
+	var params []string
+	for _, pair := range strings.Split(query, "&") {
+		if name, _, _ := strings.Cut(pair, "="); name != "" {
+			params = append(params, name+"="+redactedValue)
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// apply rewrites a request target: stripPrefix, the rewrites in order and
+// addPrefix change the path, then the query operations change the query
+func (cfg rewriteConfig) apply(requestTarget string) string {
+	path, query, hasQuery := strings.Cut(requestTarget, "?")
+
+	if cfg.StripPrefix != "" && hasPathPrefix(path, cfg.StripPrefix) {
+		path = path[len(cfg.StripPrefix):]
+	}
+	for _, rw := range cfg.Rewrites {
+		path = rw.pattern.ReplaceAllString(path, rw.replacement)
+	}
+	if cfg.AddPrefix != "" {
+		if path == "" || path == "/" {
+			path = cfg.AddPrefix
+		} else {
+			path = strings.TrimSuffix(cfg.AddPrefix, "/") + ensureSlash(path)
+		}
+	}
+	path = ensureSlash(path)
+
+	if !cfg.Query.empty() {
+		query = cfg.Query.apply(query)
+		hasQuery = query != ""
+	}
+	if hasQuery {
+		return path + "?" + query
+	}
+	return path
+}
+
+// hasPathPrefix matches whole segments, so /api strips /api and /api/v1 but
+// not /apis
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	return rest == "" || rest[0] == '/'
+}
+
+func ensureSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
+
+func (p *URLRewritePolicy) parseConfig(params map[string]interface{}) (rewriteConfig, error) {
+	var cfg rewriteConfig
+	for name, dst := range map[string]*string{
+		"stripPrefix": &cfg.StripPrefix,
+		"addPrefix":   &cfg.AddPrefix,
+	} {
+		if v, ok := params[name]; ok {
+			s, ok := v.(string)
+			if !ok || !strings.HasPrefix(s, "/") || strings.ContainsAny(s, "?# ") {
+				return cfg, fmt.Errorf("%s must be a path starting with a slash", name)
+			}
+			*dst = s
+		}
+	}
+	if _, ok := params["stripPrefix"]; ok {
+		if cfg.StripPrefix = strings.TrimSuffix(cfg.StripPrefix, "/"); cfg.StripPrefix == "" {
+			return cfg, errors.New("stripPrefix must not be the root path")
+		}
+	}
+
+	if v, ok := params["rewrites"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return cfg, errors.New("rewrites must be a list")
+		}
+		for i, raw := range list {
+			m, ok := raw.(map[string]interface{})
+			if !ok {
+				return cfg, fmt.Errorf("rewrites[%d] must be an object", i)
+			}
+			expr, ok := m["pattern"].(string)
+			if !ok || expr == "" {
+				return cfg, fmt.Errorf("rewrites[%d].pattern must be a regular expression", i)
+			}
+			re, err := p.pattern(expr)
+			if err != nil {
+				return cfg, fmt.Errorf("rewrites[%d].pattern: %v", i, err)
+			}
+			replacement, ok := m["replacement"].(string)
+			if !ok {
+				return cfg, fmt.Errorf("rewrites[%d].replacement is required and must be a string", i)
+			}
+			cfg.Rewrites = append(cfg.Rewrites, rewrite{pattern: re, replacement: replacement})
+		}
+	}
+
+	if v, ok := params["query"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return cfg, errors.New("query must be an object")
+		}
+		var err error
+		if cfg.Query, err = parseQueryOps(m); err != nil {
+			return cfg, fmt.Errorf("query.%v", err)
+		}
+		if cfg.Query.empty() {
+			return cfg, errors.New("query must have at least one of remove, rename and add")
+		}
+	}
+
+	if v, ok := params["dryRun"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return cfg, errors.New("dryRun must be a boolean")
+		}
+		cfg.DryRun = b
+	}
+
+	if cfg.StripPrefix == "" && len(cfg.Rewrites) == 0 && cfg.AddPrefix == "" && cfg.Query.empty() {
+		return cfg, errors.New("at least one of stripPrefix, rewrites, addPrefix and query must be configured")
+	}
+	return cfg, nil
+}
+
+// pattern compiles a regular expression once per policy instance
+func (p *URLRewritePolicy) pattern(expr string) (*regexp.Regexp, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if re, ok := p.patterns[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if p.patterns == nil {
+		p.patterns = make(map[string]*regexp.Regexp)
+	}
+	p.patterns[expr] = re
+	return re, nil
+}
@@ -0,0 +1,123 @@
+package url_rewrite
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// queryOps change query parameters. Parameters that are not named keep their
+// position and encoding.
+type queryOps struct {
+	Remove []string
+	Rename map[string]string
+	// Add sets parameters, replacing any values the client sent
+	Add map[string]string
+	// addOrder keeps Add deterministic
+	addOrder []string
+}
+
+func (q queryOps) empty() bool {
+	return len(q.Remove) == 0 && len(q.Rename) == 0 && len(q.Add) == 0
+}
+
+// apply removes, then renames, then adds parameters of a raw query string
+func (q queryOps) apply(query string) string {
+	var out []string
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, rawValue, hasValue := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if contains(q.Remove, name) {
+			continue
+		}
+		if to, ok := q.Rename[name]; ok {
+			name, rawName = to, url.QueryEscape(to)
+		}
+		if _, ok := q.Add[name]; ok {
+			continue
+		}
+		if hasValue {
+			out = append(out, rawName+"="+rawValue)
+		} else {
+			out = append(out, rawName)
+		}
+	}
+	for _, name := range q.addOrder {
+		out = append(out, url.QueryEscape(name)+"="+url.QueryEscape(q.Add[name]))
+	}
+	return strings.Join(out, "&")
+}
+
+func parseQueryOps(m map[string]interface{}) (queryOps, error) {
+	var q queryOps
+	var err error
+	if q.Remove, err = stringList(m, "remove"); err != nil {
+		return q, err
+	}
+	for name, dst := range map[string]*map[string]string{
+		"rename": &q.Rename,
+		"add":    &q.Add,
+	} {
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return q, fmt.Errorf("%s must be an object mapping parameter names to strings", name)
+		}
+		*dst = make(map[string]string, len(obj))
+		for k, raw := range obj {
+			s, ok := raw.(string)
+			if !ok || k == "" {
+				return q, fmt.Errorf("%s.%s must be a string", name, k)
+			}
+			if name == "rename" && s == "" {
+				return q, fmt.Errorf("rename.%s must be a parameter name", k)
+			}
+			(*dst)[k] = s
+		}
+	}
+	for name := range q.Add {
+		q.addOrder = append(q.addOrder, name)
+	}
+	sort.Strings(q.addOrder)
+	return q, nil
+}
+
+// stringList reads a parameter that may be a single string or a list of them
+func stringList(params map[string]interface{}, name string) ([]string, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain only strings", name)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%s must be a string or a list of strings", name)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+#!/bin/bash
+
+# Run the Go benchmarks for a policy or a policy chain
+# Usage: ./benchmark.sh <policy> [version] [-- <go test flags>]
+#        ./benchmark.sh --chain <chain.json> [-- <go test flags>]
+#
+# Like the conformance suite, the benchmarks are compiled into a copy of the
+# policy source in a throwaway module. Both kinds run every request in
+# benchmarks/fixtures/requests.json and report time and allocations per
+# request.
+#
+# For a policy, BenchmarkRequest and BenchmarkResponse run each phase for
+# every configuration in benchmarks/policies/<policy>.json, a JSON list of
+# {"name": ..., "params": {...}}, or with empty parameters when there is no
+# such file. Policies with a Compile method are run both with their
+# parameters map and compiled, as e.g. static/browser-page/compiled.
+#
+# A chain file names the policies in order, each with an optional version:
+#
+#   {"name": "edge", "policies": [
+#     {"policy": "correlation-id", "params": {}},
+#     {"policy": "set-header", "version": "v1.5.0", "params": {...}}
+#   ]}
+#
+# BenchmarkChain sends each request through the chain as the gateway would,
+# see benchmarks/chains for examples. Chains need versions built on the
+# SharedContext and Scope types. Flags after -- are passed to go test, e.g.
+# -- -benchtime=2s -count=5 -bench Request.
+#
+# Tests and benchmarks a policy keeps in _test.go files next to its source
+# are compiled in as well. The benchmarks run with the others; the tests run
+# with -- -run . -bench '^$', which CI does with -race.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+TEMPLATE_DIR="$SCRIPT_DIR/benchmark"
+BENCH_DIR="$REPO_ROOT/benchmarks"
+FIXTURES="$BENCH_DIR/fixtures/requests.json"
+
+usage() {
+  echo "Usage: $0 <policy> [version] [-- <go test flags>]" >&2
+  echo "       $0 --chain <chain.json> [-- <go test flags>]" >&2
+  exit 1
+}
+
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+
+latest_version() {
+  find "$REPO_ROOT/policies/$1" -mindepth 1 -maxdepth 1 -type d -name 'v*' -exec basename {} \; | sort -V | tail -1
+}
+
+# policy_source prints the src directory of a policy version, the latest by
+# default
+policy_source() {
+  local policy="$1" version="${2:-}"
+  if [[ ! -d "$REPO_ROOT/policies/$policy" ]]; then
+    echo "❌ Policy not found: $policy" >&2
+    return 1
+  fi
+  version="${version:-$(latest_version "$policy")}"
+  version="v${version#v}"
+  if [[ ! -d "$REPO_ROOT/policies/$policy/$version/src" ]]; then
+    echo "❌ $policy/$version: src directory not found" >&2
+    return 1
+  fi
+  echo "$REPO_ROOT/policies/$policy/$version/src"
+}
+
+# substitute fills in a template for the policy source in $1
+substitute() {
+  local src="$1" template="$2" package type_name
+  package="$(sed -n 's/^package \([A-Za-z0-9_]*\).*/\1/p' "$src"/*.go | head -1)"
+  type_name="$(sed -n 's/^func ([A-Za-z_]* \*\([A-Za-z0-9_]*\)) Validate(.*/\1/p' "$src"/*.go | head -1)"
+  if [[ -z "$package" || -z "$type_name" ]]; then
+    echo "❌ Could not find the policy type in $src" >&2
+    return 1
+  fi
+  sed -e "s/__PACKAGE__/$package/g" -e "s/__TYPE__/$type_name/g" "$template"
+}
+
+CHAIN=""
+POLICY=""
+VERSION=""
+case "${1:-}" in
+  ""|--) usage ;;
+  --chain)
+    CHAIN="${2:-}"
+    [[ -n "$CHAIN" ]] || usage
+    shift 2
+    ;;
+  *)
+    POLICY="$1"
+    shift
+    if [[ $# -gt 0 && "$1" != "--" ]]; then
+      VERSION="$1"
+      shift
+    fi
+    ;;
+esac
+if [[ $# -gt 0 ]]; then
+  [[ "$1" == "--" ]] || usage
+  shift
+fi
+GO_FLAGS=("$@")
+
+TEMP_DIR="$(mktemp -d)"
+trap 'rm -rf "$TEMP_DIR"' EXIT
+
+if [[ -n "$POLICY" ]]; then
+  SRC_DIR="$(policy_source "$POLICY" "$VERSION")"
+  cp -r "$SRC_DIR"/. "$TEMP_DIR/"
+  substitute "$SRC_DIR" "$TEMPLATE_DIR/policy_test.go.tmpl" > "$TEMP_DIR/benchmark_test.go"
+  CONFIGS="$BENCH_DIR/policies/$POLICY.json"
+  if [[ ! -f "$CONFIGS" ]]; then
+    CONFIGS="$TEMP_DIR/configs.json"
+    echo '[{"name": "defaults", "params": {}}]' > "$CONFIGS"
+  fi
+  echo "🏁 Benchmarking $POLICY/$(basename "$(dirname "$SRC_DIR")")"
+  cd "$TEMP_DIR"
+  go mod init benchmark >/dev/null 2>&1
+  BENCHMARK_FIXTURES="$FIXTURES" BENCHMARK_CONFIGS="$CONFIGS" \
+    go test -run '^$' -bench . ${GO_FLAGS[@]+"${GO_FLAGS[@]}"} .
+  exit
+fi
+
+if ! command -v jq >/dev/null 2>&1; then
+  echo "❌ jq is required for chain benchmarks" >&2
+  exit 1
+fi
+if [[ ! -f "$CHAIN" ]]; then
+  echo "❌ Chain file not found: $CHAIN" >&2
+  exit 1
+fi
+CHAIN="$(cd "$(dirname "$CHAIN")" && pwd)/$(basename "$CHAIN")"
+
+imports=""
+steps=""
+count="$(jq '.policies | length' "$CHAIN")"
+for ((i = 0; i < count; i++)); do
+  policy="$(jq -r ".policies[$i].policy" "$CHAIN")"
+  version="$(jq -r ".policies[$i].version // empty" "$CHAIN")"
+  src="$(policy_source "$policy" "$version")"
+  mkdir -p "$TEMP_DIR/p$i"
+  cp -r "$src"/. "$TEMP_DIR/p$i/"
+  # Policies built as package main cannot be imported
+  sed -i "s/^package main\$/package p$i/" "$TEMP_DIR/p$i"/*.go
+  substitute "$TEMP_DIR/p$i" "$TEMPLATE_DIR/step.go.tmpl" > "$TEMP_DIR/p$i/zz_benchmark_step.go"
+  imports+=$'\t'"p$i \"chain/p$i\""$'\n'
+  steps+=$'\t'"link(\"$policy\", p$i.NewBenchStep),"$'\n'
+  echo "🔗 $policy/$(basename "$(dirname "$src")")"
+done
+
+awk -v imports="$imports" -v steps="$steps" '
+  /^__IMPORTS__/ { printf "%s", imports; sub(/^__IMPORTS__/, "") }
+  /^__STEPS__/   { printf "%s", steps; sub(/^__STEPS__/, "") }
+  { print }
+' "$TEMPLATE_DIR/chain_test.go.tmpl" > "$TEMP_DIR/chain_test.go"
+
+cd "$TEMP_DIR"
+go mod init chain >/dev/null 2>&1
+BENCHMARK_FIXTURES="$FIXTURES" BENCHMARK_CHAIN="$CHAIN" \
+  go test -run '^$' -bench . ${GO_FLAGS[@]+"${GO_FLAGS[@]}"} .
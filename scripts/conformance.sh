@@ -0,0 +1,203 @@
+#!/bin/bash
+
+# Run the conformance suite against policy implementations
+# Usage: ./conformance.sh <policy> [version]
+#        ./conformance.sh --all
+#
+# The suite in scripts/conformance/conformance_test.go.tmpl is filled in from
+# the policy's policy-definition.yaml and compiled into a copy of its source
+# in a throwaway module, so policies stay free of test dependencies. It checks
+# that:
+#   - Validate never panics, rejects missing required parameters and rejects
+#     parameters of the wrong type
+#   - Mode is stable and matches the declared processingMode
+#   - OnRequest and OnResponse never panic on empty contexts or odd
+#     parameters
+#   - ImmediateResponse status codes are between 100 and 599
+#   - Compile, for policies that implement it, accepts exactly the
+#     parameters Validate accepts, and its phases never panic
+#   - Init and Close, for policies that implement them, never panic, Close
+#     returns no error, and the phases run between them without panicking
+#   - Rotate, for policies that implement it, accepts the parameters Init
+#     was called with, and the phases still run after it
+#   - The parameters schema does not declare enforcementMode, onError or
+#     errorCircuit, which the gateway handles for every policy
+#   - The parametersSchemaJSON constant that policies validate against, when
+#     the source has one, is the parametersSchema of policy-definition.yaml
+#     without its descriptions
+# The suite uses the current SDK types, so it applies to versions built on
+# the SharedContext and ImmediateResponse types. Without a version the latest
+# version is checked; --all checks the latest version of every policy.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+TEMPLATE="$SCRIPT_DIR/conformance/conformance_test.go.tmpl"
+
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+if ! command -v jq >/dev/null 2>&1; then
+  echo "❌ jq is not installed" >&2
+  exit 1
+fi
+
+# definition_fields prints what the suite needs from a policy-definition.yaml,
+# one item per line:
+#   mode <Field> <VALUE>   a processingMode entry
+#   required <name>        a required top level parameter
+#   property <name>        a top level parameter
+#   type <name> <type>     a top level parameter with a single declared type
+# Only the top level of parametersSchema is read, so it is parsed by
+# indentation without a YAML library.
+definition_fields() {
+  awk '
+    function indent(line) { match(line, /^ */); return RLENGTH }
+    /^[^ \t#]/ { section = $1; sub(/:.*/, "", section); block = ""; next }
+    section == "processingMode" && /^  [A-Za-z]+:/ {
+      key = $1; sub(/:$/, "", key)
+      print "mode " toupper(substr(key, 1, 1)) substr(key, 2) " " $2
+      next
+    }
+    section != "parametersSchema" { next }
+    indent($0) == 2 && /^  [A-Za-z]+:/ { block = $1; sub(/:.*/, "", block); prop = ""; next }
+    block == "required" && /^  +- / { name = $0; sub(/^ +- */, "", name); print "required " name; next }
+    block == "properties" && indent($0) == 4 && /^    [A-Za-z0-9_]+:/ { prop = $1; sub(/:.*/, "", prop); print "property " prop; next }
+    block == "properties" && prop != "" && indent($0) == 6 && /^      type: *[a-z]+ *$/ {
+      print "type " prop " " $2
+    }
+  ' "$1"
+}
+
+# check_schema compares the parametersSchemaJSON constant of a policy source
+# directory with the parametersSchema of its definition. Descriptions only
+# document the definition, so they are left out; everything else, defaults
+# included, must be the same. The definition is read with scripts/version,
+# as generate-index.sh reads it.
+check_schema() {
+  local name="$1" src="$2" definition="$3"
+  local file declared embedded
+  file="$(grep -l '^const parametersSchemaJSON = `' "$src"/*.go 2>/dev/null | head -1 || true)"
+  if [[ -z "$file" ]]; then
+    return 0
+  fi
+  declared="$("$SCRIPT_DIR/version.sh" schema "$definition" |
+    jq -S 'walk(if type == "object" and (.description | type) == "string" then del(.description) else . end)')" || return 1
+  if ! embedded="$(awk '
+      sub(/^const parametersSchemaJSON = `/, "") { inside = 1 }
+      inside && sub(/`$/, "") { print; exit }
+      inside { print }
+    ' "$file" | jq -S . 2>&1)"; then
+    echo "❌ $name: parametersSchemaJSON in $(basename "$file") is not valid JSON: $embedded" >&2
+    return 1
+  fi
+  if [[ "$declared" != "$embedded" ]]; then
+    echo "❌ $name: parametersSchemaJSON in $(basename "$file") differs from the parametersSchema of policy-definition.yaml (< definition, > source):" >&2
+    diff <(echo "$declared") <(echo "$embedded") | sed 's/^/   /' >&2
+    return 1
+  fi
+}
+
+# generate_suite writes the suite for one policy source directory
+generate_suite() {
+  local src="$1" definition="$2" out="$3"
+  local package type_name
+  package="$(sed -n 's/^package \([A-Za-z0-9_]*\).*/\1/p' "$src"/*.go | head -1)"
+  type_name="$(sed -n 's/^func ([A-Za-z_]* \*\([A-Za-z0-9_]*\)) Validate(.*/\1/p' "$src"/*.go | head -1)"
+  if [[ -z "$package" || -z "$type_name" ]]; then
+    echo "❌ Could not find the policy type in $src" >&2
+    return 1
+  fi
+
+  local mode="" types="" has_required=false kind a b
+  while read -r kind a b; do
+    case "$kind" in
+      mode) mode+=$'\t\t'"$a: \"$b\","$'\n' ;;
+      required) has_required=true ;;
+      property)
+        case "$a" in
+          enforcementMode|onError|errorCircuit)
+            echo "❌ $definition declares $a, which is reserved for the gateway" >&2
+            return 1
+            ;;
+        esac
+        ;;
+      type) types+=$'\t\t'"\"$a\": \"$b\","$'\n' ;;
+    esac
+  done < <(definition_fields "$definition")
+
+  awk -v package="$package" -v type_name="$type_name" -v mode="$mode" \
+      -v types="$types" -v has_required="$has_required" '
+    /^__MODE__/  { printf "%s", mode; sub(/^__MODE__/, "") }
+    /^__TYPES__/ { printf "%s", types; sub(/^__TYPES__/, "") }
+    {
+      gsub(/__PACKAGE__/, package)
+      gsub(/__TYPE__/, type_name)
+      gsub(/__HAS_REQUIRED__/, has_required)
+      print
+    }
+  ' "$TEMPLATE" > "$out"
+}
+
+# run_policy runs the suite against one policy version
+run_policy() {
+  local policy="$1" version="$2"
+  local policy_dir="$REPO_ROOT/policies/$policy/$version"
+  if [[ ! -d "$policy_dir/src" ]]; then
+    echo "❌ $policy/$version: src directory not found" >&2
+    return 1
+  fi
+
+  local temp_dir
+  temp_dir="$(mktemp -d)"
+  cp -r "$policy_dir/src"/. "$temp_dir/"
+  local status=0
+  if ! check_schema "$policy/$version" "$policy_dir/src" "$policy_dir/policy-definition.yaml"; then
+    status=1
+  elif generate_suite "$policy_dir/src" "$policy_dir/policy-definition.yaml" "$temp_dir/conformance_test.go"; then
+    if (cd "$temp_dir" && go mod init conformance >/dev/null 2>&1 && go test -count=1 -run '^TestConformance' . >"$temp_dir/output" 2>&1); then
+      echo "✅ $policy/$version conforms"
+    else
+      echo "❌ $policy/$version does not conform:" >&2
+      sed 's/^/   /' "$temp_dir/output" >&2
+      status=1
+    fi
+  else
+    status=1
+  fi
+  rm -rf "$temp_dir"
+  return $status
+}
+
+latest_version() {
+  find "$REPO_ROOT/policies/$1" -mindepth 1 -maxdepth 1 -type d -name 'v*' -exec basename {} \; | sort -V | tail -1
+}
+
+if [[ "${1:-}" == "--all" ]]; then
+  failures=0
+  for policy_dir in "$REPO_ROOT"/policies/*/; do
+    policy="$(basename "$policy_dir")"
+    run_policy "$policy" "$(latest_version "$policy")" || ((failures++)) || true
+  done
+  if [[ $failures -gt 0 ]]; then
+    echo "💥 $failures policies failed the conformance suite" >&2
+    exit 1
+  fi
+  exit 0
+fi
+
+POLICY="${1:-}"
+if [[ -z "$POLICY" ]]; then
+  echo "Usage: $0 <policy> [version] | --all" >&2
+  exit 1
+fi
+if [[ ! -d "$REPO_ROOT/policies/$POLICY" ]]; then
+  echo "❌ Policy not found: $POLICY" >&2
+  exit 1
+fi
+VERSION="${2:-$(latest_version "$POLICY")}"
+VERSION="v${VERSION#v}"
+run_policy "$POLICY" "$VERSION"
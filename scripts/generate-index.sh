@@ -0,0 +1,174 @@
+#!/bin/bash
+
+# Generate the hub index from the policy manifests
+# Usage: ./generate-index.sh [--check] [output-file]
+#
+# Every policy version directory policies/<name>/v<X.Y.Z>/ carries its
+# manifest in two files:
+#   metadata.json           name, version (without the "v"), displayName,
+#                           description, provider, categories, tags and
+#                           supportedPlatforms, the compatibility range
+#                           such as "apim-4.5+"
+#   policy-definition.yaml  parametersSchema, processingMode,
+#                           supportedFlows and executionMode
+#
+# The index lists every policy with its versions in semantic version order,
+# so gateways can discover what the hub offers without walking the tree. Each
+# version carries its parametersSchema as JSON, read from the definition by
+# the YAML reader of scripts/version, so gateways and tooling can validate
+# parameters from the index alone.
+# With --check the index is compared with the committed file instead of
+# written, and the script fails if it is out of date.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+
+CHECK=false
+if [[ "${1:-}" == "--check" ]]; then
+  CHECK=true
+  shift
+fi
+INDEX_FILE="${1:-$REPO_ROOT/index.json}"
+
+if ! command -v jq >/dev/null 2>&1; then
+  echo "❌ jq is not installed" >&2
+  exit 1
+fi
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+
+BUILD_DIR="$(mktemp -d)"
+trap 'rm -rf "$BUILD_DIR"' EXIT
+go build -o "$BUILD_DIR/version" "$SCRIPT_DIR"/version/*.go
+
+errors=0
+
+# definition_json prints the processing section of a policy-definition.yaml
+# as JSON. The section is flat, so it is read without a YAML library.
+definition_json() {
+  awk '
+    /^processingMode:/ { section = "mode"; next }
+    /^supportedFlows:/ { section = "flows"; next }
+    /^executionMode:/  { sub(/^executionMode:[ \t]*/, ""); execution = $0; section = ""; next }
+    /^[^ \t]/          { section = "" }
+    section == "mode" && /^[ \t]+[A-Za-z]+:/ {
+      line = $0
+      sub(/^[ \t]+/, "", line)
+      key = line; sub(/:.*/, "", key)
+      value = line; sub(/^[^:]*:[ \t]*/, "", value)
+      mode = mode (mode == "" ? "" : ",") "\"" key "\":\"" value "\""
+    }
+    section == "flows" && /^[ \t]*-[ \t]*/ {
+      flow = $0
+      sub(/^[ \t]*-[ \t]*/, "", flow)
+      flows = flows (flows == "" ? "" : ",") "\"" flow "\""
+    }
+    END {
+      printf "{\"processingMode\":{%s},\"supportedFlows\":[%s],\"executionMode\":\"%s\"}\n", mode, flows, execution
+    }
+  ' "$1"
+}
+
+entries=()
+for policy_dir in "$REPO_ROOT"/policies/*/; do
+  name="$(basename "$policy_dir")"
+  while IFS= read -r version_dir; do
+    [[ -z "$version_dir" ]] && continue
+    version="$(basename "$version_dir")"
+    rel="policies/$name/$version"
+    metadata="$version_dir/metadata.json"
+    definition="$version_dir/policy-definition.yaml"
+
+    if [[ ! "$version" =~ ^v[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+      echo "⚠️  Skipping $rel: not a version directory" >&2
+      continue
+    fi
+    if [[ ! -f "$metadata" ]] || ! jq empty "$metadata" 2>/dev/null; then
+      echo "❌ $rel: metadata.json is missing or invalid" >&2
+      ((errors++)) || true
+      continue
+    fi
+    if [[ ! -f "$definition" ]]; then
+      echo "❌ $rel: policy-definition.yaml is missing" >&2
+      ((errors++)) || true
+      continue
+    fi
+
+    # The directory layout is what gateways and the publisher rely on, so
+    # the manifest must agree with it
+    if [[ "$(jq -r '.name' "$metadata")" != "$name" ]]; then
+      echo "❌ $rel: metadata name does not match the directory" >&2
+      ((errors++)) || true
+    fi
+    if [[ "$(jq -r '.version' "$metadata")" != "${version#v}" ]]; then
+      echo "❌ $rel: metadata version does not match the directory" >&2
+      ((errors++)) || true
+    fi
+
+    if ! schema="$("$BUILD_DIR/version" schema "$definition")"; then
+      echo "❌ $rel: parametersSchema cannot be read" >&2
+      ((errors++)) || true
+      continue
+    fi
+
+    entries+=("$(jq -c \
+      --arg path "$rel" \
+      --argjson definition "$(definition_json "$definition")" \
+      --argjson schema "$schema" \
+      '{
+        name,
+        version,
+        displayName,
+        description,
+        provider,
+        categories: (.categories // []),
+        tags: (.tags // []),
+        supportedPlatforms: (.supportedPlatforms // []),
+        path: $path,
+        definition: ($path + "/policy-definition.yaml")
+      } + $definition + {parametersSchema: $schema}' "$metadata")")
+  done < <(find "$policy_dir" -mindepth 1 -maxdepth 1 -type d -name 'v*' | sort -V)
+done
+
+if [[ $errors -gt 0 ]]; then
+  echo "💥 Found $errors manifest error(s)" >&2
+  exit 1
+fi
+
+# Versions are already in semantic version order; the last one of a policy
+# is its latest. Policy level fields come from the latest version.
+index="$(printf '%s\n' "${entries[@]}" | jq -s '
+  {
+    policies: (
+      group_by(.name)
+      | map(
+          (last) as $latest
+          | {
+              name: $latest.name,
+              displayName: $latest.displayName,
+              description: $latest.description,
+              provider: $latest.provider,
+              categories: $latest.categories,
+              latest: $latest.version,
+              versions: map(del(.name, .displayName, .description, .provider, .categories))
+            }
+        )
+    )
+  }')"
+
+if $CHECK; then
+  if [[ ! -f "$INDEX_FILE" ]] || [[ "$(cat "$INDEX_FILE")" != "$index" ]]; then
+    echo "❌ $INDEX_FILE is out of date; run scripts/generate-index.sh" >&2
+    exit 1
+  fi
+  echo "✅ Hub index is up to date"
+  exit 0
+fi
+
+printf '%s\n' "$index" > "$INDEX_FILE"
+echo "✅ Wrote $(jq '.policies | length' "$INDEX_FILE") policies to $INDEX_FILE"
@@ -0,0 +1,81 @@
+#!/bin/bash
+
+# Generate a typed config struct for a policy version
+# Usage: ./policygen.sh [--check] <policy> [version]
+#
+# Reads the parametersSchema of the version's policy-definition.yaml, the
+# latest version by default, and writes src/config_gen.go with a Config
+# struct, one field per parameter, and
+#
+#   func Unmarshal(params map[string]interface{}) (Config, error)
+#
+# Unmarshal fills in schema defaults and checks types, enums, numeric bounds,
+# lengths, sizes, patterns and additionalProperties: false. It returns an
+# error naming the parameter, e.g. "store.timeoutMs must be at least 1",
+# where a type assertion such as params["burstLimit"].(float64) would panic.
+# Nested objects get their own types (ConfigStore for store), as do
+# definitions (ConfigHeaderOp for #/definitions/headerOp). Optional objects
+# without a default are pointers; other optional parameters without a
+# default keep their zero value. A value or a list of them (oneOf string and
+# array of strings) becomes a list, and anything else without one Go type,
+# such as oneOf string and object, stays interface{}. Parameters the schema
+# does not list, such as enforcementMode, are ignored unless the schema sets
+# additionalProperties: false.
+#
+# With --check, nothing is written and the script fails if config_gen.go is
+# missing or out of date; policyhub.sh validate and CI run it for versions
+# that have one. The generated file is part of the version's source and is
+# packaged like any other file.
+#
+# The generator lives in scripts/policygen and, like scripts/version, uses
+# only the Go standard library. It shares the YAML reader in
+# scripts/version/yaml.go, so both read definitions the same way.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+
+usage() {
+  echo "Usage: $0 [--check] <policy> [version]" >&2
+  exit 1
+}
+
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+
+CHECK=()
+if [[ "${1:-}" == "--check" ]]; then
+  CHECK=(-check)
+  shift
+fi
+POLICY="${1:-}"
+case $# in
+  1) VERSION="" ;;
+  2) VERSION="v${2#v}" ;;
+  *) usage ;;
+esac
+
+if [[ ! -d "$REPO_ROOT/policies/$POLICY" ]]; then
+  echo "❌ Policy not found: $POLICY" >&2
+  exit 1
+fi
+if [[ -z "$VERSION" ]]; then
+  VERSION="$(find "$REPO_ROOT/policies/$POLICY" -mindepth 1 -maxdepth 1 -type d -name 'v*' -exec basename {} \; | sort -V | tail -1)"
+fi
+VERSION_DIR="$REPO_ROOT/policies/$POLICY/$VERSION"
+if [[ ! -d "$VERSION_DIR/src" ]]; then
+  echo "❌ $POLICY/$VERSION: src directory not found" >&2
+  exit 1
+fi
+
+# go build takes files from one directory only, so the generator is built
+# from a copy that includes the YAML reader
+BUILD_DIR="$(mktemp -d)"
+trap 'rm -rf "$BUILD_DIR"' EXIT
+cp "$SCRIPT_DIR"/policygen/*.go "$SCRIPT_DIR"/version/yaml.go "$BUILD_DIR/"
+(cd "$BUILD_DIR" && go build -o policygen ./*.go)
+"$BUILD_DIR/policygen" ${CHECK[@]+"${CHECK[@]}"} "$VERSION_DIR"
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// decoder is the Go side of one schema node: the type it decodes to and the
+// function that decodes it, func(v interface{}, path string) (T, error)
+type decoder struct {
+	goType string
+	fn     string
+	// object is set for structs, which become pointers when optional and
+	// without a default
+	object bool
+}
+
+// anyDecoder keeps values the generator cannot type, such as a oneOf of
+// unrelated alternatives, as they are
+var anyDecoder = decoder{goType: "interface{}", fn: "configAny"}
+
+// generator turns a parametersSchema into Go source. Types and functions are
+// written in the order they are first needed, which follows the sorted
+// property names, so the output is stable.
+type generator struct {
+	definitions map[string]interface{}
+	types       bytes.Buffer
+	funcs       bytes.Buffer
+	names       map[string]bool
+	refs        map[string]*decoder
+	helpers     map[string]bool
+	patterns    []string
+	err         error
+}
+
+// Generate returns the config_gen.go source for a parametersSchema, before
+// gofmt
+func Generate(pkg string, schema map[string]interface{}) ([]byte, error) {
+	g := &generator{
+		names:   map[string]bool{},
+		refs:    map[string]*decoder{},
+		helpers: map[string]bool{},
+	}
+	g.definitions, _ = schema["definitions"].(map[string]interface{})
+	root := g.object(schema, "Config", "")
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by scripts/policygen.sh from policy-definition.yaml. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\n", pkg)
+	out.WriteString("import (\n")
+	for _, imp := range g.imports() {
+		fmt.Fprintf(&out, "\t%q\n", imp)
+	}
+	out.WriteString(")\n\n")
+	out.Write(g.types.Bytes())
+	fmt.Fprintf(&out, `// Unmarshal decodes the policy parameters into a Config. Parameters that
+// are not set take their schema default. A value of the wrong type or out of
+// bounds is an error naming the parameter, e.g. store.timeoutMs, instead of a
+// panic.
+func Unmarshal(params map[string]interface{}) (Config, error) {
+	return %s(params, "")
+}
+
+`, root.fn)
+	out.Write(g.funcs.Bytes())
+	for i, p := range g.patterns {
+		fmt.Fprintf(&out, "var configPattern%d = regexp.MustCompile(%s)\n\n", i, goString(p))
+	}
+	for _, name := range helperOrder {
+		if g.helpers[name] {
+			out.WriteString(helperSource[name])
+			out.WriteString("\n")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func (g *generator) imports() []string {
+	set := map[string]bool{"fmt": true}
+	if len(g.patterns) > 0 {
+		set["regexp"] = true
+	}
+	for name := range g.helpers {
+		for _, imp := range helperImports[name] {
+			set[imp] = true
+		}
+	}
+	imports := make([]string, 0, len(set))
+	for imp := range set {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+func (g *generator) fail(format string, args ...interface{}) {
+	if g.err == nil {
+		g.err = fmt.Errorf(format, args...)
+	}
+}
+
+// typeName reserves a Go type name, numbering it if it is taken
+func (g *generator) typeName(name string) string {
+	unique := name
+	for i := 2; g.names[unique]; i++ {
+		unique = name + strconv.Itoa(i)
+	}
+	g.names[unique] = true
+	return unique
+}
+
+func (g *generator) helper(name string) string {
+	g.helpers[name] = true
+	for _, dep := range helperDeps[name] {
+		g.helper(dep)
+	}
+	return name
+}
+
+// node returns the decoder for a schema node. name is the Go type name the
+// node gets if it needs one, param the parameter it describes.
+func (g *generator) node(s map[string]interface{}, name, param string) decoder {
+	if ref, ok := s["$ref"].(string); ok {
+		return g.ref(ref)
+	}
+	if alts, ok := s["oneOf"].([]interface{}); ok {
+		return g.oneOf(alts, name, param)
+	}
+	types := schemaTypes(s)
+	if len(types) != 1 {
+		g.helper("configAny")
+		return anyDecoder
+	}
+	switch types[0] {
+	case "object":
+		if _, ok := s["properties"].(map[string]interface{}); ok {
+			return g.object(s, name, param)
+		}
+		if items, ok := s["additionalProperties"].(map[string]interface{}); ok {
+			return g.mapOf(s, items, name, param)
+		}
+		return g.scalar(s, name, "map[string]interface{}", "configObject")
+	case "array":
+		return g.array(s, name, param)
+	case "string":
+		return g.scalar(s, name, "string", "configString")
+	case "integer":
+		return g.scalar(s, name, "int", "configInteger")
+	case "number":
+		return g.scalar(s, name, "float64", "configNumber")
+	case "boolean":
+		return g.scalar(s, name, "bool", "configBool")
+	}
+	g.helper("configAny")
+	return anyDecoder
+}
+
+// ref returns the decoder of a definition. Definitions get one type each,
+// named after the definition; a definition that refers back to itself is
+// left untyped.
+func (g *generator) ref(ref string) decoder {
+	key := strings.TrimPrefix(ref, "#/definitions/")
+	if d, ok := g.refs[key]; ok {
+		if d == nil {
+			g.helper("configAny")
+			return anyDecoder
+		}
+		return *d
+	}
+	def, ok := g.definitions[key].(map[string]interface{})
+	if key == ref || !ok {
+		g.fail("unsupported $ref %s", ref)
+		return anyDecoder
+	}
+	g.refs[key] = nil
+	d := g.node(def, "Config"+exportName(key), "the "+key+" definition")
+	g.refs[key] = &d
+	return d
+}
+
+// oneOf types the one common shape, a value or a list of them, as a list.
+// Anything else stays untyped.
+func (g *generator) oneOf(alts []interface{}, name, param string) decoder {
+	if len(alts) == 2 {
+		for i := range alts {
+			single, _ := alts[i].(map[string]interface{})
+			list, _ := alts[1-i].(map[string]interface{})
+			if single == nil || list == nil || !isType(list, "array") || isType(single, "array") {
+				continue
+			}
+			items, _ := list["items"].(map[string]interface{})
+			if !reflect.DeepEqual(withoutDescription(items), withoutDescription(single)) {
+				continue
+			}
+			item := g.node(single, name+"Item", param)
+			return g.listOf(list, item, name, true)
+		}
+	}
+	g.helper("configAny")
+	return anyDecoder
+}
+
+func (g *generator) array(s map[string]interface{}, name, param string) decoder {
+	items, ok := s["items"].(map[string]interface{})
+	if !ok {
+		g.helper("configAny")
+		return g.listOf(s, anyDecoder, name, false)
+	}
+	return g.listOf(s, g.node(items, name+"Item", param+"[]"), name, false)
+}
+
+func (g *generator) listOf(s map[string]interface{}, item decoder, name string, single bool) decoder {
+	d := decoder{goType: "[]" + item.goType, fn: "decode" + g.typeName(name)}
+	w := &g.funcs
+	fmt.Fprintf(w, "func %s(v interface{}, path string) (%s, error) {\n", d.fn, d.goType)
+	if single {
+		fmt.Fprintf(w, "\tif _, ok := v.([]interface{}); !ok {\n")
+		fmt.Fprintf(w, "\t\titem, err := %s(v, path)\n", item.fn)
+		fmt.Fprintf(w, "\t\tif err != nil {\n\t\t\treturn nil, err\n\t\t}\n")
+		fmt.Fprintf(w, "\t\treturn %s{item}, nil\n\t}\n", d.goType)
+	}
+	fmt.Fprintf(w, "\tlist, err := %s(v, path)\n", g.helper("configArray"))
+	fmt.Fprintf(w, "\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+	if n, ok := intKeyword(s, "minItems"); ok {
+		msg := fmt.Sprintf("must have at least %d entries", n)
+		if n == 1 {
+			msg = "must not be empty"
+		}
+		fmt.Fprintf(w, "\tif len(list) < %d {\n\t\treturn nil, %s(path, %q)\n\t}\n", n, g.helper("configError"), msg)
+	}
+	if n, ok := intKeyword(s, "maxItems"); ok {
+		fmt.Fprintf(w, "\tif len(list) > %d {\n\t\treturn nil, %s(path, %q)\n\t}\n", n, g.helper("configError"), fmt.Sprintf("must have at most %d entries", n))
+	}
+	fmt.Fprintf(w, "\tout := make(%s, len(list))\n", d.goType)
+	fmt.Fprintf(w, "\tfor i, item := range list {\n")
+	fmt.Fprintf(w, "\t\tif out[i], err = %s(item, %s(path, i)); err != nil {\n", item.fn, g.helper("configIndex"))
+	fmt.Fprintf(w, "\t\t\treturn nil, err\n\t\t}\n\t}\n")
+	fmt.Fprintf(w, "\treturn out, nil\n}\n\n")
+	return d
+}
+
+func (g *generator) mapOf(s, items map[string]interface{}, name, param string) decoder {
+	item := g.node(items, name+"Value", param+".*")
+	d := decoder{goType: "map[string]" + item.goType, fn: "decode" + g.typeName(name)}
+	w := &g.funcs
+	fmt.Fprintf(w, "func %s(v interface{}, path string) (%s, error) {\n", d.fn, d.goType)
+	fmt.Fprintf(w, "\tobj, err := %s(v, path)\n", g.helper("configObject"))
+	fmt.Fprintf(w, "\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+	fmt.Fprintf(w, "\tout := make(%s, len(obj))\n", d.goType)
+	fmt.Fprintf(w, "\tfor _, name := range %s(obj) {\n", g.helper("configKeys"))
+	fmt.Fprintf(w, "\t\tif out[name], err = %s(obj[name], %s(path, name)); err != nil {\n", item.fn, g.helper("configJoin"))
+	fmt.Fprintf(w, "\t\t\treturn nil, err\n\t\t}\n\t}\n")
+	fmt.Fprintf(w, "\treturn out, nil\n}\n\n")
+	return d
+}
+
+// object writes a struct with one field per property, and its decoder.
+// Unknown properties are ignored, since the gateway adds some of its own
+// such as enforcementMode, unless additionalProperties is false.
+func (g *generator) object(s map[string]interface{}, name, param string) decoder {
+	name = g.typeName(name)
+	d := decoder{goType: name, fn: "decode" + name, object: true}
+	props, _ := s["properties"].(map[string]interface{})
+	names := make([]string, 0, len(props))
+	for prop := range props {
+		names = append(names, prop)
+	}
+	sort.Strings(names)
+	required := map[string]bool{}
+	for _, r := range stringList(s["required"]) {
+		required[r] = true
+	}
+
+	type field struct {
+		prop, goName string
+		dec          decoder
+		desc         string
+		def          interface{}
+		hasDef       bool
+	}
+	fields := make([]field, 0, len(names))
+	taken := map[string]bool{}
+	for _, prop := range names {
+		ps, ok := props[prop].(map[string]interface{})
+		if !ok {
+			g.fail("%s: property %s is not a schema", name, prop)
+			continue
+		}
+		goName := exportName(prop)
+		for i := 2; taken[goName]; i++ {
+			goName = exportName(prop) + strconv.Itoa(i)
+		}
+		taken[goName] = true
+		f := field{prop: prop, goName: goName, dec: g.node(ps, name+goName, joinParam(param, prop))}
+		f.desc, _ = ps["description"].(string)
+		f.def, f.hasDef = ps["default"]
+		fields = append(fields, f)
+	}
+
+	t := &g.types
+	if param == "" {
+		fmt.Fprintf(t, "// %s holds the policy parameters, as described by the\n// parametersSchema of policy-definition.yaml\n", name)
+	} else {
+		fmt.Fprintf(t, "// %s holds %s\n", name, describeParam(param))
+	}
+	fmt.Fprintf(t, "type %s struct {\n", name)
+	for i, f := range fields {
+		if i > 0 {
+			t.WriteString("\n")
+		}
+		if f.desc != "" {
+			fmt.Fprintf(t, "\t// %s\n", strings.ReplaceAll(f.desc, "\n", "\n\t// "))
+		}
+		goType := f.dec.goType
+		if f.dec.object && !required[f.prop] && !f.hasDef {
+			goType = "*" + goType
+		}
+		fmt.Fprintf(t, "\t%s %s `json:\"%s,omitempty\"`\n", f.goName, goType, f.prop)
+	}
+	t.WriteString("}\n\n")
+
+	w := &g.funcs
+	fmt.Fprintf(w, "func %s(v interface{}, path string) (%s, error) {\n", d.fn, name)
+	fmt.Fprintf(w, "\tvar c %s\n", name)
+	fmt.Fprintf(w, "\tobj, err := %s(v, path)\n", g.helper("configObject"))
+	fmt.Fprintf(w, "\tif err != nil {\n\t\treturn c, err\n\t}\n")
+	if s["additionalProperties"] == false {
+		quoted := make([]string, len(names))
+		for i, prop := range names {
+			quoted[i] = strconv.Quote(prop)
+		}
+		fmt.Fprintf(w, "\tif err := %s(obj, path, %s); err != nil {\n\t\treturn c, err\n\t}\n", g.helper("configKnown"), strings.Join(quoted, ", "))
+	}
+	for _, f := range fields {
+		fpath := fmt.Sprintf("%s(path, %q)", g.helper("configJoin"), f.prop)
+		switch {
+		case required[f.prop]:
+			fmt.Fprintf(w, "\tif _, ok := obj[%q]; !ok {\n", f.prop)
+			fmt.Fprintf(w, "\t\treturn c, %s(%s, \"is required\")\n\t}\n", g.helper("configError"), fpath)
+			fmt.Fprintf(w, "\tif c.%s, err = %s(obj[%q], %s); err != nil {\n\t\treturn c, err\n\t}\n", f.goName, f.dec.fn, f.prop, fpath)
+		case f.hasDef:
+			fmt.Fprintf(w, "\tif c.%s, err = %s(%s(obj, %q, %s), %s); err != nil {\n\t\treturn c, err\n\t}\n",
+				f.goName, f.dec.fn, g.helper("configValue"), f.prop, goLiteral(f.def), fpath)
+		case f.dec.object:
+			fmt.Fprintf(w, "\tif x, ok := obj[%q]; ok {\n", f.prop)
+			fmt.Fprintf(w, "\t\tvalue, err := %s(x, %s)\n", f.dec.fn, fpath)
+			fmt.Fprintf(w, "\t\tif err != nil {\n\t\t\treturn c, err\n\t\t}\n")
+			fmt.Fprintf(w, "\t\tc.%s = &value\n\t}\n", f.goName)
+		default:
+			fmt.Fprintf(w, "\tif x, ok := obj[%q]; ok {\n", f.prop)
+			fmt.Fprintf(w, "\t\tif c.%s, err = %s(x, %s); err != nil {\n\t\t\treturn c, err\n\t\t}\n\t}\n", f.goName, f.dec.fn, fpath)
+		}
+	}
+	fmt.Fprintf(w, "\treturn c, nil\n}\n\n")
+	return d
+}
+
+// scalar returns the decoder of a value with a Go built-in type. Nodes
+// without constraints use the helper directly, others get a function that
+// checks enum, bounds, lengths and pattern after the helper.
+func (g *generator) scalar(s map[string]interface{}, name, goType, helper string) decoder {
+	var checks bytes.Buffer
+	fail := func(cond, msg string) {
+		fmt.Fprintf(&checks, "\tif %s {\n\t\treturn value, %s(path, %s)\n\t}\n", cond, g.helper("configError"), strconv.Quote(msg))
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok && goType != "map[string]interface{}" {
+		cases := make([]string, 0, len(enum))
+		shown := make([]string, 0, len(enum))
+		for _, e := range enum {
+			switch val := e.(type) {
+			case string:
+				if goType == "string" {
+					cases = append(cases, strconv.Quote(val))
+				}
+			case float64:
+				if goType == "float64" || (goType == "int" && val == float64(int64(val))) {
+					cases = append(cases, strconv.FormatFloat(val, 'f', -1, 64))
+				}
+			case bool:
+				if goType == "bool" {
+					cases = append(cases, strconv.FormatBool(val))
+				}
+			}
+			shown = append(shown, fmt.Sprint(e))
+		}
+		if len(cases) == 0 {
+			g.fail("%s: no enum value has the type %s", name, goType)
+		}
+		fmt.Fprintf(&checks, "\tswitch value {\n\tcase %s:\n\tdefault:\n", strings.Join(cases, ", "))
+		fmt.Fprintf(&checks, "\t\treturn value, %s(path, %q)\n\t}\n", g.helper("configError"), "must be one of: "+strings.Join(shown, ", "))
+	}
+	switch goType {
+	case "string":
+		if n, ok := intKeyword(s, "minLength"); ok {
+			msg := fmt.Sprintf("must be at least %d characters long", n)
+			if n == 1 {
+				msg = "must not be empty"
+			}
+			fail(fmt.Sprintf("len(value) < %d", n), msg)
+		}
+		if n, ok := intKeyword(s, "maxLength"); ok {
+			fail(fmt.Sprintf("len(value) > %d", n), fmt.Sprintf("must be at most %d characters long", n))
+		}
+		if p, ok := s["pattern"].(string); ok {
+			if _, err := regexp.Compile(p); err != nil {
+				g.fail("%s: pattern %s: %v", name, p, err)
+			}
+			fail(fmt.Sprintf("!configPattern%d.MatchString(value)", len(g.patterns)), "must match "+p)
+			g.patterns = append(g.patterns, p)
+		}
+	case "int", "float64":
+		bounds := []struct{ keyword, op, msg string }{
+			{"minimum", "<", "must be at least "},
+			{"maximum", ">", "must be at most "},
+			{"exclusiveMinimum", "<=", "must be greater than "},
+			{"exclusiveMaximum", ">=", "must be less than "},
+		}
+		for _, b := range bounds {
+			f, ok := s[b.keyword].(float64)
+			if !ok {
+				continue
+			}
+			bound := strconv.FormatFloat(f, 'f', -1, 64)
+			value := "value"
+			if goType == "int" && f != float64(int64(f)) {
+				value = "float64(value)"
+			}
+			fail(fmt.Sprintf("%s %s %s", value, b.op, bound), b.msg+bound)
+		}
+	}
+
+	g.helper(helper)
+	if checks.Len() == 0 {
+		return decoder{goType: goType, fn: helper}
+	}
+	d := decoder{goType: goType, fn: "decode" + g.typeName(name)}
+	w := &g.funcs
+	fmt.Fprintf(w, "func %s(v interface{}, path string) (%s, error) {\n", d.fn, goType)
+	fmt.Fprintf(w, "\tvalue, err := %s(v, path)\n", helper)
+	fmt.Fprintf(w, "\tif err != nil {\n\t\treturn value, err\n\t}\n")
+	w.Write(checks.Bytes())
+	fmt.Fprintf(w, "\treturn value, nil\n}\n\n")
+	return d
+}
+
+// schemaTypes returns the types a node allows; type may be a string or a
+// list
+func schemaTypes(s map[string]interface{}) []string {
+	switch t := s["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		return stringList(t)
+	}
+	return nil
+}
+
+func isType(s map[string]interface{}, t string) bool {
+	types := schemaTypes(s)
+	return len(types) == 1 && types[0] == t
+}
+
+func withoutDescription(s map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(s))
+	for k, v := range s {
+		if k != "description" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func intKeyword(s map[string]interface{}, keyword string) (int, bool) {
+	f, ok := s[keyword].(float64)
+	return int(f), ok
+}
+
+var nonIdent = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// exportName turns a parameter name such as timeoutMs or x-api-key into an
+// exported Go name, TimeoutMs or XApiKey
+func exportName(name string) string {
+	var b strings.Builder
+	for _, part := range nonIdent.Split(name, -1) {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	out := b.String()
+	if out == "" || (out[0] >= '0' && out[0] <= '9') {
+		out = "X" + out
+	}
+	return out
+}
+
+// joinParam names a nested parameter the way the documentation does, e.g.
+// store.timeoutMs
+func joinParam(param, prop string) string {
+	if param == "" {
+		return prop
+	}
+	return param + "." + prop
+}
+
+// describeParam words a parameter path for a type comment: "the store
+// parameter", "an entry of the rules parameter", or a description such as
+// "the headerOp definition" as it is
+func describeParam(param string) string {
+	switch {
+	case strings.HasPrefix(param, "the "):
+		return param
+	case strings.HasSuffix(param, "[]"):
+		return "an entry of the " + strings.TrimSuffix(param, "[]") + " parameter"
+	case strings.HasSuffix(param, ".*"):
+		return "a value of the " + strings.TrimSuffix(param, ".*") + " parameter"
+	}
+	return "the " + param + " parameter"
+}
+
+// goLiteral writes a decoded YAML value as a Go expression that evaluates to
+// the same value, so defaults go through the same decoder as parameters
+func goLiteral(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(val)
+	case string:
+		return strconv.Quote(val)
+	case float64:
+		return "float64(" + strconv.FormatFloat(val, 'g', -1, 64) + ")"
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			items[i] = goLiteral(item)
+		}
+		return "[]interface{}{" + strings.Join(items, ", ") + "}"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = strconv.Quote(k) + ": " + goLiteral(val[k])
+		}
+		return "map[string]interface{}{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+// goString quotes a string as a raw literal when it can, which keeps regular
+// expressions readable
+func goString(s string) string {
+	if !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
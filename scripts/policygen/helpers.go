@@ -0,0 +1,158 @@
+package main
+
+// The helpers below are copied into generated files that use them. They are
+// prefixed with config so that they do not clash with the policy's own code.
+
+// helperOrder is the order helpers appear in generated files
+var helperOrder = []string{
+	"configValue",
+	"configKnown",
+	"configKeys",
+	"configObject",
+	"configArray",
+	"configString",
+	"configInteger",
+	"configNumber",
+	"configBool",
+	"configAny",
+	"configJoin",
+	"configIndex",
+	"configError",
+}
+
+// helperDeps lists the helpers each helper calls
+var helperDeps = map[string][]string{
+	"configKnown":   {"configJoin", "configError", "configKeys"},
+	"configObject":  {"configError"},
+	"configArray":   {"configError"},
+	"configString":  {"configError"},
+	"configInteger": {"configError"},
+	"configNumber":  {"configError"},
+	"configBool":    {"configError"},
+}
+
+// helperImports lists the packages each helper needs besides fmt
+var helperImports = map[string][]string{
+	"configKeys":    {"sort"},
+	"configInteger": {"math"},
+}
+
+var helperSource = map[string]string{
+	"configValue": `// configValue returns a parameter, or its default when it is not set
+func configValue(obj map[string]interface{}, name string, def interface{}) interface{} {
+	if v, ok := obj[name]; ok {
+		return v
+	}
+	return def
+}
+`,
+	"configKnown": `// configKnown rejects parameters the schema does not list
+func configKnown(obj map[string]interface{}, path string, known ...string) error {
+	for _, name := range configKeys(obj) {
+		found := false
+		for _, k := range known {
+			found = found || k == name
+		}
+		if !found {
+			return configError(configJoin(path, name), "is not a known parameter")
+		}
+	}
+	return nil
+}
+`,
+	"configKeys": `// configKeys returns the names in obj in order, so that errors are stable
+func configKeys(obj map[string]interface{}) []string {
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+`,
+	"configObject": `func configObject(v interface{}, path string) (map[string]interface{}, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, configError(path, "must be an object")
+	}
+	return obj, nil
+}
+`,
+	"configArray": `func configArray(v interface{}, path string) ([]interface{}, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, configError(path, "must be an array")
+	}
+	return list, nil
+}
+`,
+	"configString": `func configString(v interface{}, path string) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", configError(path, "must be a string")
+	}
+	return s, nil
+}
+`,
+	"configInteger": `// configInteger accepts whole numbers as encoding/json decodes them, and
+// Go integers from parameters built in code
+func configInteger(v interface{}, path string) (int, error) {
+	switch n := v.(type) {
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) <= 1<<53 {
+			return int(n), nil
+		}
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	}
+	return 0, configError(path, "must be an integer")
+}
+`,
+	"configNumber": `func configNumber(v interface{}, path string) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	}
+	return 0, configError(path, "must be a number")
+}
+`,
+	"configBool": `func configBool(v interface{}, path string) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, configError(path, "must be a boolean")
+	}
+	return b, nil
+}
+`,
+	"configAny": `// configAny keeps a value the schema does not give one Go type
+func configAny(v interface{}, path string) (interface{}, error) {
+	return v, nil
+}
+`,
+	"configJoin": `func configJoin(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+`,
+	"configIndex": `func configIndex(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+`,
+	"configError": `// configError reports a problem with the parameter at path, e.g.
+// "store.timeoutMs must be at least 1"
+func configError(path, msg string) error {
+	if path == "" {
+		path = "parameters"
+	}
+	return fmt.Errorf("%s %s", path, msg)
+}
+`,
+}
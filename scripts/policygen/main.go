@@ -0,0 +1,126 @@
+// Command policygen writes a typed Config struct and an Unmarshal function
+// for a policy version from the parametersSchema in its
+// policy-definition.yaml. Run it through scripts/policygen.sh.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputFile is the file policygen writes in a version's src directory
+const outputFile = "config_gen.go"
+
+func main() {
+	checkOnly := flag.Bool("check", false, "fail if "+outputFile+" is missing or out of date instead of writing it")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(args[0], *checkOnly); err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: policygen [-check] <policy version directory>
+
+Writes src/`+outputFile+` for the policy version:
+a Config struct with one field per parameter in parametersSchema, and
+Unmarshal(params map[string]interface{}) (Config, error), which fills in
+defaults and checks types, enums, bounds, lengths and patterns.
+
+  -check  fail if `+outputFile+` is missing or differs from what would be
+          written, instead of writing it`)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "❌ "+err.Error())
+	os.Exit(1)
+}
+
+func run(dir string, checkOnly bool) error {
+	schema, err := readSchema(filepath.Join(dir, "policy-definition.yaml"))
+	if err != nil {
+		return err
+	}
+	srcDir := filepath.Join(dir, "src")
+	pkg, err := packageName(srcDir)
+	if err != nil {
+		return err
+	}
+	src, err := Generate(pkg, schema)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+	formatted, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("%s: generated code does not parse: %v", dir, err)
+	}
+
+	out := filepath.Join(srcDir, outputFile)
+	if checkOnly {
+		current, err := os.ReadFile(out)
+		if err != nil || !bytes.Equal(current, formatted) {
+			return fmt.Errorf("%s is out of date, run scripts/policygen.sh", out)
+		}
+		return nil
+	}
+	if err := os.WriteFile(out, formatted, 0o644); err != nil {
+		return err
+	}
+	fmt.Println("✅ Wrote " + out)
+	return nil
+}
+
+func readSchema(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	m, _ := doc.(map[string]interface{})
+	schema, _ := m["parametersSchema"].(map[string]interface{})
+	if schema == nil {
+		schema = map[string]interface{}{}
+	}
+	return schema, nil
+}
+
+// packageName returns the package of the policy source, ignoring tests and
+// the generated file itself
+func packageName(srcDir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(srcDir, "*.go"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	fset := token.NewFileSet()
+	for _, file := range files {
+		base := filepath.Base(file)
+		if base == outputFile || strings.HasSuffix(base, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return "", err
+		}
+		return f.Name.Name, nil
+	}
+	return "", errors.New(srcDir + ": no Go source found")
+}
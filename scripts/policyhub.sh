@@ -0,0 +1,561 @@
+#!/bin/bash
+
+# Policy Hub contributor tool
+# Usage: ./policyhub.sh <command> [arguments]
+#
+# Commands:
+#   new <policy> [version]       Start a policy version. An existing policy
+#                                gets a copy of its latest version, bumped to
+#                                the next minor version unless one is given;
+#                                a new policy is scaffolded from
+#                                scripts/templates/policy at v1.0.0.
+#   validate <policy> [version]  Check the manifest and docs, vet the Go
+#                                source, run the conformance suite and the
+#                                version's scenarios, check the hub index and
+#                                check that parameters stay compatible within
+#                                a major version. Defaults to the latest
+#                                version.
+#   simulate <policy> [version] [scenario.json]
+#                                Run request scenarios against the policy, see
+#                                scripts/simulate.sh.
+#   package <policy> <version> [--sign]
+#                                Build the version ZIP and a SHA-256 checksum
+#                                file next to it. --sign adds a detached
+#                                signature made with the tool set in
+#                                signing.tool of the hub config.
+#   verify <zip>                 Check a package against its checksum and,
+#                                when signing.trustedKeys is set, require a
+#                                signature by one of those keys.
+#   resolve <policy>@<constraint>...
+#                                Print the highest version that satisfies a
+#                                constraint such as ^1.0, see
+#                                scripts/version.sh.
+#   generate [--check] <policy> [version]
+#                                Write src/config_gen.go, a typed Config
+#                                struct and Unmarshal function for the
+#                                parameters, see scripts/policygen.sh.
+#   list [policy]                List policies with their versions.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+POLICIES_DIR="$REPO_ROOT/policies"
+TEMPLATE_DIR="$SCRIPT_DIR/templates/policy"
+CONFIG_FILE="${CONFIG_FILE:-$REPO_ROOT/config/policy-hub-config.json}"
+
+# Colors
+GREEN='\033[0;32m'
+BLUE='\033[0;34m'
+YELLOW='\033[1;33m'
+RED='\033[0;31m'
+NC='\033[0m'
+
+log_info() {
+    echo -e "${BLUE}[INFO]${NC} $1"
+}
+
+log_success() {
+    echo -e "${GREEN}[SUCCESS]${NC} $1"
+}
+
+log_warning() {
+    echo -e "${YELLOW}[WARNING]${NC} $1"
+}
+
+log_error() {
+    echo -e "${RED}[ERROR]${NC} $1" >&2
+}
+
+require_tool() {
+    if ! command -v "$1" >/dev/null 2>&1; then
+        log_error "$1 is not installed"
+        exit 1
+    fi
+}
+
+check_policy_name() {
+    if [[ ! "$1" =~ ^[a-z0-9]+(-[a-z0-9]+)*$ ]]; then
+        log_error "Invalid policy name: $1 (use lowercase words separated by hyphens)"
+        exit 1
+    fi
+}
+
+# normalize_version accepts 1.2.3 or v1.2.3 and prints v1.2.3
+normalize_version() {
+    local version="v${1#v}"
+    if [[ ! "$version" =~ ^v[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+        log_error "Invalid version: $1 (expected vX.Y.Z)"
+        exit 1
+    fi
+    echo "$version"
+}
+
+# versions prints the version directories of a policy in semantic version order
+versions() {
+    if [[ -d "$POLICIES_DIR/$1" ]]; then
+        find "$POLICIES_DIR/$1" -mindepth 1 -maxdepth 1 -type d -name 'v*' -exec basename {} \; | sort -V
+    fi
+}
+
+latest_version() {
+    versions "$1" | tail -1
+}
+
+# policy_identifiers derives the Go package, type and display names from a
+# policy name, e.g. request-size-limit gives request_size_limit,
+# RequestSizeLimitPolicy and "Request Size Limit Policy"
+policy_identifiers() {
+    local name="$1"
+    PACKAGE_NAME="${name//-/_}"
+    TYPE_NAME=""
+    DISPLAY_NAME=""
+    local word
+    IFS='-' read -ra words <<< "$name"
+    for word in "${words[@]}"; do
+        TYPE_NAME+="$(tr '[:lower:]' '[:upper:]' <<< "${word:0:1}")${word:1}"
+        DISPLAY_NAME+="$(tr '[:lower:]' '[:upper:]' <<< "${word:0:1}")${word:1} "
+    done
+    TYPE_NAME+="Policy"
+    DISPLAY_NAME+="Policy"
+}
+
+cmd_new() {
+    local policy="${1:-}"
+    if [[ -z "$policy" ]]; then
+        log_error "Usage: $0 new <policy> [version]"
+        exit 1
+    fi
+    check_policy_name "$policy"
+
+    local latest
+    latest="$(latest_version "$policy")"
+    local version
+    if [[ -n "${2:-}" ]]; then
+        version="$(normalize_version "$2")"
+    elif [[ -n "$latest" ]]; then
+        local major minor
+        IFS='.' read -r major minor _ <<< "${latest#v}"
+        version="v$major.$((minor + 1)).0"
+    else
+        version="v1.0.0"
+    fi
+
+    local target="$POLICIES_DIR/$policy/$version"
+    if [[ -e "$target" ]]; then
+        log_error "$policy/$version already exists"
+        exit 1
+    fi
+
+    if [[ -n "$latest" ]]; then
+        if [[ "$(printf '%s\n%s\n' "$latest" "$version" | sort -V | tail -1)" != "$version" ]]; then
+            log_error "$version is not newer than the latest version $latest"
+            exit 1
+        fi
+        # Released versions are never edited, so changes start from a copy
+        cp -r "$POLICIES_DIR/$policy/$latest" "$target"
+        # Edited in place rather than through jq to keep the file's layout
+        sed -i.bak "s/\"version\": *\"[^\"]*\"/\"version\": \"${version#v}\"/" "$target/metadata.json"
+        rm -f "$target/metadata.json.bak"
+        if [[ -f "$target/docs/changelog.md" ]]; then
+            awk -v version="$version" '
+                !done && /^## / { print "## " version; print "- Describe the change"; print ""; done = 1 }
+                { print }
+            ' "$target/docs/changelog.md" > "$target/docs/changelog.md.tmp"
+            mv "$target/docs/changelog.md.tmp" "$target/docs/changelog.md"
+        fi
+        log_success "Created $policy/$version from $latest"
+        log_info "Describe the change in docs/changelog.md and update the docs it affects"
+    else
+        policy_identifiers "$policy"
+        mkdir -p "$target"
+        cp -r "$TEMPLATE_DIR"/. "$target/"
+        find "$target" -type f -exec sed -i.bak \
+            -e "s/__POLICY_NAME__/$policy/g" \
+            -e "s/__PACKAGE__/$PACKAGE_NAME/g" \
+            -e "s/__TYPE__/$TYPE_NAME/g" \
+            -e "s/__DISPLAY_NAME__/$DISPLAY_NAME/g" \
+            -e "s/__VERSION__/${version#v}/g" \
+            -e "s/__CATEGORY__/mediation/g" \
+            {} \;
+        find "$target" -name '*.bak' -delete
+        log_success "Created $policy/$version"
+        log_info "Fill in metadata.json, policy-definition.yaml and the docs, and keep src/schema.go in sync with the parameters schema; the conformance suite checks it"
+    fi
+    log_info "Run '$0 validate $policy $version' when the policy is ready"
+}
+
+# vet_source type checks a policy in a throwaway module. go vet is used rather
+# than go build so policies built as package main need no main function.
+vet_source() {
+    local src="$1"
+    if ! command -v go >/dev/null 2>&1; then
+        log_warning "go is not installed, skipping the source check"
+        return 0
+    fi
+    local temp_dir
+    temp_dir="$(mktemp -d)"
+    cp -r "$src"/. "$temp_dir/"
+    local errors=0
+    (
+        cd "$temp_dir"
+        go mod init temp-policy >/dev/null 2>&1
+        unformatted="$(gofmt -l .)"
+        if [[ -n "$unformatted" ]]; then
+            log_error "Not gofmt formatted: $(echo "$unformatted" | tr '\n' ' ')"
+            exit 1
+        fi
+        go vet . 2>&1
+    ) || errors=1
+    rm -rf "$temp_dir"
+    return $errors
+}
+
+cmd_validate() {
+    local policy="${1:-}"
+    if [[ -z "$policy" ]]; then
+        log_error "Usage: $0 validate <policy> [version]"
+        exit 1
+    fi
+    local version
+    if [[ -n "${2:-}" ]]; then
+        version="$(normalize_version "$2")"
+    else
+        version="$(latest_version "$policy")"
+        if [[ -z "$version" ]]; then
+            log_error "Policy not found: $policy"
+            exit 1
+        fi
+    fi
+
+    local errors=0
+    if ! "$SCRIPT_DIR/validate-policy.sh" "$policy" "$version"; then
+        ((errors++)) || true
+    fi
+
+    echo ""
+    log_info "Checking Go source of $policy/$version"
+    if vet_source "$POLICIES_DIR/$policy/$version/src"; then
+        log_success "Go source is formatted and passes go vet"
+    else
+        log_error "Go source check failed"
+        ((errors++)) || true
+    fi
+
+    if [[ -f "$POLICIES_DIR/$policy/$version/src/config_gen.go" ]]; then
+        log_info "Checking the generated config struct"
+        if "$SCRIPT_DIR/policygen.sh" --check "$policy" "$version"; then
+            log_success "config_gen.go matches the parameters schema"
+        else
+            ((errors++)) || true
+        fi
+    fi
+
+    log_info "Running the conformance suite"
+    if ! "$SCRIPT_DIR/conformance.sh" "$policy" "$version"; then
+        ((errors++)) || true
+    fi
+
+    if compgen -G "$POLICIES_DIR/$policy/$version/scenarios/*.json" >/dev/null; then
+        log_info "Running the request scenarios"
+        if "$SCRIPT_DIR/simulate.sh" "$policy" "$version" >/dev/null; then
+            log_success "All scenarios pass"
+        else
+            ((errors++)) || true
+        fi
+    fi
+
+    log_info "Checking the hub index"
+    if ! "$SCRIPT_DIR/generate-index.sh" --check; then
+        ((errors++)) || true
+    fi
+
+    log_info "Checking parameter compatibility with earlier versions"
+    local index_file
+    index_file="$(mktemp)"
+    # A fresh index, so a version that is not in the committed one yet counts
+    if "$SCRIPT_DIR/generate-index.sh" "$index_file" >/dev/null &&
+        "$SCRIPT_DIR/version.sh" -index "$index_file" check "$policy"; then
+        :
+    else
+        ((errors++)) || true
+    fi
+    rm -f "$index_file"
+
+    echo ""
+    if [[ $errors -gt 0 ]]; then
+        log_error "$policy/$version failed $errors check(s)"
+        exit 1
+    fi
+    log_success "$policy/$version is ready"
+}
+
+cmd_package() {
+    local sign=false
+    local args=()
+    local arg
+    for arg in "$@"; do
+        case "$arg" in
+            --sign) sign=true ;;
+            *) args+=("$arg") ;;
+        esac
+    done
+    local policy="${args[0]:-}"
+    if [[ -z "$policy" || -z "${args[1]:-}" ]]; then
+        log_error "Usage: $0 package <policy> <version> [--sign]"
+        exit 1
+    fi
+    local version
+    version="$(normalize_version "${args[1]}")"
+    local zip_file="$REPO_ROOT/$policy-$version.zip"
+    local tool=""
+    if $sign; then
+        # Fail before building anything when the signature cannot be made
+        tool="$(signing_tool)"
+        require_tool "$tool"
+    fi
+
+    rm -f "$zip_file"
+    "$SCRIPT_DIR/prepare-zip.sh" "$policy" "$version"
+
+    # Same format as sha256sum output, so 'sha256sum -c' verifies it
+    local checksum
+    if command -v sha256sum >/dev/null 2>&1; then
+        checksum="$(sha256sum "$zip_file" | cut -d' ' -f1)"
+    else
+        checksum="$(shasum -a 256 "$zip_file" | cut -d' ' -f1)"
+    fi
+    echo "$checksum  $(basename "$zip_file")" > "$zip_file.sha256"
+    log_success "Wrote $(basename "$zip_file").sha256"
+
+    if $sign; then
+        # The ZIP holds metadata.json and policy-definition.yaml, so one
+        # signature covers the manifest as well as the source
+        local signature
+        signature="$zip_file$(signature_suffix "$tool")"
+        rm -f "$signature"
+        case "$tool" in
+            minisign)
+                # The trusted comment is signed too; verify checks it against
+                # the file name so a signed package cannot pose as another
+                # version
+                local key_args=()
+                if [[ -n "${POLICYHUB_SIGNING_KEY:-}" ]]; then
+                    key_args=(-s "$POLICYHUB_SIGNING_KEY")
+                fi
+                minisign -S "${key_args[@]}" -m "$zip_file" -x "$signature" -t "$policy $version"
+                ;;
+            cosign)
+                if [[ -z "${POLICYHUB_SIGNING_KEY:-}" ]]; then
+                    log_error "Set POLICYHUB_SIGNING_KEY to the cosign key file or KMS URI"
+                    exit 1
+                fi
+                cosign sign-blob --yes --key "$POLICYHUB_SIGNING_KEY" --output-signature "$signature" "$zip_file" >/dev/null
+                ;;
+        esac
+        log_success "Wrote $(basename "$signature")"
+    fi
+}
+
+# signing_tool prints signing.tool from the hub config, minisign by default
+signing_tool() {
+    require_tool jq
+    local tool
+    tool="$(jq -r '.signing.tool // "minisign"' "$CONFIG_FILE")"
+    case "$tool" in
+        minisign|cosign) echo "$tool" ;;
+        *)
+            log_error "Unsupported signing.tool: $tool (use minisign or cosign)"
+            exit 1
+            ;;
+    esac
+}
+
+signature_suffix() {
+    case "$1" in
+        minisign) echo ".minisig" ;;
+        cosign) echo ".sig" ;;
+    esac
+}
+
+# verify_signature checks a signature against one public key
+verify_signature() {
+    local tool="$1" zip_file="$2" signature="$3" key="$4" expected="$5"
+    case "$tool" in
+        minisign)
+            local output
+            output="$(minisign -V -p "$key" -m "$zip_file" -x "$signature" 2>/dev/null)" || return 1
+            if ! grep -qxF "Trusted comment: $expected" <<< "$output"; then
+                log_warning "Signature by $key is for another package: $(grep '^Trusted comment: ' <<< "$output" | cut -d' ' -f3-)"
+                return 1
+            fi
+            ;;
+        cosign)
+            cosign verify-blob --key "$key" --signature "$signature" "$zip_file" >/dev/null 2>&1
+            ;;
+    esac
+}
+
+cmd_verify() {
+    local zip_file="${1:-}"
+    if [[ -z "$zip_file" ]]; then
+        log_error "Usage: $0 verify <zip>"
+        exit 1
+    fi
+    if [[ ! -f "$zip_file" ]]; then
+        log_error "Package not found: $zip_file"
+        exit 1
+    fi
+    local name
+    name="$(basename "$zip_file")"
+    if [[ ! "$name" =~ ^([a-z0-9-]+)-(v[0-9]+\.[0-9]+\.[0-9]+)\.zip$ ]]; then
+        log_error "Not a package name: $name (expected <policy>-vX.Y.Z.zip)"
+        exit 1
+    fi
+    local expected="${BASH_REMATCH[1]} ${BASH_REMATCH[2]}"
+
+    if [[ -f "$zip_file.sha256" ]]; then
+        local want got
+        want="$(cut -d' ' -f1 "$zip_file.sha256")"
+        if command -v sha256sum >/dev/null 2>&1; then
+            got="$(sha256sum "$zip_file" | cut -d' ' -f1)"
+        else
+            got="$(shasum -a 256 "$zip_file" | cut -d' ' -f1)"
+        fi
+        if [[ "$want" != "$got" ]]; then
+            log_error "$name does not match its checksum"
+            exit 1
+        fi
+        log_success "$name matches its checksum"
+    else
+        log_warning "$name has no checksum file"
+    fi
+
+    require_tool jq
+    local keys=()
+    local key
+    while IFS= read -r key; do
+        [[ -z "$key" ]] && continue
+        # Relative key paths are taken from the repository root
+        [[ "$key" != /* && "$key" != *://* ]] && key="$REPO_ROOT/$key"
+        keys+=("$key")
+    done < <(jq -r '.signing.trustedKeys[]?' "$CONFIG_FILE")
+
+    local tool signature
+    tool="$(signing_tool)"
+    signature="$zip_file$(signature_suffix "$tool")"
+    if [[ ${#keys[@]} -eq 0 ]]; then
+        # Without a trust policy, signatures are optional and not checked
+        if [[ -f "$signature" ]]; then
+            log_warning "signing.trustedKeys is empty, so the signature was not checked"
+        fi
+        log_success "$name verified"
+        return
+    fi
+    if [[ ! -f "$signature" ]]; then
+        log_error "$name is not signed, and signing.trustedKeys requires a signature"
+        exit 1
+    fi
+    require_tool "$tool"
+    for key in "${keys[@]}"; do
+        if verify_signature "$tool" "$zip_file" "$signature" "$key" "$expected"; then
+            log_success "$name is signed by $key"
+            return
+        fi
+    done
+    log_error "$name is not signed by a trusted key"
+    exit 1
+}
+
+cmd_list() {
+    require_tool jq
+    local filter="${1:-}"
+    local policy_dir name version
+    for policy_dir in "$POLICIES_DIR"/*/; do
+        name="$(basename "$policy_dir")"
+        if [[ -n "$filter" && "$name" != "$filter" ]]; then
+            continue
+        fi
+        local all
+        all="$(versions "$name" | tr '\n' ' ')"
+        version="$(latest_version "$name")"
+        local display
+        display="$(jq -r '.displayName // ""' "$policy_dir/$version/metadata.json" 2>/dev/null || echo "")"
+        printf '%-24s %-10s %s\n' "$name" "$version" "$display"
+        printf '%-24s %s\n' "" "$all"
+    done
+}
+
+show_help() {
+    echo "Policy Hub contributor tool"
+    echo ""
+    echo "Usage: $0 <command> [arguments]"
+    echo ""
+    echo "Commands:"
+    echo "  new <policy> [version]       - Start a new policy or a new version of one"
+    echo "  validate <policy> [version]  - Check manifest, docs, Go source, conformance, scenarios, hub index and compatibility"
+    echo "  simulate <policy> [version] [scenario.json]"
+    echo "                               - Run request scenarios against a policy"
+    echo "  package <policy> <version> [--sign]"
+    echo "                               - Build the version ZIP with a SHA-256 checksum, and a signature with --sign"
+    echo "  verify <zip>                 - Check a package's checksum and signature"
+    echo "  resolve <policy>@<constraint>..."
+    echo "                               - Print the highest version that satisfies a constraint"
+    echo "  generate [--check] <policy> [version]"
+    echo "                               - Generate a typed config struct from the parameters schema"
+    echo "  list [policy]                - List policies and their versions"
+    echo "  help                         - Show this help message"
+    echo ""
+    echo "Examples:"
+    echo "  $0 new rate-limiter"
+    echo "  $0 new my-policy"
+    echo "  $0 validate rate-limiter v1.6.0"
+    echo "  $0 package set-header v1.4.0"
+    echo "  $0 package set-header v1.4.0 --sign"
+    echo "  $0 verify set-header-v1.4.0.zip"
+    echo "  $0 resolve rate-limiter@^1.0"
+    echo "  $0 generate rate-limiter"
+}
+
+main() {
+    local command="${1:-help}"
+    shift || true
+    case "$command" in
+        new)
+            cmd_new "$@"
+            ;;
+        validate)
+            cmd_validate "$@"
+            ;;
+        simulate)
+            "$SCRIPT_DIR/simulate.sh" "$@"
+            ;;
+        package)
+            cmd_package "$@"
+            ;;
+        verify)
+            cmd_verify "$@"
+            ;;
+        resolve)
+            "$SCRIPT_DIR/version.sh" resolve "$@"
+            ;;
+        generate)
+            "$SCRIPT_DIR/policygen.sh" "$@"
+            ;;
+        list)
+            cmd_list "$@"
+            ;;
+        help|-h|--help)
+            show_help
+            ;;
+        *)
+            log_error "Unknown command: $command"
+            echo ""
+            show_help
+            exit 1
+            ;;
+    esac
+}
+
+main "$@"
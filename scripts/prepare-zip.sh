@@ -88,9 +88,10 @@ for doc in "${REQUIRED_DOCS[@]}"; do
   fi
 done
 
-# Create ZIP with better error handling
+# Create ZIP with better error handling. Scenarios are for the hub's own
+# checks and are not shipped to gateways.
 cd "$POLICY_DIR"
-if ! zip -r "$ZIP_FILE" . >/dev/null 2>&1; then
+if ! zip -r "$ZIP_FILE" . -x 'scenarios/*' >/dev/null 2>&1; then
   echo "Failed to create ZIP file" >&2
   exit 1
 fi
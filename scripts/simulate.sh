@@ -0,0 +1,181 @@
+#!/bin/bash
+
+# Run request scenarios against a policy without a gateway
+# Usage: ./simulate.sh <policy> [version] [scenario.json]
+#
+# Without a scenario file, every scenarios/*.json of the version is run; each
+# policy version keeps the scenarios that describe its behaviour there, and
+# policyhub.sh validate and CI run them.
+#
+# A scenario is a JSON list of cases. Each case sends one request through the
+# policy's Validate, OnRequest and OnResponse, applies the returned
+# modifications the way the gateway does, and optionally checks the outcome:
+#
+#   [
+#     {
+#       "name": "missing key is rejected",
+#       "params": {"keySource": {"type": "static", "keys": [{"key": "abc"}]}},
+#       "request": {"method": "GET", "path": "/orders", "headers": {}},
+#       "expect": {"immediate": {"status": 401, "bodyContains": "missing API key"}}
+#     },
+#     {
+#       "name": "valid key is forwarded without the header",
+#       "params": {"keySource": {"type": "static", "keys": [{"key": "abc"}]}},
+#       "request": {"headers": {"X-API-Key": "abc"}},
+#       "response": {"status": 200, "headers": {"Content-Type": "application/json"}},
+#       "expect": {"upstream": {"headers": {"X-API-Key": null}}, "client": {"status": 200}}
+#     }
+#   ]
+#
+# request takes method, path, headers, body, bodyBase64 for content that is
+# not text, remoteAddr and shared (values seeded into the SharedContext);
+# response takes status, headers and body or bodyBase64, or
+# pending to leave the request in flight without a response phase, and
+# latencyMs, which turns the response into the gateway's 504 when it exceeds
+# the upstream timeout a policy set.
+# files maps relative paths to base64 content that is written before the
+# case, for parameters that name files such as a geo database; the policy
+# runs in a throwaway directory, so relative paths in params find them, and
+# the files stay there for the cases that follow.
+# env sets environment variables of the gateway from this case on, for
+# templates and secret references that read them.
+# service sets what a mock HTTP service answers from this case on, as a
+# response does; params that point at http://service.test, such as a JWKS
+# or introspection URL, are sent to it. expect may hold call, the last
+# request the case made to the service with method, path, headers, body and
+# bodyContains, and calls, how many requests the case made.
+# expect may hold error (a substring of the Validate error), immediate,
+# upstream and client, each with status, path, headers (null for absent),
+# body and bodyContains; upstream may also hold timeoutMs. repeat sends a
+# case several times. All cases share one policy instance, so state such as
+# rate limit counters carries over. For a policy with an Init method, a case
+# whose params differ from the previous case's replaces the instance: the
+# old one is closed and a new one initialized, as on a changed route.
+# params may set enforcementMode: shadow, which the simulator handles as the
+# gateway does: an immediate response is reported as wouldBlock, counted in
+# policy_shadow_blocks_total, and the request carries on, with an
+# X-Policy-Would-Block header upstream when it was held back in the request
+# phase. expect may hold wouldBlock like immediate.
+# onError and errorCircuit are handled the same way: a phase that returns a
+# PolicyError or panics fails as onError says, and expect may hold
+# policyError, a substring of the last failure.
+# Secret references, {"$secretRef": {"source": "env", "name": "API_KEY"}}, are
+# resolved before Validate as well: env and file references from the
+# environment and files, or from the case's secrets, which maps
+# "source:name" to a value and is the only way to supply vault references.
+# A case whose resolved secrets differ from the previous case's, with params
+# otherwise the same, rotates a policy with a Rotate method instead of
+# replacing its instance.
+# For policies whose SDK types include Metrics, expect may also hold metrics,
+# mapping series such as requests_total{decision="allowed"} to their values
+# so far; histograms give _count and _sum series.
+#
+# The outcome of every case is printed as JSON. Each scenario file starts
+# with a new policy instance. The script fails if any expectation is not
+# met. Like the conformance suite, it applies to versions built on the
+# current SDK types.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+TEMPLATE="$SCRIPT_DIR/simulator/simulator_test.go.tmpl"
+METRICS_TEMPLATE="$SCRIPT_DIR/simulator/simulator_metrics_test.go.tmpl"
+
+usage() {
+  echo "Usage: $0 <policy> [version] [scenario.json]" >&2
+  exit 1
+}
+
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+
+POLICY="${1:-}"
+VERSION=""
+SCENARIO=""
+case $# in
+  1) ;;
+  2)
+    # A second argument is a version unless it names a scenario file
+    if [[ "$2" =~ ^v?[0-9]+\.[0-9]+\.[0-9]+$ ]]; then
+      VERSION="v${2#v}"
+    else
+      SCENARIO="$2"
+    fi
+    ;;
+  3) VERSION="v${2#v}"; SCENARIO="$3" ;;
+  *) usage ;;
+esac
+
+if [[ ! -d "$REPO_ROOT/policies/$POLICY" ]]; then
+  echo "❌ Policy not found: $POLICY" >&2
+  exit 1
+fi
+if [[ -z "$VERSION" ]]; then
+  VERSION="$(find "$REPO_ROOT/policies/$POLICY" -mindepth 1 -maxdepth 1 -type d -name 'v*' -exec basename {} \; | sort -V | tail -1)"
+fi
+SRC_DIR="$REPO_ROOT/policies/$POLICY/$VERSION/src"
+if [[ ! -d "$SRC_DIR" ]]; then
+  echo "❌ $POLICY/$VERSION: src directory not found" >&2
+  exit 1
+fi
+SCENARIOS=()
+if [[ -n "$SCENARIO" ]]; then
+  if [[ ! -f "$SCENARIO" ]]; then
+    echo "❌ Scenario file not found: $SCENARIO" >&2
+    exit 1
+  fi
+  SCENARIOS=("$(cd "$(dirname "$SCENARIO")" && pwd)/$(basename "$SCENARIO")")
+else
+  for file in "$REPO_ROOT/policies/$POLICY/$VERSION/scenarios"/*.json; do
+    [[ -f "$file" ]] && SCENARIOS+=("$file")
+  done
+  if [[ ${#SCENARIOS[@]} -eq 0 ]]; then
+    echo "❌ $POLICY/$VERSION has no scenarios/*.json" >&2
+    exit 1
+  fi
+fi
+
+PACKAGE="$(sed -n 's/^package \([A-Za-z0-9_]*\).*/\1/p' "$SRC_DIR"/*.go | head -1)"
+TYPE_NAME="$(sed -n 's/^func ([A-Za-z_]* \*\([A-Za-z0-9_]*\)) Validate(.*/\1/p' "$SRC_DIR"/*.go | head -1)"
+if [[ -z "$PACKAGE" || -z "$TYPE_NAME" ]]; then
+  echo "❌ Could not find the policy type in $SRC_DIR" >&2
+  exit 1
+fi
+
+TEMP_DIR="$(mktemp -d)"
+trap 'rm -rf "$TEMP_DIR"' EXIT
+cp -r "$SRC_DIR"/. "$TEMP_DIR/"
+sed -e "s/__PACKAGE__/$PACKAGE/g" -e "s/__TYPE__/$TYPE_NAME/g" -e "s/__POLICY_NAME__/$POLICY/g" "$TEMPLATE" > "$TEMP_DIR/simulator_test.go"
+if grep -q '^type Metrics interface' "$SRC_DIR"/*.go; then
+  sed -e "s/__PACKAGE__/$PACKAGE/g" "$METRICS_TEMPLATE" > "$TEMP_DIR/simulator_metrics_test.go"
+fi
+
+(cd "$TEMP_DIR" && go mod init simulator >/dev/null 2>&1)
+
+failed=0
+for SCENARIO in "${SCENARIOS[@]}"; do
+  status=0
+  rm -f "$TEMP_DIR/result.json"
+  (
+    cd "$TEMP_DIR"
+    SIMULATOR_SCENARIO="$SCENARIO" SIMULATOR_OUTPUT="$TEMP_DIR/result.json" \
+      go test -count=1 -run '^TestSimulate$' . >"$TEMP_DIR/output" 2>&1
+  ) || status=$?
+
+  if [[ -f "$TEMP_DIR/result.json" ]]; then
+    cat "$TEMP_DIR/result.json"
+  fi
+  if [[ $status -ne 0 ]]; then
+    # Test failures name the cases whose expectations were not met
+    grep -E '^\s+simulator_test\.go:[0-9]+: ' "$TEMP_DIR/output" | sed 's/^\s*simulator_test\.go:[0-9]*: /❌ /' >&2 || cat "$TEMP_DIR/output" >&2
+    echo "❌ $(basename "$SCENARIO") failed against $POLICY/$VERSION" >&2
+    failed=1
+  else
+    echo "✅ All cases of $(basename "$SCENARIO") passed against $POLICY/$VERSION" >&2
+  fi
+done
+exit $failed
@@ -0,0 +1,12 @@
+package __PACKAGE__
+
+// parametersSchemaJSON is the parametersSchema of policy-definition.yaml in
+// JSON form, without the descriptions. Keep the two in sync;
+// scripts/conformance.sh fails when they differ.
+const parametersSchemaJSON = `{
+  "type": "object",
+  "properties": {}
+}`
+
+// parameters checks the policy parameters and fills in their defaults
+var parameters = mustCompileParams(parametersSchemaJSON)
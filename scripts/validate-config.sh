@@ -54,4 +54,15 @@ if [[ ! "$timeout" =~ ^[1-9][0-9]*$ ]] || [[ "$timeout" -gt 300 ]]; then
   exit 1
 fi
 
+signing_tool=$(jq -r '.signing.tool // "minisign"' "$CONFIG_FILE")
+if [[ "$signing_tool" != "minisign" && "$signing_tool" != "cosign" ]]; then
+  echo "❌ signing.tool must be minisign or cosign"
+  exit 1
+fi
+
+if ! jq -e '(.signing.trustedKeys // []) | type == "array" and all(type == "string")' "$CONFIG_FILE" >/dev/null; then
+  echo "❌ signing.trustedKeys must be a list of public key paths"
+  exit 1
+fi
+
 echo "✅ Configuration file is valid"
\ No newline at end of file
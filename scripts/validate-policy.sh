@@ -192,6 +192,34 @@ validate_metadata() {
     return $errors
 }
 
+validate_metadata_location() {
+    local metadata_file="$1"
+    local policy_name="$2"
+    local version="$3"
+    local errors=0
+
+    echo "🔍 Validating metadata against the policy directory"
+
+    local name=$(jq -r '.name // ""' "$metadata_file")
+    if [ "$name" != "$policy_name" ]; then
+        log_error "Metadata name '$name' does not match the policy directory '$policy_name'"
+        ((errors++))
+    else
+        log_success "Metadata name matches the policy directory"
+    fi
+
+    # Directories carry the "v" prefix, metadata versions do not
+    local meta_version=$(jq -r '.version // ""' "$metadata_file")
+    if [ "$meta_version" != "${version#v}" ]; then
+        log_error "Metadata version '$meta_version' does not match the version directory '$version'"
+        ((errors++))
+    else
+        log_success "Metadata version matches the version directory"
+    fi
+
+    return $errors
+}
+
 validate_metadata_file_references() {
     local metadata_file="$1"
     local policy_dir="$2"
@@ -349,6 +377,10 @@ main() {
     metadata_errors=$?
     total_errors=$((total_errors + metadata_errors))
 
+    validate_metadata_location "$policy_dir/metadata.json" "$policy_name" "$version"
+    location_errors=$?
+    total_errors=$((total_errors + location_errors))
+
     # Validate Go code compilation (if enabled in config)
     if [ "$(get_config_value "validateGoBuild")" = "true" ]; then
         validate_go_build "$policy_dir"
@@ -0,0 +1,40 @@
+#!/bin/bash
+
+# Resolve policy versions and check their compatibility
+# Usage: ./version.sh [-index <file>] resolve <policy>@<constraint>...
+#        ./version.sh [-index <file>] check [policy...]
+#        ./version.sh [-index <file>] diff <policy> <from> <to>
+#        ./version.sh schema <policy-definition.yaml>...
+#
+# resolve prints the highest version of a policy in the hub index that
+# satisfies a constraint, written as in npm or Cargo: ^1.0 for any 1.x
+# release, ~1.2.0 for 1.2 patch releases, 1.2.x, >=1.2 <1.5, ^1.0 || ^2.0 or
+# latest.
+#
+# check compares the parametersSchema of every version with the version
+# before it. A minor or patch release fails when a configuration that was
+# valid before may be rejected or behave differently: parameters removed or
+# newly required, types, enums, bounds or patterns narrowed, defaults
+# changed. Only major releases may do that. diff lists the changes between
+# two versions, with breaking ones marked "!". schema prints the
+# parametersSchema of definition files as JSON; generate-index.sh uses it to
+# put the schemas in the index.
+#
+# The command lives in scripts/version and uses only the Go standard
+# library, so it runs without a module.
+
+set -euo pipefail
+
+# Get the directory where this script is located
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+
+if ! command -v go >/dev/null 2>&1; then
+  echo "❌ go is not installed" >&2
+  exit 1
+fi
+
+BUILD_DIR="$(mktemp -d)"
+trap 'rm -rf "$BUILD_DIR"' EXIT
+go build -o "$BUILD_DIR/version" "$SCRIPT_DIR"/version/*.go
+"$BUILD_DIR/version" -root "$REPO_ROOT" "$@"
@@ -0,0 +1,315 @@
+// Command version resolves version constraints against the hub index and
+// checks that policy releases keep their parameters compatible. Run it
+// through scripts/version.sh.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hubIndex is the part of index.json this command reads
+type hubIndex struct {
+	Policies []struct {
+		Name     string `json:"name"`
+		Versions []struct {
+			Version    string `json:"version"`
+			Path       string `json:"path"`
+			Definition string `json:"definition"`
+		} `json:"versions"`
+	} `json:"policies"`
+}
+
+// release is one version of a policy in the index
+type release struct {
+	Version    Version
+	Path       string
+	Definition string
+}
+
+func main() {
+	root := flag.String("root", ".", "repository root")
+	index := flag.String("index", "", "hub index (default <root>/index.json)")
+	flag.Usage = usage
+	flag.Parse()
+	if *index == "" {
+		*index = filepath.Join(*root, "index.json")
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	// The index is generated from the schemas, so schema does not read it
+	if args[0] == "schema" {
+		if err := printSchemas(args[1:]); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	releases, err := loadIndex(*index)
+	if err != nil {
+		fail(err)
+	}
+	switch args[0] {
+	case "resolve":
+		err = resolve(releases, args[1:])
+	case "check":
+		err = check(*root, releases, args[1:])
+	case "diff":
+		err = diff(*root, releases, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: version.sh [-index <file>] <command> [arguments]
+
+Commands:
+  resolve <policy>@<constraint>...  Print the highest version of each policy
+                                    that satisfies the constraint, e.g.
+                                    rate-limiter@^1.0 or cors@~1.2.0
+  check [policy...]                 Compare the parameters schema of every
+                                    version with the version before it and
+                                    fail on breaking changes in minor and
+                                    patch releases; all policies by default
+  diff <policy> <from> <to>         List the parameters schema changes
+                                    between two versions
+  schema <policy-definition.yaml>...
+                                    Print the parameters schema of each
+                                    definition as JSON, one per line`)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "❌ "+err.Error())
+	os.Exit(1)
+}
+
+// loadIndex reads the releases of every policy, in version order
+func loadIndex(path string) (map[string][]release, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading the hub index: %v", err)
+	}
+	var idx hubIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("reading the hub index %s: %v", path, err)
+	}
+	releases := make(map[string][]release, len(idx.Policies))
+	for _, p := range idx.Policies {
+		versions := make([]Version, 0, len(p.Versions))
+		byVersion := make(map[Version]release, len(p.Versions))
+		for _, v := range p.Versions {
+			parsed, err := ParseVersion(v.Version)
+			if err != nil {
+				return nil, fmt.Errorf("%s in the hub index: %v", p.Name, err)
+			}
+			versions = append(versions, parsed)
+			byVersion[parsed] = release{Version: parsed, Path: v.Path, Definition: v.Definition}
+		}
+		SortVersions(versions)
+		for _, v := range versions {
+			releases[p.Name] = append(releases[p.Name], byVersion[v])
+		}
+	}
+	return releases, nil
+}
+
+func resolve(releases map[string][]release, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: resolve <policy>@<constraint>...")
+	}
+	for _, arg := range args {
+		name, raw, found := strings.Cut(arg, "@")
+		if !found {
+			raw = "latest"
+		}
+		list, ok := releases[name]
+		if !ok {
+			return fmt.Errorf("policy not found: %s", name)
+		}
+		c, err := ParseConstraint(raw)
+		if err != nil {
+			return err
+		}
+		versions := make([]Version, len(list))
+		for i, r := range list {
+			versions[i] = r.Version
+		}
+		v, ok := c.Resolve(versions)
+		if !ok {
+			return fmt.Errorf("no version of %s satisfies %s", name, c)
+		}
+		for _, r := range list {
+			if r.Version == v {
+				fmt.Printf("%s %s %s\n", name, v, r.Path)
+			}
+		}
+	}
+	return nil
+}
+
+func check(root string, releases map[string][]release, names []string) error {
+	if len(names) == 0 {
+		for name := range releases {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	failures := 0
+	for _, name := range names {
+		list, ok := releases[name]
+		if !ok {
+			return fmt.Errorf("policy not found: %s", name)
+		}
+		for i := 1; i < len(list); i++ {
+			prev, cur := list[i-1], list[i]
+			if cur.Version.Major > prev.Version.Major {
+				// A major release may change anything
+				continue
+			}
+			changes, err := diffReleases(root, prev, cur)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			var broken []Change
+			for _, c := range changes {
+				if c.Breaking {
+					broken = append(broken, c)
+				}
+			}
+			if len(broken) == 0 {
+				continue
+			}
+			failures++
+			kind := "minor"
+			if cur.Version.Minor == prev.Version.Minor {
+				kind = "patch"
+			}
+			fmt.Fprintf(os.Stderr, "❌ %s %s is a %s release but changes the parameters of %s incompatibly:\n", name, cur.Version, kind, prev.Version)
+			for _, c := range broken {
+				fmt.Fprintf(os.Stderr, "   %s\n", c)
+			}
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d release(s) need a new major version or a compatible schema", failures)
+	}
+	fmt.Println("✅ Parameters of every minor and patch release are compatible with the release before")
+	return nil
+}
+
+func diff(root string, releases map[string][]release, args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: diff <policy> <from> <to>")
+	}
+	list, ok := releases[args[0]]
+	if !ok {
+		return fmt.Errorf("policy not found: %s", args[0])
+	}
+	find := func(s string) (release, error) {
+		v, err := ParseVersion(s)
+		if err != nil {
+			return release{}, err
+		}
+		for _, r := range list {
+			if r.Version == v {
+				return r, nil
+			}
+		}
+		return release{}, fmt.Errorf("%s has no version %s", args[0], v)
+	}
+	from, err := find(args[1])
+	if err != nil {
+		return err
+	}
+	to, err := find(args[2])
+	if err != nil {
+		return err
+	}
+	changes, err := diffReleases(root, from, to)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Println("No parameter changes")
+		return nil
+	}
+	for _, c := range changes {
+		mark := "  "
+		if c.Breaking {
+			mark = "! "
+		}
+		fmt.Println(mark + c.String())
+	}
+	return nil
+}
+
+func diffReleases(root string, old, new release) ([]Change, error) {
+	oldSchema, err := loadSchema(root, old)
+	if err != nil {
+		return nil, err
+	}
+	newSchema, err := loadSchema(root, new)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSchemas(oldSchema, newSchema), nil
+}
+
+// printSchemas writes the parametersSchema of each definition file as
+// compact JSON, for generate-index.sh
+func printSchemas(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("usage: schema <policy-definition.yaml>...")
+	}
+	for _, path := range paths {
+		schema, err := readSchema(path)
+		if err != nil {
+			return err
+		}
+		out, err := json.Marshal(schema)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Println(string(out))
+	}
+	return nil
+}
+
+// loadSchema reads the parametersSchema of a release's policy definition
+func loadSchema(root string, r release) (map[string]interface{}, error) {
+	return readSchema(filepath.Join(root, r.Definition))
+}
+
+// readSchema reads the parametersSchema of a policy definition file. A
+// definition without one has an empty schema.
+func readSchema(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	m, _ := doc.(map[string]interface{})
+	schema, _ := m["parametersSchema"].(map[string]interface{})
+	if schema == nil {
+		schema = map[string]interface{}{}
+	}
+	return schema, nil
+}
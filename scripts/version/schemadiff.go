@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a difference between the parameters schemas of two versions.
+// Breaking changes can make a configuration that worked with the old version
+// fail validation, or behave differently, with the new one.
+type Change struct {
+	Path     string
+	Message  string
+	Breaking bool
+}
+
+func (c Change) String() string {
+	return c.Path + ": " + c.Message
+}
+
+// maxSchemaDepth bounds the comparison of recursive $ref definitions
+const maxSchemaDepth = 32
+
+// schemaDiff compares the parametersSchema of two policy definitions
+type schemaDiff struct {
+	oldRoot, newRoot map[string]interface{}
+}
+
+// DiffSchemas lists the changes from old to new, breaking ones first
+func DiffSchemas(old, new map[string]interface{}) []Change {
+	d := &schemaDiff{oldRoot: old, newRoot: new}
+	changes := d.compare(old, new, "parameters", 0)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Breaking && !changes[j].Breaking
+	})
+	return changes
+}
+
+// compare returns the changes from old to new at path
+func (d *schemaDiff) compare(old, new map[string]interface{}, path string, depth int) []Change {
+	if depth > maxSchemaDepth {
+		return nil
+	}
+	old = resolveRef(d.oldRoot, old)
+	new = resolveRef(d.newRoot, new)
+	var changes []Change
+	breaking := func(format string, args ...interface{}) {
+		changes = append(changes, Change{Path: path, Message: fmt.Sprintf(format, args...), Breaking: true})
+	}
+	compatible := func(format string, args ...interface{}) {
+		changes = append(changes, Change{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	oldAlts, newAlts := alternatives(old), alternatives(new)
+	if len(oldAlts) > 1 || len(newAlts) > 1 {
+		// Every form the old schema accepted must still be accepted by one
+		// of the new forms
+		for i, o := range oldAlts {
+			ok := false
+			for _, n := range newAlts {
+				if !hasBreaking(d.compare(o, n, path, depth+1)) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				if len(oldAlts) > 1 {
+					breaking("no longer accepts the form of oneOf[%d]", i)
+				} else {
+					breaking("no longer accepts %s", describeSchema(o))
+				}
+			}
+		}
+		if len(newAlts) > len(oldAlts) && !hasBreaking(changes) {
+			compatible("now also accepts %d other form(s)", len(newAlts)-len(oldAlts))
+		}
+		return changes
+	}
+
+	oldTypes, newTypes := schemaTypes(old), schemaTypes(new)
+	switch {
+	case len(newTypes) == 0 && len(oldTypes) > 0:
+		compatible("accepts any type instead of %s", strings.Join(oldTypes, " or "))
+	case len(newTypes) > 0 && len(oldTypes) == 0:
+		breaking("must now be %s", strings.Join(newTypes, " or "))
+	default:
+		var lost []string
+		for _, t := range oldTypes {
+			if !containsString(newTypes, t) && !(t == "integer" && containsString(newTypes, "number")) {
+				lost = append(lost, t)
+			}
+		}
+		if len(lost) > 0 {
+			breaking("type changed from %s to %s", strings.Join(oldTypes, " or "), strings.Join(newTypes, " or "))
+		} else if len(newTypes) > len(oldTypes) {
+			compatible("type widened from %s to %s", strings.Join(oldTypes, " or "), strings.Join(newTypes, " or "))
+		}
+	}
+
+	oldEnum, hasOldEnum := old["enum"].([]interface{})
+	newEnum, hasNewEnum := new["enum"].([]interface{})
+	switch {
+	case hasNewEnum && !hasOldEnum:
+		breaking("now restricted to %s", formatValues(newEnum))
+	case hasOldEnum && !hasNewEnum:
+		compatible("no longer restricted to %s", formatValues(oldEnum))
+	case hasOldEnum:
+		var removed, added []interface{}
+		for _, v := range oldEnum {
+			if !containsValue(newEnum, v) {
+				removed = append(removed, v)
+			}
+		}
+		for _, v := range newEnum {
+			if !containsValue(oldEnum, v) {
+				added = append(added, v)
+			}
+		}
+		if len(removed) > 0 {
+			breaking("no longer accepts %s", formatValues(removed))
+		}
+		if len(added) > 0 {
+			compatible("now also accepts %s", formatValues(added))
+		}
+	}
+
+	oldDefault, hasOldDefault := old["default"]
+	newDefault, hasNewDefault := new["default"]
+	switch {
+	case hasOldDefault && !hasNewDefault:
+		breaking("default %s removed", formatValue(oldDefault))
+	case hasOldDefault && !reflect.DeepEqual(oldDefault, newDefault):
+		breaking("default changed from %s to %s", formatValue(oldDefault), formatValue(newDefault))
+	case hasNewDefault && !hasOldDefault:
+		compatible("default %s added", formatValue(newDefault))
+	}
+
+	for _, bound := range []struct {
+		key   string
+		lower bool
+	}{
+		{"minimum", true}, {"exclusiveMinimum", true}, {"minLength", true}, {"minItems", true},
+		{"maximum", false}, {"exclusiveMaximum", false}, {"maxLength", false}, {"maxItems", false},
+	} {
+		o, hasO := old[bound.key].(float64)
+		n, hasN := new[bound.key].(float64)
+		switch {
+		case hasN && !hasO:
+			breaking("%s %s added", bound.key, formatNumber(n))
+		case hasO && !hasN:
+			compatible("%s %s removed", bound.key, formatNumber(o))
+		case hasO && (bound.lower && n > o || !bound.lower && n < o):
+			breaking("%s tightened from %s to %s", bound.key, formatNumber(o), formatNumber(n))
+		case hasO && n != o:
+			compatible("%s relaxed from %s to %s", bound.key, formatNumber(o), formatNumber(n))
+		}
+	}
+
+	oldPattern, _ := old["pattern"].(string)
+	newPattern, _ := new["pattern"].(string)
+	if newPattern != oldPattern {
+		if newPattern != "" {
+			breaking("pattern changed from %q to %q", oldPattern, newPattern)
+		} else {
+			compatible("pattern %q removed", oldPattern)
+		}
+	}
+
+	oldRequired, newRequired := stringList(old["required"]), stringList(new["required"])
+	for _, name := range newRequired {
+		if !containsString(oldRequired, name) {
+			changes = append(changes, Change{Path: path + "." + name, Message: "now required", Breaking: true})
+		}
+	}
+	for _, name := range oldRequired {
+		if !containsString(newRequired, name) {
+			changes = append(changes, Change{Path: path + "." + name, Message: "no longer required"})
+		}
+	}
+
+	oldProps, _ := old["properties"].(map[string]interface{})
+	newProps, _ := new["properties"].(map[string]interface{})
+	closed := new["additionalProperties"] == false
+	for _, name := range sortedKeys(oldProps) {
+		o, _ := oldProps[name].(map[string]interface{})
+		n, ok := newProps[name].(map[string]interface{})
+		if !ok {
+			if closed {
+				changes = append(changes, Change{Path: path + "." + name, Message: "removed, so configurations that set it are rejected", Breaking: true})
+			} else {
+				changes = append(changes, Change{Path: path + "." + name, Message: "removed, so configurations that set it lose its effect", Breaking: true})
+			}
+			continue
+		}
+		changes = append(changes, d.compare(o, n, path+"."+name, depth+1)...)
+	}
+	for _, name := range sortedKeys(newProps) {
+		if _, ok := oldProps[name]; !ok {
+			changes = append(changes, Change{Path: path + "." + name, Message: "added"})
+		}
+	}
+
+	switch oldAdd := old["additionalProperties"].(type) {
+	case map[string]interface{}:
+		if newAdd, ok := new["additionalProperties"].(map[string]interface{}); ok {
+			changes = append(changes, d.compare(oldAdd, newAdd, path+".*", depth+1)...)
+		} else if closed {
+			breaking("no longer accepts other properties")
+		}
+	case bool:
+		if oldAdd && closed {
+			breaking("no longer accepts other properties")
+		}
+	case nil:
+		if closed {
+			breaking("no longer accepts unknown properties")
+		}
+	}
+
+	if oldItems, ok := old["items"].(map[string]interface{}); ok {
+		if newItems, ok := new["items"].(map[string]interface{}); ok {
+			changes = append(changes, d.compare(oldItems, newItems, path+"[]", depth+1)...)
+		}
+	} else if newItems, ok := new["items"].(map[string]interface{}); ok && len(newItems) > 0 {
+		breaking("items must now match %s", describeSchema(newItems))
+	}
+	return changes
+}
+
+// alternatives returns the oneOf branches of a schema, or the schema itself
+func alternatives(s map[string]interface{}) []map[string]interface{} {
+	list, ok := s["oneOf"].([]interface{})
+	if !ok || len(list) == 0 {
+		return []map[string]interface{}{s}
+	}
+	alts := make([]map[string]interface{}, 0, len(list))
+	for _, v := range list {
+		m, _ := v.(map[string]interface{})
+		alts = append(alts, m)
+	}
+	return alts
+}
+
+// resolveRef follows "$ref": "#/definitions/<name>" within the same schema
+func resolveRef(root, s map[string]interface{}) map[string]interface{} {
+	for i := 0; i < maxSchemaDepth; i++ {
+		ref, ok := s["$ref"].(string)
+		if !ok {
+			return s
+		}
+		defs, _ := root["definitions"].(map[string]interface{})
+		target, ok := defs[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+		if !ok {
+			return s
+		}
+		s = target
+	}
+	return s
+}
+
+func schemaTypes(s map[string]interface{}) []string {
+	switch t := s["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		return stringList(t)
+	}
+	return nil
+}
+
+func describeSchema(s map[string]interface{}) string {
+	if types := schemaTypes(s); len(types) > 0 {
+		return strings.Join(types, " or ")
+	}
+	return "the old schema"
+}
+
+func hasBreaking(changes []Change) bool {
+	for _, c := range changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatValues(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = formatValue(v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func formatNumber(f float64) string {
+	return formatValue(f)
+}
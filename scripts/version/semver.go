@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a policy version. The hub only publishes releases, so there are
+// no pre-release or build parts.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion reads 1.2.3 or v1.2.3
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid version %q: expected X.Y.Z", s)
+	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 || p != strconv.Itoa(v) {
+			return Version{}, fmt.Errorf("invalid version %q: %q is not a number", s, p)
+		}
+		n[i] = v
+	}
+	return Version{n[0], n[1], n[2]}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or 1 as v is lower than, equal to or higher than w
+func (v Version) Compare(w Version) int {
+	for _, d := range [3]int{v.Major - w.Major, v.Minor - w.Minor, v.Patch - w.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// SortVersions orders versions from lowest to highest
+func SortVersions(versions []Version) {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Compare(versions[j]) < 0 })
+}
+
+// comparator is one bound of a range, such as >=1.2.0
+type comparator struct {
+	op string
+	v  Version
+}
+
+func (c comparator) allows(v Version) bool {
+	d := v.Compare(c.v)
+	switch c.op {
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	}
+	return d == 0
+}
+
+// Constraint is a set of acceptable versions, written the way npm and
+// Cargo write them:
+//
+//	1.2.3, =1.2.3   exactly that version
+//	1.2, 1.2.x      any 1.2 release; 1, 1.x and * work alike
+//	^1.2.3          compatible with 1.2.3: >=1.2.3 <2.0.0, or for 0.x
+//	                versions >=0.2.3 <0.3.0
+//	~1.2.3          patch releases of 1.2 from 1.2.3: >=1.2.3 <1.3.0
+//	>=1.2 <1.5      comparators, all of which must hold; commas work as well
+//	^1.0 || ^2.0    either range
+//	latest          any version, so the highest is chosen
+type Constraint struct {
+	raw string
+	// any holds alternatives, each a list of comparators that must all hold
+	any [][]comparator
+}
+
+// ParseConstraint reads a version constraint
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{raw: s}
+	for _, alt := range strings.Split(s, "||") {
+		var all []comparator
+		fields := strings.Fields(strings.ReplaceAll(alt, ",", " "))
+		if len(fields) == 0 {
+			return c, fmt.Errorf("invalid constraint %q: empty range", s)
+		}
+		for _, f := range fields {
+			cs, err := parseRange(f)
+			if err != nil {
+				return c, fmt.Errorf("invalid constraint %q: %v", s, err)
+			}
+			all = append(all, cs...)
+		}
+		c.any = append(c.any, all)
+	}
+	return c, nil
+}
+
+func (c Constraint) String() string {
+	return c.raw
+}
+
+// Allows reports whether v satisfies the constraint
+func (c Constraint) Allows(v Version) bool {
+	for _, all := range c.any {
+		ok := true
+		for _, cmp := range all {
+			if !cmp.allows(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the highest version that satisfies the constraint
+func (c Constraint) Resolve(versions []Version) (Version, bool) {
+	var best Version
+	found := false
+	for _, v := range versions {
+		if c.Allows(v) && (!found || v.Compare(best) > 0) {
+			best, found = v, true
+		}
+	}
+	return best, found
+}
+
+// parseRange turns one term of a constraint into comparators
+func parseRange(s string) ([]comparator, error) {
+	if s == "latest" || s == "*" || s == "x" {
+		return nil, nil
+	}
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+	v, n, err := parsePartial(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// upper is the first version after the given parts, e.g. 1.3.0 for 1.2
+	upper := func(parts int) Version {
+		switch parts {
+		case 1:
+			return Version{v.Major + 1, 0, 0}
+		case 2:
+			return Version{v.Major, v.Minor + 1, 0}
+		}
+		return Version{v.Major, v.Minor, v.Patch + 1}
+	}
+	switch op {
+	case "^":
+		// The leftmost non-zero part may not change
+		switch {
+		case v.Major > 0 || n == 1:
+			return []comparator{{">=", v}, {"<", upper(1)}}, nil
+		case v.Minor > 0 || n == 2:
+			return []comparator{{">=", v}, {"<", upper(2)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", upper(3)}}, nil
+	case "~":
+		if n == 1 {
+			return []comparator{{">=", v}, {"<", upper(1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", upper(2)}}, nil
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	case ">":
+		// >1.2 means above every 1.2 release
+		return []comparator{{">=", upper(n)}}, nil
+	case "<=":
+		return []comparator{{"<", upper(n)}}, nil
+	}
+	if n == 3 {
+		return []comparator{{"=", v}}, nil
+	}
+	return []comparator{{">=", v}, {"<", upper(n)}}, nil
+}
+
+// parsePartial reads a version that may leave out its minor and patch parts,
+// or write them as x or *. n is the number of parts given.
+func parsePartial(s string) (v Version, n int, err error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 3 || s == "" {
+		return v, 0, fmt.Errorf("%q is not a version", s)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		num, err := strconv.Atoi(p)
+		if err != nil || num < 0 {
+			return v, 0, fmt.Errorf("%q is not a version", s)
+		}
+		nums[i] = num
+		n++
+	}
+	if n == 0 {
+		return v, 0, fmt.Errorf("%q is not a version", s)
+	}
+	return Version{nums[0], nums[1], nums[2]}, n, nil
+}